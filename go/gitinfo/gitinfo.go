@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
@@ -24,6 +25,24 @@ import (
 // subject groups.
 var commitLineRe = regexp.MustCompile(`([0-9a-f]{40}),([^,\n]+),(.+)$`)
 
+var (
+	// repoMutexes serialize the updates of GitInfos that share a repo, e.g.
+	// the GitInfos of different branches, keyed by the directory of the repo.
+	repoMutexes      = map[string]*sync.Mutex{}
+	repoMutexesMutex sync.Mutex
+)
+
+// repoMutex returns the mutex that serializes updates of the repo in dir.
+func repoMutex(dir string) *sync.Mutex {
+	repoMutexesMutex.Lock()
+	defer repoMutexesMutex.Unlock()
+	dir = filepath.Clean(dir)
+	if _, ok := repoMutexes[dir]; !ok {
+		repoMutexes[dir] = &sync.Mutex{}
+	}
+	return repoMutexes[dir]
+}
+
 // ShortCommit stores the hash, author, and subject of a git commit.
 type ShortCommit struct {
 	Hash    string `json:"hash"`
@@ -42,6 +61,7 @@ type LongCommit struct {
 // GitInfo allows querying a Git repo.
 type GitInfo struct {
 	dir          string
+	branch       string
 	hashes       []string
 	timestamps   map[string]time.Time // Key is the hash.
 	detailsCache map[string]*LongCommit
@@ -62,6 +82,21 @@ func NewGitInfo(dir string, pull, allBranches bool) (*GitInfo, error) {
 	return g, g.Update(pull, allBranches)
 }
 
+// NewBranchGitInfo creates a new GitInfo for the Git repository found in
+// directory dir that only contains the history of the given branch, i.e.
+// the commits reachable from 'origin/<branch>'. If pull is true then a git
+// fetch is done on the repo before querying it for history. The checked out
+// branch of the repo is left untouched, so several GitInfos can share a repo.
+func NewBranchGitInfo(dir string, pull bool, branch string) (*GitInfo, error) {
+	g := &GitInfo{
+		dir:          dir,
+		branch:       branch,
+		hashes:       []string{},
+		detailsCache: map[string]*LongCommit{},
+	}
+	return g, g.Update(pull, false)
+}
+
 // Clone creates a new GitInfo by running "git clone" in the given directory.
 func Clone(repoUrl, dir string, allBranches bool) (*GitInfo, error) {
 	cmd := exec.Command("git", "clone", repoUrl, dir)
@@ -87,13 +122,22 @@ func CloneOrUpdate(repoUrl, dir string, allBranches bool) (*GitInfo, error) {
 }
 
 // Update refreshes the history that GitInfo stores for the repo. If pull is
-// true then git pull is performed before refreshing.
+// true then git pull is performed before refreshing, or git fetch if the
+// GitInfo was created for a branch. If the GitInfo was created for a branch
+// then allBranches is ignored. Updates of all GitInfos of the same repo are
+// serialized.
 func (g *GitInfo) Update(pull, allBranches bool) error {
 	g.mutex.Lock()
 	defer g.mutex.Unlock()
+	repoLock := repoMutex(g.dir)
+	repoLock.Lock()
+	defer repoLock.Unlock()
 	glog.Info("Beginning Update.")
 	if pull {
 		cmd := exec.Command("git", "pull")
+		if g.branch != "" {
+			cmd = exec.Command("git", "fetch", "origin")
+		}
 		cmd.Dir = g.dir
 		b, err := cmd.Output()
 		if err != nil {
@@ -104,7 +148,9 @@ func (g *GitInfo) Update(pull, allBranches bool) error {
 	var hashes []string
 	var timestamps map[string]time.Time
 	var err error
-	if allBranches {
+	if g.branch != "" {
+		hashes, timestamps, err = readCommitsFromGit(g.dir, "origin/"+g.branch)
+	} else if allBranches {
 		hashes, timestamps, err = readCommitsFromGitAllBranches(g.dir)
 	} else {
 		hashes, timestamps, err = readCommitsFromGit(g.dir, "HEAD")
@@ -118,6 +164,12 @@ func (g *GitInfo) Update(pull, allBranches bool) error {
 	return nil
 }
 
+// Branch returns the branch this GitInfo was created for or "" if it was
+// not restricted to a branch.
+func (g *GitInfo) Branch() string {
+	return g.branch
+}
+
 // Details returns more information than ShortCommit about a given commit.
 func (g *GitInfo) Details(hash string) (*LongCommit, error) {
 	g.mutex.Lock()
@@ -1,8 +1,10 @@
 package gitinfo
 
 import (
+	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -241,6 +243,88 @@ func TestNumCommits(t *testing.T) {
 	}
 }
 
+func TestBranchGitInfo(t *testing.T) {
+	tr := util.NewTempRepo()
+	defer tr.Cleanup()
+
+	dir := filepath.Join(tr.Dir, "testrepo")
+	if _, err := NewBranchGitInfo(dir, false, "release"); err == nil {
+		t.Fatal("Expected error for unknown branch.")
+	}
+
+	// Create a release branch that was cut at the first commit.
+	cmd := exec.Command("git", "update-ref", "refs/remotes/origin/release", "7a669cfa3f4cd3482a4fd03989f75efcc7595f7f")
+	cmd.Dir = dir
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewBranchGitInfo(dir, false, "release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.Branch(), "release"; got != want {
+		t.Errorf("Branch wrong: Got %v Want %v", got, want)
+	}
+	if got, want := r.From(time.Unix(0, 0)), []string{"7a669cfa3f4cd3482a4fd03989f75efcc7595f7f"}; !util.SSliceEqual(got, want) {
+		t.Errorf("From wrong: Got %v Want %v", got, want)
+	}
+
+	// Updating keeps the history restricted to the branch.
+	if err := r.Update(false, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.NumCommits(), 1; got != want {
+		t.Errorf("NumCommit wrong number: Got %v Want %v", got, want)
+	}
+}
+
+func TestSharedRepoUpdate(t *testing.T) {
+	tr := util.NewTempRepo()
+	defer tr.Cleanup()
+
+	// Clone the test repo, so that it can be pulled from.
+	origin := filepath.Join(tr.Dir, "testrepo")
+	dir := filepath.Join(tr.Dir, "clone")
+	if _, err := Clone(origin, dir, false); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewGitInfo(dir, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewBranchGitInfo(dir, false, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("git", "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--allow-empty", "-m", "Third commit.")
+	cmd.Dir = origin
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent updates of GitInfos that share a repo don't collide.
+	var wg sync.WaitGroup
+	for _, g := range []*GitInfo{r, b, r, b} {
+		wg.Add(1)
+		go func(g *GitInfo) {
+			defer wg.Done()
+			if err := g.Update(true, false); err != nil {
+				t.Error(err)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if got, want := r.NumCommits(), 3; got != want {
+		t.Errorf("NumCommit wrong number: Got %v Want %v", got, want)
+	}
+	if got, want := b.NumCommits(), 3; got != want {
+		t.Errorf("NumCommit wrong number for branch: Got %v Want %v", got, want)
+	}
+}
+
 func TestRevList(t *testing.T) {
 	tr := util.NewTempRepo()
 	defer tr.Cleanup()
@@ -36,6 +36,7 @@ type Issue struct {
 	Modified       time.Time
 	ModifiedString string `json:"modified"`
 	Owner          string
+	Patchsets      []int64
 	Project        string
 	Reviewers      []string
 	Subject        string
@@ -70,12 +71,26 @@ type Rietveld struct {
 	Url string
 }
 
+// HTTPError is returned if Rietveld responds with a status other than 200 OK,
+// e.g. 404 for an issue that was deleted or 403 for a private issue.
+type HTTPError struct {
+	Url        string
+	StatusCode int
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("GET %s returned %d %s", e.Url, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
 func (r Rietveld) get(suburl string, rv interface{}) error {
 	resp, err := http.Get(r.Url + suburl)
 	if err != nil {
 		return fmt.Errorf("Failed to GET %s: %v", r.Url+suburl, err)
 	}
 	defer util.Close(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return &HTTPError{Url: r.Url + suburl, StatusCode: resp.StatusCode}
+	}
 	dec := json.NewDecoder(resp.Body)
 	if err := dec.Decode(rv); err != nil {
 		return fmt.Errorf("Failed to decode JSON: %v", err)
@@ -146,23 +161,7 @@ func (r Rietveld) Search(terms ...*SearchTerm) ([]*Issue, error) {
 			} else {
 				fullIssue.Created = parseTime(fullIssue.CreatedString)
 				fullIssue.Modified = parseTime(fullIssue.ModifiedString)
-				for _, msg := range fullIssue.Messages {
-					committed := false
-					for _, r := range committedIssueRegexp {
-						committed, err = regexp.MatchString(r, msg.Text)
-						if committed {
-							break
-						}
-					}
-					msg.Date = parseTime(msg.DateString)
-					if err != nil {
-						glog.Error(err)
-						continue
-					}
-					if committed {
-						fullIssue.Committed = true
-					}
-				}
+				fullIssue.Committed = isCommitted(fullIssue.Messages)
 				issues = append(issues, &fullIssue)
 			}
 		}
@@ -172,6 +171,38 @@ func (r Rietveld) Search(terms ...*SearchTerm) ([]*Issue, error) {
 	return issues, nil
 }
 
+// isCommitted returns true if one of the messages announces that the issue
+// has been committed.
+func isCommitted(messages []IssueMessage) bool {
+	for _, msg := range messages {
+		for _, r := range committedIssueRegexp {
+			committed, err := regexp.MatchString(r, msg.Text)
+			if err != nil {
+				glog.Error(err)
+				break
+			}
+			if committed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetIssueProperties returns the details of the given issue. The messages of
+// the issue are only retrieved if messages is true. Committed can only be
+// true if the messages are retrieved.
+func (r Rietveld) GetIssueProperties(issue int, messages bool) (*Issue, error) {
+	res, err := r.getIssueProperties(issue, messages)
+	if err != nil {
+		return nil, err
+	}
+	res.Created = parseTime(res.CreatedString)
+	res.Modified = parseTime(res.ModifiedString)
+	res.Committed = isCommitted(res.Messages)
+	return &res, nil
+}
+
 // getIssueProperties returns a fully filled-in Issue object, as opposed to
 // the partial data returned by Rietveld's search endpoint.
 func (r Rietveld) getIssueProperties(issue int, messages bool) (Issue, error) {
@@ -181,6 +212,10 @@ func (r Rietveld) getIssueProperties(issue int, messages bool) (Issue, error) {
 	}
 	var res Issue
 	err := r.get(url, &res)
+	if _, ok := err.(*HTTPError); ok {
+		// Keep the type, so callers can tell missing issues apart.
+		return Issue{}, err
+	}
 	if err != nil {
 		return Issue{}, fmt.Errorf("Failed to load details for issue %d: %v", issue, err)
 	}
@@ -124,6 +124,15 @@ func MapsEqual(a, b map[string]string) bool {
 	return true
 }
 
+// CopyStringMap returns a copy of the provided map.
+func CopyStringMap(m map[string]string) map[string]string {
+	ret := make(map[string]string, len(m))
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
+
 // MaxInt returns largest integer of a and b.
 func MaxInt(a, b int) int {
 	if a < b {
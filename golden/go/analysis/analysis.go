@@ -2,6 +2,7 @@ package analysis
 
 import (
 	"encoding/json"
+	"reflect"
 	"sort"
 	"sync"
 	"time"
@@ -189,6 +190,18 @@ type Analyzer struct {
 	// lastRawTile points to the last tile loaded from the tileStore.
 	lastRawTile *ptypes.Tile
 
+	// tracker computes the delta of each loaded tile to the previous one, so
+	// only the details of changed tests need to be recalculated.
+	tracker *storage.DeltaTracker
+
+	// lastIgnoreRevision is the revision of the ignore rules the current
+	// outputs were derived from, see IgnoreStore.Revision.
+	lastIgnoreRevision int64
+
+	// lastExpectations are the expectations the current outputs were
+	// derived from.
+	lastExpectations *expstorage.Expectations
+
 	// labeledTileCache caches the labeled tiles extracted tiles.
 	labeledTileCache util.LRUCache
 
@@ -225,6 +238,7 @@ func NewAnalyzer(storages *storage.Storage, puConverter PathToURLConverter, cach
 		current:          &AnalyzeState{},
 		ignored:          &AnalyzeState{},
 		lastRawTile:      nil,
+		tracker:          storage.NewDeltaTracker(storages.FullRecomputeInterval),
 		labeledTileCache: labeledTileCache,
 	}
 
@@ -342,12 +356,15 @@ func (a *Analyzer) GetTestDetails(testName string, query map[string][]string) (*
 }
 
 // SetDigestLabels sets the labels for the given digest and records the user
-// that made the classification.
-func (a *Analyzer) SetDigestLabels(labeledTestDigests map[string]types.TestClassification, userId string) (*GUITestDetails, error) {
+// that made the classification. versions are the expectation versions of the
+// tests the client based the change on, see expstorage.ExpectationsStore
+// AddChange. If a test changed since, an *expstorage.ConflictError is
+// returned and nothing is changed. nil skips the check.
+func (a *Analyzer) SetDigestLabels(labeledTestDigests map[string]types.TestClassification, userId string, versions map[string]int) (*GUITestDetails, error) {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 
-	if err := a.storages.ExpectationsStore.AddChange(labeledTestDigests, userId); err != nil {
+	if err := a.storages.ExpectationsStore.AddChange(labeledTestDigests, userId, versions); err != nil {
 		return nil, err
 	}
 
@@ -359,6 +376,7 @@ func (a *Analyzer) SetDigestLabels(labeledTestDigests map[string]types.TestClass
 	// Let's update our knowledge of the labels.
 	a.updateDerivedOutputs(labeledTestDigests, expectations, a.current)
 	a.updateDerivedOutputs(labeledTestDigests, expectations, a.ignored)
+	a.lastExpectations = expectations
 
 	result := make([]*GUITestDetail, 0, len(labeledTestDigests))
 	for testName := range labeledTestDigests {
@@ -476,6 +494,9 @@ func (a *Analyzer) cacheTiles(newLabeledTile *LabeledTile, ignoredLabeledTile *L
 // are ignoring.
 // The flags indicate whether to use the cached labeled tiles (during startup)
 // and whether to reload the tile from disk or use lastRawTile instead.
+// If a tile is reloaded only the details of the tests that changed since the
+// last tile are recalculated, unless a full recompute is due, see
+// storage.DeltaTracker.
 // The return value indicates whether a raw tile was loaded from disk.
 func (a *Analyzer) processTile(useCached bool, reloadRawTile bool) bool {
 	loadedTile := false
@@ -485,6 +506,11 @@ func (a *Analyzer) processTile(useCached bool, reloadRawTile bool) bool {
 	var newLabeledTile, ignoredLabeledTile *LabeledTile = nil, nil
 	var err error
 
+	// changedTests contains the tests whose details need to be recalculated.
+	// If it is nil all tests are recalculated.
+	var changedTests map[string]bool
+	ignoreRevision := a.lastIgnoreRevision
+
 	// Load the labeled tiles from cache. This will require no new diffs
 	// since they have already been calculated for the cached tile.
 	if useCached {
@@ -508,15 +534,27 @@ func (a *Analyzer) processTile(useCached bool, reloadRawTile bool) bool {
 			a.lastRawTile = tile
 			loadedTile = true
 			glog.Infoln("Loaded new tile from disk.")
+
+			if delta := a.tracker.Next(tile); !delta.Full {
+				changedTests = delta.ChangedTests
+				glog.Infof("Tests changed in new tile: %d", len(changedTests))
+			}
 		} else {
 			tile = a.lastRawTile
 			glog.Infoln("Reusing last raw tile.")
 		}
 
+		// Changed ignore rules move traces between the labeled tiles, so
+		// all tests are recalculated.
+		ignoreRevision = a.storages.IgnoreStore.Revision()
+		if ignoreRevision != a.lastIgnoreRevision {
+			changedTests = nil
+		}
+
 		newLabeledTile, ignoredLabeledTile = a.partitionRawTile(tile)
 
-		a.prepDiffsForLabeledTile(newLabeledTile)
-		a.prepDiffsForLabeledTile(ignoredLabeledTile)
+		a.prepDiffsForLabeledTile(newLabeledTile, changedTests)
+		a.prepDiffsForLabeledTile(ignoredLabeledTile, changedTests)
 		a.cacheTiles(newLabeledTile, ignoredLabeledTile)
 	}
 
@@ -531,10 +569,16 @@ func (a *Analyzer) processTile(useCached bool, reloadRawTile bool) bool {
 	expectations, err := a.storages.ExpectationsStore.Get()
 	if err != nil {
 		glog.Errorf("Error retrieving expectations: %s", err)
+		// The changes of this delta were not applied, so the next run has
+		// to recalculate everything.
+		a.tracker.Reset()
 		return false
 	}
-	a.setDerivedOutputs(newLabeledTile, expectations, a.current, false)
-	a.setDerivedOutputs(ignoredLabeledTile, expectations, a.ignored, false)
+	changedTests = a.addExpectationChanges(changedTests, expectations)
+	a.setDerivedOutputs(newLabeledTile, expectations, a.current, false, a.current.TestDetails, changedTests)
+	a.setDerivedOutputs(ignoredLabeledTile, expectations, a.ignored, false, a.ignored.TestDetails, changedTests)
+	a.lastExpectations = expectations
+	a.lastIgnoreRevision = ignoreRevision
 
 	glog.Info("Done processing tiles.")
 	runsCounter.Inc(1)
@@ -567,25 +611,66 @@ func (a *Analyzer) completeDiffs(labeledTile *LabeledTile) {
 
 // prepDiffsForLabeledTile forces the DiffStore to precalculate the diffs
 // between new digests. We do this outside the locking so that when we are
-// inside the lock almost all diffs will be cached already.
-func (a *Analyzer) prepDiffsForLabeledTile(labeledTile *LabeledTile) {
+// inside the lock almost all diffs will be cached already. If changedTests
+// is not nil only the diffs of the changed tests are calculated.
+func (a *Analyzer) prepDiffsForLabeledTile(labeledTile *LabeledTile, changedTests map[string]bool) {
 	glog.Infof("Starting prep diffs")
 	// Get the current expectations.
 	a.mutex.RLock()
 	expectations, err := a.storages.ExpectationsStore.Get()
+	if err == nil {
+		changedTests = a.addExpectationChanges(changedTests, expectations)
+	}
 	a.mutex.RUnlock()
 	if err != nil {
 		glog.Errorf("Unable to read expectations: %s", err)
 		return
 	}
 
+	// Only the details of the changed tests will be recalculated.
+	if changedTests != nil {
+		changedTile := NewLabeledTile()
+		changedTile.Commits = labeledTile.Commits
+		for testName := range changedTests {
+			if traces, ok := labeledTile.Traces[testName]; ok {
+				changedTile.Traces[testName] = traces
+			}
+		}
+		labeledTile = changedTile
+	}
+
 	// Make a dummy call to setDerivedOutputs to force a diff on new
 	// digest pairs.
 	tempState := AnalyzeState{}
-	a.setDerivedOutputs(labeledTile, expectations, &tempState, true)
+	a.setDerivedOutputs(labeledTile, expectations, &tempState, true, nil, nil)
 	glog.Infof("Done prep diffs")
 }
 
+// addExpectationChanges returns changedTests with the tests added whose
+// expectations differ from the expectations the current outputs were
+// derived from. It returns nil if changedTests is nil or the outputs have not
+// been derived yet. The caller must hold at least the read lock.
+func (a *Analyzer) addExpectationChanges(changedTests map[string]bool, expectations *expstorage.Expectations) map[string]bool {
+	if changedTests == nil || a.lastExpectations == nil || a.current.TestDetails == nil {
+		return nil
+	}
+	ret := make(map[string]bool, len(changedTests))
+	for testName := range changedTests {
+		ret[testName] = true
+	}
+	for testName, digests := range expectations.Tests {
+		if !reflect.DeepEqual(digests, a.lastExpectations.Tests[testName]) {
+			ret[testName] = true
+		}
+	}
+	for testName := range a.lastExpectations.Tests {
+		if _, ok := expectations.Tests[testName]; !ok {
+			ret[testName] = true
+		}
+	}
+	return ret
+}
+
 // partitionRawTile partitions the input tile into two tiles (current and ignored)
 // and derives the output data structures for both.
 func (a *Analyzer) partitionRawTile(tile *ptypes.Tile) (*LabeledTile, *LabeledTile) {
@@ -682,8 +767,10 @@ func getCommitsByDigest(labeledTile *LabeledTile, commitsByDigestMap map[string]
 }
 
 // setDerivedOutputs derives the output data from the given tile and
-// updates the outputs and tile in the analyzer.
-func (a *Analyzer) setDerivedOutputs(labeledTile *LabeledTile, expectations *expstorage.Expectations, state *AnalyzeState, prep bool) {
+// updates the outputs and tile in the analyzer. If prevDetails is not nil
+// only the details of the tests in changedTests are recalculated, see
+// getTestDetails.
+func (a *Analyzer) setDerivedOutputs(labeledTile *LabeledTile, expectations *expstorage.Expectations, state *AnalyzeState, prep bool, prevDetails *GUITestDetails, changedTests map[string]bool) {
 	// Assign all the labels.
 	for testName, traces := range labeledTile.Traces {
 		for _, trace := range traces {
@@ -694,7 +781,10 @@ func (a *Analyzer) setDerivedOutputs(labeledTile *LabeledTile, expectations *exp
 	// Generate the lookup index for the tile and get all parameters.
 	state.Index = NewLabeledTileIndex(labeledTile)
 	state.Tile = labeledTile
-	state.TestDetails = a.getTestDetails(state)
+	if changedTests == nil {
+		prevDetails = nil
+	}
+	state.TestDetails = a.getTestDetails(state, prevDetails, changedTests)
 
 	// Don't calculate these during prep runs.
 	if !prep {
@@ -145,10 +145,25 @@ func TestGetListTestDetails(t *testing.T) {
 	assert.Equal(t, 2, len(findTest(t, list1, "t5").Untriaged))
 
 	// Triage some digests.
-	list1, err = a.SetDigestLabels(LABELING_1, "John Doe")
+	versions, err := storages.ExpectationsStore.Versions()
+	assert.Nil(t, err)
+	list1, err = a.SetDigestLabels(LABELING_1, "John Doe", versions)
 	assert.Nil(t, err)
 	assert.Equal(t, len(LABELING_1), len(list1.Tests))
 
+	// A change based on the versions before LABELING_1 conflicts and leaves
+	// the labels untouched.
+	_, err = a.SetDigestLabels(map[string]types.TestClassification{
+		"t1": map[string]types.Label{"d_12": types.POSITIVE},
+	}, "Jim Doe", versions)
+	conflictErr, ok := err.(*expstorage.ConflictError)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(conflictErr.Conflicts))
+	assert.Equal(t, "d_12", conflictErr.Conflicts[0].Digest)
+	test1, err = a.GetTestDetails("t1", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(test1.Tests[0].Negative))
+
 	status := a.GetStatus()
 	assert.NotNil(t, status)
 	assert.Equal(t, STATUS_OK_1, status.OK)
@@ -156,7 +171,7 @@ func TestGetListTestDetails(t *testing.T) {
 	assert.Equal(t, UNTRIAGED_COUNT_1, status.CorpStatus[CORPUS].UntriagedCount)
 	assert.Equal(t, NEGATIVE_COUNT_1, status.CorpStatus[CORPUS].NegativeCount)
 
-	list1, err = a.SetDigestLabels(LABELING_2, "Jim Doe")
+	list1, err = a.SetDigestLabels(LABELING_2, "Jim Doe", nil)
 	assert.Nil(t, err)
 	assert.Equal(t, len(LABELING_2), len(list1.Tests))
 	list1, err = a.ListTestDetails(nil)
@@ -319,3 +334,50 @@ func findTest(t *testing.T, tDetails *GUITestDetails, testName string) *GUITestD
 	assert.FailNow(t, "Unable to find test: "+testName)
 	return nil
 }
+
+func TestIgnoreRevision(t *testing.T) {
+	digests := [][]string{
+		[]string{"d_11", "d_12"},
+		[]string{"d_13", "d_14"},
+	}
+	params := []map[string]string{
+		map[string]string{types.PRIMARY_KEY_FIELD: "t1", types.CORPUS_FIELD: "corpus1", "p1": "v11"},
+		map[string]string{types.PRIMARY_KEY_FIELD: "t1", types.CORPUS_FIELD: "corpus1", "p1": "v12"},
+	}
+	start := time.Now().Unix()
+	commits := []*ptypes.Commit{
+		&ptypes.Commit{CommitTime: start + 10, Hash: "h1", Author: "John Doe 1"},
+		&ptypes.Commit{CommitTime: start + 20, Hash: "h2", Author: "John Doe 2"},
+	}
+
+	storages := &storage.Storage{
+		DiffStore:             mocks.NewMockDiffStore(),
+		ExpectationsStore:     expstorage.NewMemExpectationsStore(),
+		IgnoreStore:           types.NewMemIgnoreStore(),
+		TileStore:             mocks.NewMockTileStore(t, digests, params, commits),
+		FullRecomputeInterval: time.Hour,
+	}
+	a := NewAnalyzer(storages, mocks.MockUrlGenerator, filediffstore.MemCacheFactory, 10*time.Hour)
+	for {
+		allTests, err := a.ListTestDetails(nil)
+		assert.Nil(t, err)
+		if allTests != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test1, err := a.GetTestDetails("t1", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(test1.Tests[0].Untriaged))
+
+	// The tile is unchanged, but a rule added to the IgnoreStore directly
+	// still moves one of the traces of t1 to the ignored tile.
+	rule := types.NewIgnoreRule("John Doe", time.Now().Add(time.Hour), "p1=v11", "")
+	assert.Nil(t, storages.IgnoreStore.Create(rule))
+	assert.True(t, a.processTile(false, true))
+
+	test1, err = a.GetTestDetails("t1", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(test1.Tests[0].Untriaged))
+	assert.Equal(t, 2, len(a.ignored.TestDetails.lookup("t1").Untriaged))
+}
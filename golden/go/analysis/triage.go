@@ -55,23 +55,39 @@ type GUIUntriagedDigest struct {
 	Diffs GUIDiffMetrics `json:"diffs"`
 }
 
-// GUIDiffMetrics is a sortable slice of diff metrics.
+// GUIDiffMetrics is a sortable slice of diff metrics. The closest positive
+// digest is the one with the fewest pixels that differ perceptibly. Ties are
+// broken by the mean color distance and then by the raw pixel difference,
+// so that anti-aliasing noise does not hide a visually identical image.
 type GUIDiffMetrics []*GUIDiffMetric
 
 func (m GUIDiffMetrics) Len() int { return len(m) }
 func (m GUIDiffMetrics) Less(i, j int) bool {
-	return (m[i] == nil) || (m[j] == nil) || (m[i].PixelDiffPercent < m[j].PixelDiffPercent)
+	if (m[i] == nil) || (m[j] == nil) {
+		return true
+	}
+	if m[i].NumPixelsOverTolerance != m[j].NumPixelsOverTolerance {
+		return m[i].NumPixelsOverTolerance < m[j].NumPixelsOverTolerance
+	}
+	if m[i].MeanDeltaE != m[j].MeanDeltaE {
+		return m[i].MeanDeltaE < m[j].MeanDeltaE
+	}
+	return m[i].PixelDiffPercent < m[j].PixelDiffPercent
 }
 func (m GUIDiffMetrics) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
 
 // GUIDiffMetric is an output type to store the diff metrics comparing an
 // untriaged digest to a positive digest as well as the url of the diff image.
 type GUIDiffMetric struct {
-	NumDiffPixels    int     `json:"numDiffPixels"`
-	PixelDiffPercent float32 `json:"pixelDiffPercent"`
-	MaxRGBADiffs     []int   `json:"maxRGBADiffs"`
-	DiffImgUrl       string  `json:"diffImgUrl"`
-	PosDigest        string  `json:"posDigest"`
+	NumDiffPixels          int     `json:"numDiffPixels"`
+	PixelDiffPercent       float32 `json:"pixelDiffPercent"`
+	MaxRGBADiffs           []int   `json:"maxRGBADiffs"`
+	SSIM                   float64 `json:"ssim"`
+	MeanDeltaE             float64 `json:"meanDeltaE"`
+	MaxDeltaE              float64 `json:"maxDeltaE"`
+	NumPixelsOverTolerance int     `json:"numPixelsOverTolerance"`
+	DiffImgUrl             string  `json:"diffImgUrl"`
+	PosDigest              string  `json:"posDigest"`
 }
 
 // GUITestDetailSortable is a wrapper to sort a slice of GUITestDetail.
@@ -81,23 +97,31 @@ func (g GUITestDetailSortable) Len() int           { return len(g) }
 func (g GUITestDetailSortable) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
 func (g GUITestDetailSortable) Less(i, j int) bool { return g[i].Name < g[j].Name }
 
-// getTestDetails processes a tile and calculates the diff metrics for all
-// untriaged digests.
-func (a *Analyzer) getTestDetails(state *AnalyzeState) *GUITestDetails {
+// getTestDetails processes the tile in state and calculates the diff metrics
+// for all untriaged digests. If prev is not nil the details of the tests that
+// are not in changedTests are taken from prev instead of being recalculated.
+func (a *Analyzer) getTestDetails(state *AnalyzeState, prev *GUITestDetails, changedTests map[string]bool) *GUITestDetails {
 	glog.Infof("Latest commit: %v", state.Tile.Commits[len(state.Tile.Commits)-1])
 	glog.Infoln("Starting to extract test details.")
-	nTests := len(state.Tile.Traces)
-	resultCh := make(chan *GUITestDetail, nTests)
+	resultCh := make(chan *GUITestDetail, len(state.Tile.Traces))
+	result := make([]*GUITestDetail, 0, len(state.Tile.Traces))
 
+	nTests := 0
 	for testName, testTraces := range state.Tile.Traces {
+		if prev != nil && !changedTests[testName] {
+			if detail := prev.lookup(testName); detail != nil {
+				result = append(result, detail)
+				continue
+			}
+		}
 		go a.processOneTestDetail(testName, testTraces, resultCh)
+		nTests++
 	}
 
 	// Wait for the results to finish.
-	result := make([]*GUITestDetail, 0, nTests)
 	for i := 0; i < nTests; i++ {
 		result = append(result, <-resultCh)
-		glog.Infof("Processed %d/%d tests. (%f%%)", len(result), nTests, float64(len(result))/float64(nTests)*100.0)
+		glog.Infof("Processed %d/%d tests. (%f%%)", i+1, nTests, float64(i+1)/float64(nTests)*100.0)
 	}
 
 	// Sort the resulting tests by name.
@@ -280,11 +304,15 @@ func (a *Analyzer) newGUIDiffMetrics(digest string, posDigests []string) GUIDiff
 
 	for posDigest, dm := range dms {
 		result = append(result, &GUIDiffMetric{
-			NumDiffPixels:    dm.NumDiffPixels,
-			PixelDiffPercent: dm.PixelDiffPercent,
-			MaxRGBADiffs:     dm.MaxRGBADiffs,
-			DiffImgUrl:       a.pathToURLConverter(dm.PixelDiffFilePath),
-			PosDigest:        posDigest,
+			NumDiffPixels:          dm.NumDiffPixels,
+			PixelDiffPercent:       dm.PixelDiffPercent,
+			MaxRGBADiffs:           dm.MaxRGBADiffs,
+			SSIM:                   dm.SSIM,
+			MeanDeltaE:             dm.MeanDeltaE,
+			MaxDeltaE:              dm.MaxDeltaE,
+			NumPixelsOverTolerance: dm.NumPixelsOverTolerance,
+			DiffImgUrl:             a.pathToURLConverter(dm.PixelDiffFilePath),
+			PosDigest:              posDigest,
 		})
 	}
 	return result
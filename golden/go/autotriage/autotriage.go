@@ -0,0 +1,209 @@
+// autotriage labels untriaged digests as positive if they are within the
+// tolerance of a digest of the same test that a user labeled positive. The tolerances are
+// defined by the rules in the ToleranceStore. Every change is recorded in
+// the triage log with the user id of the rule that made it, see
+// types.ToleranceRule.UserID.
+package autotriage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/skia-dev/glog"
+	"go.skia.org/infra/go/timer"
+	"go.skia.org/infra/golden/go/diff"
+	"go.skia.org/infra/golden/go/storage"
+	"go.skia.org/infra/golden/go/types"
+	ptypes "go.skia.org/infra/perf/go/types"
+)
+
+const (
+	// METRIC_AUTO_TRIAGED is the name of the counter of auto-triaged digests.
+	METRIC_AUTO_TRIAGED = "gold.autotriage.digests"
+)
+
+var autoTriagedCounter = metrics.NewRegisteredCounter(METRIC_AUTO_TRIAGED, nil)
+
+// AutoTriager watches the tiles and the expectations and applies the
+// tolerance rules whenever either of them changes.
+type AutoTriager struct {
+	storages *storage.Storage
+
+	// mutex serializes calls to Triage.
+	mutex sync.Mutex
+}
+
+// New creates a new AutoTriager and starts watching for new tiles and
+// expectation changes in the background.
+func New(storages *storage.Storage) *AutoTriager {
+	ret := &AutoTriager{
+		storages: storages,
+	}
+	go ret.watch()
+	return ret
+}
+
+func (a *AutoTriager) watch() {
+	expChanges := a.storages.ExpectationsStore.Changes()
+	tileStream := storage.GetTileStreamNow(a.storages.TileStore, 2*time.Minute)
+	for {
+		select {
+		case <-tileStream:
+		case <-expChanges:
+			storage.DrainChangeChannel(expChanges)
+		}
+		if _, err := a.Triage(); err != nil {
+			glog.Errorf("Error auto-triaging digests: %s", err)
+		}
+	}
+}
+
+// Triage applies the tolerance rules to all untriaged digests in the last
+// tile and returns the number of digests that were labeled positive.
+//
+// A digest is labeled by the first matching rule (ordered by id) for which
+// the digest is within tolerance of at least one digest of the same test that
+// a user labeled positive. Digests that a user explicitly set to untriaged,
+// e.g. by undoing the change of a rule, and digests whose label set by a rule
+// was removed are left alone, so users can override the rules.
+func (a *AutoTriager) Triage() (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	defer timer.New("auto-triage").Stop()
+
+	matcher, err := a.storages.ToleranceStore.BuildToleranceMatcher()
+	if err != nil {
+		return 0, err
+	}
+	exp, err := a.storages.ExpectationsStore.Get()
+	if err != nil {
+		return 0, err
+	}
+	labeledBy, err := a.storages.ExpectationsStore.LabeledBy()
+	if err != nil {
+		return 0, err
+	}
+	removedBy, err := a.storages.ExpectationsStore.RemovedBy()
+	if err != nil {
+		return 0, err
+	}
+	tile, err := a.storages.GetLastTileTrimmed()
+	if err != nil {
+		return 0, err
+	}
+
+	// Collect the untriaged digests and the rules that apply to them,
+	// keyed by test name and digest.
+	candidates := map[string]map[string]map[int]*types.ToleranceRule{}
+	for _, trace := range tile.Traces {
+		rules, ok := matcher(trace.Params())
+		if !ok {
+			continue
+		}
+		testName := trace.Params()[types.PRIMARY_KEY_FIELD]
+		for _, digest := range trace.(*ptypes.GoldenTrace).Values {
+			if digest == ptypes.MISSING_DIGEST || exp.Classification(testName, digest) != types.UNTRIAGED || overridden(labeledBy, removedBy, testName, digest) {
+				continue
+			}
+			if _, ok := candidates[testName]; !ok {
+				candidates[testName] = map[string]map[int]*types.ToleranceRule{}
+			}
+			if _, ok := candidates[testName][digest]; !ok {
+				candidates[testName][digest] = map[int]*types.ToleranceRule{}
+			}
+			for _, rule := range rules {
+				candidates[testName][digest][rule.ID] = rule
+			}
+		}
+	}
+
+	// Compare the candidates to the positive digests of their test that were
+	// labeled by a user. Comparing to auto-triaged digests would let a chain
+	// of small differences drift arbitrarily far from what a user approved.
+	// The changes are grouped by rule so the triage log shows which rule made
+	// them.
+	changes := map[int]map[string]types.TestClassification{}
+	rulesById := map[int]*types.ToleranceRule{}
+	for testName, digests := range candidates {
+		positives := []string{}
+		for digest, label := range exp.Tests[testName] {
+			if _, byRule := types.ToleranceRuleID(labeledBy[testName][digest]); label == types.POSITIVE && !byRule {
+				positives = append(positives, digest)
+			}
+		}
+		if len(positives) == 0 {
+			continue
+		}
+
+		for digest, rules := range digests {
+			dms, err := a.storages.DiffStore.Get(digest, positives)
+			if err != nil {
+				glog.Errorf("Unable to diff %s against the positive digests of %s: %s", digest, testName, err)
+				continue
+			}
+			if rule := firstWithin(rules, dms); rule != nil {
+				if _, ok := changes[rule.ID]; !ok {
+					changes[rule.ID] = map[string]types.TestClassification{}
+				}
+				if _, ok := changes[rule.ID][testName]; !ok {
+					changes[rule.ID][testName] = types.TestClassification{}
+				}
+				changes[rule.ID][testName][digest] = types.POSITIVE
+				rulesById[rule.ID] = rule
+			}
+		}
+	}
+
+	count := 0
+	for id, change := range changes {
+		if err := a.storages.ExpectationsStore.AddChange(change, rulesById[id].UserID(), nil); err != nil {
+			return count, err
+		}
+		for _, digests := range change {
+			count += len(digests)
+		}
+	}
+	autoTriagedCounter.Inc(int64(count))
+	if count > 0 {
+		glog.Infof("Auto-triaged %d digests.", count)
+	}
+	return count, nil
+}
+
+// overridden returns true if a user overrode the tolerance rules for the
+// untriaged digest, i.e. its untriaged label was set by a user or a label set
+// by a rule was removed.
+func overridden(labeledBy, removedBy map[string]map[string]string, testName, digest string) bool {
+	if userId, ok := labeledBy[testName][digest]; ok {
+		if _, byRule := types.ToleranceRuleID(userId); !byRule {
+			return true
+		}
+	}
+	if userId, ok := removedBy[testName][digest]; ok {
+		if _, byRule := types.ToleranceRuleID(userId); byRule {
+			return true
+		}
+	}
+	return false
+}
+
+// firstWithin returns the rule with the lowest id for which any of the given
+// diff metrics are within tolerance. Returns nil if there is no such rule.
+func firstWithin(rules map[int]*types.ToleranceRule, dms map[string]*diff.DiffMetrics) *types.ToleranceRule {
+	sorted := make([]*types.ToleranceRule, 0, len(rules))
+	for _, rule := range rules {
+		sorted = append(sorted, rule)
+	}
+	sort.Sort(types.ToleranceRuleSlice(sorted))
+
+	for _, rule := range sorted {
+		for _, dm := range dms {
+			if rule.Within(dm) {
+				return rule
+			}
+		}
+	}
+	return nil
+}
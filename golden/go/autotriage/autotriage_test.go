@@ -0,0 +1,138 @@
+package autotriage
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/go/testutils"
+	"go.skia.org/infra/golden/go/expstorage"
+	"go.skia.org/infra/golden/go/filediffstore"
+	"go.skia.org/infra/golden/go/mocks"
+	"go.skia.org/infra/golden/go/storage"
+	"go.skia.org/infra/golden/go/types"
+	ptypes "go.skia.org/infra/perf/go/types"
+)
+
+func init() {
+	filediffstore.Init()
+}
+
+// grayImage returns a 10x10 gray image. If changed is true one of its pixels,
+// i.e. 1% of them, differs by up to 5 per channel.
+func grayImage(changed bool) image.Image {
+	ret := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			ret.SetNRGBA(x, y, color.NRGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff})
+		}
+	}
+	if changed {
+		ret.SetNRGBA(3, 4, color.NRGBA{R: 0x85, G: 0x83, B: 0x84, A: 0xff})
+	}
+	return ret
+}
+
+func TestTriage(t *testing.T) {
+	commits := []*ptypes.Commit{
+		&ptypes.Commit{CommitTime: 42, Hash: "ffffffffffffffffffffffffffffffffffffffff", Author: "test@test.cz"},
+		&ptypes.Commit{CommitTime: 45, Hash: "gggggggggggggggggggggggggggggggggggggggg", Author: "test@test.cz"},
+	}
+	params := []map[string]string{
+		{"name": "foo", "config": "gpu", "source_type": "gm"},
+		{"name": "foo", "config": "8888", "source_type": "gm"},
+		{"name": "bar", "config": "gpu", "source_type": "gm"},
+	}
+	digests := [][]string{
+		{"aaa", "bbb"},
+		{"aaa", "ccc"},
+		{"ddd", "eee"},
+	}
+
+	baseDir, err := ioutil.TempDir("", "autotriage")
+	assert.Nil(t, err)
+	defer testutils.RemoveAll(t, baseDir)
+	diffStore, err := filediffstore.NewOfflineDiffStore(filediffstore.NewMemImageSource(map[string]image.Image{
+		"aaa": grayImage(false),
+		"bbb": grayImage(true),
+		"ccc": grayImage(true),
+		"ddd": grayImage(false),
+		"eee": grayImage(true),
+	}), baseDir, filediffstore.MemCacheFactory, 10, nil)
+	assert.Nil(t, err)
+
+	storages := &storage.Storage{
+		DiffStore:         diffStore,
+		ExpectationsStore: expstorage.NewMemExpectationsStore(),
+		ToleranceStore:    types.NewMemToleranceStore(),
+		TileStore:         mocks.NewMockTileStore(t, digests, params, commits),
+	}
+	// The positive digest of foo was labeled by a rule.
+	assert.Nil(t, storages.ExpectationsStore.AddChange(map[string]types.TestClassification{
+		"foo": {"aaa": types.POSITIVE},
+	}, (&types.ToleranceRule{ID: 99}).UserID(), nil))
+	assert.Nil(t, storages.ExpectationsStore.AddChange(map[string]types.TestClassification{
+		"bar": {"ddd": types.NEGATIVE},
+	}, "jon@example.com", nil))
+	autoTriager := &AutoTriager{storages: storages}
+
+	// Without rules nothing is triaged.
+	count, err := autoTriager.Triage()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	// The changed digests have a max channel delta of 5 and 1% of their
+	// pixels differ, which is outside of the tolerance of this rule.
+	tight := types.NewToleranceRule("jon@example.com", "config=gpu", 2, 0.1, "")
+	assert.Nil(t, storages.ToleranceStore.Create(tight))
+	count, err = autoTriager.Triage()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	// Digests are only compared to positive digests labeled by a user.
+	loose := types.NewToleranceRule("jon@example.com", "config=gpu", 5, 1, "")
+	assert.Nil(t, storages.ToleranceStore.Create(loose))
+	count, err = autoTriager.Triage()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	assert.Nil(t, storages.ExpectationsStore.AddChange(map[string]types.TestClassification{
+		"foo": {"aaa": types.POSITIVE},
+	}, "jon@example.com", nil))
+	count, err = autoTriager.Triage()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	// Only the gpu digest of foo is labeled. bar has no positive digests and
+	// ccc was produced by a config without a rule.
+	exp, err := storages.ExpectationsStore.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, types.POSITIVE, exp.Classification("foo", "bbb"))
+	assert.Equal(t, types.UNTRIAGED, exp.Classification("foo", "ccc"))
+	assert.Equal(t, types.UNTRIAGED, exp.Classification("bar", "eee"))
+
+	// Running again does not find anything new.
+	count, err = autoTriager.Triage()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	// Removing the label set by the rule overrides the rule.
+	assert.Nil(t, storages.ExpectationsStore.RemoveChange(map[string][]string{"foo": {"bbb"}}))
+	count, err = autoTriager.Triage()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	// So does a user setting the digest to untriaged, e.g. by undoing the
+	// change of the rule.
+	assert.Nil(t, storages.ExpectationsStore.AddChange(map[string]types.TestClassification{
+		"foo": {"bbb": types.UNTRIAGED},
+	}, "jon@example.com", nil))
+	count, err = autoTriager.Triage()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+	exp, err = storages.ExpectationsStore.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, types.UNTRIAGED, exp.Classification("foo", "bbb"))
+}
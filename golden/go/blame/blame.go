@@ -1,12 +1,15 @@
 package blame
 
 import (
+	"reflect"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/skia-dev/glog"
 	"go.skia.org/infra/go/timer"
 	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/golden/go/expstorage"
 	"go.skia.org/infra/golden/go/storage"
 	"go.skia.org/infra/golden/go/types"
 	ptypes "go.skia.org/infra/perf/go/types"
@@ -21,6 +24,16 @@ type Blamer struct {
 	// testBlameLists are the blamelists keyed by testName and digest.
 	testBlameLists map[string]map[string]*BlameDistribution
 
+	// commitBlames is the inverse of testBlameLists including the negative
+	// digests, keyed by commit hash.
+	commitBlames map[string][]*CommitBlame
+
+	// allBlameLists are the blame lists including the negative digests and
+	// corpora the corpus of each test. They are the state that is updated
+	// incrementally.
+	allBlameLists map[string]map[string]*BlameDistribution
+	corpora       map[string]string
+
 	storages *storage.Storage
 	mutex    sync.Mutex
 }
@@ -34,11 +47,25 @@ type BlameDistribution struct {
 	Freq []int `json:"freq"`
 }
 
+// CommitBlame is an untriaged or negative digest that was likely introduced
+// by a commit.
+type CommitBlame struct {
+	TestName string `json:"test"`
+	Digest   string `json:"digest"`
+	Corpus   string `json:"corpus"`
+	Status   string `json:"status"`
+
+	// Prob is the probability that the commit introduced the digest, i.e.
+	// the share of the digest's BlameDistribution that points at the commit.
+	Prob float64 `json:"prob"`
+}
+
 // New returns a new Blamer instance and error. The error is not
 // nil if the first run of calculating the blame lists failed.
 func New(storages *storage.Storage) (*Blamer, error) {
 	ret := &Blamer{
 		testBlameLists: map[string]map[string]*BlameDistribution{},
+		commitBlames:   map[string][]*CommitBlame{},
 		storages:       storages,
 	}
 
@@ -50,10 +77,10 @@ func New(storages *storage.Storage) (*Blamer, error) {
 // process to recalculate the blame lists as tiles and expectations change.
 func (b *Blamer) processTileStream() error {
 	expChanges := b.storages.ExpectationsStore.Changes()
-	tileStream := storage.GetTileStreamNow(b.storages.TileStore, 2*time.Minute)
+	deltaStream := storage.GetTileDeltaStreamNow(b.storages.TileStore, 2*time.Minute, b.storages.FullRecomputeInterval)
 
-	lastTile := <-tileStream
-	if err := b.updateBlame(lastTile); err != nil {
+	lastDelta := <-deltaStream
+	if err := b.updateBlame(lastDelta); err != nil {
 		return err
 	}
 
@@ -61,15 +88,24 @@ func (b *Blamer) processTileStream() error {
 	go func() {
 		for {
 			select {
-			case tile := <-tileStream:
-				if err := b.updateBlame(tile); err != nil {
+			case delta := <-deltaStream:
+				// If the last update failed the delta does not apply to the
+				// current blame lists.
+				if lastDelta == nil {
+					delta.Full = true
+				}
+				if err := b.updateBlame(delta); err != nil {
 					glog.Errorf("Error updating blame lists: %s", err)
+					lastDelta = nil
 				} else {
-					lastTile = tile
+					lastDelta = delta
 				}
-			case <-expChanges:
-				storage.DrainChangeChannel(expChanges)
-				if err := b.updateBlame(lastTile); err != nil {
+			case testNames := <-expChanges:
+				testNames = drainTestNames(expChanges, testNames)
+				if lastDelta == nil {
+					continue
+				}
+				if err := b.updateTests(lastDelta.Tile, testNames); err != nil {
 					glog.Errorf("Error updating blame lists: %s", err)
 				}
 			}
@@ -79,6 +115,24 @@ func (b *Blamer) processTileStream() error {
 	return nil
 }
 
+// drainTestNames adds the test names of all changes that are buffered or
+// ready to be read from ch to testNames. The result is nil if any change
+// did not name its tests.
+func drainTestNames(ch <-chan []string, testNames []string) []string {
+	for {
+		select {
+		case names := <-ch:
+			if testNames == nil || names == nil {
+				testNames = nil
+			} else {
+				testNames = append(testNames, names...)
+			}
+		default:
+			return testNames
+		}
+	}
+}
+
 func (b *Blamer) GetAllBlameLists() (map[string]map[string]*BlameDistribution, []*ptypes.Commit) {
 	b.mutex.Lock()
 	blameLists, commits := b.testBlameLists, b.commits
@@ -98,16 +152,149 @@ func (b *Blamer) GetBlameList(testName string) (map[string]*BlameDistribution, [
 	return map[string]*BlameDistribution{}, commits
 }
 
-// updateBlame reads from the provided tileStream and updates the current
-// blame lists.
-func (b *Blamer) updateBlame(tile *ptypes.Tile) error {
+// GetCommitBlame returns the untriaged and negative digests that were likely
+// introduced by the commit with the given hash, most likely first.
+func (b *Blamer) GetCommitBlame(hash string) []*CommitBlame {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if ret, ok := b.commitBlames[hash]; ok {
+		return ret
+	}
+	return []*CommitBlame{}
+}
+
+// updateBlame updates the blame lists to the tile of the given delta. Only
+// the tests in delta.ChangedTests are recalculated unless the delta is a full
+// delta or commits were dropped from the start of the tile.
+func (b *Blamer) updateBlame(delta *storage.TileDelta) error {
+	exp, err := b.storages.ExpectationsStore.Get()
+	if err != nil {
+		return err
+	}
+
+	defer timer.New("blame").Stop()
+	commits := delta.Tile.Commits[:delta.Tile.LastCommitIndex()+1]
+	incremental := delta.Incremental() && (delta.Shift == 0) && (b.allBlameLists != nil)
+	if delta.Full || !incremental {
+		blameLists, corpora := b.calcBlame(delta.Tile, exp, nil)
+		if delta.Check && incremental {
+			// This can also report a difference if the expectations changed
+			// and the change has not been processed yet.
+			changedBlameLists, changedCorpora := b.calcBlame(delta.Tile, exp, delta.ChangedTests)
+			incBlameLists, _ := mergeBlame(b.allBlameLists, b.corpora, changedBlameLists, changedCorpora, delta.ChangedTests, delta.NewCommits)
+			if !reflect.DeepEqual(incBlameLists, blameLists) {
+				glog.Warningf("Incrementally updated blame lists differ from the full recompute.")
+			}
+		}
+		b.setBlame(blameLists, corpora, commits, exp)
+		return nil
+	}
+
+	blameLists, corpora := b.calcBlame(delta.Tile, exp, delta.ChangedTests)
+	blameLists, corpora = mergeBlame(b.allBlameLists, b.corpora, blameLists, corpora, delta.ChangedTests, delta.NewCommits)
+	b.setBlame(blameLists, corpora, commits, exp)
+	return nil
+}
+
+// updateTests recalculates the blame lists of the given tests in the given
+// tile, which is the tile the current blame lists are based on. If testNames
+// is nil all tests are recalculated.
+func (b *Blamer) updateTests(tile *ptypes.Tile, testNames []string) error {
 	exp, err := b.storages.ExpectationsStore.Get()
 	if err != nil {
 		return err
 	}
 
 	defer timer.New("blame").Stop()
+	commits := tile.Commits[:tile.LastCommitIndex()+1]
+	if testNames == nil {
+		blameLists, corpora := b.calcBlame(tile, exp, nil)
+		b.setBlame(blameLists, corpora, commits, exp)
+		return nil
+	}
+
+	changed := make(map[string]bool, len(testNames))
+	for _, testName := range testNames {
+		changed[testName] = true
+	}
+	blameLists, corpora := b.calcBlame(tile, exp, changed)
+	blameLists, corpora = mergeBlame(b.allBlameLists, b.corpora, blameLists, corpora, changed, 0)
+	b.setBlame(blameLists, corpora, commits, exp)
+	return nil
+}
+
+// mergeBlame returns the blame lists and corpora of the previous tile
+// (prevBlameLists, prevCorpora) updated with the recalculated blame lists and
+// corpora of the changed tests. The tile has newCommits more commits than the
+// previous tile, so the distributions of the tests that did not change are
+// extended accordingly.
+func mergeBlame(prevBlameLists map[string]map[string]*BlameDistribution, prevCorpora map[string]string, blameLists map[string]map[string]*BlameDistribution, corpora map[string]string, changed map[string]bool, newCommits int) (map[string]map[string]*BlameDistribution, map[string]string) {
+	retBlameLists := make(map[string]map[string]*BlameDistribution, len(prevBlameLists))
+	for testName, digests := range prevBlameLists {
+		if changed[testName] {
+			continue
+		}
+		if newCommits == 0 {
+			retBlameLists[testName] = digests
+			continue
+		}
+		extended := make(map[string]*BlameDistribution, len(digests))
+		for digest, dist := range digests {
+			if len(dist.Freq) == 0 {
+				extended[digest] = dist
+			} else {
+				extended[digest] = &BlameDistribution{Freq: append(append([]int{}, dist.Freq...), make([]int, newCommits)...)}
+			}
+		}
+		retBlameLists[testName] = extended
+	}
+	retCorpora := make(map[string]string, len(prevCorpora))
+	for testName, corpus := range prevCorpora {
+		if !changed[testName] {
+			retCorpora[testName] = corpus
+		}
+	}
+
+	for testName, digests := range blameLists {
+		retBlameLists[testName] = digests
+	}
+	for testName, corpus := range corpora {
+		retCorpora[testName] = corpus
+	}
+	return retBlameLists, retCorpora
+}
 
+// setBlame sets the given blame lists, which include the negative digests,
+// and derives the blame lists without negative digests and the commit index
+// from them.
+func (b *Blamer) setBlame(blameLists map[string]map[string]*BlameDistribution, corpora map[string]string, commits []*ptypes.Commit, exp *expstorage.Expectations) {
+	// The negative digests are only needed for the commit index.
+	commitBlames := invertBlame(blameLists, commits, exp, corpora)
+	testBlameLists := make(map[string]map[string]*BlameDistribution, len(blameLists))
+	for testName, digests := range blameLists {
+		filtered := make(map[string]*BlameDistribution, len(digests))
+		for digest, dist := range digests {
+			if exp.Classification(testName, digest) != types.NEGATIVE {
+				filtered[digest] = dist
+			}
+		}
+		if len(filtered) > 0 {
+			testBlameLists[testName] = filtered
+		}
+	}
+
+	// Swap out the old blame lists for the new ones.
+	b.mutex.Lock()
+	b.testBlameLists, b.commits, b.commitBlames = testBlameLists, commits, commitBlames
+	b.allBlameLists, b.corpora = blameLists, corpora
+	b.mutex.Unlock()
+}
+
+// calcBlame calculates the blame lists, including the negative digests, and
+// the corpora of the tests in the tile. If testNames is not nil only the
+// given tests are calculated.
+func (b *Blamer) calcBlame(tile *ptypes.Tile, exp *expstorage.Expectations, testNames map[string]bool) (map[string]map[string]*BlameDistribution, map[string]string) {
 	// Note: blameStart and blameEnd are continously updated to contain the
 	// smalles start and end index of the ranges for a testName/digest pair.
 	blameStart := map[string]map[string]int{}
@@ -115,12 +302,19 @@ func (b *Blamer) updateBlame(tile *ptypes.Tile) error {
 
 	// blameRange stores the candidate ranges for a testName/digest pair.
 	blameRange := map[string]map[string][][]int{}
+
+	// corpora stores the corpus of each testName.
+	corpora := map[string]string{}
 	firstCommit := tile.Commits[0]
 
 	tileLen := tile.LastCommitIndex() + 1
 	for _, trace := range tile.Traces {
 		gtr := trace.(*ptypes.GoldenTrace)
 		testName := gtr.Params()[types.PRIMARY_KEY_FIELD]
+		if testNames != nil && !testNames[testName] {
+			continue
+		}
+		corpora[testName] = gtr.Params()[types.CORPUS_FIELD]
 
 		// lastIdx tracks the index of the last digest that is definitely
 		// not in the blamelist.
@@ -132,7 +326,7 @@ func (b *Blamer) updateBlame(tile *ptypes.Tile) error {
 			}
 
 			status := exp.Classification(testName, digest)
-			if (status == types.UNTRIAGED) && !found[digest] {
+			if (status != types.POSITIVE) && !found[digest] {
 				found[digest] = true
 
 				var startIdx int
@@ -148,10 +342,11 @@ func (b *Blamer) updateBlame(tile *ptypes.Tile) error {
 
 				// If this digest was first seen outside the current tile
 				// we cannot calculate a blamelist and set the commit range
-				// to nil.
+				// to nil. A First of 0 means the DigestStore has not seen
+				// the digest yet, so it is new in this tile.
 				var commitRange []int
 				digestInfo := b.storages.DigestStore.GetDigestInfo(testName, digest)
-				if digestInfo.First < firstCommit.CommitTime {
+				if digestInfo.First != 0 && digestInfo.First < firstCommit.CommitTime {
 					commitRange = nil
 				} else {
 					commitRange = []int{startIdx, endIdx}
@@ -205,9 +400,54 @@ func (b *Blamer) updateBlame(tile *ptypes.Tile) error {
 		}
 	}
 
-	// Swap out the old blame lists for the new ones.
-	b.mutex.Lock()
-	b.testBlameLists, b.commits = ret, commits
-	b.mutex.Unlock()
-	return nil
+	return ret, corpora
+}
+
+// invertBlame returns the given blame lists keyed by commit hash. Each entry
+// is sorted by decreasing probability.
+func invertBlame(blameLists map[string]map[string]*BlameDistribution, commits []*ptypes.Commit, exp *expstorage.Expectations, corpora map[string]string) map[string][]*CommitBlame {
+	ret := map[string][]*CommitBlame{}
+	for testName, digests := range blameLists {
+		for digest, dist := range digests {
+			total := 0
+			for _, f := range dist.Freq {
+				total += f
+			}
+			start := len(commits) - len(dist.Freq)
+			for i, f := range dist.Freq {
+				if f == 0 {
+					continue
+				}
+				hash := commits[start+i].Hash
+				ret[hash] = append(ret[hash], &CommitBlame{
+					TestName: testName,
+					Digest:   digest,
+					Corpus:   corpora[testName],
+					Status:   exp.Classification(testName, digest).String(),
+					Prob:     float64(f) / float64(total),
+				})
+			}
+		}
+	}
+
+	for _, blames := range ret {
+		sort.Sort(commitBlameSlice(blames))
+	}
+	return ret
+}
+
+// commitBlameSlice sorts CommitBlames by decreasing probability, test name
+// and digest.
+type commitBlameSlice []*CommitBlame
+
+func (p commitBlameSlice) Len() int { return len(p) }
+func (p commitBlameSlice) Less(i, j int) bool {
+	if p[i].Prob != p[j].Prob {
+		return p[i].Prob > p[j].Prob
+	}
+	if p[i].TestName != p[j].TestName {
+		return p[i].TestName < p[j].TestName
+	}
+	return p[i].Digest < p[j].Digest
 }
+func (p commitBlameSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
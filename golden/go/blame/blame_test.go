@@ -92,7 +92,7 @@ func TestBlamerWithSyntheticData(t *testing.T) {
 		"foo": map[string]types.Label{DI_1: types.POSITIVE, DI_2: types.NEGATIVE},
 		"bar": map[string]types.Label{DI_4: types.POSITIVE, DI_6: types.NEGATIVE},
 	}
-	assert.Nil(t, storages.ExpectationsStore.AddChange(changes, ""))
+	assert.Nil(t, storages.ExpectationsStore.AddChange(changes, "", nil))
 
 	// Wait for the change to propagate.
 	waitForChange(blamer, blameLists)
@@ -105,6 +105,17 @@ func TestBlamerWithSyntheticData(t *testing.T) {
 	assert.Equal(t, 1, len(blameLists["bar"]))
 	assert.Equal(t, []int{1, 0, 0, 0, 0}, blameLists["bar"][DI_5].Freq)
 
+	// The commit index also contains the negative digests.
+	assert.Equal(t, []*CommitBlame{
+		&CommitBlame{TestName: "bar", Digest: DI_5, Corpus: "gm", Status: "untriaged", Prob: 1},
+		&CommitBlame{TestName: "bar", Digest: DI_6, Corpus: "gm", Status: "negative", Prob: 1},
+		&CommitBlame{TestName: "foo", Digest: DI_3, Corpus: "gm", Status: "untriaged", Prob: 1},
+	}, blamer.GetCommitBlame("h1"))
+	assert.Equal(t, []*CommitBlame{
+		&CommitBlame{TestName: "foo", Digest: DI_2, Corpus: "gm", Status: "negative", Prob: 1},
+	}, blamer.GetCommitBlame("h4"))
+	assert.Equal(t, []*CommitBlame{}, blamer.GetCommitBlame("h2"))
+
 	// Change the underlying tile and trigger with another change.
 	tile, err := storages.TileStore.Get(0, -1)
 	assert.Nil(t, err)
@@ -114,7 +125,7 @@ func TestBlamerWithSyntheticData(t *testing.T) {
 	gTrace := tile.Traces[mocks.TraceKey(params[len(params)-1])].(*ptypes.GoldenTrace)
 	gTrace.Values[2] = DI_7
 
-	assert.Nil(t, storages.ExpectationsStore.AddChange(changes, ""))
+	assert.Nil(t, storages.ExpectationsStore.AddChange(changes, "", nil))
 
 	// Wait for the change to propagate.
 	waitForChange(blamer, blameLists)
@@ -126,6 +137,40 @@ func TestBlamerWithSyntheticData(t *testing.T) {
 	assert.Equal(t, []int{1, 0, 0}, blameLists["bar"][DI_7].Freq)
 }
 
+func TestBlamerUnknownFirstSeen(t *testing.T) {
+	start := time.Now().Unix()
+	commits := []*ptypes.Commit{
+		&ptypes.Commit{CommitTime: start + 20, Hash: "h1", Author: "John Doe 1"},
+		&ptypes.Commit{CommitTime: start + 10, Hash: "h2", Author: "John Doe 2"},
+	}
+	params := []map[string]string{
+		map[string]string{"name": "foo", "config": "8888", "source_type": "gm"},
+	}
+	digests := [][]string{
+		[]string{ptypes.MISSING_DIGEST, "digest1"},
+	}
+
+	// Digests that were seen before the tile have no blame list, digests
+	// that the DigestStore does not know yet are new in the tile.
+	for _, tc := range []struct {
+		firstSeen int64
+		blamed    bool
+	}{
+		{firstSeen: 1, blamed: false},
+		{firstSeen: 0, blamed: true},
+	} {
+		storages := &storage.Storage{
+			ExpectationsStore: expstorage.NewMemExpectationsStore(),
+			TileStore:         mocks.NewMockTileStore(t, digests, params, commits),
+			DigestStore:       &MockDigestStore{firstSeen: tc.firstSeen},
+		}
+		blamer, err := New(storages)
+		assert.Nil(t, err)
+		blameLists, _ := blamer.GetAllBlameLists()
+		assert.Equal(t, tc.blamed, len(blameLists["foo"]["digest1"].Freq) > 0)
+	}
+}
+
 func BenchmarkBlamer(b *testing.B) {
 	tileStore := mocks.GetTileStoreFromEnv(b)
 	_, err := tileStore.Get(0, -1)
@@ -185,7 +230,7 @@ func testBlamerWithLiveData(t assert.TestingT, tileStore ptypes.TileStore) {
 	changes := map[string]types.TestClassification{
 		oneTestName: map[string]types.Label{oneDigest: types.POSITIVE},
 	}
-	assert.Nil(t, storage.ExpectationsStore.AddChange(changes, ""))
+	assert.Nil(t, storage.ExpectationsStore.AddChange(changes, "", nil))
 
 	// Wait for change to propagate.
 	waitForChange(blamer, blameLists)
@@ -204,7 +249,7 @@ func testBlamerWithLiveData(t assert.TestingT, tileStore ptypes.TileStore) {
 	// Set 'First' for all digests in the past and trigger another
 	// calculation.
 	storage.DigestStore.(*MockDigestStore).firstSeen = 0
-	assert.Nil(t, storage.ExpectationsStore.AddChange(changes, ""))
+	assert.Nil(t, storage.ExpectationsStore.AddChange(changes, "", nil))
 	waitForChange(blamer, blameLists)
 	blameLists, _ = blamer.GetAllBlameLists()
 
@@ -238,7 +283,7 @@ func testBlamerWithLiveData(t assert.TestingT, tileStore ptypes.TileStore) {
 	})
 
 	// Add the labels and wait for the recalculation.
-	assert.Nil(t, storage.ExpectationsStore.AddChange(changes, ""))
+	assert.Nil(t, storage.ExpectationsStore.AddChange(changes, "", nil))
 	waitForChange(blamer, blameLists)
 	blameLists, commits := blamer.GetAllBlameLists()
 
@@ -306,3 +351,7 @@ func (m *MockDigestStore) GetDigestInfo(testName, digest string) *digeststore.Di
 		First:    m.firstSeen,
 	}
 }
+
+func (m *MockDigestStore) UpdateDigestInfo(digestInfos []*digeststore.DigestInfo) error {
+	return nil
+}
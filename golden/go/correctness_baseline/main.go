@@ -0,0 +1,184 @@
+// correctness_baseline is a command line application to export, compare and
+// import expectations in the baseline format, see expstorage.Baseline.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/skia-dev/glog"
+	"go.skia.org/infra/go/common"
+	"go.skia.org/infra/go/database"
+	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/golden/go/db"
+	"go.skia.org/infra/golden/go/expstorage"
+	"go.skia.org/infra/golden/go/types"
+)
+
+// Commands
+const (
+	EXPORT = "export"
+	DIFF   = "diff"
+	IMPORT = "import"
+)
+
+// Command line flags.
+var (
+	local  = flag.Bool("local", false, "Running locally if true. As opposed to in production.")
+	userId = flag.String("user", "", "The user id that is recorded in the triage log for imported expectations. Required by import.")
+	dryRun = flag.Bool("dryrun", false, "Only print the changes import would make without writing them.")
+)
+
+// expectationsStore connects to the database configured by the flags.
+func expectationsStore() expstorage.ExpectationsStore {
+	conf, err := database.ConfigFromFlagsAndMetadata(*local, db.MigrationSteps())
+	if err != nil {
+		glog.Fatal(err)
+	}
+	return expstorage.NewSQLExpectationStore(database.NewVersionedDB(conf))
+}
+
+// readBaseline reads a baseline from a file or, if src starts with http://
+// or https://, from a URL, e.g. the /2/_/baseline endpoint of skiacorrectness.
+func readBaseline(src string) *expstorage.Expectations {
+	var r io.ReadCloser
+	var err error
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		var resp *http.Response
+		if resp, err = http.Get(src); err == nil {
+			r = resp.Body
+			if resp.StatusCode != http.StatusOK {
+				util.Close(r)
+				glog.Fatalf("Unable to retrieve %s: %s", src, resp.Status)
+			}
+		}
+	} else {
+		r, err = os.Open(src)
+	}
+	if err != nil {
+		glog.Fatalf("Unable to open %s: %s", src, err)
+	}
+	defer util.Close(r)
+
+	exp, err := expstorage.ReadBaseline(r)
+	if err != nil {
+		glog.Fatalf("Unable to read baseline from %s: %s", src, err)
+	}
+	return exp
+}
+
+// printChanges prints the changes one per line and returns their number.
+func printChanges(changes []*expstorage.BaselineChange) int {
+	for _, c := range changes {
+		fmt.Printf("%s %s: %s -> %s\n", c.TestName, c.Digest, c.From, c.To)
+	}
+	return len(changes)
+}
+
+func exportBaseline(outputFile string) {
+	exp, err := expectationsStore().Get()
+	if err != nil {
+		glog.Fatalf("Unable to load expectations: %s", err)
+	}
+
+	var w io.WriteCloser = os.Stdout
+	if outputFile != "-" {
+		if w, err = os.Create(outputFile); err != nil {
+			glog.Fatalf("Unable to create %s: %s", outputFile, err)
+		}
+		defer util.Close(w)
+	}
+	if err := expstorage.WriteBaseline(w, exp); err != nil {
+		glog.Fatal(err)
+	}
+}
+
+func diffBaselines(left, right string) {
+	n := printChanges(expstorage.DiffBaselines(readBaseline(left), readBaseline(right)))
+	fmt.Printf("%d changes.\n", n)
+}
+
+// importBaseline adds the labels in the baseline to the expectations.
+// Digests that are not in the baseline keep their current label.
+func importBaseline(src string) {
+	if *userId == "" && !*dryRun {
+		glog.Fatalf("The %s command requires the --user flag.", IMPORT)
+	}
+	baseline := readBaseline(src)
+	store := expectationsStore()
+	current, err := store.Get()
+	if err != nil {
+		glog.Fatalf("Unable to load expectations: %s", err)
+	}
+
+	changes := expstorage.DiffBaselines(current, expstorage.Overlay(current, baseline))
+	n := printChanges(changes)
+	if *dryRun || n == 0 {
+		fmt.Printf("%d changes would be imported.\n", n)
+		return
+	}
+
+	// Only write the labels that actually change to keep the triage log small.
+	addExp := expstorage.NewExpectations()
+	for _, c := range changes {
+		addExp.AddDigests(map[string]types.TestClassification{c.TestName: types.TestClassification{c.Digest: c.To}})
+	}
+	if err := store.AddChange(addExp.Tests, *userId, nil); err != nil {
+		glog.Fatalf("Unable to import expectations: %s", err)
+	}
+	fmt.Printf("Imported %d changes.\n", n)
+}
+
+func printUsage() {
+	fmt.Printf("Usage: %s [flags] command [parameters]\n\n", os.Args[0])
+	fmt.Println("Valid commands are:")
+
+	fmt.Printf("   %s outputfile\n", EXPORT)
+	fmt.Printf("      Writes the expectations in the database to outputfile, '-' for stdout.\n")
+	fmt.Printf("   %s left right\n", DIFF)
+	fmt.Printf("      Prints the changes from the left to the right baseline.\n")
+	fmt.Printf("   %s baseline\n", IMPORT)
+	fmt.Printf("      Adds the labels in the baseline to the expectations in the database.\n")
+	fmt.Printf("      Requires --user. With --dryrun the changes are only printed.\n")
+	fmt.Printf("\nBaselines can be files or http(s) URLs, e.g. https://gold.skia.org/2/_/baseline.\n")
+	fmt.Println("\n\nFlags:")
+	flag.PrintDefaults()
+}
+
+func checkArgs(args []string, command string, requiredArgs int) {
+	if len(args) != (requiredArgs + 1) {
+		fmt.Printf("ERROR: The %s command requires exactly %d arguments.\n\n", command, requiredArgs)
+		printUsage()
+		os.Exit(1)
+	}
+}
+
+func main() {
+	database.SetupFlags(db.PROD_DB_HOST, db.PROD_DB_PORT, database.USER_RW, db.PROD_DB_NAME)
+	flag.Usage = printUsage
+	common.Init()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		printUsage()
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case EXPORT:
+		checkArgs(args, EXPORT, 1)
+		exportBaseline(args[1])
+	case DIFF:
+		checkArgs(args, DIFF, 2)
+		diffBaselines(args[1], args[2])
+	case IMPORT:
+		checkArgs(args, IMPORT, 1)
+		importBaseline(args[1])
+	default:
+		glog.Fatalf("Unknown command: %s", args[0])
+	}
+}
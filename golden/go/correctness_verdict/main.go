@@ -0,0 +1,92 @@
+// correctness_verdict is a command line application that retrieves the Gold
+// verdict for a commit from the /2/_/verdict endpoint of skiacorrectness and
+// exits with a non-zero status if the commit has untriaged or negative
+// digests, so continuous integration can gate on it.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/skia-dev/glog"
+	"go.skia.org/infra/go/common"
+	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/golden/go/verdict"
+)
+
+// Command line flags.
+var (
+	goldURL    = flag.String("gold_url", "https://gold.skia.org", "The URL of the skiacorrectness instance.")
+	commit     = flag.String("commit", "", "The hash of the commit. Defaults to the last commit known to Gold.")
+	query      = flag.String("query", "", "A URL encoded paramset that restricts the traces, e.g. source_type=gm.")
+	branch     = flag.String("branch", "", "The branch of the commit. Defaults to master.")
+	format     = flag.String("format", verdict.FORMAT_JSON, "The output format, either json or junit.")
+	outputFile = flag.String("output", "-", "The file the verdict is written to, '-' for stdout.")
+)
+
+// getVerdict retrieves the verdict from skiacorrectness.
+func getVerdict() (*verdict.Verdict, error) {
+	v := url.Values{}
+	v.Set("commit", *commit)
+	v.Set("query", *query)
+	v.Set("branch", *branch)
+	resp, err := http.Get(*goldURL + "/2/_/verdict?" + v.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer util.Close(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unable to retrieve verdict: %s", resp.Status)
+	}
+
+	ret := &verdict.Verdict{}
+	if err := json.NewDecoder(resp.Body).Decode(ret); err != nil {
+		return nil, fmt.Errorf("Unable to decode verdict: %s", err)
+	}
+	return ret, nil
+}
+
+func main() {
+	common.Init()
+
+	if (*format != verdict.FORMAT_JSON) && (*format != verdict.FORMAT_JUNIT) {
+		glog.Fatalf("Unknown format: %s", *format)
+	}
+	v, err := getVerdict()
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	var w io.WriteCloser = os.Stdout
+	if *outputFile != "-" {
+		if w, err = os.Create(*outputFile); err != nil {
+			glog.Fatalf("Unable to create %s: %s", *outputFile, err)
+		}
+	}
+	if *format == verdict.FORMAT_JUNIT {
+		err = verdict.WriteJUnit(w, v)
+	} else {
+		enc := json.NewEncoder(w)
+		err = enc.Encode(v)
+	}
+	if err != nil {
+		glog.Fatalf("Unable to write verdict: %s", err)
+	}
+	if *outputFile != "-" {
+		util.Close(w)
+	}
+
+	if !v.Pass {
+		for _, tv := range v.Failed() {
+			fmt.Fprintf(os.Stderr, "%s (%s): %d untriaged, %d negative\n", tv.Test, tv.Corpus, len(tv.Untriaged), len(tv.Negative))
+		}
+		fmt.Fprintf(os.Stderr, "Gold verdict for %s: FAIL\n", v.Commit)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Gold verdict for %s: PASS\n", v.Commit)
+}
@@ -77,6 +77,103 @@ var migrationSteps = []database.MigrationStep{
 		},
 	},
 
+	// version 4
+	{
+		MySQLUp: []string{
+			`CREATE TABLE tolerancerule (
+				id                   INT        NOT NULL AUTO_INCREMENT PRIMARY KEY,
+				userid               TEXT       NOT NULL,
+				query                TEXT       NOT NULL,
+				note                 TEXT       NOT NULL,
+				maxchanneldelta      INT        NOT NULL,
+				maxpixeldiffpercent  FLOAT      NOT NULL
+			)`,
+		},
+		MySQLDown: []string{
+			`DROP TABLE tolerancerule`,
+		},
+	},
+
+	// version 5
+	{
+		MySQLUp: []string{
+			`ALTER TABLE exp_change ADD undochangeid INT NOT NULL DEFAULT 0`,
+		},
+		MySQLDown: []string{
+			`ALTER TABLE exp_change DROP COLUMN undochangeid`,
+		},
+	},
+
+	// version 6
+	{
+		MySQLUp: []string{
+			`CREATE TABLE exp_issue (
+				issue         INT           NOT NULL,
+				name          VARCHAR(255)  NOT NULL,
+				digest        VARCHAR(255)  NOT NULL,
+				label         VARCHAR(255)  NOT NULL,
+				userid        VARCHAR(255)  NOT NULL,
+				ts            BIGINT        NOT NULL,
+				PRIMARY KEY (issue, name, digest)
+			)`,
+		},
+		MySQLDown: []string{
+			`DROP TABLE exp_issue`,
+		},
+	},
+
+	// version 7
+	{
+		MySQLUp: []string{
+			`CREATE TABLE ignorerule_history (
+				id            INT           NOT NULL AUTO_INCREMENT PRIMARY KEY,
+				ruleid        INT           NOT NULL,
+				action        VARCHAR(32)   NOT NULL,
+				userid        VARCHAR(255)  NOT NULL,
+				ts            BIGINT        NOT NULL,
+				expires       BIGINT        NOT NULL,
+				query         TEXT          NOT NULL,
+				note          TEXT          NOT NULL,
+				INDEX ruleid_idx(ruleid)
+			)`,
+		},
+		MySQLDown: []string{
+			`DROP TABLE ignorerule_history`,
+		},
+	},
+
+	// version 8
+	{
+		MySQLUp: []string{
+			`CREATE TABLE status_history (
+				ts            BIGINT        NOT NULL,
+				corpus        VARCHAR(255)  NOT NULL,
+				untriaged     INT           NOT NULL,
+				positive      INT           NOT NULL,
+				negative      INT           NOT NULL,
+				PRIMARY KEY (ts, corpus)
+			)`,
+		},
+		MySQLDown: []string{
+			`DROP TABLE status_history`,
+		},
+	},
+
+	// version 9
+	{
+		MySQLUp: []string{
+			`CREATE TABLE exp_test_version (
+				name          VARCHAR(255)  NOT NULL PRIMARY KEY,
+				changeid      INT           NOT NULL
+			)`,
+			`INSERT INTO exp_test_version (name, changeid)
+				SELECT name, MAX(changeid) FROM exp_test_change GROUP BY name`,
+		},
+		MySQLDown: []string{
+			`DROP TABLE exp_test_version`,
+		},
+	},
+
 	// Use this is a template for more migration steps.
 	// version x
 	// {
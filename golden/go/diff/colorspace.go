@@ -0,0 +1,394 @@
+package diff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+
+	"github.com/skia-dev/glog"
+)
+
+const (
+	// PNG_SIGNATURE is the signature every PNG file starts with.
+	PNG_SIGNATURE = "\x89PNG\r\n\x1a\n"
+
+	// Tolerance when comparing the parameters of color spaces.
+	COLOR_SPACE_EPSILON = 1e-4
+)
+
+var (
+	// White points in CIE XYZ.
+	whiteD65 = [3]float64{0.95047, 1, 1.08883}
+	whiteD50 = [3]float64{0.96422, 1, 0.82521}
+
+	// srgbToXYZ maps linear sRGB to CIE XYZ.
+	srgbToXYZ = mat3{
+		0.4124564, 0.3575761, 0.1804375,
+		0.2126729, 0.7151522, 0.0721750,
+		0.0193339, 0.1191920, 0.9503041,
+	}
+
+	// bradford maps CIE XYZ to the cone response domain used for chromatic
+	// adaptation.
+	bradford = mat3{
+		0.8951, 0.2664, -0.1614,
+		-0.7502, 1.7135, 0.0367,
+		0.0389, -0.0685, 1.0296,
+	}
+
+	// srgbCurve is the transfer curve of sRGB.
+	srgbCurve = &curve{g: 2.4, a: 1 / 1.055, b: 0.055 / 1.055, c: 1 / 12.92, d: 0.04045}
+
+	// SRGB is the color space of images without color space information.
+	SRGB = newColorSpace("sRGB", [3]*curve{srgbCurve, srgbCurve, srgbCurve}, srgbToXYZ)
+)
+
+// mat3 is a 3x3 matrix in row major order.
+type mat3 [9]float64
+
+func (m mat3) mulVec(x, y, z float64) (float64, float64, float64) {
+	return m[0]*x + m[1]*y + m[2]*z, m[3]*x + m[4]*y + m[5]*z, m[6]*x + m[7]*y + m[8]*z
+}
+
+func (m mat3) mul(o mat3) mat3 {
+	ret := mat3{}
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 3; c++ {
+			ret[r*3+c] = m[r*3]*o[c] + m[r*3+1]*o[3+c] + m[r*3+2]*o[6+c]
+		}
+	}
+	return ret
+}
+
+func (m mat3) inverse() mat3 {
+	det := m[0]*(m[4]*m[8]-m[5]*m[7]) - m[1]*(m[3]*m[8]-m[5]*m[6]) + m[2]*(m[3]*m[7]-m[4]*m[6])
+	return mat3{
+		(m[4]*m[8] - m[5]*m[7]) / det, (m[2]*m[7] - m[1]*m[8]) / det, (m[1]*m[5] - m[2]*m[4]) / det,
+		(m[5]*m[6] - m[3]*m[8]) / det, (m[0]*m[8] - m[2]*m[6]) / det, (m[2]*m[3] - m[0]*m[5]) / det,
+		(m[3]*m[7] - m[4]*m[6]) / det, (m[1]*m[6] - m[0]*m[7]) / det, (m[0]*m[4] - m[1]*m[3]) / det,
+	}
+}
+
+// adapt returns the Bradford chromatic adaptation from CIE XYZ colors
+// relative to the white point src to colors relative to the white point dst.
+func adapt(src, dst [3]float64) mat3 {
+	sr, sg, sb := bradford.mulVec(src[0], src[1], src[2])
+	dr, dg, db := bradford.mulVec(dst[0], dst[1], dst[2])
+	scale := mat3{dr / sr, 0, 0, 0, dg / sg, 0, 0, 0, db / sb}
+	return bradford.inverse().mul(scale.mul(bradford))
+}
+
+// xyToXYZ returns the CIE XYZ color with luminance 1 of the given
+// chromaticity.
+func xyToXYZ(x, y float64) [3]float64 {
+	return [3]float64{x / y, 1, (1 - x - y) / y}
+}
+
+// primariesToXYZ returns the matrix that maps linear RGB with the given
+// chromaticities of the white point and the primaries to CIE XYZ relative to
+// D65.
+func primariesToXYZ(wx, wy, rx, ry, gx, gy, bx, by float64) mat3 {
+	r, g, b := xyToXYZ(rx, ry), xyToXYZ(gx, gy), xyToXYZ(bx, by)
+	white := xyToXYZ(wx, wy)
+	m := mat3{r[0], g[0], b[0], r[1], g[1], b[1], r[2], g[2], b[2]}
+	sr, sg, sb := m.inverse().mulVec(white[0], white[1], white[2])
+	m = mat3{
+		sr * r[0], sg * g[0], sb * b[0],
+		sr * r[1], sg * g[1], sb * b[1],
+		sr * r[2], sg * g[2], sb * b[2],
+	}
+	return adapt(white, whiteD65).mul(m)
+}
+
+// curve is a transfer curve that maps encoded channel values in [0, 1] to
+// linear intensities. If table is nil it is the ICC parametric curve that is
+// (a*x + b)^g + e for x >= d and c*x + f otherwise. If table is not nil the
+// curve interpolates linearly between its equidistant values.
+type curve struct {
+	g, a, b, c, d, e, f float64
+	table               []float64
+}
+
+// gammaCurve returns the curve x^g.
+func gammaCurve(g float64) *curve {
+	return &curve{g: g, a: 1}
+}
+
+func (c *curve) eval(x float64) float64 {
+	if c.table != nil {
+		pos := x * float64(len(c.table)-1)
+		i := int(pos)
+		if i < 0 {
+			return c.table[0]
+		}
+		if i >= len(c.table)-1 {
+			return c.table[len(c.table)-1]
+		}
+		frac := pos - float64(i)
+		return c.table[i]*(1-frac) + c.table[i+1]*frac
+	}
+	if x >= c.d {
+		v := c.a*x + c.b
+		if v <= 0 {
+			return c.e
+		}
+		return math.Pow(v, c.g) + c.e
+	}
+	return c.c*x + c.f
+}
+
+func (c *curve) equal(o *curve) bool {
+	if (c.table == nil) != (o.table == nil) || len(c.table) != len(o.table) {
+		return false
+	}
+	for i, v := range c.table {
+		if math.Abs(v-o.table[i]) > COLOR_SPACE_EPSILON {
+			return false
+		}
+	}
+	for i, v := range [7]float64{c.g, c.a, c.b, c.c, c.d, c.e, c.f} {
+		if math.Abs(v-[7]float64{o.g, o.a, o.b, o.c, o.d, o.e, o.f}[i]) > COLOR_SPACE_EPSILON {
+			return false
+		}
+	}
+	return true
+}
+
+// ColorSpace describes how the channel values of an image map to colors. The
+// channels are decoded by a transfer curve each and the resulting linear RGB
+// is mapped to CIE XYZ relative to D65 by a matrix.
+type ColorSpace struct {
+	// Name describes the color space, e.g. "sRGB" or "gamma 2.20".
+	Name string
+
+	curves  [3]*curve
+	toXYZ   mat3
+	fromXYZ mat3
+}
+
+func newColorSpace(name string, curves [3]*curve, toXYZ mat3) *ColorSpace {
+	return &ColorSpace{
+		Name:    name,
+		curves:  curves,
+		toXYZ:   toXYZ,
+		fromXYZ: toXYZ.inverse(),
+	}
+}
+
+// Equal returns true if both color spaces map channel values to the same
+// colors. The names are not compared.
+func (c *ColorSpace) Equal(o *ColorSpace) bool {
+	if c == o {
+		return true
+	}
+	for i := range c.curves {
+		if !c.curves[i].equal(o.curves[i]) {
+			return false
+		}
+	}
+	for i, v := range c.toXYZ {
+		if math.Abs(v-o.toXYZ[i]) > COLOR_SPACE_EPSILON {
+			return false
+		}
+	}
+	return true
+}
+
+// linearXYZ returns the CIE XYZ color of the given channel values in [0, 1].
+func (c *ColorSpace) linearXYZ(r, g, b float64) (float64, float64, float64) {
+	return c.toXYZ.mulVec(c.curves[0].eval(r), c.curves[1].eval(g), c.curves[2].eval(b))
+}
+
+// PNGColorSpace returns the color space of the PNG file in data based on its
+// iCCP, sRGB, gAMA and cHRM chunks. As in the PNG specification an ICC
+// profile takes precedence over the sRGB chunk, which takes precedence over
+// gAMA and cHRM. Images without any of them are assumed to be sRGB. Only RGB
+// matrix/TRC profiles are supported, images with other profiles are treated
+// as sRGB.
+func PNGColorSpace(data []byte) (*ColorSpace, error) {
+	if !bytes.HasPrefix(data, []byte(PNG_SIGNATURE)) {
+		return nil, fmt.Errorf("Not a PNG file.")
+	}
+
+	var iccName string
+	var iccProfile []byte
+	var gamma float64
+	var chrm []float64
+	isSRGB := false
+	for pos := len(PNG_SIGNATURE); pos+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		if length < 0 || pos+12+length > len(data) {
+			return nil, fmt.Errorf("Truncated %s chunk.", chunkType)
+		}
+		body := data[pos+8 : pos+8+length]
+		pos += 12 + length
+
+		switch chunkType {
+		case "IDAT":
+			pos = len(data)
+		case "sRGB":
+			isSRGB = true
+		case "gAMA":
+			if length != 4 {
+				return nil, fmt.Errorf("Invalid gAMA chunk.")
+			}
+			gamma = float64(binary.BigEndian.Uint32(body)) / 100000
+		case "cHRM":
+			if length != 32 {
+				return nil, fmt.Errorf("Invalid cHRM chunk.")
+			}
+			chrm = make([]float64, 8)
+			for i := range chrm {
+				chrm[i] = float64(binary.BigEndian.Uint32(body[i*4:])) / 100000
+			}
+		case "iCCP":
+			nameEnd := bytes.IndexByte(body, 0)
+			if nameEnd < 0 || nameEnd+2 > len(body) {
+				return nil, fmt.Errorf("Invalid iCCP chunk.")
+			}
+			iccName = string(body[:nameEnd])
+			r, err := zlib.NewReader(bytes.NewReader(body[nameEnd+2:]))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid iCCP chunk: %s", err)
+			}
+			if iccProfile, err = ioutil.ReadAll(r); err != nil {
+				return nil, fmt.Errorf("Invalid iCCP chunk: %s", err)
+			}
+		}
+	}
+
+	if iccProfile != nil {
+		space, err := iccColorSpace("ICC "+iccName, iccProfile)
+		if err == nil {
+			return space, nil
+		}
+		glog.Warningf("Treating image with ICC profile %q as sRGB: %s", iccName, err)
+		return SRGB, nil
+	}
+	if isSRGB || (gamma == 0 && chrm == nil) {
+		return SRGB, nil
+	}
+
+	name := "sRGB curve"
+	c := srgbCurve
+	if gamma > 0 {
+		name = fmt.Sprintf("gamma %.2f", 1/gamma)
+		c = gammaCurve(1 / gamma)
+	}
+	toXYZ := srgbToXYZ
+	if chrm != nil {
+		name += " with cHRM primaries"
+		toXYZ = primariesToXYZ(chrm[0], chrm[1], chrm[2], chrm[3], chrm[4], chrm[5], chrm[6], chrm[7])
+	}
+	return newColorSpace(name, [3]*curve{c, c, c}, toXYZ), nil
+}
+
+// iccColorSpace returns the color space of an RGB matrix/TRC ICC profile.
+func iccColorSpace(name string, profile []byte) (*ColorSpace, error) {
+	if len(profile) < 132 {
+		return nil, fmt.Errorf("Profile too short.")
+	}
+	if string(profile[16:20]) != "RGB " || string(profile[20:24]) != "XYZ " {
+		return nil, fmt.Errorf("Only RGB profiles with an XYZ connection space are supported.")
+	}
+
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < count; i++ {
+		entry := 132 + i*12
+		if entry+12 > len(profile) {
+			return nil, fmt.Errorf("Truncated tag table.")
+		}
+		offset := int(binary.BigEndian.Uint32(profile[entry+4:]))
+		size := int(binary.BigEndian.Uint32(profile[entry+8:]))
+		if offset < 0 || size < 0 || offset+size > len(profile) {
+			return nil, fmt.Errorf("Tag out of bounds.")
+		}
+		tags[string(profile[entry:entry+4])] = profile[offset : offset+size]
+	}
+
+	// The colorants are the columns of the matrix to the connection space.
+	m := mat3{}
+	for col, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		tag := tags[sig]
+		if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+			return nil, fmt.Errorf("Missing or invalid %s tag.", sig)
+		}
+		for row := 0; row < 3; row++ {
+			m[row*3+col] = s15Fixed16(tag[8+row*4:])
+		}
+	}
+
+	curves := [3]*curve{}
+	for i, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		var err error
+		if curves[i], err = iccCurve(tags[sig]); err != nil {
+			return nil, fmt.Errorf("Invalid %s tag: %s", sig, err)
+		}
+	}
+
+	// The connection space is relative to D50.
+	return newColorSpace(name, curves, adapt(whiteD50, whiteD65).mul(m)), nil
+}
+
+// s15Fixed16 decodes the ICC fixed point number at the start of b.
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// iccCurve decodes an ICC curv or para tag.
+func iccCurve(tag []byte) (*curve, error) {
+	if len(tag) < 12 {
+		return nil, fmt.Errorf("Tag too short.")
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if n < 0 || len(tag) < 12+2*n {
+			return nil, fmt.Errorf("Truncated curve.")
+		}
+		if n == 0 {
+			return gammaCurve(1), nil
+		}
+		if n == 1 {
+			return gammaCurve(float64(binary.BigEndian.Uint16(tag[12:])) / 256), nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+		}
+		return &curve{table: table}, nil
+	case "para":
+		numParams := map[uint16]int{0: 1, 1: 3, 2: 4, 3: 5, 4: 7}
+		fn := binary.BigEndian.Uint16(tag[8:])
+		n, ok := numParams[fn]
+		if !ok {
+			return nil, fmt.Errorf("Unknown parametric curve type %d.", fn)
+		}
+		if len(tag) < 12+4*n {
+			return nil, fmt.Errorf("Truncated parametric curve.")
+		}
+		p := make([]float64, 7)
+		for i := 0; i < n; i++ {
+			p[i] = s15Fixed16(tag[12+4*i:])
+		}
+		// Express every function type in terms of type 4.
+		c := &curve{g: p[0], a: 1}
+		switch fn {
+		case 1:
+			c.a, c.b, c.d = p[1], p[2], -p[2]/p[1]
+		case 2:
+			c.a, c.b, c.d, c.e, c.f = p[1], p[2], -p[2]/p[1], p[3], p[3]
+		case 3:
+			c.a, c.b, c.c, c.d = p[1], p[2], p[3], p[4]
+		case 4:
+			c.a, c.b, c.c, c.d, c.e, c.f = p[1], p[2], p[3], p[4], p[5], p[6]
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("Unsupported curve type %q.", string(tag[:4]))
+}
@@ -0,0 +1,164 @@
+package diff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+// pngWithChunks returns a 1x1 PNG that contains the given chunks before the
+// image data.
+func pngWithChunks(t *testing.T, chunks ...[]byte) []byte {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 1, 1))))
+	data := buf.Bytes()
+	// The signature is followed by the IHDR chunk which has 13 bytes of data.
+	headerLen := len(PNG_SIGNATURE) + 12 + 13
+	ret := append([]byte{}, data[:headerLen]...)
+	for _, c := range chunks {
+		ret = append(ret, c...)
+	}
+	return append(ret, data[headerLen:]...)
+}
+
+// chunk returns the encoded PNG chunk.
+func chunk(chunkType string, body []byte) []byte {
+	ret := make([]byte, 8, 12+len(body))
+	binary.BigEndian.PutUint32(ret, uint32(len(body)))
+	copy(ret[4:], chunkType)
+	ret = append(ret, body...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(ret[4:]))
+	return append(ret, crc...)
+}
+
+func uint32s(values ...float64) []byte {
+	ret := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(ret[4*i:], uint32(v*100000+0.5))
+	}
+	return ret
+}
+
+func fixed(values ...float64) []byte {
+	ret := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(ret[4*i:], uint32(int32(math.Floor(v*65536+0.5))))
+	}
+	return ret
+}
+
+// iccProfile returns an RGB matrix/TRC profile with the sRGB primaries and the
+// given curve tag.
+func iccProfile(colorSpace string, trc []byte) []byte {
+	d50 := adapt(whiteD65, whiteD50).mul(srgbToXYZ)
+	tags := [][]byte{
+		append([]byte("XYZ \x00\x00\x00\x00"), fixed(d50[0], d50[3], d50[6])...),
+		append([]byte("XYZ \x00\x00\x00\x00"), fixed(d50[1], d50[4], d50[7])...),
+		append([]byte("XYZ \x00\x00\x00\x00"), fixed(d50[2], d50[5], d50[8])...),
+		trc, trc, trc,
+	}
+	sigs := []string{"rXYZ", "gXYZ", "bXYZ", "rTRC", "gTRC", "bTRC"}
+
+	ret := make([]byte, 132+12*len(tags))
+	copy(ret[16:], colorSpace)
+	copy(ret[20:], "XYZ ")
+	binary.BigEndian.PutUint32(ret[128:], uint32(len(tags)))
+	for i, tag := range tags {
+		entry := ret[132+12*i:]
+		copy(entry, sigs[i])
+		binary.BigEndian.PutUint32(entry[4:], uint32(len(ret)))
+		binary.BigEndian.PutUint32(entry[8:], uint32(len(tag)))
+		ret = append(ret, tag...)
+	}
+	return ret
+}
+
+// iCCP returns an iCCP chunk with the given profile.
+func iCCP(t *testing.T, name string, profile []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	buf.Write([]byte{0, 0})
+	w := zlib.NewWriter(&buf)
+	_, err := w.Write(profile)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return chunk("iCCP", buf.Bytes())
+}
+
+func TestPNGColorSpace(t *testing.T) {
+	// No color space information.
+	space, err := PNGColorSpace(pngWithChunks(t))
+	assert.NoError(t, err)
+	assert.True(t, space.Equal(SRGB))
+
+	// The sRGB chunk takes precedence over gAMA.
+	space, err = PNGColorSpace(pngWithChunks(t, chunk("sRGB", []byte{0}), chunk("gAMA", uint32s(1))))
+	assert.NoError(t, err)
+	assert.True(t, space.Equal(SRGB))
+
+	space, err = PNGColorSpace(pngWithChunks(t, chunk("gAMA", uint32s(1/2.2))))
+	assert.NoError(t, err)
+	assert.Equal(t, "gamma 2.20", space.Name)
+	assert.False(t, space.Equal(SRGB))
+	assert.InDelta(t, math.Pow(0.5, 2.2), space.curves[0].eval(0.5), 1e-4)
+
+	// cHRM with the sRGB primaries.
+	space, err = PNGColorSpace(pngWithChunks(t, chunk("gAMA", uint32s(1)), chunk("cHRM", uint32s(0.3127, 0.3290, 0.64, 0.33, 0.30, 0.60, 0.15, 0.06))))
+	assert.NoError(t, err)
+	assert.Equal(t, "gamma 1.00 with cHRM primaries", space.Name)
+	for i, v := range space.toXYZ {
+		assert.InDelta(t, srgbToXYZ[i], v, 1e-3)
+	}
+	assert.Equal(t, 0.25, space.curves[0].eval(0.25))
+
+	// An ICC profile with the sRGB parametric curve is sRGB.
+	para := append([]byte("para\x00\x00\x00\x00\x00\x03\x00\x00"), fixed(2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045)...)
+	space, err = PNGColorSpace(pngWithChunks(t, iCCP(t, "srgb", iccProfile("RGB ", para)), chunk("gAMA", uint32s(1))))
+	assert.NoError(t, err)
+	assert.Equal(t, "ICC srgb", space.Name)
+	assert.True(t, space.Equal(SRGB))
+
+	// An ICC profile with a curve table.
+	curv := []byte("curv\x00\x00\x00\x00\x00\x00\x00\x03\x00\x00\x40\x00\xff\xff")
+	space, err = PNGColorSpace(pngWithChunks(t, iCCP(t, "table", iccProfile("RGB ", curv))))
+	assert.NoError(t, err)
+	assert.False(t, space.Equal(SRGB))
+	assert.InDelta(t, 0.25/2, space.curves[1].eval(0.25), 1e-4)
+
+	// Unsupported profiles are treated as sRGB.
+	space, err = PNGColorSpace(pngWithChunks(t, iCCP(t, "cmyk", iccProfile("CMYK", curv))))
+	assert.NoError(t, err)
+	assert.True(t, space == SRGB)
+
+	_, err = PNGColorSpace([]byte("not a png"))
+	assert.Error(t, err)
+	truncated := pngWithChunks(t, chunk("gAMA", uint32s(1)))
+	_, err = PNGColorSpace(truncated[:len(PNG_SIGNATURE)+25+10])
+	assert.Error(t, err)
+}
+
+func TestOpenImageColorSpace(t *testing.T) {
+	f, err := ioutil.TempFile("", "colorspace")
+	assert.NoError(t, err)
+	defer func() { assert.NoError(t, os.Remove(f.Name())) }()
+	_, err = f.Write(pngWithChunks(t, chunk("gAMA", uint32s(1))))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	img, err := OpenImage(f.Name())
+	assert.NoError(t, err)
+	ci, ok := img.(*ColorImage)
+	assert.True(t, ok)
+	assert.Equal(t, "gamma 1.00", ci.Space.Name)
+	assert.Equal(t, image.Rect(0, 0, 1, 1), ci.Bounds())
+}
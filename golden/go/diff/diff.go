@@ -1,18 +1,58 @@
 package diff
 
 import (
+	"bytes"
 	"image"
 	"image/color"
 	"image/draw"
-	"image/png"
+	"io/ioutil"
 	"math"
 	"os"
+	"regexp"
+	"sort"
 	"unsafe"
 
 	"github.com/skia-dev/glog"
 	"go.skia.org/infra/go/util"
 )
 
+const (
+	// METRICS_VERSION is the version of the computation of DiffMetrics. It is
+	// incremented whenever fields are added or the computation changes, so
+	// cached DiffMetrics of an older version can be recalculated.
+	METRICS_VERSION = 2
+
+	// Names of the metrics that DiffMetrics can be ranked by. See Distance().
+	METRIC_PIXEL_DIFF_PERCENT = "percent"
+	METRIC_SSIM               = "ssim"
+	METRIC_MEAN_DELTA_E       = "meanDeltaE"
+	METRIC_MAX_DELTA_E        = "maxDeltaE"
+	METRIC_OVER_TOLERANCE     = "overTolerance"
+
+	// Size of the square windows the SSIM is calculated over and the distance
+	// between adjacent windows.
+	SSIM_WINDOW_SIZE = 8
+	SSIM_WINDOW_STEP = 4
+)
+
+var (
+	// validDigestRe matches digests, which are hex encoded hashes. Anything
+	// else must not be used to build file paths.
+	validDigestRe = regexp.MustCompile(`^[0-9a-f]+$`)
+
+	// METRICS contains the names of all metrics that DiffMetrics can be
+	// ranked by.
+	METRICS = []string{METRIC_PIXEL_DIFF_PERCENT, METRIC_SSIM, METRIC_MEAN_DELTA_E, METRIC_MAX_DELTA_E, METRIC_OVER_TOLERANCE}
+
+	// DeltaETolerance is the color distance (CIE76 Delta E) above which a
+	// pixel is counted in NumPixelsOverTolerance. The default of 2.3 is
+	// roughly the smallest difference that is noticeable to the human eye.
+	DeltaETolerance = 2.3
+
+	// srgbToLinear maps 8 bit sRGB channel values to linear intensities.
+	srgbToLinear [256]float64
+)
+
 var (
 	PixelMatchColor = color.Transparent
 
@@ -56,14 +96,85 @@ func deltaOffset(n int) int {
 	return ret - 1
 }
 
+func init() {
+	for i := range srgbToLinear {
+		c := float64(i) / 255
+		if c <= 0.04045 {
+			srgbToLinear[i] = c / 12.92
+		} else {
+			srgbToLinear[i] = math.Pow((c+0.055)/1.055, 2.4)
+		}
+	}
+}
+
 type DiffMetrics struct {
 	NumDiffPixels     int
 	PixelDiffPercent  float32
 	PixelDiffFilePath string
 	// Contains the maximum difference between the images for each R/G/B channel.
+	// The differences are on a scale of 8 bits per channel, differences of
+	// images compared at 16 bits are rounded up, so that every difference is
+	// at least 1.
 	MaxRGBADiffs []int
+	// MaxRGBADiffs16 contains the maximum differences at 16 bits per channel
+	// if BitDepth is 16 and is nil otherwise.
+	MaxRGBADiffs16 []int
 	// True if the dimensions of the compared images are different.
 	DimDiffer bool
+
+	// SSIM is the structural similarity of the luma of the two images. It is 1
+	// for identical images and decreases as the images become less similar.
+	// If the dimensions differ, the area covered by only one image counts as
+	// completely dissimilar.
+	SSIM float64
+
+	// MeanDeltaE and MaxDeltaE are the mean and maximum perceptual color
+	// distance (CIE76 Delta E in the CIELAB color space) of the pixels that
+	// are covered by both images.
+	MeanDeltaE float64
+	MaxDeltaE  float64
+
+	// NumPixelsOverTolerance is the number of pixels whose color distance is
+	// larger than DeltaETolerance, which is the tolerance the metrics were
+	// calculated with. Pixels that are only covered by one image are always
+	// counted.
+	NumPixelsOverTolerance int
+	DeltaETolerance        float64
+
+	// BitDepth is the number of bits per channel the images were compared at.
+	// It is 16 if either image has more than 8 bits per channel and 8
+	// otherwise.
+	BitDepth int
+
+	// ColorSpace is the name of the color space the images were compared in,
+	// which is the color space of the first image. See ColorImage.
+	ColorSpace string
+
+	// MetricsVersion is the METRICS_VERSION the metrics were calculated with.
+	MetricsVersion int
+}
+
+// Current returns true if the metrics were calculated with the current
+// METRICS_VERSION and DeltaETolerance.
+func (d *DiffMetrics) Current() bool {
+	return d.MetricsVersion == METRICS_VERSION && d.DeltaETolerance == DeltaETolerance
+}
+
+// Distance returns the value of the given metric oriented so that smaller
+// values mean more similar images. Unknown metrics default to
+// METRIC_PIXEL_DIFF_PERCENT.
+func (d *DiffMetrics) Distance(metric string) float64 {
+	switch metric {
+	case METRIC_SSIM:
+		return 1 - d.SSIM
+	case METRIC_MEAN_DELTA_E:
+		return d.MeanDeltaE
+	case METRIC_MAX_DELTA_E:
+		return d.MaxDeltaE
+	case METRIC_OVER_TOLERANCE:
+		return float64(d.NumPixelsOverTolerance)
+	}
+	return float64(d.PixelDiffPercent)
 }
 
 type DiffStore interface {
@@ -76,28 +187,71 @@ type DiffStore interface {
 	AbsPath(digest []string) map[string]string
 
 	// UnavailableDigests returns the set of digests that cannot be downloaded or
-	// processed (e.g. because the PNG is corrupted) and should therefore be
+	// processed (e.g. because the image is corrupted) and should therefore be
 	// be ignored. The return value is considered to be read only.
 	UnavailableDigests() map[string]bool
 
 	// CalculateDiffs calculates all diffs between the digests provided in the
 	// argument and stores them in cache for later retrieval.
 	CalculateDiffs([]string)
+
+	// RenderPath returns the path of an image that visualizes the difference
+	// between the left and the right digest in the given render mode, see
+	// RENDER_MODES. The image is rendered if it does not exist yet. Digests
+	// that are not valid, see ValidDigest, are rejected.
+	RenderPath(left, right, mode string) (string, error)
+}
+
+// ValidDigest returns true if digest is a hex encoded hash. Only valid digests
+// are safe to use in file paths.
+func ValidDigest(digest string) bool {
+	return validDigestRe.MatchString(digest)
 }
 
 // OpenImage is a utility function that opens the specified file and returns an
-// image.Image
+// image.Image. The decoder is picked by the format of the image, which has to
+// match the extension of the file, see IMAGE_FORMATS. If a PNG is not in the
+// sRGB color space, see PNGColorSpace, the image is returned as a
+// *ColorImage. Images in the other formats are assumed to be sRGB.
 func OpenImage(filePath string) (image.Image, error) {
-	reader, err := os.Open(filePath)
+	data, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		return nil, err
 	}
-	defer util.Close(reader)
-	im, err := png.Decode(reader)
+	im, format, err := decodeImage(filePath, bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
-	return im, nil
+	if format != "png" {
+		return im, nil
+	}
+	space, err := PNGColorSpace(data)
+	if err != nil {
+		return nil, err
+	}
+	if space.Equal(SRGB) {
+		return im, nil
+	}
+	return &ColorImage{Image: im, Space: space}, nil
+}
+
+// ImageSize is a utility function that returns the width and height of the
+// image in the specified file without decoding the whole image. See
+// OpenImage for the supported formats.
+func ImageSize(filePath string) (int, int, error) {
+	reader, err := os.Open(filePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer util.Close(reader)
+	config, format, err := image.DecodeConfig(reader)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := checkFormat(filePath, format); err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
 }
 
 // Returns the percentage of pixels that differ, as a float between 0 and 100
@@ -152,6 +306,209 @@ func diffColors(color1, color2 color.Color, maxRGBADiffs []int) color.Color {
 	return PixelMatchColor
 }
 
+// premultiplied returns the premultiplied RGB channels of the NRGBA pixel at
+// the start of pix.
+func premultiplied(pix []uint8) (uint8, uint8, uint8) {
+	a := int(pix[3])
+	return uint8((int(pix[0])*a + 127) / 255), uint8((int(pix[1])*a + 127) / 255), uint8((int(pix[2])*a + 127) / 255)
+}
+
+// labF is the non-linear function used in the conversion from XYZ to CIELAB.
+func labF(t float64) float64 {
+	if t > 216.0/24389.0 {
+		return math.Cbrt(t)
+	}
+	return t*841.0/108.0 + 4.0/29.0
+}
+
+// xyzToLab converts a CIE XYZ color relative to a D65 white point to the
+// CIELAB color space.
+func xyzToLab(x, y, z float64) (float64, float64, float64) {
+	fx, fy, fz := labF(x/whiteD65[0]), labF(y), labF(z/whiteD65[2])
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
+
+// toLab converts the NRGBA pixel at the start of pix to the CIELAB color
+// space, assuming sRGB primaries and a D65 white point. The color is
+// composited over black before it is converted.
+func toLab(pix []uint8) (float64, float64, float64) {
+	r8, g8, b8 := premultiplied(pix)
+	return xyzToLab(srgbToXYZ.mulVec(srgbToLinear[r8], srgbToLinear[g8], srgbToLinear[b8]))
+}
+
+// labDistance returns the CIE76 color distance between two CIELAB colors.
+func labDistance(l1, a1, b1, l2, a2, b2 float64) float64 {
+	return math.Sqrt((l1-l2)*(l1-l2) + (a1-a2)*(a1-a2) + (b1-b2)*(b1-b2))
+}
+
+// luma returns the luma of the premultiplied NRGBA pixel at the start of pix.
+func luma(pix []uint8) float64 {
+	r, g, b := premultiplied(pix)
+	return 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+}
+
+// premultiplied64 returns the premultiplied RGB channels of the NRGBA64
+// pixel at the start of pix on a scale from 0 to 1.
+func premultiplied64(pix []uint8) (float64, float64, float64) {
+	a := float64(channel16(pix, 3)) / 0xffff
+	return float64(channel16(pix, 0)) / 0xffff * a, float64(channel16(pix, 1)) / 0xffff * a, float64(channel16(pix, 2)) / 0xffff * a
+}
+
+// pixels gives direct access to the pixels of an *image.NRGBA or an
+// *image.NRGBA64 for the calculation of the perceptual metrics. x and y are
+// relative to the top left corner of the image.
+type pixels struct {
+	pix    []uint8
+	stride int
+
+	// wide is true for the 8 byte pixels of an *image.NRGBA64, whose colors
+	// are in space. The pixels of an *image.NRGBA are sRGB.
+	wide  bool
+	space *ColorSpace
+}
+
+func nrgbaPixels(img *image.NRGBA) *pixels {
+	return &pixels{
+		pix:    img.Pix[img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y):],
+		stride: img.Stride,
+		space:  SRGB,
+	}
+}
+
+func nrgba64Pixels(img *image.NRGBA64, space *ColorSpace) *pixels {
+	return &pixels{
+		pix:    img.Pix[img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y):],
+		stride: img.Stride,
+		wide:   true,
+		space:  space,
+	}
+}
+
+// at returns the pixel at x, y and everything after it.
+func (p *pixels) at(x, y int) []uint8 {
+	if p.wide {
+		return p.pix[y*p.stride+8*x:]
+	}
+	return p.pix[y*p.stride+4*x:]
+}
+
+// lab returns the color of the pixel at x, y in the CIELAB color space.
+func (p *pixels) lab(x, y int) (float64, float64, float64) {
+	if p.wide {
+		return xyzToLab(p.space.linearXYZ(premultiplied64(p.at(x, y))))
+	}
+	return toLab(p.at(x, y))
+}
+
+// luma returns the luma of the pixel at x, y on a scale from 0 to 255.
+func (p *pixels) luma(x, y int) float64 {
+	if p.wide {
+		r, g, b := premultiplied64(p.at(x, y))
+		return 255 * (0.299*r + 0.587*g + 0.114*b)
+	}
+	return luma(p.at(x, y))
+}
+
+// windowRange returns the first and the last of the n windows of size win
+// that are step pixels apart and contain the coordinate c.
+func windowRange(c, win, step, n int) (int, int) {
+	first := 0
+	if c >= win {
+		first = (c - win + step) / step
+	}
+	return first, util.MinInt(n-1, c/step)
+}
+
+// ssim returns the mean structural similarity of the luma of the two images
+// within the top left width x height pixels. The SSIM is calculated for
+// windows of SSIM_WINDOW_SIZE pixels that are SSIM_WINDOW_STEP pixels apart.
+// diffs are the offsets y*width+x of the pixels that differ. Windows without
+// any of them are identical and have an SSIM of 1, so only the others are
+// calculated.
+func ssim(p1, p2 *pixels, diffs []int, width, height int) float64 {
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+	)
+	if width == 0 || height == 0 {
+		return 0
+	}
+	winW := util.MinInt(SSIM_WINDOW_SIZE, width)
+	winH := util.MinInt(SSIM_WINDOW_SIZE, height)
+	n := float64(winW * winH)
+	numX := (width-winW)/SSIM_WINDOW_STEP + 1
+	numY := (height-winH)/SSIM_WINDOW_STEP + 1
+
+	differ := make([]bool, numX*numY)
+	for _, offset := range diffs {
+		firstX, lastX := windowRange(offset%width, winW, SSIM_WINDOW_STEP, numX)
+		firstY, lastY := windowRange(offset/width, winH, SSIM_WINDOW_STEP, numY)
+		for wy := firstY; wy <= lastY; wy++ {
+			for wx := firstX; wx <= lastX; wx++ {
+				differ[wy*numX+wx] = true
+			}
+		}
+	}
+
+	total := 0.0
+	for w, d := range differ {
+		if !d {
+			total += 1
+			continue
+		}
+		x0, y0 := (w%numX)*SSIM_WINDOW_STEP, (w/numX)*SSIM_WINDOW_STEP
+		var sum1, sum2, sq1, sq2, prod float64
+		for y := y0; y < y0+winH; y++ {
+			for x := x0; x < x0+winW; x++ {
+				v1, v2 := p1.luma(x, y), p2.luma(x, y)
+				sum1 += v1
+				sum2 += v2
+				sq1 += v1 * v1
+				sq2 += v2 * v2
+				prod += v1 * v2
+			}
+		}
+		mu1, mu2 := sum1/n, sum2/n
+		var1 := sq1/n - mu1*mu1
+		var2 := sq2/n - mu2*mu2
+		cov := prod/n - mu1*mu2
+		total += ((2*mu1*mu2 + c1) * (2*cov + c2)) / ((mu1*mu1 + mu2*mu2 + c1) * (var1 + var2 + c2))
+	}
+	return total / float64(len(differ))
+}
+
+// addPerceptualMetrics calculates the perceptual metrics of the two images and
+// stores them in m. width and height are the dimensions of the area covered
+// by both images, totalPixels the number of pixels covered by either image.
+// diffs are the offsets y*width+x of the pixels in that area that differ.
+func addPerceptualMetrics(m *DiffMetrics, p1, p2 *pixels, diffs []int, width, height, totalPixels int) {
+	m.DeltaETolerance = DeltaETolerance
+	m.MetricsVersion = METRICS_VERSION
+	if m.NumDiffPixels == 0 {
+		m.SSIM = 1
+		return
+	}
+
+	sum := 0.0
+	for _, offset := range diffs {
+		x, y := offset%width, offset/width
+		l1, a1, b1 := p1.lab(x, y)
+		l2, a2, b2 := p2.lab(x, y)
+		d := labDistance(l1, a1, b1, l2, a2, b2)
+		sum += d
+		m.MaxDeltaE = math.Max(m.MaxDeltaE, d)
+		if d > DeltaETolerance {
+			m.NumPixelsOverTolerance++
+		}
+	}
+	commonPixels := width * height
+	m.NumPixelsOverTolerance += totalPixels - commonPixels
+	if commonPixels > 0 {
+		m.MeanDeltaE = sum / float64(commonPixels)
+	}
+	m.SSIM = ssim(p1, p2, diffs, width, height) * float64(commonPixels) / float64(totalPixels)
+}
+
 // recode creates a new NRGBA image from the given image.
 func recode(img image.Image) *image.NRGBA {
 	ret := image.NewNRGBA(img.Bounds())
@@ -184,10 +541,54 @@ func getNRGBA(img image.Image) *image.NRGBA {
 	}
 }
 
+// ColorImage is an image whose channel values are in a color space other than
+// sRGB. Diff compares the colors of ColorImages, not their channel values.
+type ColorImage struct {
+	image.Image
+	Space *ColorSpace
+}
+
+// colorSpace returns the image without its ColorImage wrapper and its color
+// space.
+func colorSpace(img image.Image) (image.Image, *ColorSpace) {
+	if ci, ok := img.(*ColorImage); ok && ci.Space != nil {
+		return ci.Image, ci.Space
+	}
+	return img, SRGB
+}
+
+// is16Bit returns true if the image has more than 8 bits per channel.
+func is16Bit(img image.Image) bool {
+	switch img.ColorModel() {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+		return true
+	}
+	return false
+}
+
 // Diff is a utility function that calculates the DiffMetrics and the image of the
-// difference for the provided images.
+// difference for the provided images. Images with 16 bits per channel are
+// compared at their native precision and images in different color spaces are
+// compared in the color space of img1, see ColorImage.
 func Diff(img1, img2 image.Image) (*DiffMetrics, *image.NRGBA) {
+	// Most images are 8 bit sRGB PNGs, which are compared without looking
+	// at their color spaces.
+	_, ok1 := img1.(*image.NRGBA)
+	_, ok2 := img2.(*image.NRGBA)
+	if ok1 && ok2 {
+		return diff8(img1, img2)
+	}
+
+	img1, space1 := colorSpace(img1)
+	img2, space2 := colorSpace(img2)
+	if is16Bit(img1) || is16Bit(img2) || !space1.Equal(SRGB) || !space2.Equal(SRGB) {
+		return diff16(img1, space1, img2, space2)
+	}
+	return diff8(img1, img2)
+}
 
+// diff8 implements Diff for sRGB images with 8 bits per channel.
+func diff8(img1, img2 image.Image) (*DiffMetrics, *image.NRGBA) {
 	img1Bounds := img1.Bounds()
 	img2Bounds := img2.Bounds()
 
@@ -208,9 +609,15 @@ func Diff(img1, img2 image.Image) (*DiffMetrics, *image.NRGBA) {
 	numDiffPixels := resultWidth * resultHeight
 	maxRGBADiffs := make([]int, 4)
 
+	// diffs are the offsets y*cmpWidth+x of the differing pixels within the
+	// compared area, which are all the perceptual metrics need to look at.
+	diffs := []int{}
+
 	// Pix is a []uint8 rotating through R, G, B, A, R, G, B, A, ...
-	p1 := getNRGBA(img1).Pix
-	p2 := getNRGBA(img2).Pix
+	nrgba1 := getNRGBA(img1)
+	nrgba2 := getNRGBA(img2)
+	p1 := nrgba1.Pix
+	p2 := nrgba2.Pix
 	// Compare the bounds, if they are the same then use this fast path.
 	// We pun to uint64 to compare 2 pixels at a time, so we also require
 	// an even number of pixels here.  If that's a big deal, we can easily
@@ -233,6 +640,7 @@ func Diff(img1, img2 image.Image) (*DiffMetrics, *image.NRGBA) {
 				R, G, B, A := p2[off+i+0], p2[off+i+1], p2[off+i+2], p2[off+i+3]
 				if r != R || g != G || b != B || a != A {
 					numDiffPixels++
+					diffs = append(diffs, (off+i)/nrgba1.Stride*cmpWidth+(off+i)%nrgba1.Stride/4)
 					dr := util.AbsInt(int(r) - int(R))
 					dg := util.AbsInt(int(g) - int(G))
 					db := util.AbsInt(int(b) - int(B))
@@ -258,15 +666,149 @@ func Diff(img1, img2 image.Image) (*DiffMetrics, *image.NRGBA) {
 				dc := diffColors(color1, color2, maxRGBADiffs)
 				if dc == PixelMatchColor {
 					numDiffPixels--
+				} else {
+					diffs = append(diffs, y*cmpWidth+x)
 				}
 				resultImg.Set(x, y, dc)
 			}
 		}
 	}
 
-	return &DiffMetrics{
+	metrics := &DiffMetrics{
+		NumDiffPixels:    numDiffPixels,
+		PixelDiffPercent: getPixelDiffPercent(numDiffPixels, totalPixels),
+		MaxRGBADiffs:     maxRGBADiffs,
+		DimDiffer:        (cmpWidth != resultWidth) || (cmpHeight != resultHeight),
+		BitDepth:         8,
+		ColorSpace:       SRGB.Name,
+	}
+	addPerceptualMetrics(metrics, nrgbaPixels(nrgba1), nrgbaPixels(nrgba2), diffs, cmpWidth, cmpHeight, totalPixels)
+	return metrics, resultImg
+}
+
+// channel16 returns channel c of the NRGBA64 pixel at the start of pix.
+func channel16(pix []uint8, c int) int {
+	return int(pix[2*c])<<8 | int(pix[2*c+1])
+}
+
+// getNRGBA64 converts the image to an *image.NRGBA64.
+func getNRGBA64(img image.Image) *image.NRGBA64 {
+	if t, ok := img.(*image.NRGBA64); ok {
+		return t
+	}
+	ret := image.NewNRGBA64(img.Bounds())
+	draw.Draw(ret, img.Bounds(), img, img.Bounds().Min, draw.Src)
+	return ret
+}
+
+// convertColorSpace returns a copy of img with its colors converted from the
+// color space from to the color space to. Colors outside of the gamut of to
+// are clipped.
+func convertColorSpace(img *image.NRGBA64, from, to *ColorSpace) *image.NRGBA64 {
+	m := to.fromXYZ.mul(from.toXYZ)
+
+	// Encode linear intensities by a binary search in the tabulated curves.
+	tables := [3][]float64{}
+	for c := range tables {
+		tables[c] = make([]float64, 0x10000)
+		for i := range tables[c] {
+			tables[c][i] = to.curves[c].eval(float64(i) / 0xffff)
+		}
+	}
+	encode := func(c int, v float64) int {
+		i := sort.SearchFloat64s(tables[c], v)
+		if i > 0xffff {
+			return 0xffff
+		}
+		if i > 0 && v-tables[c][i-1] < tables[c][i]-v {
+			return i - 1
+		}
+		return i
+	}
+
+	ret := image.NewNRGBA64(img.Rect)
+	copy(ret.Pix, img.Pix)
+	for i := 0; i < len(ret.Pix); i += 8 {
+		pix := ret.Pix[i:]
+		r, g, b := m.mulVec(
+			from.curves[0].eval(float64(channel16(pix, 0))/0xffff),
+			from.curves[1].eval(float64(channel16(pix, 1))/0xffff),
+			from.curves[2].eval(float64(channel16(pix, 2))/0xffff))
+		for c, v := range []float64{r, g, b} {
+			e := encode(c, math.Max(0, math.Min(1, v)))
+			pix[2*c], pix[2*c+1] = uint8(e>>8), uint8(e)
+		}
+	}
+	return ret
+}
+
+// diff16 implements Diff for images with 16 bits per channel or in color
+// spaces other than sRGB. The images are compared at 16 bits per channel in
+// the color space of img1, img2 is converted to it if necessary.
+func diff16(img1 image.Image, space1 *ColorSpace, img2 image.Image, space2 *ColorSpace) (*DiffMetrics, *image.NRGBA) {
+	bitDepth := 8
+	if is16Bit(img1) || is16Bit(img2) {
+		bitDepth = 16
+	}
+	nrgba1 := getNRGBA64(img1)
+	nrgba2 := getNRGBA64(img2)
+	if !space1.Equal(space2) {
+		nrgba2 = convertColorSpace(nrgba2, space2, space1)
+	}
+
+	img1Bounds := nrgba1.Bounds()
+	img2Bounds := nrgba2.Bounds()
+	cmpWidth := util.MinInt(img1Bounds.Dx(), img2Bounds.Dx())
+	cmpHeight := util.MinInt(img1Bounds.Dy(), img2Bounds.Dy())
+	resultWidth := util.MaxInt(img1Bounds.Dx(), img2Bounds.Dx())
+	resultHeight := util.MaxInt(img1Bounds.Dy(), img2Bounds.Dy())
+	resultImg := image.NewNRGBA(image.Rect(0, 0, resultWidth, resultHeight))
+	totalPixels := resultWidth * resultHeight
+
+	numDiffPixels := totalPixels
+	maxRGBADiffs16 := make([]int, 4)
+	diffs := []int{}
+	for y := 0; y < cmpHeight; y++ {
+		for x := 0; x < cmpWidth; x++ {
+			p1 := nrgba1.Pix[nrgba1.PixOffset(x+img1Bounds.Min.X, y+img1Bounds.Min.Y):]
+			p2 := nrgba2.Pix[nrgba2.PixOffset(x+img2Bounds.Min.X, y+img2Bounds.Min.Y):]
+			if bytes.Equal(p1[:8], p2[:8]) {
+				numDiffPixels--
+				continue
+			}
+			diffs = append(diffs, y*cmpWidth+x)
+
+			// The color of the diff image is based on the differences
+			// scaled to 8 bits.
+			d := [4]int{}
+			for c := range d {
+				diff := util.AbsInt(channel16(p1, c) - channel16(p2, c))
+				maxRGBADiffs16[c] = util.MaxInt(diff, maxRGBADiffs16[c])
+				d[c] = (diff + 0x100) / 0x101
+			}
+			if d[0]+d[1]+d[2] > 0 {
+				copy(resultImg.Pix[resultImg.PixOffset(x, y):], PixelDiffColor[deltaOffset(d[0]+d[1]+d[2]+d[3])])
+			} else {
+				copy(resultImg.Pix[resultImg.PixOffset(x, y):], PixelAlphaDiffColor[deltaOffset(d[3])])
+			}
+		}
+	}
+
+	maxRGBADiffs := make([]int, 4)
+	for c, diff := range maxRGBADiffs16 {
+		maxRGBADiffs[c] = (diff + 0x100) / 0x101
+	}
+	metrics := &DiffMetrics{
 		NumDiffPixels:    numDiffPixels,
 		PixelDiffPercent: getPixelDiffPercent(numDiffPixels, totalPixels),
 		MaxRGBADiffs:     maxRGBADiffs,
-		DimDiffer:        (cmpWidth != resultWidth) || (cmpHeight != resultHeight)}, resultImg
+		DimDiffer:        (cmpWidth != resultWidth) || (cmpHeight != resultHeight),
+		BitDepth:         bitDepth,
+		ColorSpace:       space1.Name,
+	}
+	if bitDepth == 16 {
+		metrics.MaxRGBADiffs16 = maxRGBADiffs16
+	}
+	addPerceptualMetrics(metrics, nrgba64Pixels(nrgba1, space1), nrgba64Pixels(nrgba2, space1), diffs, cmpWidth, cmpHeight, totalPixels)
+	return metrics, resultImg
 }
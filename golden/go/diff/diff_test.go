@@ -3,6 +3,8 @@ package diff
 import (
 	"bytes"
 	"image"
+	"image/color"
+	"math"
 	"path/filepath"
 	"reflect"
 	"strings"
@@ -10,6 +12,7 @@ import (
 	"testing"
 
 	"github.com/skia-dev/glog"
+	assert "github.com/stretchr/testify/require"
 	"go.skia.org/infra/golden/go/image/text"
 )
 
@@ -21,77 +24,149 @@ func TestDiffMetrics(t *testing.T) {
 	// Assert different images with the same dimensions.
 	assertDiffs(t, "4029959456464745507", "16465366847175223174",
 		&DiffMetrics{
-			NumDiffPixels:     16,
-			PixelDiffPercent:  0.0064,
-			PixelDiffFilePath: "",
-			MaxRGBADiffs:      []int{54, 100, 125, 0},
-			DimDiffer:         false})
+			NumDiffPixels:          16,
+			PixelDiffPercent:       0.0064,
+			PixelDiffFilePath:      "",
+			MaxRGBADiffs:           []int{54, 100, 125, 0},
+			DimDiffer:              false,
+			SSIM:                   0.9999,
+			MeanDeltaE:             0.0014,
+			MaxDeltaE:              45.0963,
+			NumPixelsOverTolerance: 16,
+			DeltaETolerance:        DeltaETolerance,
+			BitDepth:               8,
+			ColorSpace:             "sRGB",
+			MetricsVersion:         METRICS_VERSION})
 	assertDiffs(t, "5024150605949408692", "11069776588985027208",
 		&DiffMetrics{
-			NumDiffPixels:     2233,
-			PixelDiffPercent:  0.8932,
-			PixelDiffFilePath: "",
-			MaxRGBADiffs:      []int{0, 0, 1, 0},
-			DimDiffer:         false})
+			NumDiffPixels:          2233,
+			PixelDiffPercent:       0.8932,
+			PixelDiffFilePath:      "",
+			MaxRGBADiffs:           []int{0, 0, 1, 0},
+			DimDiffer:              false,
+			SSIM:                   1,
+			MeanDeltaE:             0.0055,
+			MaxDeltaE:              0.6808,
+			NumPixelsOverTolerance: 0,
+			DeltaETolerance:        DeltaETolerance,
+			BitDepth:               8,
+			ColorSpace:             "sRGB",
+			MetricsVersion:         METRICS_VERSION})
 	// Assert the same image.
 	assertDiffs(t, "5024150605949408692", "5024150605949408692",
 		&DiffMetrics{
-			NumDiffPixels:     0,
-			PixelDiffPercent:  0,
-			PixelDiffFilePath: "",
-			MaxRGBADiffs:      []int{0, 0, 0, 0},
-			DimDiffer:         false})
+			NumDiffPixels:          0,
+			PixelDiffPercent:       0,
+			PixelDiffFilePath:      "",
+			MaxRGBADiffs:           []int{0, 0, 0, 0},
+			DimDiffer:              false,
+			SSIM:                   1,
+			MeanDeltaE:             0,
+			MaxDeltaE:              0,
+			NumPixelsOverTolerance: 0,
+			DeltaETolerance:        DeltaETolerance,
+			BitDepth:               8,
+			ColorSpace:             "sRGB",
+			MetricsVersion:         METRICS_VERSION})
 	// Assert different images with different dimensions.
 	assertDiffs(t, "ffce5042b4ac4a57bd7c8657b557d495", "fffbcca7e8913ec45b88cc2c6a3a73ad",
 		&DiffMetrics{
-			NumDiffPixels:     571674,
-			PixelDiffPercent:  89.324066,
-			PixelDiffFilePath: "",
-			MaxRGBADiffs:      []int{255, 255, 255, 0},
-			DimDiffer:         true})
+			NumDiffPixels:          571674,
+			PixelDiffPercent:       89.324066,
+			PixelDiffFilePath:      "",
+			MaxRGBADiffs:           []int{255, 255, 255, 0},
+			DimDiffer:              true,
+			SSIM:                   0.0982,
+			MeanDeltaE:             49.5387,
+			MaxDeltaE:              168.374,
+			NumPixelsOverTolerance: 571655,
+			DeltaETolerance:        DeltaETolerance,
+			BitDepth:               8,
+			ColorSpace:             "sRGB",
+			MetricsVersion:         METRICS_VERSION})
 	// Assert with images that match in dimensions but where all pixels differ.
 	assertDiffs(t, "4029959456464745507", "4029959456464745507-inverted",
 		&DiffMetrics{
-			NumDiffPixels:     250000,
-			PixelDiffPercent:  100.0,
-			PixelDiffFilePath: "",
-			MaxRGBADiffs:      []int{255, 255, 255, 0},
-			DimDiffer:         false})
+			NumDiffPixels:          250000,
+			PixelDiffPercent:       100.0,
+			PixelDiffFilePath:      "",
+			MaxRGBADiffs:           []int{255, 255, 255, 0},
+			DimDiffer:              false,
+			SSIM:                   0.0542,
+			MeanDeltaE:             98.3744,
+			MaxDeltaE:              199.1425,
+			NumPixelsOverTolerance: 250000,
+			DeltaETolerance:        DeltaETolerance,
+			BitDepth:               8,
+			ColorSpace:             "sRGB",
+			MetricsVersion:         METRICS_VERSION})
 
 	// Assert different images where neither fits into the other.
 	assertDiffs(t, "fffbcca7e8913ec45b88cc2c6a3a73ad", "fffbcca7e8913ec45b88cc2c6a3a73ad-rotated",
 		&DiffMetrics{
-			NumDiffPixels:     172466,
-			PixelDiffPercent:  74.8550347222,
-			PixelDiffFilePath: "",
-			MaxRGBADiffs:      []int{255, 255, 255, 0},
-			DimDiffer:         true})
+			NumDiffPixels:          172466,
+			PixelDiffPercent:       74.8550347222,
+			PixelDiffFilePath:      "",
+			MaxRGBADiffs:           []int{255, 255, 255, 0},
+			DimDiffer:              true,
+			SSIM:                   0.2061,
+			MeanDeltaE:             28.8201,
+			MaxDeltaE:              117.3271,
+			NumPixelsOverTolerance: 172391,
+			DeltaETolerance:        DeltaETolerance,
+			BitDepth:               8,
+			ColorSpace:             "sRGB",
+			MetricsVersion:         METRICS_VERSION})
 	// Make sure the metric is symmetric.
 	assertDiffs(t, "fffbcca7e8913ec45b88cc2c6a3a73ad-rotated", "fffbcca7e8913ec45b88cc2c6a3a73ad",
 		&DiffMetrics{
-			NumDiffPixels:     172466,
-			PixelDiffPercent:  74.8550347222,
-			PixelDiffFilePath: "",
-			MaxRGBADiffs:      []int{255, 255, 255, 0},
-			DimDiffer:         true})
+			NumDiffPixels:          172466,
+			PixelDiffPercent:       74.8550347222,
+			PixelDiffFilePath:      "",
+			MaxRGBADiffs:           []int{255, 255, 255, 0},
+			DimDiffer:              true,
+			SSIM:                   0.2061,
+			MeanDeltaE:             28.8201,
+			MaxDeltaE:              117.3271,
+			NumPixelsOverTolerance: 172391,
+			DeltaETolerance:        DeltaETolerance,
+			BitDepth:               8,
+			ColorSpace:             "sRGB",
+			MetricsVersion:         METRICS_VERSION})
 
 	// Compare two images where one has an alpha channel and the other doesn't.
 	assertDiffs(t, "b716a12d5b98d04b15db1d9dd82c82ea", "df1591dde35907399734ea19feb76663",
 		&DiffMetrics{
-			NumDiffPixels:     8750,
-			PixelDiffPercent:  2.8483074,
-			PixelDiffFilePath: "",
-			MaxRGBADiffs:      []int{255, 2, 255, 0},
-			DimDiffer:         false})
+			NumDiffPixels:          8750,
+			PixelDiffPercent:       2.8483074,
+			PixelDiffFilePath:      "",
+			MaxRGBADiffs:           []int{255, 2, 255, 0},
+			DimDiffer:              false,
+			SSIM:                   0.9958,
+			MeanDeltaE:             2.8155,
+			MaxDeltaE:              176.314,
+			NumPixelsOverTolerance: 6250,
+			DeltaETolerance:        DeltaETolerance,
+			BitDepth:               8,
+			ColorSpace:             "sRGB",
+			MetricsVersion:         METRICS_VERSION})
 
 	// Compare two images where the alpha differs.
 	assertDiffs(t, "df1591dde35907399734ea19feb76663", "df1591dde35907399734ea19feb76663-6-alpha-diff",
 		&DiffMetrics{
-			NumDiffPixels:     6,
-			PixelDiffPercent:  0.001953125,
-			PixelDiffFilePath: "",
-			MaxRGBADiffs:      []int{0, 0, 0, 235},
-			DimDiffer:         false})
+			NumDiffPixels:          6,
+			PixelDiffPercent:       0.001953125,
+			PixelDiffFilePath:      "",
+			MaxRGBADiffs:           []int{0, 0, 0, 235},
+			DimDiffer:              false,
+			SSIM:                   0.9999,
+			MeanDeltaE:             0.0004,
+			MaxDeltaE:              119.5284,
+			NumPixelsOverTolerance: 1,
+			DeltaETolerance:        DeltaETolerance,
+			BitDepth:               8,
+			ColorSpace:             "sRGB",
+			MetricsVersion:         METRICS_VERSION})
 }
 
 const SRC1 = `! SKTEXTSIMPLE
@@ -180,6 +255,15 @@ func imageFromString(t *testing.T, s string) *image.NRGBA {
 	return img.(*image.NRGBA)
 }
 
+// image16FromString decodes the 16 bit SKTEXT image from the string.
+func image16FromString(t *testing.T, s string) *image.NRGBA64 {
+	img, err := text.Decode(bytes.NewBufferString(s))
+	if err != nil {
+		t.Fatalf("Failed to decode a valid image: %s", err)
+	}
+	return img.(*image.NRGBA64)
+}
+
 // lineDiff lists the differences in the lines of a and b.
 func lineDiff(t *testing.T, a, b string) {
 	aslice := strings.Split(a, "\n")
@@ -252,11 +336,164 @@ func assertDiffs(t *testing.T, d1, d2 string, expectedDiffMetrics *DiffMetrics)
 	if err != nil {
 		t.Error("Unexpected error: ", err)
 	}
-	if got, want := diffMetrics, expectedDiffMetrics; !reflect.DeepEqual(got, want) {
+	assertDiffMetricsEqual(t, expectedDiffMetrics, diffMetrics)
+}
+
+// assertDiffMetricsEqual asserts that the two DiffMetrics are identical, except
+// for the perceptual metrics, which only need to match to four decimal places.
+func assertDiffMetricsEqual(t *testing.T, want, got *DiffMetrics) {
+	gotCopy, wantCopy := *got, *want
+	for _, metric := range []string{METRIC_SSIM, METRIC_MEAN_DELTA_E, METRIC_MAX_DELTA_E} {
+		if math.Abs(got.Distance(metric)-want.Distance(metric)) > 1e-4 {
+			t.Errorf("Image Diff %s: Got %v Want %v", metric, got.Distance(metric), want.Distance(metric))
+		}
+	}
+	gotCopy.SSIM, gotCopy.MeanDeltaE, gotCopy.MaxDeltaE = 0, 0, 0
+	wantCopy.SSIM, wantCopy.MeanDeltaE, wantCopy.MaxDeltaE = 0, 0, 0
+	if !reflect.DeepEqual(&gotCopy, &wantCopy) {
 		t.Errorf("Image Diff: Got %v Want %v", got, want)
 	}
 }
 
+// OPAQUE1, OPAQUE2 and OPAQUE3 are opaque gray images. OPAQUE2 differs from
+// OPAQUE1 by one in a single channel, which is below the tolerance, while the
+// difference to OPAQUE3 is clearly visible.
+const OPAQUE1 = `! SKTEXTSIMPLE
+1 2
+0x808080ff
+0x808080ff`
+
+const OPAQUE2 = `! SKTEXTSIMPLE
+1 2
+0x818080ff
+0x808081ff`
+
+const OPAQUE3 = `! SKTEXTSIMPLE
+1 2
+0xff0000ff
+0x808080ff`
+
+func TestPerceptualMetrics(t *testing.T) {
+	m, _ := Diff(imageFromString(t, OPAQUE1), imageFromString(t, OPAQUE2))
+	assert.Equal(t, 2, m.NumDiffPixels)
+	assert.Equal(t, 0, m.NumPixelsOverTolerance)
+	assert.True(t, m.MaxDeltaE > 0)
+	assert.True(t, m.MaxDeltaE < DeltaETolerance)
+
+	m, _ = Diff(imageFromString(t, OPAQUE1), imageFromString(t, OPAQUE3))
+	assert.Equal(t, 1, m.NumDiffPixels)
+	assert.Equal(t, 1, m.NumPixelsOverTolerance)
+	assert.True(t, m.MaxDeltaE > DeltaETolerance)
+	assert.Equal(t, m.MaxDeltaE/2, m.MeanDeltaE)
+	assert.True(t, m.SSIM < 1)
+
+	// Identical images.
+	m, _ = Diff(imageFromString(t, OPAQUE1), imageFromString(t, OPAQUE1))
+	assert.Equal(t, 1.0, m.SSIM)
+	assert.Equal(t, 0.0, m.MaxDeltaE)
+	assert.True(t, m.Current())
+
+	// The tolerance is recorded in the metrics.
+	defer func(tolerance float64) { DeltaETolerance = tolerance }(DeltaETolerance)
+	DeltaETolerance = 0
+	assert.False(t, m.Current())
+	m, _ = Diff(imageFromString(t, OPAQUE1), imageFromString(t, OPAQUE2))
+	assert.Equal(t, 2, m.NumPixelsOverTolerance)
+	assert.Equal(t, 0.0, m.DeltaETolerance)
+}
+
+// OPAQUE16_1 and OPAQUE16_2 are 16 bit versions of OPAQUE1 that differ in a
+// way that is lost at 8 bits per channel.
+const OPAQUE16_1 = `! SKTEXTSIMPLE16
+1 2
+0x808080808080ffff
+0x808080808080ffff`
+
+const OPAQUE16_2 = `! SKTEXTSIMPLE16
+1 2
+0x808180808080ffff
+0x808080808080ffff`
+
+func TestDiff16(t *testing.T) {
+	m, _ := Diff(image16FromString(t, OPAQUE16_1), image16FromString(t, OPAQUE16_2))
+	assert.Equal(t, 16, m.BitDepth)
+	assert.Equal(t, 1, m.NumDiffPixels)
+	assert.Equal(t, []int{1, 0, 0, 0}, m.MaxRGBADiffs)
+	assert.Equal(t, []int{1, 0, 0, 0}, m.MaxRGBADiffs16)
+	assert.True(t, m.MaxDeltaE > 0)
+	assert.True(t, m.MaxDeltaE < 0.01)
+
+	// An 8 bit image is identical to its 16 bit version.
+	m, _ = Diff(imageFromString(t, OPAQUE1), image16FromString(t, OPAQUE16_1))
+	assert.Equal(t, 16, m.BitDepth)
+	assert.Equal(t, 0, m.NumDiffPixels)
+	assert.Equal(t, []int{0, 0, 0, 0}, m.MaxRGBADiffs16)
+	assert.Equal(t, 1.0, m.SSIM)
+
+	m, _ = Diff(imageFromString(t, OPAQUE1), imageFromString(t, OPAQUE3))
+	assert.Equal(t, 8, m.BitDepth)
+	assert.Nil(t, m.MaxRGBADiffs16)
+}
+
+func TestDiffColorSpaces(t *testing.T) {
+	// The sRGB gray of OPAQUE1 encoded with a linear transfer curve.
+	v := uint16(srgbToLinear[0x80]*0xffff + 0.5)
+	linearImg := image.NewNRGBA64(image.Rect(0, 0, 1, 2))
+	for y := 0; y < 2; y++ {
+		linearImg.SetNRGBA64(0, y, color.NRGBA64{R: v, G: v, B: v, A: 0xffff})
+	}
+	linear := &ColorImage{
+		Image: linearImg,
+		Space: newColorSpace("linear", [3]*curve{gammaCurve(1), gammaCurve(1), gammaCurve(1)}, srgbToXYZ),
+	}
+
+	m, _ := Diff(imageFromString(t, OPAQUE1), linear)
+	assert.Equal(t, "sRGB", m.ColorSpace)
+	assert.True(t, m.MaxRGBADiffs16[0] <= 1)
+	assert.True(t, m.MaxDeltaE < 0.01)
+
+	// Compared as plain channel values the images are very different.
+	m, _ = Diff(imageFromString(t, OPAQUE1), linearImg)
+	assert.True(t, m.MaxDeltaE > DeltaETolerance)
+
+	// The color space of the first image is used.
+	m, _ = Diff(linear, imageFromString(t, OPAQUE1))
+	assert.Equal(t, "linear", m.ColorSpace)
+	assert.True(t, m.MaxDeltaE < 0.01)
+
+	// 8 bit sRGB images are compared the same with or without their color
+	// space.
+	m, _ = Diff(imageFromString(t, OPAQUE1), imageFromString(t, OPAQUE3))
+	mSRGB, _ := Diff(&ColorImage{Image: imageFromString(t, OPAQUE1), Space: SRGB}, imageFromString(t, OPAQUE3))
+	assert.Equal(t, 8, mSRGB.BitDepth)
+	assert.Equal(t, m, mSRGB)
+}
+
+func TestDistance(t *testing.T) {
+	m := &DiffMetrics{
+		PixelDiffPercent:       2.5,
+		SSIM:                   0.75,
+		MeanDeltaE:             1.5,
+		MaxDeltaE:              10,
+		NumPixelsOverTolerance: 3,
+	}
+	assert.Equal(t, 2.5, m.Distance(METRIC_PIXEL_DIFF_PERCENT))
+	assert.Equal(t, 2.5, m.Distance("unknown"))
+	assert.Equal(t, 0.25, m.Distance(METRIC_SSIM))
+	assert.Equal(t, 1.5, m.Distance(METRIC_MEAN_DELTA_E))
+	assert.Equal(t, 10.0, m.Distance(METRIC_MAX_DELTA_E))
+	assert.Equal(t, 3.0, m.Distance(METRIC_OVER_TOLERANCE))
+}
+
+func TestValidDigest(t *testing.T) {
+	assert.True(t, ValidDigest("445aa63b2200baaba9b37fd5f80c0447"))
+	assert.True(t, ValidDigest("11069776588985027208"))
+	assert.False(t, ValidDigest(""))
+	assert.False(t, ValidDigest("../445aa63b2200baaba9b37fd5f80c0447"))
+	assert.False(t, ValidDigest("445AA63B"))
+	assert.False(t, ValidDigest("445aa63b/.."))
+}
+
 func TestDeltaOffset(t *testing.T) {
 	testCases := []struct {
 		offset int
@@ -323,3 +560,25 @@ func BenchmarkDiff(b *testing.B) {
 		Diff(img1, img2)
 	}
 }
+
+func TestImageSize(t *testing.T) {
+	fName := filepath.Join(TESTDATA_DIR, "4029959456464745507.png")
+	img, err := OpenImage(fName)
+	if err != nil {
+		t.Fatal("Failed to open test file: ", err)
+	}
+	width, height, err := ImageSize(fName)
+	if err != nil {
+		t.Fatal("Failed to get image size: ", err)
+	}
+	if got, want := width, img.Bounds().Dx(); got != want {
+		t.Errorf("Width: Got %v Want %v", got, want)
+	}
+	if got, want := height, img.Bounds().Dy(); got != want {
+		t.Errorf("Height: Got %v Want %v", got, want)
+	}
+
+	if _, _, err := ImageSize(filepath.Join(TESTDATA_DIR, "does-not-exist.png")); err == nil {
+		t.Error("Expected error for missing file.")
+	}
+}
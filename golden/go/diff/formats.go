@@ -0,0 +1,68 @@
+package diff
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"path/filepath"
+	"strings"
+
+	// Register the decoders of the formats in IMAGE_FORMATS.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "go.skia.org/infra/golden/go/image/text"
+	_ "golang.org/x/image/bmp"
+)
+
+// IMAGE_FORMATS maps the file extensions of the images that can be diffed to
+// the names of the formats, as registered with image.RegisterFormat, that
+// images with the extension may be in. This package registers the decoders of
+// all of them.
+var IMAGE_FORMATS = map[string][]string{
+	"png":    []string{"png"},
+	"jpg":    []string{"jpeg"},
+	"jpeg":   []string{"jpeg"},
+	"gif":    []string{"gif"},
+	"bmp":    []string{"bmp"},
+	"sktext": []string{"sktext", "sktext16"},
+}
+
+// SupportedExt returns true if images with the given file extension can be
+// decoded, see IMAGE_FORMATS. The extension is given without the dot.
+func SupportedExt(ext string) bool {
+	_, ok := IMAGE_FORMATS[strings.ToLower(ext)]
+	return ok
+}
+
+// decodeImage decodes the image in r with the decoder registered for its
+// format. If the extension of filePath is in IMAGE_FORMATS the image has to be
+// in one of the formats of the extension, otherwise any registered format is
+// accepted. The name of the format is returned with the image.
+func decodeImage(filePath string, r io.Reader) (image.Image, string, error) {
+	img, format, err := image.Decode(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := checkFormat(filePath, format); err != nil {
+		return nil, "", err
+	}
+	return img, format, nil
+}
+
+// checkFormat returns an error if the format does not match the extension of
+// filePath, see decodeImage.
+func checkFormat(filePath, format string) error {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filePath), "."))
+	formats, ok := IMAGE_FORMATS[ext]
+	if !ok {
+		return nil
+	}
+	for _, f := range formats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("Image %s is in format %s, expected one of %v.", filePath, format, formats)
+}
@@ -0,0 +1,81 @@
+package diff
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/golden/go/image/text"
+	"golang.org/x/image/bmp"
+)
+
+func TestOpenImageFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formats")
+	assert.NoError(t, err)
+	defer func() { assert.NoError(t, os.RemoveAll(dir)) }()
+
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	img.Set(1, 1, color.NRGBA{0x00, 0x00, 0x00, 0xff})
+
+	encoded := map[string][]byte{}
+	for ext, encode := range map[string]func(buf *bytes.Buffer) error{
+		"png":    func(buf *bytes.Buffer) error { return png.Encode(buf, img) },
+		"jpg":    func(buf *bytes.Buffer) error { return jpeg.Encode(buf, img, &jpeg.Options{Quality: 100}) },
+		"gif":    func(buf *bytes.Buffer) error { return gif.Encode(buf, img, nil) },
+		"bmp":    func(buf *bytes.Buffer) error { return bmp.Encode(buf, img) },
+		"sktext": func(buf *bytes.Buffer) error { return text.Encode(buf, img) },
+	} {
+		var buf bytes.Buffer
+		assert.NoError(t, encode(&buf))
+		encoded[ext] = buf.Bytes()
+		path := filepath.Join(dir, "img."+ext)
+		assert.NoError(t, ioutil.WriteFile(path, buf.Bytes(), 0644))
+		assert.True(t, SupportedExt(ext))
+
+		opened, err := OpenImage(path)
+		assert.NoError(t, err, ext)
+		assert.Equal(t, img.Bounds(), opened.Bounds(), ext)
+		if ext == "jpg" {
+			// JPEG is lossy, but the black pixel survives.
+			r, g, b, _ := opened.At(1, 1).RGBA()
+			assert.True(t, r+g+b < 3*0x2000, ext)
+		} else {
+			dm, _ := Diff(img, opened)
+			assert.Equal(t, 0, dm.NumDiffPixels, ext)
+		}
+
+		width, height, err := ImageSize(path)
+		assert.NoError(t, err, ext)
+		assert.Equal(t, []int{3, 2}, []int{width, height}, ext)
+	}
+
+	// The format has to match the extension.
+	path := filepath.Join(dir, "jpeg.png")
+	assert.NoError(t, ioutil.WriteFile(path, encoded["jpg"], 0644))
+	_, err = OpenImage(path)
+	assert.Error(t, err)
+	_, _, err = ImageSize(path)
+	assert.Error(t, err)
+
+	// Upper case extensions are supported, unknown extensions accept any
+	// format.
+	for _, name := range []string{"img.JPEG", "img.unknown"} {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(path, encoded["jpg"], 0644))
+		_, err = OpenImage(path)
+		assert.NoError(t, err, name)
+	}
+	assert.True(t, SupportedExt("JPEG"))
+	assert.False(t, SupportedExt("pdf"))
+}
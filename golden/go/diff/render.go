@@ -0,0 +1,191 @@
+package diff
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+
+	"go.skia.org/infra/go/util"
+)
+
+const (
+	// RENDER_COMPOSITE shows the left image, the diff image and the right
+	// image side by side.
+	RENDER_COMPOSITE = "composite"
+
+	// RENDER_FLICKER is an animated GIF that alternates between the left and
+	// the right image.
+	RENDER_FLICKER = "flicker"
+
+	// RENDER_ZOOM is a magnified RENDER_COMPOSITE of the area around the
+	// bounding box of the differing pixels.
+	RENDER_ZOOM = "zoom"
+
+	// FLICKER_DELAY is the time each frame of RENDER_FLICKER is shown in
+	// 100ths of a second.
+	FLICKER_DELAY = 50
+
+	// ZOOM_MARGIN is the number of pixels around the bounding box of the
+	// differing pixels that are included in RENDER_ZOOM.
+	ZOOM_MARGIN = 4
+
+	// ZOOM_MAX_SCALE is the maximum magnification of RENDER_ZOOM.
+	ZOOM_MAX_SCALE = 16
+
+	// ZOOM_TARGET_SIZE is the size in pixels the longer side of the cropped
+	// area is magnified to, subject to ZOOM_MAX_SCALE.
+	ZOOM_TARGET_SIZE = 256
+)
+
+// RENDER_MODES contains all render modes supported by Render.
+var RENDER_MODES = []string{RENDER_COMPOSITE, RENDER_FLICKER, RENDER_ZOOM}
+
+// RenderExt returns the file extension of the output of the given render
+// mode.
+func RenderExt(mode string) string {
+	if mode == RENDER_FLICKER {
+		return "gif"
+	}
+	return "png"
+}
+
+// Render writes a visualization of the difference between left and right
+// to w. The format depends on the mode, see RenderExt.
+func Render(mode string, left, right image.Image, w io.Writer) error {
+	switch mode {
+	case RENDER_COMPOSITE:
+		_, diffImg := Diff(left, right)
+		return encodePNG(w, composite(left, diffImg, right, diffImg.Bounds(), 1))
+	case RENDER_FLICKER:
+		return gif.EncodeAll(w, flicker(left, right))
+	case RENDER_ZOOM:
+		_, diffImg := Diff(left, right)
+		bbox := diffBounds(left, right, diffImg)
+		if bbox.Empty() {
+			bbox = diffImg.Bounds()
+		}
+		bbox = bbox.Inset(-ZOOM_MARGIN).Intersect(diffImg.Bounds())
+		scale := util.MaxInt(1, util.MinInt(ZOOM_MAX_SCALE, ZOOM_TARGET_SIZE/util.MaxInt(bbox.Dx(), bbox.Dy())))
+		return encodePNG(w, composite(left, diffImg, right, bbox, scale))
+	default:
+		return fmt.Errorf("Unknown render mode: %s", mode)
+	}
+}
+
+func encodePNG(w io.Writer, img image.Image) error {
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	return encoder.Encode(w, img)
+}
+
+// composite returns the area r of the given images next to each other,
+// magnified by the given integer scale. Parts of r that are outside of an
+// image are transparent.
+func composite(left, diffImg, right image.Image, r image.Rectangle, scale int) *image.NRGBA {
+	w, h := r.Dx()*scale, r.Dy()*scale
+	ret := image.NewNRGBA(image.Rect(0, 0, 3*w, h))
+	for i, img := range []image.Image{left, diffImg, right} {
+		crop := r.Intersect(img.Bounds())
+		offset := image.Pt(i*w, 0).Sub(r.Min.Mul(scale))
+		if scale == 1 {
+			draw.Draw(ret, crop.Add(offset), img, crop.Min, draw.Src)
+			continue
+		}
+		for y := crop.Min.Y; y < crop.Max.Y; y++ {
+			for x := crop.Min.X; x < crop.Max.X; x++ {
+				c := img.At(x, y)
+				dstX, dstY := x*scale+offset.X, y*scale+offset.Y
+				for dy := 0; dy < scale; dy++ {
+					for dx := 0; dx < scale; dx++ {
+						ret.Set(dstX+dx, dstY+dy, c)
+					}
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// diffBounds returns the bounding box of the differing pixels. Areas that
+// are only covered by one of the images are considered different.
+func diffBounds(left, right image.Image, diffImg *image.NRGBA) image.Rectangle {
+	bbox := image.ZR
+	overlap := left.Bounds().Intersect(right.Bounds())
+	for _, b := range []image.Rectangle{left.Bounds(), right.Bounds()} {
+		if overlap.Empty() {
+			bbox = bbox.Union(b)
+			continue
+		}
+		if b.Max.X > overlap.Max.X {
+			bbox = bbox.Union(image.Rect(overlap.Max.X, b.Min.Y, b.Max.X, b.Max.Y))
+		}
+		if b.Max.Y > overlap.Max.Y {
+			bbox = bbox.Union(image.Rect(b.Min.X, overlap.Max.Y, b.Max.X, b.Max.Y))
+		}
+	}
+
+	for y := overlap.Min.Y; y < overlap.Max.Y; y++ {
+		for x := overlap.Min.X; x < overlap.Max.X; x++ {
+			if diffImg.Pix[diffImg.PixOffset(x, y)+3] != 0 {
+				bbox = bbox.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return bbox
+}
+
+// flicker returns an animation that alternates between the two images. The
+// images are drawn on a white background. The palette contains the exact
+// colors of the images if there are at most 256 of them, so small
+// differences survive the conversion to GIF.
+func flicker(left, right image.Image) *gif.GIF {
+	bounds := left.Bounds().Union(right.Bounds())
+	frames := []*image.NRGBA{onWhite(left, bounds), onWhite(right, bounds)}
+
+	pal := exactPalette(frames, 256)
+	if pal == nil {
+		pal = palette.Plan9
+	}
+
+	ret := &gif.GIF{}
+	for _, frame := range frames {
+		paletted := image.NewPaletted(bounds, pal)
+		draw.Draw(paletted, bounds, frame, bounds.Min, draw.Src)
+		ret.Image = append(ret.Image, paletted)
+		ret.Delay = append(ret.Delay, FLICKER_DELAY)
+	}
+	return ret
+}
+
+// onWhite draws img with the given bounds on an opaque white background.
+func onWhite(img image.Image, bounds image.Rectangle) *image.NRGBA {
+	ret := image.NewNRGBA(bounds)
+	draw.Draw(ret, bounds, image.White, image.ZP, draw.Src)
+	draw.Draw(ret, img.Bounds(), img, img.Bounds().Min, draw.Over)
+	return ret
+}
+
+// exactPalette returns the colors used in the given opaque images or nil if
+// there are more than max different colors.
+func exactPalette(imgs []*image.NRGBA, max int) color.Palette {
+	found := map[color.NRGBA]bool{}
+	ret := color.Palette{}
+	for _, img := range imgs {
+		for i := 0; i < len(img.Pix); i += 4 {
+			c := color.NRGBA{R: img.Pix[i], G: img.Pix[i+1], B: img.Pix[i+2], A: img.Pix[i+3]}
+			if found[c] {
+				continue
+			}
+			if len(ret) == max {
+				return nil
+			}
+			found[c] = true
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,89 @@
+package diff
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestRenderComposite(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.Nil(t, Render(RENDER_COMPOSITE, imageFromString(t, OPAQUE1), imageFromString(t, OPAQUE3), buf))
+	img, err := png.Decode(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, 3, 2), img.Bounds())
+
+	// Left, diff and right image next to each other.
+	assert.Equal(t, color.NRGBA{0x80, 0x80, 0x80, 0xff}, color.NRGBAModel.Convert(img.At(0, 0)))
+	assert.NotEqual(t, color.NRGBA{}, color.NRGBAModel.Convert(img.At(1, 0)))
+	assert.Equal(t, color.NRGBA{}, color.NRGBAModel.Convert(img.At(1, 1)))
+	assert.Equal(t, color.NRGBA{0xff, 0x00, 0x00, 0xff}, color.NRGBAModel.Convert(img.At(2, 0)))
+}
+
+func TestRenderFlicker(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.Nil(t, Render(RENDER_FLICKER, imageFromString(t, OPAQUE1), imageFromString(t, OPAQUE2), buf))
+	anim, err := gif.DecodeAll(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(anim.Image))
+	assert.Equal(t, []int{FLICKER_DELAY, FLICKER_DELAY}, anim.Delay)
+
+	// The difference of one in a single channel survives the conversion.
+	r, g, b, _ := anim.Image[0].At(0, 0).RGBA()
+	assert.Equal(t, []uint32{0x80, 0x80, 0x80}, []uint32{r >> 8, g >> 8, b >> 8})
+	r, g, b, _ = anim.Image[1].At(0, 0).RGBA()
+	assert.Equal(t, []uint32{0x81, 0x80, 0x80}, []uint32{r >> 8, g >> 8, b >> 8})
+}
+
+func TestRenderZoom(t *testing.T) {
+	left := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	draw.Draw(left, left.Bounds(), image.White, image.ZP, draw.Src)
+	right := image.NewNRGBA(left.Bounds())
+	copy(right.Pix, left.Pix)
+	right.Set(15, 12, color.Black)
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, Render(RENDER_ZOOM, left, right, buf))
+	img, err := png.Decode(buf)
+	assert.Nil(t, err)
+
+	// The crop is the differing pixel plus the margin, clipped to the image,
+	// i.e. 9 by 9 pixels which are magnified 16 times.
+	size := 9 * ZOOM_MAX_SCALE
+	assert.Equal(t, image.Rect(0, 0, 3*size, size), img.Bounds())
+	black := color.NRGBA{0, 0, 0, 0xff}
+	x, y := ZOOM_MARGIN*ZOOM_MAX_SCALE, ZOOM_MARGIN*ZOOM_MAX_SCALE
+	assert.Equal(t, black, color.NRGBAModel.Convert(img.At(2*size+x, y)))
+	assert.Equal(t, black, color.NRGBAModel.Convert(img.At(2*size+x+ZOOM_MAX_SCALE-1, y+ZOOM_MAX_SCALE-1)))
+	assert.NotEqual(t, black, color.NRGBAModel.Convert(img.At(2*size+x-1, y)))
+	assert.NotEqual(t, black, color.NRGBAModel.Convert(img.At(x, y)))
+}
+
+func TestDiffBounds(t *testing.T) {
+	left := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	right := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	_, diffImg := Diff(left, right)
+	assert.True(t, diffBounds(left, right, diffImg).Empty())
+
+	right.Set(3, 4, color.Black)
+	right.Set(5, 2, color.Black)
+	_, diffImg = Diff(left, right)
+	assert.Equal(t, image.Rect(3, 2, 6, 5), diffBounds(left, right, diffImg))
+
+	// Areas that are only covered by one image differ.
+	wider := image.NewNRGBA(image.Rect(0, 0, 12, 10))
+	_, diffImg = Diff(left, wider)
+	assert.Equal(t, image.Rect(10, 0, 12, 10), diffBounds(left, wider, diffImg))
+}
+
+func TestRenderUnknownMode(t *testing.T) {
+	assert.NotNil(t, Render("unknown", imageFromString(t, OPAQUE1), imageFromString(t, OPAQUE1), &bytes.Buffer{}))
+	assert.Equal(t, "gif", RenderExt(RENDER_FLICKER))
+	assert.Equal(t, "png", RenderExt(RENDER_ZOOM))
+}
@@ -0,0 +1,182 @@
+// digestcluster groups the digests of a test that are similar to each other,
+// so they can be triaged in one action. It uses agglomerative clustering with
+// complete linkage, i.e. every pair of digests in a cluster is within the
+// threshold under the chosen metric, see diff.DiffMetrics.Distance.
+package digestcluster
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"go.skia.org/infra/go/timer"
+	"go.skia.org/infra/golden/go/diff"
+)
+
+const (
+	// MAX_DIGESTS is the maximum number of digests that can be clustered in
+	// one call. Clustering needs the diffs between all pairs of digests, i.e.
+	// up to 4950 diffs.
+	MAX_DIGESTS = 100
+)
+
+// DEFAULT_THRESHOLDS maps the metrics in diff.METRICS to their default
+// threshold, since each metric has its own scale. By default the digests in a
+// cluster differ in at most 1% of their pixels, have an SSIM of at least 0.99,
+// a mean Delta E of at most 1, a maximum Delta E of at most 2.3 (the default
+// diff.DeltaETolerance) or no pixels over the Delta E tolerance.
+var DEFAULT_THRESHOLDS = map[string]float64{
+	diff.METRIC_PIXEL_DIFF_PERCENT: 1.0,
+	diff.METRIC_SSIM:               0.01,
+	diff.METRIC_MEAN_DELTA_E:       1.0,
+	diff.METRIC_MAX_DELTA_E:        2.3,
+	diff.METRIC_OVER_TOLERANCE:     0,
+}
+
+// DefaultThreshold returns the default threshold of the given metric. Unknown
+// metrics default to diff.METRIC_PIXEL_DIFF_PERCENT, like
+// diff.DiffMetrics.Distance.
+func DefaultThreshold(metric string) float64 {
+	if threshold, ok := DEFAULT_THRESHOLDS[metric]; ok {
+		return threshold
+	}
+	return DEFAULT_THRESHOLDS[diff.METRIC_PIXEL_DIFF_PERCENT]
+}
+
+// Cluster is a group of digests of one test that are within the threshold of
+// each other.
+type Cluster struct {
+	// Representative is the digest with the smallest total distance to the
+	// other digests of the cluster.
+	Representative string `json:"representative"`
+
+	// Digests are all digests in the cluster, including the representative,
+	// sorted.
+	Digests []string `json:"digests"`
+
+	// MaxDistance is the largest distance between two digests of the cluster.
+	MaxDistance float64 `json:"maxDistance"`
+}
+
+// ClusterDigests clusters the given digests by the distance of their diffs
+// under the given metric. Digests with different dimensions or whose diffs
+// are not available are never in the same cluster. The clusters are sorted
+// by descending size.
+func ClusterDigests(digests []string, diffStore diff.DiffStore, metric string, threshold float64) ([]*Cluster, error) {
+	if len(digests) > MAX_DIGESTS {
+		return nil, fmt.Errorf("Too many digests to cluster: %d > %d", len(digests), MAX_DIGESTS)
+	}
+	defer timer.New("clustering digests").Stop()
+
+	n := len(digests)
+	dist := make([][]float64, n)
+	for i := range dist {
+		dist[i] = make([]float64, n)
+	}
+	for i := 0; i < n-1; i++ {
+		dms, err := diffStore.Get(digests[i], digests[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		for j := i + 1; j < n; j++ {
+			d := math.Inf(1)
+			if dm, ok := dms[digests[j]]; ok && !dm.DimDiffer {
+				d = dm.Distance(metric)
+			}
+			dist[i][j], dist[j][i] = d, d
+		}
+	}
+
+	ret := []*Cluster{}
+	for _, members := range cluster(dist, threshold) {
+		ret = append(ret, newCluster(digests, members, dist))
+	}
+	sort.Sort(clusterSlice(ret))
+	return ret, nil
+}
+
+// cluster returns the indices of the members of each cluster, given the
+// symmetric matrix of distances between all items.
+func cluster(dist [][]float64, threshold float64) [][]int {
+	n := len(dist)
+	members := make([][]int, n)
+	// linkage is the distance between clusters, i.e. the maximum distance
+	// between their members. It is kept up to date as clusters are merged.
+	linkage := make([][]float64, n)
+	for i := range members {
+		members[i] = []int{i}
+		linkage[i] = make([]float64, n)
+		copy(linkage[i], dist[i])
+	}
+
+	for {
+		// Find the closest pair of clusters.
+		bestI, bestJ, best := -1, -1, math.Inf(1)
+		for i := 0; i < n; i++ {
+			if members[i] == nil {
+				continue
+			}
+			for j := i + 1; j < n; j++ {
+				if members[j] != nil && linkage[i][j] < best {
+					bestI, bestJ, best = i, j, linkage[i][j]
+				}
+			}
+		}
+		if bestI == -1 || best > threshold {
+			break
+		}
+
+		// Merge cluster bestJ into bestI.
+		members[bestI] = append(members[bestI], members[bestJ]...)
+		members[bestJ] = nil
+		for k := 0; k < n; k++ {
+			d := math.Max(linkage[bestI][k], linkage[bestJ][k])
+			linkage[bestI][k], linkage[k][bestI] = d, d
+		}
+	}
+
+	ret := [][]int{}
+	for _, m := range members {
+		if m != nil {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
+
+// newCluster returns the Cluster with the given members.
+func newCluster(digests []string, members []int, dist [][]float64) *Cluster {
+	ret := &Cluster{
+		Digests: make([]string, 0, len(members)),
+	}
+	bestSum := math.Inf(1)
+	for _, i := range members {
+		ret.Digests = append(ret.Digests, digests[i])
+		sum := 0.0
+		for _, j := range members {
+			if i != j {
+				sum += dist[i][j]
+				ret.MaxDistance = math.Max(ret.MaxDistance, dist[i][j])
+			}
+		}
+		// Break ties by digest so the result is deterministic.
+		if sum < bestSum || (sum == bestSum && digests[i] < ret.Representative) {
+			bestSum = sum
+			ret.Representative = digests[i]
+		}
+	}
+	sort.Strings(ret.Digests)
+	return ret
+}
+
+// clusterSlice sorts clusters by descending size and then by representative.
+type clusterSlice []*Cluster
+
+func (p clusterSlice) Len() int { return len(p) }
+func (p clusterSlice) Less(i, j int) bool {
+	if len(p[i].Digests) == len(p[j].Digests) {
+		return p[i].Representative < p[j].Representative
+	}
+	return len(p[i].Digests) > len(p[j].Digests)
+}
+func (p clusterSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
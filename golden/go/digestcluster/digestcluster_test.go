@@ -0,0 +1,75 @@
+package digestcluster
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/golden/go/diff"
+)
+
+// mockDiffStore returns the pixel diff percentages in diffs, keyed by the
+// two digests in either order.
+type mockDiffStore struct {
+	diff.DiffStore
+	diffs map[[2]string]float32
+}
+
+func (m mockDiffStore) Get(dMain string, dRest []string) (map[string]*diff.DiffMetrics, error) {
+	ret := map[string]*diff.DiffMetrics{}
+	for _, d := range dRest {
+		percent, ok := m.diffs[[2]string{dMain, d}]
+		if !ok {
+			percent, ok = m.diffs[[2]string{d, dMain}]
+		}
+		if ok {
+			ret[d] = &diff.DiffMetrics{PixelDiffPercent: percent}
+		}
+	}
+	return ret, nil
+}
+
+func TestClusterDigests(t *testing.T) {
+	store := mockDiffStore{diffs: map[[2]string]float32{
+		{"a", "b"}: 0.1,
+		{"a", "c"}: 0.2,
+		{"b", "c"}: 0.15,
+		{"a", "d"}: 5,
+		{"b", "d"}: 5,
+		{"c", "d"}: 0.3, // d is close to c, but not to a and b.
+		{"a", "e"}: 9,
+		{"b", "e"}: 9,
+		{"c", "e"}: 9,
+		{"d", "e"}: 0.4,
+		// f is unavailable.
+	}}
+
+	clusters, err := ClusterDigests([]string{"a", "b", "c", "d", "e", "f"}, store, diff.METRIC_PIXEL_DIFF_PERCENT, 0.5)
+	assert.Nil(t, err)
+	assert.Equal(t, []*Cluster{
+		&Cluster{Representative: "b", Digests: []string{"a", "b", "c"}, MaxDistance: float64(float32(0.2))},
+		&Cluster{Representative: "d", Digests: []string{"d", "e"}, MaxDistance: float64(float32(0.4))},
+		&Cluster{Representative: "f", Digests: []string{"f"}},
+	}, clusters)
+
+	// A threshold of 0 only groups identical images.
+	clusters, err = ClusterDigests([]string{"a", "b", "c"}, store, diff.METRIC_PIXEL_DIFF_PERCENT, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(clusters))
+
+	// Nothing to cluster.
+	clusters, err = ClusterDigests([]string{}, store, diff.METRIC_PIXEL_DIFF_PERCENT, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(clusters))
+
+	_, err = ClusterDigests(make([]string, MAX_DIGESTS+1), store, diff.METRIC_PIXEL_DIFF_PERCENT, 1)
+	assert.NotNil(t, err)
+}
+
+func TestDefaultThreshold(t *testing.T) {
+	for _, metric := range diff.METRICS {
+		_, ok := DEFAULT_THRESHOLDS[metric]
+		assert.True(t, ok, metric)
+	}
+	assert.Equal(t, 0.01, DefaultThreshold(diff.METRIC_SSIM))
+	assert.Equal(t, 1.0, DefaultThreshold("unknown"))
+}
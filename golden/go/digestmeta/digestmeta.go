@@ -0,0 +1,334 @@
+package digestmeta
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/skia-dev/glog"
+	"go.skia.org/infra/go/fileutil"
+	"go.skia.org/infra/go/util"
+)
+
+const (
+	// Keys in the options of a DM result that are stored in dedicated fields
+	// of DigestMetadata.
+	EXT_OPTION         = "ext"
+	SOURCE_TYPE_OPTION = "source_type"
+
+	// DEFAULT_EXT is the extension of digests that did not report one.
+	DEFAULT_EXT = "png"
+
+	// Extension of the files written by FileMetadataStore.
+	METADATA_EXTENSION = "json"
+
+	// Name of the directory in which FileMetadataStore writes temporary files.
+	TEMP_DIR_NAME = "__temp"
+
+	// Name of the file FileMetadataStore locks while it updates metadata.
+	LOCK_FILE_NAME = "__lock"
+)
+
+// DigestMetadata contains the information that was reported alongside a
+// digest when it was ingested.
+type DigestMetadata struct {
+	// TestName and Digest identify the result.
+	TestName string `json:"testName"`
+	Digest   string `json:"digest"`
+
+	// Ext is the file extension of the output, e.g. "png" or "pdf".
+	Ext string `json:"ext"`
+
+	// SourceType is the corpus the result belongs to.
+	SourceType string `json:"sourceType"`
+
+	// Width and Height of the image. They are 0 if the dimensions are unknown.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+
+	// Options contains all options reported with the result, including the
+	// ones that are also stored in the fields above.
+	Options map[string]string `json:"options"`
+}
+
+// merge updates m with the values set in other. Zero values in other leave
+// the corresponding values in m untouched. Returns true if m was changed.
+func (m *DigestMetadata) merge(other *DigestMetadata) bool {
+	changed := false
+	if other.Ext != "" && other.Ext != m.Ext {
+		m.Ext = other.Ext
+		changed = true
+	}
+	if other.SourceType != "" && other.SourceType != m.SourceType {
+		m.SourceType = other.SourceType
+		changed = true
+	}
+	if other.Width > 0 && other.Width != m.Width {
+		m.Width = other.Width
+		changed = true
+	}
+	if other.Height > 0 && other.Height != m.Height {
+		m.Height = other.Height
+		changed = true
+	}
+	if len(other.Options) > 0 && !util.MapsEqual(other.Options, m.Options) {
+		m.Options = util.CopyStringMap(other.Options)
+		changed = true
+	}
+	return changed
+}
+
+// copy returns a deep copy of m.
+func (m *DigestMetadata) copy() *DigestMetadata {
+	ret := *m
+	ret.Options = util.CopyStringMap(m.Options)
+	return &ret
+}
+
+// New creates a DigestMetadata instance from the key and options of a DM
+// result. Ext defaults to DEFAULT_EXT if it was not reported.
+func New(testName, digest string, key, options map[string]string) *DigestMetadata {
+	ret := &DigestMetadata{
+		TestName:   testName,
+		Digest:     digest,
+		Ext:        options[EXT_OPTION],
+		SourceType: key[SOURCE_TYPE_OPTION],
+		Options:    util.CopyStringMap(options),
+	}
+	if ret.Ext == "" {
+		ret.Ext = DEFAULT_EXT
+	}
+	if st, ok := options[SOURCE_TYPE_OPTION]; ok {
+		ret.SourceType = st
+	}
+	return ret
+}
+
+// MetadataStore stores DigestMetadata keyed by test name and digest.
+type MetadataStore interface {
+	// Get returns the metadata of the given test and digest or nil if none
+	// has been recorded.
+	Get(testName, digest string) (*DigestMetadata, error)
+
+	// Ext returns the extension of the given digest independent of the test
+	// it belongs to. It returns "" if the digest is unknown.
+	Ext(digest string) (string, error)
+
+	// Update merges the given metadata into the store. Fields that are not set
+	// in the argument keep their current value, e.g. the image dimensions
+	// that are added after ingestion.
+	Update(metadata []*DigestMetadata) error
+}
+
+// MemMetadataStore is an in-memory implementation of MetadataStore.
+type MemMetadataStore struct {
+	// digests maps digest -> testName -> metadata.
+	digests map[string]map[string]*DigestMetadata
+	mutex   sync.RWMutex
+}
+
+// NewMemMetadataStore returns an empty MemMetadataStore.
+func NewMemMetadataStore() MetadataStore {
+	return &MemMetadataStore{
+		digests: map[string]map[string]*DigestMetadata{},
+	}
+}
+
+// See MetadataStore interface.
+func (m *MemMetadataStore) Get(testName, digest string) (*DigestMetadata, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if found, ok := m.digests[digest][testName]; ok {
+		return found.copy(), nil
+	}
+	return nil, nil
+}
+
+// See MetadataStore interface.
+func (m *MemMetadataStore) Ext(digest string) (string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return extOf(m.digests[digest]), nil
+}
+
+// See MetadataStore interface.
+func (m *MemMetadataStore) Update(metadata []*DigestMetadata) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, md := range metadata {
+		if _, ok := m.digests[md.Digest]; !ok {
+			m.digests[md.Digest] = map[string]*DigestMetadata{}
+		}
+		mergeInto(m.digests[md.Digest], md)
+	}
+	return nil
+}
+
+// FileMetadataStore implements MetadataStore by writing one JSON file per
+// digest into a directory. Every file contains the metadata of all tests
+// that produced the digest. Files are written atomically, so they can be
+// read without locking. Updates hold an exclusive lock on LOCK_FILE_NAME, so
+// several processes, e.g. the ingester and Gold, can update the same
+// directory without losing each other's changes.
+type FileMetadataStore struct {
+	dir     string
+	tempDir string
+
+	// lockFile is locked with flock(2) during read-modify-write cycles to
+	// serialize them across processes. Locks are held by the open file, so
+	// mutex serializes them within this process.
+	lockFile *os.File
+	mutex    sync.Mutex
+}
+
+// NewFileMetadataStore returns a FileMetadataStore that stores its files in
+// dir. The directory is created if it does not exist.
+func NewFileMetadataStore(dir string) (MetadataStore, error) {
+	tempDir := filepath.Join(dir, TEMP_DIR_NAME)
+	if _, err := fileutil.EnsureDirExists(tempDir); err != nil {
+		return nil, fmt.Errorf("Unable to create metadata directory %s: %s", dir, err)
+	}
+	lockFile, err := os.OpenFile(filepath.Join(dir, LOCK_FILE_NAME), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open lock file in %s: %s", dir, err)
+	}
+	return &FileMetadataStore{
+		dir:      dir,
+		tempDir:  tempDir,
+		lockFile: lockFile,
+	}, nil
+}
+
+// See MetadataStore interface.
+func (f *FileMetadataStore) Get(testName, digest string) (*DigestMetadata, error) {
+	entries, err := f.read(digest)
+	if err != nil {
+		return nil, err
+	}
+	return entries[testName], nil
+}
+
+// See MetadataStore interface.
+func (f *FileMetadataStore) Ext(digest string) (string, error) {
+	entries, err := f.read(digest)
+	if err != nil {
+		return "", err
+	}
+	return extOf(entries), nil
+}
+
+// See MetadataStore interface.
+func (f *FileMetadataStore) Update(metadata []*DigestMetadata) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := syscall.Flock(int(f.lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("Unable to lock metadata directory %s: %s", f.dir, err)
+	}
+	defer func() {
+		if err := syscall.Flock(int(f.lockFile.Fd()), syscall.LOCK_UN); err != nil {
+			glog.Errorf("Unable to unlock metadata directory %s: %s", f.dir, err)
+		}
+	}()
+
+	byDigest := map[string][]*DigestMetadata{}
+	for _, md := range metadata {
+		byDigest[md.Digest] = append(byDigest[md.Digest], md)
+	}
+
+	for digest, mds := range byDigest {
+		entries, err := f.read(digest)
+		if err != nil {
+			return err
+		}
+		if entries == nil {
+			entries = map[string]*DigestMetadata{}
+		}
+		changed := false
+		for _, md := range mds {
+			changed = mergeInto(entries, md) || changed
+		}
+		if changed {
+			if err := f.write(digest, entries); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// path returns the path of the file that stores the metadata of digest.
+func (f *FileMetadataStore) path(digest string) string {
+	return filepath.Join(f.dir, fmt.Sprintf("%s.%s", digest, METADATA_EXTENSION))
+}
+
+// read returns the metadata of the given digest keyed by test name. It
+// returns nil if no metadata has been recorded for the digest.
+func (f *FileMetadataStore) read(digest string) (map[string]*DigestMetadata, error) {
+	b, err := ioutil.ReadFile(f.path(digest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Unable to read metadata for %s: %s", digest, err)
+	}
+	ret := map[string]*DigestMetadata{}
+	if err := json.Unmarshal(b, &ret); err != nil {
+		return nil, fmt.Errorf("Unable to decode metadata for %s: %s", digest, err)
+	}
+	return ret, nil
+}
+
+// write atomically replaces the metadata file of the given digest.
+func (f *FileMetadataStore) write(digest string, entries map[string]*DigestMetadata) error {
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to encode metadata for %s: %s", digest, err)
+	}
+	tempOut, err := ioutil.TempFile(f.tempDir, fmt.Sprintf("tempfile-%s", digest))
+	if err != nil {
+		return fmt.Errorf("Unable to create temp file: %s", err)
+	}
+	if _, err := tempOut.Write(b); err != nil {
+		util.Close(tempOut)
+		return fmt.Errorf("Unable to write temp file: %s", err)
+	}
+	if err := tempOut.Close(); err != nil {
+		return fmt.Errorf("Error closing temp file: %s", err)
+	}
+	if err := os.Rename(tempOut.Name(), f.path(digest)); err != nil {
+		return fmt.Errorf("Unable to move file: %s", err)
+	}
+	return nil
+}
+
+// mergeInto merges md into the entries of a single digest and returns true
+// if the entries changed.
+func mergeInto(entries map[string]*DigestMetadata, md *DigestMetadata) bool {
+	if found, ok := entries[md.TestName]; ok {
+		return found.merge(md)
+	}
+	entries[md.TestName] = md.copy()
+	return true
+}
+
+// extOf returns the extension of a digest given the metadata of all tests
+// that produced it. A digest identifies the content of a file, so all
+// entries should agree. If they do not the result is still deterministic.
+func extOf(entries map[string]*DigestMetadata) string {
+	if len(entries) == 0 {
+		return ""
+	}
+	testNames := make([]string, 0, len(entries))
+	for testName := range entries {
+		testNames = append(testNames, testName)
+	}
+	sort.Strings(testNames)
+	return entries[testNames[0]].Ext
+}
@@ -0,0 +1,133 @@
+package digestmeta
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/go/util"
+)
+
+func TestNew(t *testing.T) {
+	md := New("test1", "aaa", map[string]string{"source_type": "gm", "config": "8888"}, map[string]string{})
+	assert.Equal(t, DEFAULT_EXT, md.Ext)
+	assert.Equal(t, "gm", md.SourceType)
+
+	md = New("test1", "aaa", map[string]string{"source_type": "gm"}, map[string]string{"ext": "pdf", "source_type": "skp"})
+	assert.Equal(t, "pdf", md.Ext)
+	assert.Equal(t, "skp", md.SourceType)
+	assert.Equal(t, map[string]string{"ext": "pdf", "source_type": "skp"}, md.Options)
+}
+
+func TestMemMetadataStore(t *testing.T) {
+	testMetadataStore(t, NewMemMetadataStore())
+}
+
+func TestFileMetadataStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digestmeta")
+	assert.Nil(t, err)
+	defer util.RemoveAll(dir)
+
+	store, err := NewFileMetadataStore(dir)
+	assert.Nil(t, err)
+	testMetadataStore(t, store)
+
+	// A second store on the same directory sees the same data.
+	store2, err := NewFileMetadataStore(dir)
+	assert.Nil(t, err)
+	found, err := store2.Get("test2", "bbb")
+	assert.Nil(t, err)
+	assert.Equal(t, "pdf", found.Ext)
+
+	// Unchanged metadata does not rewrite the files.
+	fi, err := os.Stat(dir + "/bbb.json")
+	assert.Nil(t, err)
+	assert.Nil(t, store.Update([]*DigestMetadata{New("test2", "bbb", nil, map[string]string{"ext": "pdf"})}))
+	fi2, err := os.Stat(dir + "/bbb.json")
+	assert.Nil(t, err)
+	assert.Equal(t, fi.ModTime(), fi2.ModTime())
+}
+
+func TestFileMetadataStoreConcurrentUpdates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digestmeta")
+	assert.Nil(t, err)
+	defer util.RemoveAll(dir)
+
+	// Two stores on the same directory, like the ingester and Gold, update
+	// different tests of the same digest at the same time.
+	stores := make([]MetadataStore, 2)
+	for i := range stores {
+		stores[i], err = NewFileMetadataStore(dir)
+		assert.Nil(t, err)
+	}
+	const N = 200
+	var wg sync.WaitGroup
+	for i, store := range stores {
+		wg.Add(1)
+		go func(i int, store MetadataStore) {
+			defer wg.Done()
+			for j := 0; j < N; j++ {
+				assert.Nil(t, store.Update([]*DigestMetadata{{TestName: fmt.Sprintf("test-%d-%d", i, j), Digest: "aaa", Width: j + 1}}))
+			}
+		}(i, store)
+	}
+	wg.Wait()
+
+	for i := range stores {
+		for j := 0; j < N; j++ {
+			found, err := stores[0].Get(fmt.Sprintf("test-%d-%d", i, j), "aaa")
+			assert.Nil(t, err)
+			assert.NotNil(t, found)
+			assert.Equal(t, j+1, found.Width)
+		}
+	}
+}
+
+func testMetadataStore(t *testing.T, store MetadataStore) {
+	found, err := store.Get("test1", "aaa")
+	assert.Nil(t, err)
+	assert.Nil(t, found)
+	ext, err := store.Ext("aaa")
+	assert.Nil(t, err)
+	assert.Equal(t, "", ext)
+
+	assert.Nil(t, store.Update([]*DigestMetadata{
+		New("test1", "aaa", map[string]string{"source_type": "gm"}, map[string]string{"ext": "png"}),
+		New("test2", "bbb", map[string]string{"source_type": "gm"}, map[string]string{"ext": "pdf"}),
+		New("test3", "bbb", map[string]string{"source_type": "gm"}, map[string]string{"ext": "pdf"}),
+	}))
+
+	found, err = store.Get("test1", "aaa")
+	assert.Nil(t, err)
+	assert.Equal(t, "png", found.Ext)
+	assert.Equal(t, "gm", found.SourceType)
+	ext, err = store.Ext("bbb")
+	assert.Nil(t, err)
+	assert.Equal(t, "pdf", ext)
+
+	// Modifying the returned value does not change the store.
+	found.Ext = "jpg"
+	found.Options["ext"] = "jpg"
+	found, err = store.Get("test1", "aaa")
+	assert.Nil(t, err)
+	assert.Equal(t, "png", found.Ext)
+	assert.Equal(t, "png", found.Options["ext"])
+
+	// Dimensions are merged into the existing metadata.
+	assert.Nil(t, store.Update([]*DigestMetadata{{TestName: "test1", Digest: "aaa", Width: 100, Height: 200}}))
+	found, err = store.Get("test1", "aaa")
+	assert.Nil(t, err)
+	assert.Equal(t, "png", found.Ext)
+	assert.Equal(t, 100, found.Width)
+	assert.Equal(t, 200, found.Height)
+
+	// Ingesting the same result again keeps the dimensions.
+	assert.Nil(t, store.Update([]*DigestMetadata{New("test1", "aaa", map[string]string{"source_type": "gm"}, map[string]string{"ext": "png", "gamma": "srgb"})}))
+	found, err = store.Get("test1", "aaa")
+	assert.Nil(t, err)
+	assert.Equal(t, 100, found.Width)
+	assert.Equal(t, "srgb", found.Options["gamma"])
+}
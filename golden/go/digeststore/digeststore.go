@@ -1,5 +1,23 @@
+// digeststore keeps track of when digests have been seen and of the
+// problems and issues associated with them.
 package digeststore
 
+import (
+	"sort"
+	"time"
+
+	"github.com/skia-dev/glog"
+	"go.skia.org/infra/golden/go/diff"
+	"go.skia.org/infra/golden/go/types"
+	ptypes "go.skia.org/infra/perf/go/types"
+)
+
+const (
+	// EXCEPTION_UNAVAILABLE is recorded as the Exception of digests whose
+	// image could not be retrieved or decoded by the DiffStore.
+	EXCEPTION_UNAVAILABLE = "Unable to retrieve or decode the image."
+)
+
 // DigestInfo aggregates all information we have about an individual digest.
 type DigestInfo struct {
 	// TestName for this digest.
@@ -22,10 +40,108 @@ type DigestInfo struct {
 	IssueIDs []int
 }
 
+// Merge adds the information in other to d. First and Last are widened to
+// cover both and the IssueIDs are combined. The Exception of other replaces
+// the one in d if it is not empty or if other was seen in a tile, i.e. Last
+// is set, since FromTile reports the current state of the image. Other
+// updates, e.g. of the IssueIDs, leave the Exception untouched.
+func (d *DigestInfo) Merge(other *DigestInfo) {
+	if d.First == 0 || (other.First != 0 && other.First < d.First) {
+		d.First = other.First
+	}
+	if other.Last > d.Last {
+		d.Last = other.Last
+	}
+	if other.Exception != "" || other.Last != 0 {
+		d.Exception = other.Exception
+	}
+
+	ids := map[int]bool{}
+	for _, id := range d.IssueIDs {
+		ids[id] = true
+	}
+	for _, id := range other.IssueIDs {
+		if !ids[id] {
+			ids[id] = true
+			d.IssueIDs = append(d.IssueIDs, id)
+		}
+	}
+	sort.Ints(d.IssueIDs)
+}
+
 type DigestStore interface {
 	// GetDigestInfo returns the information about the given testName-digest
-	// pair.
+	// pair. If the digest has never been seen, First and Last are 0.
 	GetDigestInfo(testName, digest string) *DigestInfo
+
+	// UpdateDigestInfo merges the given DigestInfos into the store,
+	// see DigestInfo.Merge.
+	UpdateDigestInfo(digestInfos []*DigestInfo) error
+}
+
+// FromTile returns a DigestInfo for every digest in the given tile with the
+// time range of the commits it appears in. Digests in unavailable, see
+// diff.DiffStore.UnavailableDigests, are marked with EXCEPTION_UNAVAILABLE.
+func FromTile(tile *ptypes.Tile, unavailable map[string]bool) []*DigestInfo {
+	found := map[string]map[string]*DigestInfo{}
+	ret := []*DigestInfo{}
+	for _, trace := range tile.Traces {
+		gTrace := trace.(*ptypes.GoldenTrace)
+		testName := gTrace.Params()[types.PRIMARY_KEY_FIELD]
+		if _, ok := found[testName]; !ok {
+			found[testName] = map[string]*DigestInfo{}
+		}
+		for idx, digest := range gTrace.Values {
+			if digest == ptypes.MISSING_DIGEST || idx >= len(tile.Commits) || tile.Commits[idx].CommitTime == 0 {
+				continue
+			}
+			ts := tile.Commits[idx].CommitTime
+			info, ok := found[testName][digest]
+			if !ok {
+				info = &DigestInfo{
+					TestName: testName,
+					Digest:   digest,
+					First:    ts,
+					Last:     ts,
+				}
+				if unavailable[digest] {
+					info.Exception = EXCEPTION_UNAVAILABLE
+				}
+				found[testName][digest] = info
+				ret = append(ret, info)
+				continue
+			}
+			if ts < info.First {
+				info.First = ts
+			}
+			if ts > info.Last {
+				info.Last = ts
+			}
+		}
+	}
+	return ret
 }
 
-// TODO(stephana): Implement a caching digest store.
+// Update updates the store with the digests of the given tile. diffStore
+// provides the digests whose images are unavailable.
+func Update(store DigestStore, tile *ptypes.Tile, diffStore diff.DiffStore) error {
+	start := time.Now()
+	infos := FromTile(tile, diffStore.UnavailableDigests())
+	if err := store.UpdateDigestInfo(infos); err != nil {
+		return err
+	}
+	glog.Infof("Updated %d digests in the digest store in %s.", len(infos), time.Now().Sub(start))
+	return nil
+}
+
+// StartUpdater calls Update for every tile that is sent on tileStream, see
+// storage.GetTileStreamNow.
+func StartUpdater(store DigestStore, tileStream <-chan *ptypes.Tile, diffStore diff.DiffStore) {
+	go func() {
+		for tile := range tileStream {
+			if err := Update(store, tile, diffStore); err != nil {
+				glog.Errorf("Error updating the digest store: %s", err)
+			}
+		}
+	}()
+}
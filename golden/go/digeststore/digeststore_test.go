@@ -0,0 +1,89 @@
+package digeststore
+
+import (
+	"io/ioutil"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/go/util"
+	ptypes "go.skia.org/infra/perf/go/types"
+)
+
+func TestFromTile(t *testing.T) {
+	tile := ptypes.NewTile()
+	tile.Commits[0].CommitTime = 10
+	tile.Commits[1].CommitTime = 20
+	tile.Commits[2].CommitTime = 30
+
+	tr := ptypes.NewGoldenTrace()
+	tr.Params_["name"] = "foo"
+	tr.Values[0] = "aaa"
+	tr.Values[1] = "bbb"
+	tr.Values[2] = "aaa"
+	tile.Traces["t1"] = tr
+
+	tr = ptypes.NewGoldenTrace()
+	tr.Params_["name"] = "bar"
+	tr.Values[1] = "aaa"
+	tr.Values[5] = "ccc"
+	tile.Traces["t2"] = tr
+
+	infos := map[string]*DigestInfo{}
+	for _, info := range FromTile(tile, map[string]bool{"bbb": true}) {
+		infos[info.TestName+":"+info.Digest] = info
+	}
+	assert.Equal(t, 3, len(infos))
+	assert.Equal(t, &DigestInfo{TestName: "foo", Digest: "aaa", First: 10, Last: 30}, infos["foo:aaa"])
+	assert.Equal(t, &DigestInfo{TestName: "foo", Digest: "bbb", First: 20, Last: 20, Exception: EXCEPTION_UNAVAILABLE}, infos["foo:bbb"])
+	assert.Equal(t, &DigestInfo{TestName: "bar", Digest: "aaa", First: 20, Last: 20}, infos["bar:aaa"])
+}
+
+func TestLevelDBDigestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digeststore")
+	assert.Nil(t, err)
+	defer util.RemoveAll(dir)
+
+	store, err := NewLevelDBDigestStore(dir)
+	assert.Nil(t, err)
+
+	// Unknown digests have no time range.
+	assert.Equal(t, &DigestInfo{TestName: "foo", Digest: "aaa"}, store.GetDigestInfo("foo", "aaa"))
+
+	assert.Nil(t, store.UpdateDigestInfo([]*DigestInfo{
+		&DigestInfo{TestName: "foo", Digest: "aaa", First: 20, Last: 30, Exception: "broken"},
+		&DigestInfo{TestName: "foo", Digest: "bbb", First: 10, Last: 10},
+	}))
+	assert.Nil(t, store.UpdateDigestInfo([]*DigestInfo{
+		&DigestInfo{TestName: "foo", Digest: "aaa", First: 10, Last: 25},
+		&DigestInfo{TestName: "foo", Digest: "bbb", IssueIDs: []int{5, 3}},
+	}))
+	assert.Nil(t, store.UpdateDigestInfo([]*DigestInfo{
+		&DigestInfo{TestName: "foo", Digest: "bbb", Last: 40, IssueIDs: []int{3, 7}},
+	}))
+
+	// The second update saw aaa without a problem, which cleared the
+	// exception. Linking issues keeps it.
+	assert.Equal(t, "", store.GetDigestInfo("foo", "aaa").Exception)
+	assert.Nil(t, store.UpdateDigestInfo([]*DigestInfo{
+		&DigestInfo{TestName: "foo", Digest: "aaa", First: 30, Last: 30, Exception: "broken"},
+	}))
+	assert.Nil(t, store.UpdateDigestInfo([]*DigestInfo{
+		&DigestInfo{TestName: "foo", Digest: "aaa", IssueIDs: []int{1}},
+	}))
+
+	assert.Equal(t, &DigestInfo{TestName: "foo", Digest: "aaa", First: 10, Last: 30, Exception: "broken", IssueIDs: []int{1}}, store.GetDigestInfo("foo", "aaa"))
+	assert.Equal(t, &DigestInfo{TestName: "foo", Digest: "bbb", First: 10, Last: 40, IssueIDs: []int{3, 5, 7}}, store.GetDigestInfo("foo", "bbb"))
+
+	// Seeing the digest in a tile without a problem clears the exception.
+	assert.Nil(t, store.UpdateDigestInfo([]*DigestInfo{
+		&DigestInfo{TestName: "foo", Digest: "aaa", First: 30, Last: 35},
+	}))
+	assert.Equal(t, &DigestInfo{TestName: "foo", Digest: "aaa", First: 10, Last: 35, IssueIDs: []int{1}}, store.GetDigestInfo("foo", "aaa"))
+
+	// The data survive reopening the store.
+	assert.Nil(t, store.(*LevelDBDigestStore).Close())
+	store, err = NewLevelDBDigestStore(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), store.GetDigestInfo("foo", "bbb").First)
+	assert.Nil(t, store.(*LevelDBDigestStore).Close())
+}
@@ -0,0 +1,93 @@
+package digeststore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/skia-dev/glog"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/errors"
+)
+
+// LevelDBDigestStore implements the DigestStore interface on top of a
+// leveldb. Every DigestInfo is stored as JSON under the key
+// "<testName>:<digest>".
+type LevelDBDigestStore struct {
+	db *leveldb.DB
+
+	// mutex serializes updates, since they read and write the same keys.
+	mutex sync.Mutex
+}
+
+// NewLevelDBDigestStore returns a DigestStore that keeps its data in a
+// leveldb in the given directory. The directory is created if necessary.
+func NewLevelDBDigestStore(dir string) (DigestStore, error) {
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil && errors.IsCorrupted(err) {
+		db, err = leveldb.RecoverFile(dir, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open digest store in %s: %s", dir, err)
+	}
+	return &LevelDBDigestStore{db: db}, nil
+}
+
+// GetDigestInfo, see DigestStore interface.
+func (l *LevelDBDigestStore) GetDigestInfo(testName, digest string) *DigestInfo {
+	ret, err := l.get(testName, digest)
+	if err != nil {
+		glog.Errorf("Unable to read digest info for %s/%s: %s", testName, digest, err)
+		return &DigestInfo{TestName: testName, Digest: digest}
+	}
+	return ret
+}
+
+// UpdateDigestInfo, see DigestStore interface.
+func (l *LevelDBDigestStore) UpdateDigestInfo(digestInfos []*DigestInfo) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	batch := &leveldb.Batch{}
+	for _, info := range digestInfos {
+		current, err := l.get(info.TestName, info.Digest)
+		if err != nil {
+			return err
+		}
+		current.Merge(info)
+		b, err := json.Marshal(current)
+		if err != nil {
+			return fmt.Errorf("Unable to encode digest info: %s", err)
+		}
+		batch.Put(toKey(info.TestName, info.Digest), b)
+	}
+	if err := l.db.Write(batch, nil); err != nil {
+		return fmt.Errorf("Unable to write digest infos: %s", err)
+	}
+	return nil
+}
+
+// Close closes the underlying leveldb.
+func (l *LevelDBDigestStore) Close() error {
+	return l.db.Close()
+}
+
+// get returns the stored DigestInfo or an empty one if the digest is unknown.
+func (l *LevelDBDigestStore) get(testName, digest string) (*DigestInfo, error) {
+	ret := &DigestInfo{TestName: testName, Digest: digest}
+	b, err := l.db.Get(toKey(testName, digest), nil)
+	if err == leveldb.ErrNotFound {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, ret); err != nil {
+		return nil, fmt.Errorf("Unable to decode digest info: %s", err)
+	}
+	return ret, nil
+}
+
+func toKey(testName, digest string) []byte {
+	return []byte(testName + ":" + digest)
+}
@@ -0,0 +1,140 @@
+package expstorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"go.skia.org/infra/golden/go/types"
+)
+
+const (
+	// BASELINE_VERSION is the version of the baseline format written by
+	// WriteBaseline. ReadBaseline rejects baselines with a different version.
+	BASELINE_VERSION = 1
+)
+
+// Baseline is the JSON representation of Expectations that is used to move
+// expectations between Gold instances and to review them. Tests maps test
+// names to digests to labels, where labels are stored as strings, see
+// types.Label.String.
+type Baseline struct {
+	Version int                          `json:"version"`
+	Tests   map[string]map[string]string `json:"tests"`
+}
+
+// NewBaseline returns the Baseline of the given expectations.
+func NewBaseline(exp *Expectations) *Baseline {
+	ret := &Baseline{
+		Version: BASELINE_VERSION,
+		Tests:   make(map[string]map[string]string, len(exp.Tests)),
+	}
+	for testName, digests := range exp.Tests {
+		labels := make(map[string]string, len(digests))
+		for digest, label := range digests {
+			labels[digest] = label.String()
+		}
+		ret.Tests[testName] = labels
+	}
+	return ret
+}
+
+// Expectations returns the expectations in the baseline. It fails if the
+// baseline has the wrong version or contains an unknown label.
+func (b *Baseline) Expectations() (*Expectations, error) {
+	if b.Version != BASELINE_VERSION {
+		return nil, fmt.Errorf("Unsupported baseline version %d, expected %d.", b.Version, BASELINE_VERSION)
+	}
+	ret := NewExpectations()
+	for testName, digests := range b.Tests {
+		tc := make(types.TestClassification, len(digests))
+		for digest, labelStr := range digests {
+			label := types.LabelFromString(labelStr)
+			if label.String() != labelStr {
+				return nil, fmt.Errorf("Invalid label %q for digest %s of test %s.", labelStr, digest, testName)
+			}
+			tc[digest] = label
+		}
+		ret.Tests[testName] = tc
+	}
+	return ret, nil
+}
+
+// WriteBaseline writes the baseline of the given expectations to w. The
+// output is indented and the keys are sorted so baselines can be compared
+// with text based tools.
+func WriteBaseline(w io.Writer, exp *Expectations) error {
+	b, err := json.MarshalIndent(NewBaseline(exp), "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to encode baseline: %s", err)
+	}
+	if _, err := w.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("Unable to write baseline: %s", err)
+	}
+	return nil
+}
+
+// ReadBaseline reads a baseline written by WriteBaseline and returns its
+// expectations.
+func ReadBaseline(r io.Reader) (*Expectations, error) {
+	b := &Baseline{}
+	if err := json.NewDecoder(r).Decode(b); err != nil {
+		return nil, fmt.Errorf("Unable to decode baseline: %s", err)
+	}
+	return b.Expectations()
+}
+
+// BaselineChange is a single difference between two sets of expectations.
+type BaselineChange struct {
+	TestName string
+	Digest   string
+
+	// From and To are the labels before and after the change. A digest that
+	// is not in the expectations is untriaged.
+	From types.Label
+	To   types.Label
+}
+
+// DiffBaselines returns the changes that are necessary to get from the
+// expectations in left to the ones in right, sorted by test name and digest.
+// Digests that are not in right are reported as changing to untriaged.
+func DiffBaselines(left, right *Expectations) []*BaselineChange {
+	addExp, removed := left.Delta(right)
+
+	ret := []*BaselineChange{}
+	for testName, digests := range addExp.Tests {
+		for digest, label := range digests {
+			ret = append(ret, &BaselineChange{
+				TestName: testName,
+				Digest:   digest,
+				From:     left.Classification(testName, digest),
+				To:       label,
+			})
+		}
+	}
+	for testName, digests := range removed {
+		for _, digest := range digests {
+			ret = append(ret, &BaselineChange{
+				TestName: testName,
+				Digest:   digest,
+				From:     left.Classification(testName, digest),
+				To:       types.UNTRIAGED,
+			})
+		}
+	}
+	sort.Sort(baselineChangeSlice(ret))
+	return ret
+}
+
+// baselineChangeSlice sorts BaselineChanges by test name and digest.
+type baselineChangeSlice []*BaselineChange
+
+func (p baselineChangeSlice) Len() int { return len(p) }
+func (p baselineChangeSlice) Less(i, j int) bool {
+	if p[i].TestName == p[j].TestName {
+		return p[i].Digest < p[j].Digest
+	}
+	return p[i].TestName < p[j].TestName
+}
+func (p baselineChangeSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
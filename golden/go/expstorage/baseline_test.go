@@ -0,0 +1,64 @@
+package expstorage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/golden/go/types"
+)
+
+func TestBaseline(t *testing.T) {
+	exp := NewExpectations()
+	exp.AddDigests(map[string]types.TestClassification{
+		"test1": types.TestClassification{"aaa": types.POSITIVE, "bbb": types.NEGATIVE},
+		"test2": types.TestClassification{"ccc": types.UNTRIAGED},
+	})
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, WriteBaseline(buf, exp))
+	assert.Equal(t, `{
+  "version": 1,
+  "tests": {
+    "test1": {
+      "aaa": "positive",
+      "bbb": "negative"
+    },
+    "test2": {
+      "ccc": "untriaged"
+    }
+  }
+}
+`, buf.String())
+
+	found, err := ReadBaseline(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, exp, found)
+
+	// Unknown versions and labels are rejected.
+	_, err = ReadBaseline(strings.NewReader(`{"version": 2, "tests": {}}`))
+	assert.NotNil(t, err)
+	_, err = ReadBaseline(strings.NewReader(`{"version": 1, "tests": {"test1": {"aaa": "good"}}}`))
+	assert.NotNil(t, err)
+}
+
+func TestDiffBaselines(t *testing.T) {
+	left := NewExpectations()
+	left.AddDigests(map[string]types.TestClassification{
+		"test1": types.TestClassification{"aaa": types.POSITIVE, "bbb": types.NEGATIVE},
+		"test2": types.TestClassification{"ccc": types.POSITIVE},
+	})
+	right := NewExpectations()
+	right.AddDigests(map[string]types.TestClassification{
+		"test1": types.TestClassification{"aaa": types.POSITIVE, "bbb": types.POSITIVE},
+		"test3": types.TestClassification{"ddd": types.NEGATIVE},
+	})
+
+	assert.Equal(t, []*BaselineChange{
+		&BaselineChange{TestName: "test1", Digest: "bbb", From: types.NEGATIVE, To: types.POSITIVE},
+		&BaselineChange{TestName: "test2", Digest: "ccc", From: types.POSITIVE, To: types.UNTRIAGED},
+		&BaselineChange{TestName: "test3", Digest: "ddd", From: types.UNTRIAGED, To: types.NEGATIVE},
+	}, DiffBaselines(left, right))
+	assert.Equal(t, 0, len(DiffBaselines(left, left)))
+}
@@ -1,14 +1,22 @@
 package expstorage
 
 import (
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/skia-dev/glog"
 
+	"go.skia.org/infra/go/util"
 	"go.skia.org/infra/golden/go/types"
 )
 
+// REMOVE_CHANGE_USER_ID is the user id of the changes that record calls to
+// RemoveChange. They are not part of the triage log.
+const REMOVE_CHANGE_USER_ID = "remove-change"
+
 // Wraps the set of expectations and provides methods to manipulate them.
 type Expectations struct {
 	Tests map[string]types.TestClassification `json:"tests"`
@@ -114,11 +122,30 @@ type ExpectationsStore interface {
 
 	// AddChange writes the given classified digests to the database and records the
 	// user that made the change.
-	AddChange(changes map[string]types.TestClassification, userId string) error
+	//
+	// versions maps each changed test to the version the user last saw, see
+	// Versions. If a test has been changed since, nothing is written and a
+	// *ConflictError is returned. If versions is nil the change is written
+	// unconditionally.
+	AddChange(changes map[string]types.TestClassification, userId string, versions map[string]int) error
+
+	// Versions returns the version of each test. The version of a test is the
+	// id of the last change of its expectations. Tests that have never been
+	// changed are not included, their version is 0.
+	Versions() (map[string]int, error)
+
+	// LabeledBy returns the user id of the change that set the current label
+	// of each digest in the expectations, keyed by test name and digest.
+	LabeledBy() (map[string]map[string]string, error)
+
+	// RemovedBy returns the user id of the change that set the label of each
+	// digest whose label was removed by RemoveChange, keyed by test name and
+	// digest. Digests that were labeled again since are not included.
+	RemovedBy() (map[string]map[string]string, error)
 
 	// RemoveChange removes the given digests from the expectations store.
 	// The key in changes is the test name which maps to a list of digests
-	// to remove.
+	// to remove. The versions of the tests are bumped, see Versions.
 	RemoveChange(changes map[string][]string) error
 
 	// Changes returns a receive-only channel that will provide a list of test
@@ -126,18 +153,82 @@ type ExpectationsStore interface {
 	Changes() <-chan []string
 
 	// QueryLog allows to paginate through the changes in the expecations.
-	QueryLog(offset, size int) ([]*TriageLogEntry, int, error)
+	// If details is true the changed digests and their labels are included
+	// in each entry.
+	QueryLog(offset, size int, details bool) ([]*TriageLogEntry, int, error)
+
+	// UndoChange reverts the change with the given id by restoring the labels
+	// the changed digests had before it. Digests whose label was changed
+	// since are not reverted and returned as conflicts. The undo is recorded
+	// as a new change made by userId, which bumps the versions of the reverted
+	// tests. It returns the restored labels.
+	UndoChange(changeId int, userId string) (map[string]types.TestClassification, []*TriageConflict, error)
 }
 
-// TODO(stephana): Expand the TriageLogEntry with change id and the
-// map of changed digests and their labels to support undo functionality.
-
 // TriageLogEntry represents one change in the expectation store.
 type TriageLogEntry struct {
+	ID          int    `json:"id"`
 	Name        string `json:"name"`
 	TS          int64  `json:"ts"`
 	ChangeCount int    `json:"changeCount"`
+
+	// UndoChangeID is the id of the change that was undone by this change,
+	// 0 if this change is not an undo.
+	UndoChangeID int `json:"undoChangeId"`
+
+	// Details contains the changed digests and their new labels. Only
+	// populated if requested, see ExpectationsStore.QueryLog.
+	Details []*TriageDetail `json:"details"`
+}
+
+// TriageDetail is a single digest that was labeled in a change.
+type TriageDetail struct {
+	TestName string `json:"test_name"`
+	Digest   string `json:"digest"`
+	Label    string `json:"label"`
+}
+
+// TriageConflict is a digest that was labeled by another user after the
+// version of its test that a change was based on.
+type TriageConflict struct {
+	TestName string `json:"test_name"`
+	Digest   string `json:"digest"`
+	Label    string `json:"label"`
+	UserID   string `json:"userId"`
+	TS       int64  `json:"ts"`
+}
+
+// ConflictError is returned by ExpectationsStore.AddChange if the
+// expectations of a test were changed after the version the change was
+// based on.
+type ConflictError struct {
+	// Conflicts are the digests that were labeled since, sorted by test name
+	// and digest.
+	Conflicts []*TriageConflict `json:"conflicts"`
+
+	// Versions contains the current version of each conflicting test.
+	Versions map[string]int `json:"versions"`
+}
+
+func (c *ConflictError) Error() string {
+	changed := make([]string, 0, len(c.Conflicts))
+	for _, tc := range c.Conflicts {
+		changed = append(changed, fmt.Sprintf("%s:%s by %s", tc.TestName, tc.Digest, tc.UserID))
+	}
+	return fmt.Sprintf("Expectations were changed concurrently: %s", strings.Join(changed, ", "))
+}
+
+// conflictSlice sorts TriageConflicts by test name and digest.
+type conflictSlice []*TriageConflict
+
+func (p conflictSlice) Len() int { return len(p) }
+func (p conflictSlice) Less(i, j int) bool {
+	if p[i].TestName == p[j].TestName {
+		return p[i].Digest < p[j].Digest
+	}
+	return p[i].TestName < p[j].TestName
 }
+func (p conflictSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
 
 // changesSlice is a slice of channels.
 type changesSlice [](chan []string)
@@ -166,6 +257,12 @@ type MemExpectationsStore struct {
 	readCopy     *Expectations
 	changes      changesSlice
 
+	// versions maps test names to their version, lastChanges maps test names
+	// and digests to the change that last labeled the digest.
+	versions     map[string]int
+	lastChanges  map[string]map[string]*memChange
+	lastChangeId int
+
 	// Protects expectations.
 	mutex sync.Mutex
 }
@@ -176,9 +273,20 @@ func NewMemExpectationsStore() ExpectationsStore {
 		expectations: NewExpectations(),
 		readCopy:     NewExpectations(),
 		changes:      changesSlice{},
+		versions:     map[string]int{},
+		lastChanges:  map[string]map[string]*memChange{},
 	}
 }
 
+// memChange is a change of a single digest in MemExpectationsStore.
+type memChange struct {
+	id      int
+	label   types.Label
+	userId  string
+	ts      int64
+	removed bool
+}
+
 // ------------- In-memory implementation
 // See ExpectationsStore interface.
 func (m *MemExpectationsStore) Get() (*Expectations, error) {
@@ -194,18 +302,31 @@ func (m *MemExpectationsStore) dataChanged(testNames []string) {
 }
 
 // See ExpectationsStore interface.
-func (m *MemExpectationsStore) AddChange(changedTests map[string]types.TestClassification, userId string) error {
+func (m *MemExpectationsStore) AddChange(changedTests map[string]types.TestClassification, userId string, versions map[string]int) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	if versions != nil {
+		if err := m.checkVersions(changedTests, versions); err != nil {
+			return err
+		}
+	}
+
+	m.lastChangeId++
+	ts := util.TimeStampMs()
 	testNames := make([]string, 0, len(changedTests))
 	for testName, digests := range changedTests {
 		if _, ok := m.expectations.Tests[testName]; !ok {
 			m.expectations.Tests[testName] = map[string]types.Label{}
 		}
+		if _, ok := m.lastChanges[testName]; !ok {
+			m.lastChanges[testName] = map[string]*memChange{}
+		}
 		for d, label := range digests {
 			m.expectations.Tests[testName][d] = label
+			m.lastChanges[testName][d] = &memChange{id: m.lastChangeId, label: label, userId: userId, ts: ts}
 		}
+		m.versions[testName] = m.lastChangeId
 		testNames = append(testNames, testName)
 	}
 
@@ -213,6 +334,84 @@ func (m *MemExpectationsStore) AddChange(changedTests map[string]types.TestClass
 	return nil
 }
 
+// checkVersions returns a *ConflictError if any of the changed tests has a
+// different version than given in versions. The caller must hold the lock.
+func (m *MemExpectationsStore) checkVersions(changedTests map[string]types.TestClassification, versions map[string]int) error {
+	conflictErr := &ConflictError{
+		Conflicts: []*TriageConflict{},
+		Versions:  map[string]int{},
+	}
+	for testName := range changedTests {
+		if m.versions[testName] == versions[testName] {
+			continue
+		}
+		conflictErr.Versions[testName] = m.versions[testName]
+		for digest, c := range m.lastChanges[testName] {
+			if c.id > versions[testName] {
+				conflictErr.Conflicts = append(conflictErr.Conflicts, &TriageConflict{
+					TestName: testName,
+					Digest:   digest,
+					Label:    c.label.String(),
+					UserID:   c.userId,
+					TS:       c.ts,
+				})
+			}
+		}
+	}
+	if len(conflictErr.Versions) == 0 {
+		return nil
+	}
+	sort.Sort(conflictSlice(conflictErr.Conflicts))
+	return conflictErr
+}
+
+// See ExpectationsStore interface.
+func (m *MemExpectationsStore) Versions() (map[string]int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ret := make(map[string]int, len(m.versions))
+	for testName, version := range m.versions {
+		ret[testName] = version
+	}
+	return ret, nil
+}
+
+// See ExpectationsStore interface.
+func (m *MemExpectationsStore) LabeledBy() (map[string]map[string]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ret := make(map[string]map[string]string, len(m.expectations.Tests))
+	for testName, digests := range m.expectations.Tests {
+		ret[testName] = make(map[string]string, len(digests))
+		for digest := range digests {
+			ret[testName][digest] = m.lastChanges[testName][digest].userId
+		}
+	}
+	return ret, nil
+}
+
+// See ExpectationsStore interface.
+func (m *MemExpectationsStore) RemovedBy() (map[string]map[string]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ret := map[string]map[string]string{}
+	for testName, changes := range m.lastChanges {
+		for digest, c := range changes {
+			if !c.removed {
+				continue
+			}
+			if _, ok := ret[testName]; !ok {
+				ret[testName] = map[string]string{}
+			}
+			ret[testName][digest] = c.userId
+		}
+	}
+	return ret, nil
+}
+
 // RemoveChange, see ExpectationsStore interface.
 func (m *MemExpectationsStore) RemoveChange(changedDigests map[string][]string) error {
 	m.mutex.Lock()
@@ -220,8 +419,16 @@ func (m *MemExpectationsStore) RemoveChange(changedDigests map[string][]string)
 
 	testNames := make([]string, 0, len(changedDigests))
 
+	m.lastChangeId++
 	for testName, digests := range changedDigests {
+		// Removing digests bumps the version of the test like a change.
+		if len(digests) > 0 {
+			m.versions[testName] = m.lastChangeId
+		}
 		for _, digest := range digests {
+			if c, ok := m.lastChanges[testName][digest]; ok {
+				c.removed = true
+			}
 			delete(m.expectations.Tests[testName], digest)
 			if len(m.expectations.Tests[testName]) == 0 {
 				delete(m.expectations.Tests, testName)
@@ -244,7 +451,12 @@ func (m *MemExpectationsStore) Changes() <-chan []string {
 }
 
 // See ExpectationsStore interface.
-func (m *MemExpectationsStore) QueryLog(offset, size int) ([]*TriageLogEntry, int, error) {
+func (m *MemExpectationsStore) QueryLog(offset, size int, details bool) ([]*TriageLogEntry, int, error) {
 	glog.Fatal("MemExpectation store does not support querying the logs.")
 	return nil, 0, nil
 }
+
+// See ExpectationsStore interface.
+func (m *MemExpectationsStore) UndoChange(changeId int, userId string) (map[string]types.TestClassification, []*TriageConflict, error) {
+	return nil, nil, fmt.Errorf("MemExpectationsStore does not support undoing changes.")
+}
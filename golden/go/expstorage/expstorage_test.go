@@ -28,7 +28,7 @@ func TestChanges(t *testing.T) {
 			"ddd": types.UNTRIAGED,
 		},
 	}
-	assert.Nil(t, m.AddChange(tc, ""))
+	assert.Nil(t, m.AddChange(tc, "", nil))
 
 	// Test the degenrate case of a Put with no actual changes.
 	_, err = m.Get()
@@ -37,7 +37,7 @@ func TestChanges(t *testing.T) {
 	}
 	ch := m.Changes()
 	ch2 := m.Changes()
-	assert.Nil(t, m.AddChange(map[string]types.TestClassification{}, ""))
+	assert.Nil(t, m.AddChange(map[string]types.TestClassification{}, "", nil))
 	tests := <-ch
 	_ = <-ch2 // Verify channels are stuffed in go routines.
 	if got, want := tests, []string{}; !util.SSliceEqual(got, want) {
@@ -54,7 +54,7 @@ func TestChanges(t *testing.T) {
 			"ccc": types.UNTRIAGED,
 		},
 	}
-	assert.Nil(t, m.AddChange(tc, ""))
+	assert.Nil(t, m.AddChange(tc, "", nil))
 	tests = <-ch
 	_ = <-ch2
 	if got, want := tests, []string{"test1", "test2"}; !util.SSliceEqual(got, want) {
@@ -73,10 +73,121 @@ func TestMySQLExpectationsStore(t *testing.T) {
 	// Test the MySQL backed store
 	sqlStore := NewSQLExpectationStore(vdb)
 	testExpectationStore(t, sqlStore)
+	testVersions(t, sqlStore)
+	testLabeledBy(t, sqlStore)
 
 	// Test the caching version of the MySQL store.
 	cachingStore := NewCachingExpectationStore(sqlStore)
 	testExpectationStore(t, cachingStore)
+	testVersions(t, cachingStore)
+	testLabeledBy(t, cachingStore)
+}
+
+func TestMemVersions(t *testing.T) {
+	testVersions(t, NewMemExpectationsStore())
+}
+
+func TestMemLabeledBy(t *testing.T) {
+	testLabeledBy(t, NewMemExpectationsStore())
+}
+
+// testLabeledBy tests that the user of the last change of each digest is
+// returned.
+func testLabeledBy(t *testing.T, store ExpectationsStore) {
+	TEST_1, TEST_2 := "labeledbytest1", "labeledbytest2"
+
+	assert.Nil(t, store.AddChange(map[string]types.TestClassification{
+		TEST_1: types.TestClassification{"d1": types.POSITIVE, "d2": types.POSITIVE},
+		TEST_2: types.TestClassification{"d3": types.NEGATIVE},
+	}, "user-1", nil))
+	assert.Nil(t, store.AddChange(map[string]types.TestClassification{
+		TEST_1: types.TestClassification{"d2": types.NEGATIVE},
+	}, "user-2", nil))
+	assert.Nil(t, store.RemoveChange(map[string][]string{TEST_2: []string{"d3"}}))
+
+	labeledBy, err := store.LabeledBy()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"d1": "user-1", "d2": "user-2"}, labeledBy[TEST_1])
+	assert.Equal(t, 0, len(labeledBy[TEST_2]))
+
+	// The removed label is reported until the digest is labeled again.
+	removedBy, err := store.RemovedBy()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"d3": "user-1"}, removedBy[TEST_2])
+	assert.Nil(t, store.AddChange(map[string]types.TestClassification{
+		TEST_2: types.TestClassification{"d3": types.POSITIVE},
+	}, "user-3", nil))
+	removedBy, err = store.RemovedBy()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(removedBy[TEST_2]))
+}
+
+// testVersions tests that concurrent changes of the same test are detected.
+func testVersions(t *testing.T, store ExpectationsStore) {
+	TEST_1, TEST_2 := "versiontest1", "versiontest2"
+
+	versions, err := store.Versions()
+	assert.Nil(t, err)
+	seen := map[string]int{TEST_1: versions[TEST_1], TEST_2: versions[TEST_2]}
+
+	// Two users start from the same version, the second change conflicts.
+	assert.Nil(t, store.AddChange(map[string]types.TestClassification{
+		TEST_1: types.TestClassification{"d1": types.POSITIVE, "d2": types.NEGATIVE},
+	}, "user-1", seen))
+	err = store.AddChange(map[string]types.TestClassification{
+		TEST_1: types.TestClassification{"d1": types.NEGATIVE},
+		TEST_2: types.TestClassification{"d3": types.POSITIVE},
+	}, "user-2", seen)
+	conflictErr, ok := err.(*ConflictError)
+	assert.True(t, ok)
+	assert.Equal(t, 2, len(conflictErr.Conflicts))
+	assert.Equal(t, "d1", conflictErr.Conflicts[0].Digest)
+	assert.Equal(t, types.POSITIVE.String(), conflictErr.Conflicts[0].Label)
+	assert.Equal(t, "user-1", conflictErr.Conflicts[0].UserID)
+	assert.Equal(t, "d2", conflictErr.Conflicts[1].Digest)
+	assert.Equal(t, 1, len(conflictErr.Versions))
+	assert.Contains(t, err.Error(), "versiontest1:d1 by user-1")
+
+	// Nothing of the conflicting change was written.
+	exp, err := store.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, types.POSITIVE, exp.Classification(TEST_1, "d1"))
+	assert.Equal(t, types.UNTRIAGED, exp.Classification(TEST_2, "d3"))
+
+	// With the current versions the change succeeds and bumps the versions.
+	versions, err = store.Versions()
+	assert.Nil(t, err)
+	assert.Equal(t, conflictErr.Versions[TEST_1], versions[TEST_1])
+	seen = map[string]int{TEST_1: versions[TEST_1], TEST_2: versions[TEST_2]}
+	assert.Nil(t, store.AddChange(map[string]types.TestClassification{
+		TEST_1: types.TestClassification{"d1": types.NEGATIVE},
+		TEST_2: types.TestClassification{"d3": types.POSITIVE},
+	}, "user-2", seen))
+	versions, err = store.Versions()
+	assert.Nil(t, err)
+	assert.True(t, versions[TEST_1] > seen[TEST_1])
+	assert.Equal(t, versions[TEST_1], versions[TEST_2])
+
+	// Changes without versions are not checked.
+	assert.Nil(t, store.AddChange(map[string]types.TestClassification{
+		TEST_1: types.TestClassification{"d2": types.POSITIVE},
+	}, "user-3", nil))
+
+	// Removing digests bumps the versions of their tests, so changes based
+	// on the labels before the removal conflict.
+	versions, err = store.Versions()
+	assert.Nil(t, err)
+	seen = map[string]int{TEST_1: versions[TEST_1], TEST_2: versions[TEST_2]}
+	assert.Nil(t, store.RemoveChange(map[string][]string{TEST_1: []string{"d2"}}))
+	versions, err = store.Versions()
+	assert.Nil(t, err)
+	assert.True(t, versions[TEST_1] > seen[TEST_1])
+	assert.Equal(t, seen[TEST_2], versions[TEST_2])
+	err = store.AddChange(map[string]types.TestClassification{
+		TEST_1: types.TestClassification{"d2": types.NEGATIVE},
+	}, "user-4", seen)
+	_, ok = err.(*ConflictError)
+	assert.True(t, ok)
 }
 
 // Test against the expectation store interface.
@@ -84,7 +195,7 @@ func testExpectationStore(t *testing.T, store ExpectationsStore) {
 	// Get the initial log size. This is necessary because we
 	// call this function multiple times with the same underlying
 	// SQLExpectationStore.
-	initialLogRecs, initialLogTotal, err := store.QueryLog(0, 5)
+	initialLogRecs, initialLogTotal, err := store.QueryLog(0, 5, false)
 	assert.Nil(t, err)
 	initialLogRecsLen := len(initialLogRecs)
 
@@ -104,7 +215,7 @@ func testExpectationStore(t *testing.T, store ExpectationsStore) {
 			DIGEST_22: types.NEGATIVE,
 		},
 	}
-	err = store.AddChange(newExps, "user-0")
+	err = store.AddChange(newExps, "user-0", nil)
 	assert.Nil(t, err)
 
 	foundExps, err := store.Get()
@@ -122,7 +233,7 @@ func testExpectationStore(t *testing.T, store ExpectationsStore) {
 			DIGEST_22: types.UNTRIAGED,
 		},
 	}
-	err = store.AddChange(updExps, "user-1")
+	err = store.AddChange(updExps, "user-1", nil)
 	assert.Nil(t, err)
 
 	foundExps, err = store.Get()
@@ -154,13 +265,90 @@ func testExpectationStore(t *testing.T, store ExpectationsStore) {
 	assert.Equal(t, 1, len(foundExps.Tests))
 
 	// Make sure we added the correct number of triage log entries.
-	logEntries, total, err := store.QueryLog(0, 5)
+	logEntries, total, err := store.QueryLog(0, 5, false)
 	assert.Nil(t, err)
 	assert.Equal(t, 2+initialLogTotal, total)
 	assert.Equal(t, 2+initialLogRecsLen, len(logEntries))
 
-	logEntries, total, err = store.QueryLog(100, 5)
+	logEntries, total, err = store.QueryLog(100, 5, false)
 	assert.Nil(t, err)
 	assert.Equal(t, 2+initialLogTotal, total)
 	assert.Equal(t, 0, len(logEntries))
+
+	// Undo a change and make sure the previous labels are restored.
+	err = store.AddChange(map[string]types.TestClassification{
+		TEST_1: types.TestClassification{DIGEST_11: types.POSITIVE},
+		TEST_2: types.TestClassification{DIGEST_21: types.NEGATIVE},
+	}, "user-2", nil)
+	assert.Nil(t, err)
+
+	logEntries, _, err = store.QueryLog(0, 1, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(logEntries))
+	assert.Equal(t, "user-2", logEntries[0].Name)
+	assert.Equal(t, 0, logEntries[0].UndoChangeID)
+	assert.Equal(t, []*TriageDetail{
+		&TriageDetail{TestName: TEST_1, Digest: DIGEST_11, Label: types.POSITIVE.String()},
+		&TriageDetail{TestName: TEST_2, Digest: DIGEST_21, Label: types.NEGATIVE.String()},
+	}, logEntries[0].Details)
+	changeId := logEntries[0].ID
+
+	versions, err := store.Versions()
+	assert.Nil(t, err)
+	restored, conflicts, err := store.UndoChange(changeId, "user-3")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(conflicts))
+	assert.Equal(t, map[string]types.TestClassification{
+		TEST_1: types.TestClassification{DIGEST_11: types.UNTRIAGED},
+		TEST_2: types.TestClassification{DIGEST_21: types.POSITIVE},
+	}, restored)
+
+	foundExps, err = store.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, types.UNTRIAGED, foundExps.Classification(TEST_1, DIGEST_11))
+	assert.Equal(t, types.POSITIVE, foundExps.Classification(TEST_2, DIGEST_21))
+
+	// The undo bumped the versions of the reverted tests.
+	undoVersions, err := store.Versions()
+	assert.Nil(t, err)
+	assert.True(t, undoVersions[TEST_1] > versions[TEST_1])
+	assert.True(t, undoVersions[TEST_2] > versions[TEST_2])
+
+	logEntries, total, err = store.QueryLog(0, 1, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 4+initialLogTotal, total)
+	assert.Equal(t, "user-3", logEntries[0].Name)
+	assert.Equal(t, changeId, logEntries[0].UndoChangeID)
+	assert.Nil(t, logEntries[0].Details)
+
+	_, _, err = store.UndoChange(-1, "user-3")
+	assert.NotNil(t, err)
+
+	// Digests that were labeled again after a change are not reverted.
+	assert.Nil(t, store.AddChange(map[string]types.TestClassification{
+		TEST_1: types.TestClassification{DIGEST_11: types.POSITIVE},
+		TEST_2: types.TestClassification{DIGEST_21: types.NEGATIVE},
+	}, "user-4", nil))
+	logEntries, _, err = store.QueryLog(0, 1, false)
+	assert.Nil(t, err)
+	changeId = logEntries[0].ID
+	assert.Nil(t, store.AddChange(map[string]types.TestClassification{
+		TEST_2: types.TestClassification{DIGEST_21: types.POSITIVE},
+	}, "user-5", nil))
+
+	restored, conflicts, err = store.UndoChange(changeId, "user-3")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]types.TestClassification{
+		TEST_1: types.TestClassification{DIGEST_11: types.UNTRIAGED},
+	}, restored)
+	assert.Equal(t, 1, len(conflicts))
+	assert.Equal(t, TEST_2, conflicts[0].TestName)
+	assert.Equal(t, DIGEST_21, conflicts[0].Digest)
+	assert.Equal(t, types.POSITIVE.String(), conflicts[0].Label)
+	assert.Equal(t, "user-5", conflicts[0].UserID)
+
+	foundExps, err = store.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, types.UNTRIAGED, foundExps.Classification(TEST_1, DIGEST_11))
+	assert.Equal(t, types.POSITIVE, foundExps.Classification(TEST_2, DIGEST_21))
 }
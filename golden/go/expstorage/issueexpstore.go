@@ -0,0 +1,263 @@
+package expstorage
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skia-dev/glog"
+	"go.skia.org/infra/go/database"
+	"go.skia.org/infra/go/rietveld"
+	"go.skia.org/infra/go/timer"
+	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/golden/go/types"
+)
+
+const (
+	// ISSUE_USER_PREFIX is the prefix of the user id that is recorded in the
+	// triage log when the expectations of an issue are merged into master.
+	ISSUE_USER_PREFIX = "issue:"
+)
+
+// IssueExpectationsStore stores expectations that are scoped to a code review
+// issue. They are made while looking at trybot results and overlay the master
+// expectations when the issue is viewed, see Overlay. Once the issue lands
+// they are merged into the master expectations, see MergeIssue.
+type IssueExpectationsStore interface {
+	// Get returns the expectations of the given issue. The result is empty if
+	// there are no expectations for the issue.
+	Get(issue int) (*Expectations, error)
+
+	// AddChange adds the classified digests to the expectations of the issue.
+	AddChange(issue int, changes map[string]types.TestClassification, userId string) error
+
+	// Issues returns the ids of all issues that have expectations, sorted.
+	Issues() ([]int, error)
+
+	// Delete removes all expectations of the given issue.
+	Delete(issue int) error
+}
+
+// Overlay returns a copy of the master expectations with the expectations of
+// an issue applied on top.
+func Overlay(master, issueExp *Expectations) *Expectations {
+	ret := master.DeepCopy()
+	ret.AddDigests(issueExp.Tests)
+	return ret
+}
+
+// IssueUserID returns the user id that is recorded in the triage log when the
+// expectations of the given issue are merged into master.
+func IssueUserID(issue int) string {
+	return ISSUE_USER_PREFIX + strconv.Itoa(issue)
+}
+
+// MergeIssue applies the expectations of the given issue to the master
+// expectations in store and removes them from issueStore.
+func MergeIssue(store ExpectationsStore, issueStore IssueExpectationsStore, issue int) error {
+	exp, err := issueStore.Get(issue)
+	if err != nil {
+		return err
+	}
+	if len(exp.Tests) > 0 {
+		if err := store.AddChange(exp.Tests, IssueUserID(issue), nil); err != nil {
+			return fmt.Errorf("Unable to merge expectations of issue %d: %s", issue, err)
+		}
+	}
+	return issueStore.Delete(issue)
+}
+
+// IssueLookup retrieves the details of a Rietveld issue. It is implemented
+// by rietveld.Rietveld.
+type IssueLookup interface {
+	GetIssueProperties(issue int, messages bool) (*rietveld.Issue, error)
+}
+
+// StartIssueMerger calls MergeLandedIssues in the given interval.
+func StartIssueMerger(store ExpectationsStore, issueStore IssueExpectationsStore, review IssueLookup, interval time.Duration) {
+	go func() {
+		for _ = range time.Tick(interval) {
+			if err := MergeLandedIssues(store, issueStore, review); err != nil {
+				glog.Errorf("Unable to merge landed issues: %s", err)
+			}
+		}
+	}()
+}
+
+// MergeLandedIssues merges the expectations of every issue in issueStore that
+// has been committed into store. The expectations of issues that were closed
+// without being committed are discarded.
+func MergeLandedIssues(store ExpectationsStore, issueStore IssueExpectationsStore, review IssueLookup) error {
+	issues, err := issueStore.Issues()
+	if err != nil {
+		return err
+	}
+	for _, issue := range issues {
+		props, err := review.GetIssueProperties(issue, true)
+		if err != nil {
+			glog.Errorf("Unable to retrieve issue %d: %s", issue, err)
+			continue
+		}
+		if props.Committed {
+			if err := MergeIssue(store, issueStore, issue); err != nil {
+				return err
+			}
+			glog.Infof("Merged the expectations of issue %d.", issue)
+		} else if props.Closed {
+			if err := issueStore.Delete(issue); err != nil {
+				return err
+			}
+			glog.Infof("Discarded the expectations of closed issue %d.", issue)
+		}
+	}
+	return nil
+}
+
+// MemIssueExpectationsStore implements IssueExpectationsStore in memory for
+// prototyping and testing.
+type MemIssueExpectationsStore struct {
+	issues map[int]*Expectations
+
+	// Protects issues.
+	mutex sync.Mutex
+}
+
+func NewMemIssueExpectationsStore() IssueExpectationsStore {
+	return &MemIssueExpectationsStore{
+		issues: map[int]*Expectations{},
+	}
+}
+
+// See IssueExpectationsStore interface.
+func (m *MemIssueExpectationsStore) Get(issue int) (*Expectations, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if exp, ok := m.issues[issue]; ok {
+		return exp.DeepCopy(), nil
+	}
+	return NewExpectations(), nil
+}
+
+// See IssueExpectationsStore interface.
+func (m *MemIssueExpectationsStore) AddChange(issue int, changes map[string]types.TestClassification, userId string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.issues[issue]; !ok {
+		m.issues[issue] = NewExpectations()
+	}
+	m.issues[issue].AddDigests(changes)
+	return nil
+}
+
+// See IssueExpectationsStore interface.
+func (m *MemIssueExpectationsStore) Issues() ([]int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ret := make([]int, 0, len(m.issues))
+	for issue := range m.issues {
+		ret = append(ret, issue)
+	}
+	sort.Ints(ret)
+	return ret, nil
+}
+
+// See IssueExpectationsStore interface.
+func (m *MemIssueExpectationsStore) Delete(issue int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.issues, issue)
+	return nil
+}
+
+// SQLIssueExpectationsStore implements IssueExpectationsStore in an SQL
+// database. It keeps the current label of every digest per issue.
+type SQLIssueExpectationsStore struct {
+	vdb *database.VersionedDB
+}
+
+func NewSQLIssueExpectationsStore(vdb *database.VersionedDB) IssueExpectationsStore {
+	return &SQLIssueExpectationsStore{
+		vdb: vdb,
+	}
+}
+
+// See IssueExpectationsStore interface.
+func (s *SQLIssueExpectationsStore) Get(issue int) (*Expectations, error) {
+	const stmt = `SELECT name, digest, label FROM exp_issue WHERE issue=?`
+
+	rows, err := s.vdb.DB.Query(stmt, issue)
+	if err != nil {
+		return nil, err
+	}
+	defer util.Close(rows)
+
+	ret := NewExpectations()
+	for rows.Next() {
+		var testName, digest, label string
+		if err := rows.Scan(&testName, &digest, &label); err != nil {
+			return nil, err
+		}
+		if _, ok := ret.Tests[testName]; !ok {
+			ret.Tests[testName] = types.TestClassification{}
+		}
+		ret.Tests[testName][digest] = types.LabelFromString(label)
+	}
+	return ret, nil
+}
+
+// See IssueExpectationsStore interface.
+func (s *SQLIssueExpectationsStore) AddChange(issue int, changes map[string]types.TestClassification, userId string) error {
+	defer timer.New("adding issue exp change").Stop()
+
+	const insertStmt = `REPLACE INTO exp_issue (issue, name, digest, label, userid, ts) VALUES %s`
+
+	placeHolders := []string{}
+	vals := []interface{}{}
+	ts := util.TimeStampMs()
+	for testName, digests := range changes {
+		for digest, label := range digests {
+			placeHolders = append(placeHolders, "(?, ?, ?, ?, ?, ?)")
+			vals = append(vals, issue, testName, digest, label.String(), userId, ts)
+		}
+	}
+	if len(vals) == 0 {
+		return nil
+	}
+
+	_, err := s.vdb.DB.Exec(fmt.Sprintf(insertStmt, strings.Join(placeHolders, ",")), vals...)
+	return err
+}
+
+// See IssueExpectationsStore interface.
+func (s *SQLIssueExpectationsStore) Issues() ([]int, error) {
+	const stmt = `SELECT DISTINCT issue FROM exp_issue ORDER BY issue`
+
+	rows, err := s.vdb.DB.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer util.Close(rows)
+
+	ret := []int{}
+	for rows.Next() {
+		var issue int
+		if err := rows.Scan(&issue); err != nil {
+			return nil, err
+		}
+		ret = append(ret, issue)
+	}
+	return ret, nil
+}
+
+// See IssueExpectationsStore interface.
+func (s *SQLIssueExpectationsStore) Delete(issue int) error {
+	_, err := s.vdb.DB.Exec(`DELETE FROM exp_issue WHERE issue=?`, issue)
+	return err
+}
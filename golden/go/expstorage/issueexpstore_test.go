@@ -0,0 +1,105 @@
+package expstorage
+
+import (
+	"fmt"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/go/database"
+	"go.skia.org/infra/go/database/testutil"
+	"go.skia.org/infra/go/rietveld"
+	"go.skia.org/infra/golden/go/db"
+	"go.skia.org/infra/golden/go/types"
+)
+
+type mockReview map[int]*rietveld.Issue
+
+func (m mockReview) GetIssueProperties(issue int, messages bool) (*rietveld.Issue, error) {
+	if ret, ok := m[issue]; ok {
+		return ret, nil
+	}
+	return nil, fmt.Errorf("Unknown issue %d", issue)
+}
+
+func TestMemIssueExpectationsStore(t *testing.T) {
+	testIssueExpectationsStore(t, NewMemIssueExpectationsStore())
+}
+
+func TestMySQLIssueExpectationsStore(t *testing.T) {
+	// Set up the test database.
+	testDb := testutil.SetupMySQLTestDatabase(t, db.MigrationSteps())
+	defer testDb.Close(t)
+
+	conf := testutil.LocalTestDatabaseConfig(db.MigrationSteps())
+	vdb := database.NewVersionedDB(conf)
+	testIssueExpectationsStore(t, NewSQLIssueExpectationsStore(vdb))
+}
+
+func testIssueExpectationsStore(t *testing.T, issueStore IssueExpectationsStore) {
+	TEST_1 := "test1"
+	DIGEST_11, DIGEST_12, DIGEST_13 := "d11", "d12", "d13"
+	ISSUE_1, ISSUE_2, ISSUE_3 := 1001, 1002, 1003
+
+	found, err := issueStore.Get(ISSUE_1)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(found.Tests))
+
+	assert.Nil(t, issueStore.AddChange(ISSUE_1, map[string]types.TestClassification{
+		TEST_1: types.TestClassification{DIGEST_11: types.NEGATIVE, DIGEST_12: types.POSITIVE},
+	}, "user-1"))
+	assert.Nil(t, issueStore.AddChange(ISSUE_1, map[string]types.TestClassification{
+		TEST_1: types.TestClassification{DIGEST_11: types.POSITIVE},
+	}, "user-2"))
+	assert.Nil(t, issueStore.AddChange(ISSUE_2, map[string]types.TestClassification{
+		TEST_1: types.TestClassification{DIGEST_13: types.POSITIVE},
+	}, "user-1"))
+	assert.Nil(t, issueStore.AddChange(ISSUE_3, map[string]types.TestClassification{
+		TEST_1: types.TestClassification{DIGEST_13: types.NEGATIVE},
+	}, "user-1"))
+
+	found, err = issueStore.Get(ISSUE_1)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]types.TestClassification{
+		TEST_1: types.TestClassification{DIGEST_11: types.POSITIVE, DIGEST_12: types.POSITIVE},
+	}, found.Tests)
+
+	issues, err := issueStore.Issues()
+	assert.Nil(t, err)
+	assert.Equal(t, []int{ISSUE_1, ISSUE_2, ISSUE_3}, issues)
+
+	// The issue overlays the master expectations.
+	store := NewMemExpectationsStore()
+	assert.Nil(t, store.AddChange(map[string]types.TestClassification{
+		TEST_1: types.TestClassification{DIGEST_11: types.NEGATIVE, DIGEST_13: types.NEGATIVE},
+	}, "user-0", nil))
+	master, err := store.Get()
+	assert.Nil(t, err)
+	overlaid := Overlay(master, found)
+	assert.Equal(t, types.POSITIVE, overlaid.Classification(TEST_1, DIGEST_11))
+	assert.Equal(t, types.POSITIVE, overlaid.Classification(TEST_1, DIGEST_12))
+	assert.Equal(t, types.NEGATIVE, overlaid.Classification(TEST_1, DIGEST_13))
+	assert.Equal(t, types.NEGATIVE, master.Classification(TEST_1, DIGEST_11))
+
+	// Issue 1 lands, issue 2 is closed and issue 3 is still open.
+	review := mockReview{
+		ISSUE_1: &rietveld.Issue{Issue: ISSUE_1, Committed: true, Closed: true},
+		ISSUE_2: &rietveld.Issue{Issue: ISSUE_2, Closed: true},
+		ISSUE_3: &rietveld.Issue{Issue: ISSUE_3},
+	}
+	assert.Nil(t, MergeLandedIssues(store, issueStore, review))
+
+	master, err = store.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]types.TestClassification{
+		TEST_1: types.TestClassification{DIGEST_11: types.POSITIVE, DIGEST_12: types.POSITIVE, DIGEST_13: types.NEGATIVE},
+	}, master.Tests)
+
+	issues, err = issueStore.Issues()
+	assert.Nil(t, err)
+	assert.Equal(t, []int{ISSUE_3}, issues)
+
+	assert.Nil(t, issueStore.Delete(ISSUE_3))
+	issues, err = issueStore.Issues()
+	assert.Nil(t, err)
+	assert.Equal(t, []int{}, issues)
+}
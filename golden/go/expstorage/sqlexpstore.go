@@ -1,6 +1,11 @@
 package expstorage
 
 import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
 	"github.com/skia-dev/glog"
 	"go.skia.org/infra/go/database"
 	"go.skia.org/infra/go/timer"
@@ -55,8 +60,8 @@ func (e *SQLExpectationsStore) Get() (exp *Expectations, err error) {
 }
 
 // See ExpectationsStore interface.
-func (e *SQLExpectationsStore) AddChange(changedTests map[string]types.TestClassification, userId string) error {
-	return e.AddChangeWithTimeStamp(changedTests, userId, util.TimeStampMs())
+func (e *SQLExpectationsStore) AddChange(changedTests map[string]types.TestClassification, userId string, versions map[string]int) error {
+	return e.addChange(changedTests, userId, util.TimeStampMs(), versions)
 }
 
 // TOOD(stephana): Remove the AddChangeWithTimeStamp if we remove the
@@ -64,9 +69,90 @@ func (e *SQLExpectationsStore) AddChange(changedTests map[string]types.TestClass
 
 // AddChangeWithTimeStamp adds changed tests to the database with the
 // given time stamp. This is primarily for migration purposes.
-func (e *SQLExpectationsStore) AddChangeWithTimeStamp(changedTests map[string]types.TestClassification, userId string, timeStamp int64) (retErr error) {
+func (e *SQLExpectationsStore) AddChangeWithTimeStamp(changedTests map[string]types.TestClassification, userId string, timeStamp int64) error {
+	return e.addChange(changedTests, userId, timeStamp, nil)
+}
+
+// addChange implements AddChange and AddChangeWithTimeStamp.
+func (e *SQLExpectationsStore) addChange(changedTests map[string]types.TestClassification, userId string, timeStamp int64, versions map[string]int) (retErr error) {
 	defer timer.New("adding exp change").Stop()
 
+	// start a transaction
+	tx, err := e.vdb.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() { retErr = database.CommitOrRollback(tx, retErr) }()
+
+	if versions != nil {
+		if err := checkVersions(tx, changedTests, versions); err != nil {
+			return err
+		}
+	}
+
+	_, err = insertChange(tx, changedTests, userId, timeStamp, 0)
+	return err
+}
+
+// checkVersions returns a *ConflictError if any of the changed tests has a
+// different version than given in versions. The version rows are locked
+// until the transaction ends, so concurrent changes of the same tests are
+// serialized.
+func checkVersions(tx *sql.Tx, changedTests map[string]types.TestClassification, versions map[string]int) error {
+	const (
+		versionStmt  = `SELECT changeid FROM exp_test_version WHERE name=? FOR UPDATE`
+		conflictStmt = `SELECT tc.digest, tc.label, ec.userid, ec.ts
+		                FROM exp_test_change AS tc
+		                  JOIN exp_change AS ec ON tc.changeid=ec.id
+		                WHERE (tc.name=?) AND (tc.changeid>?)
+		                ORDER BY tc.digest, tc.changeid`
+	)
+
+	conflictErr := &ConflictError{
+		Conflicts: []*TriageConflict{},
+		Versions:  map[string]int{},
+	}
+	for testName := range changedTests {
+		current := 0
+		if err := tx.QueryRow(versionStmt, testName).Scan(&current); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if current == versions[testName] {
+			continue
+		}
+		conflictErr.Versions[testName] = current
+
+		// Only report the last change of each digest.
+		rows, err := tx.Query(conflictStmt, testName, versions[testName])
+		if err != nil {
+			return err
+		}
+		byDigest := map[string]*TriageConflict{}
+		for rows.Next() {
+			c := &TriageConflict{TestName: testName}
+			if err := rows.Scan(&c.Digest, &c.Label, &c.UserID, &c.TS); err != nil {
+				util.Close(rows)
+				return err
+			}
+			byDigest[c.Digest] = c
+		}
+		util.Close(rows)
+		for _, c := range byDigest {
+			conflictErr.Conflicts = append(conflictErr.Conflicts, c)
+		}
+	}
+	if len(conflictErr.Versions) == 0 {
+		return nil
+	}
+	sort.Sort(conflictSlice(conflictErr.Conflicts))
+	return conflictErr
+}
+
+// insertChange records the given change in the transaction and returns the
+// id of the new change. undoChangeId is the id of the change that this change
+// undoes, 0 otherwise.
+func insertChange(tx *sql.Tx, changedTests map[string]types.TestClassification, userId string, timeStamp int64, undoChangeId int) (int64, error) {
 	// Count the number of values to add.
 	changeCount := 0
 	for _, digests := range changedTests {
@@ -74,31 +160,25 @@ func (e *SQLExpectationsStore) AddChangeWithTimeStamp(changedTests map[string]ty
 	}
 
 	const (
-		insertChange = `INSERT INTO exp_change (userid, ts) VALUES (?, ?)`
-		insertDigest = `INSERT INTO exp_test_change (changeid, name, digest, label) VALUES`
+		insertChange  = `INSERT INTO exp_change (userid, ts, undochangeid) VALUES (?, ?, ?)`
+		insertDigest  = `INSERT INTO exp_test_change (changeid, name, digest, label) VALUES`
+		updateVersion = `INSERT INTO exp_test_version (name, changeid) VALUES (?, ?)
+		                 ON DUPLICATE KEY UPDATE changeid=VALUES(changeid)`
 	)
 
-	// start a transaction
-	tx, err := e.vdb.DB.Begin()
-	if err != nil {
-		return err
-	}
-
-	defer func() { retErr = database.CommitOrRollback(tx, retErr) }()
-
 	// create the change record
-	result, err := tx.Exec(insertChange, userId, timeStamp)
+	result, err := tx.Exec(insertChange, userId, timeStamp, undoChangeId)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	changeId, err := result.LastInsertId()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// If there are not changed records then we stop here.
 	if changeCount == 0 {
-		return nil
+		return changeId, nil
 	}
 
 	// Assemble the INSERT values.
@@ -115,24 +195,144 @@ func (e *SQLExpectationsStore) AddChangeWithTimeStamp(changedTests map[string]ty
 	// insert all the changes
 	prepStmt, err := tx.Prepare(insertDigest + valuesStr)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer util.Close(prepStmt)
 
-	_, err = prepStmt.Exec(vals...)
+	if _, err = prepStmt.Exec(vals...); err != nil {
+		return 0, err
+	}
+
+	// Every changed test is now at the version of this change.
+	for testName, digests := range changedTests {
+		if len(digests) == 0 {
+			continue
+		}
+		if _, err = tx.Exec(updateVersion, testName, changeId); err != nil {
+			return 0, err
+		}
+	}
+	return changeId, nil
+}
+
+// UndoChange, see ExpectationsStore interface.
+//
+// The label a digest had before the change is the label of the most recent
+// earlier change of the digest that had not been removed at the time of the
+// change. Digests without such a change are reset to untriaged. A digest is
+// only reverted if its most recent change still sets the label the undone
+// change set and it has not been removed since.
+func (e *SQLExpectationsStore) UndoChange(changeId int, userId string) (ret map[string]types.TestClassification, conflicts []*TriageConflict, retErr error) {
+	defer timer.New("undoing exp change").Stop()
+
+	const (
+		changeStmt  = `SELECT ts FROM exp_change WHERE id=?`
+		digestsStmt = `SELECT name, digest, label FROM exp_test_change WHERE changeid=?`
+		currentStmt = `SELECT tc.label, tc.removed IS NOT NULL, ec.userid, ec.ts
+		               FROM exp_test_change AS tc
+		                 JOIN exp_change AS ec ON tc.changeid=ec.id
+		               WHERE (tc.name=?) AND (tc.digest=?)
+		               ORDER BY tc.changeid DESC
+		               LIMIT 1
+		               FOR UPDATE`
+		prevStmt = `SELECT label
+		            FROM exp_test_change
+		            WHERE (name=?) AND (digest=?) AND (changeid<?) AND ((removed IS NULL) OR (removed>?))
+		            ORDER BY changeid DESC
+		            LIMIT 1`
+	)
+
+	// start a transaction
+	tx, err := e.vdb.DB.Begin()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	return nil
+
+	defer func() { retErr = database.CommitOrRollback(tx, retErr) }()
+
+	var ts int64
+	if err := tx.QueryRow(changeStmt, changeId).Scan(&ts); err == sql.ErrNoRows {
+		return nil, nil, fmt.Errorf("Unable to find change with id %d", changeId)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := tx.Query(digestsStmt, changeId)
+	if err != nil {
+		return nil, nil, err
+	}
+	changed := map[string]map[string]string{}
+	for rows.Next() {
+		var testName, digest, label string
+		if err := rows.Scan(&testName, &digest, &label); err != nil {
+			util.Close(rows)
+			return nil, nil, err
+		}
+		if _, ok := changed[testName]; !ok {
+			changed[testName] = map[string]string{}
+		}
+		changed[testName][digest] = label
+	}
+	util.Close(rows)
+
+	ret = map[string]types.TestClassification{}
+	conflicts = []*TriageConflict{}
+	for testName, digests := range changed {
+		for digest, setLabel := range digests {
+			current := &TriageConflict{TestName: testName, Digest: digest}
+			var removed bool
+			if err := tx.QueryRow(currentStmt, testName, digest).Scan(&current.Label, &removed, &current.UserID, &current.TS); err != nil {
+				return nil, nil, err
+			}
+			if removed {
+				current.Label = types.UNTRIAGED.String()
+			}
+			if removed || current.Label != setLabel {
+				conflicts = append(conflicts, current)
+				continue
+			}
+
+			if _, ok := ret[testName]; !ok {
+				ret[testName] = types.TestClassification{}
+			}
+			var label string
+			err := tx.QueryRow(prevStmt, testName, digest, changeId, ts).Scan(&label)
+			if err == sql.ErrNoRows {
+				ret[testName][digest] = types.UNTRIAGED
+				continue
+			} else if err != nil {
+				return nil, nil, err
+			}
+			ret[testName][digest] = types.LabelFromString(label)
+		}
+	}
+	sort.Sort(conflictSlice(conflicts))
+
+	// Nothing is recorded if all digests were changed since.
+	if len(ret) == 0 {
+		return ret, conflicts, nil
+	}
+	if _, err := insertChange(tx, ret, userId, util.TimeStampMs(), changeId); err != nil {
+		return nil, nil, err
+	}
+	return ret, conflicts, nil
 }
 
 // RemoveChange, see ExpectationsStore interface.
+//
+// The removal bumps the versions of the changed tests. Versions are change
+// ids, so the removal is recorded as a change by REMOVE_CHANGE_USER_ID
+// without any digests, which is not listed in the triage log.
 func (e *SQLExpectationsStore) RemoveChange(changedDigests map[string][]string) (retErr error) {
 	defer timer.New("removing exp change").Stop()
 
-	const markRemovedStmt = `UPDATE exp_test_change
-	                         SET removed = IF(removed IS NULL, ?, removed)
-	                         WHERE (name=?) AND (digest=?)`
+	const (
+		markRemovedStmt = `UPDATE exp_test_change
+		                   SET removed = IF(removed IS NULL, ?, removed)
+		                   WHERE (name=?) AND (digest=?)`
+		updateVersion = `INSERT INTO exp_test_version (name, changeid) VALUES (?, ?)
+		                 ON DUPLICATE KEY UPDATE changeid=VALUES(changeid)`
+	)
 
 	// start a transaction
 	tx, err := e.vdb.DB.Begin()
@@ -152,9 +352,110 @@ func (e *SQLExpectationsStore) RemoveChange(changedDigests map[string][]string)
 		}
 	}
 
+	// Every changed test is now at the version of the removal.
+	var changeId int64
+	for testName, digests := range changedDigests {
+		if len(digests) == 0 {
+			continue
+		}
+		if changeId == 0 {
+			if changeId, err = insertChange(tx, nil, REMOVE_CHANGE_USER_ID, now, 0); err != nil {
+				return err
+			}
+		}
+		if _, err = tx.Exec(updateVersion, testName, changeId); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// See ExpectationsStore interface.
+func (e *SQLExpectationsStore) Versions() (map[string]int, error) {
+	const stmt = `SELECT name, changeid FROM exp_test_version`
+
+	rows, err := e.vdb.DB.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer util.Close(rows)
+
+	ret := map[string]int{}
+	for rows.Next() {
+		var testName string
+		var version int
+		if err := rows.Scan(&testName, &version); err != nil {
+			return nil, err
+		}
+		ret[testName] = version
+	}
+	return ret, nil
+}
+
+// See ExpectationsStore interface.
+func (e *SQLExpectationsStore) LabeledBy() (map[string]map[string]string, error) {
+	const stmt = `SELECT t1.name, t1.digest, ec.userid
+	         FROM exp_test_change AS t1
+	         JOIN (
+	         	SELECT name, digest, MAX(changeid) as changeid
+	         	FROM exp_test_change
+	         	GROUP BY name, digest ) AS t2
+				ON (t1.name = t2.name AND t1.digest = t2.digest AND t1.changeid = t2.changeid)
+	         JOIN exp_change AS ec ON t1.changeid = ec.id
+				WHERE t1.removed IS NULL`
+
+	rows, err := e.vdb.DB.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer util.Close(rows)
+
+	ret := map[string]map[string]string{}
+	for rows.Next() {
+		var testName, digest, userId string
+		if err := rows.Scan(&testName, &digest, &userId); err != nil {
+			return nil, err
+		}
+		if _, ok := ret[testName]; !ok {
+			ret[testName] = map[string]string{}
+		}
+		ret[testName][digest] = userId
+	}
+	return ret, nil
+}
+
+// See ExpectationsStore interface.
+func (e *SQLExpectationsStore) RemovedBy() (map[string]map[string]string, error) {
+	const stmt = `SELECT t1.name, t1.digest, ec.userid
+	         FROM exp_test_change AS t1
+	         JOIN (
+	         	SELECT name, digest, MAX(changeid) as changeid
+	         	FROM exp_test_change
+	         	GROUP BY name, digest ) AS t2
+				ON (t1.name = t2.name AND t1.digest = t2.digest AND t1.changeid = t2.changeid)
+	         JOIN exp_change AS ec ON t1.changeid = ec.id
+				WHERE t1.removed IS NOT NULL`
+
+	rows, err := e.vdb.DB.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer util.Close(rows)
+
+	ret := map[string]map[string]string{}
+	for rows.Next() {
+		var testName, digest, userId string
+		if err := rows.Scan(&testName, &digest, &userId); err != nil {
+			return nil, err
+		}
+		if _, ok := ret[testName]; !ok {
+			ret[testName] = map[string]string{}
+		}
+		ret[testName][digest] = userId
+	}
+	return ret, nil
+}
+
 // See ExpectationsStore interface.
 func (e *SQLExpectationsStore) Changes() <-chan []string {
 	glog.Fatal("SQLExpectationsStore doesn't really support Changes.")
@@ -162,18 +463,20 @@ func (e *SQLExpectationsStore) Changes() <-chan []string {
 }
 
 // See ExpectationsStore interface.
-func (m *SQLExpectationsStore) QueryLog(offset, size int) ([]*TriageLogEntry, int, error) {
-	const stmtList = `SELECT ec.userid, ec.ts, count(*)
+func (m *SQLExpectationsStore) QueryLog(offset, size int, details bool) ([]*TriageLogEntry, int, error) {
+	const stmtList = `SELECT ec.id, ec.userid, ec.ts, count(*), ec.undochangeid
 					  FROM exp_change AS ec
 						LEFT OUTER JOIN exp_test_change AS tc
 							ON ec.id=tc.changeid
-					  GROUP BY ec.id ORDER BY ec.ts DESC
+					  WHERE ec.userid<>?
+					  GROUP BY ec.id ORDER BY ec.ts DESC, ec.id DESC
 					  LIMIT ?, ?`
 
-	const stmtTotal = `SELECT count(*) FROM exp_change`
+	const stmtTotal = `SELECT count(*) FROM exp_change WHERE userid<>?`
 
-	// Get the total number of records.
-	row := m.vdb.DB.QueryRow(stmtTotal)
+	// Get the total number of records. Removals are not listed, see
+	// RemoveChange.
+	row := m.vdb.DB.QueryRow(stmtTotal, REMOVE_CHANGE_USER_ID)
 	var total int
 	if err := row.Scan(&total); err != nil {
 		return nil, 0, err
@@ -184,7 +487,7 @@ func (m *SQLExpectationsStore) QueryLog(offset, size int) ([]*TriageLogEntry, in
 	}
 
 	// Fetch the records we are interested in.
-	rows, err := m.vdb.DB.Query(stmtList, offset, size)
+	rows, err := m.vdb.DB.Query(stmtList, REMOVE_CHANGE_USER_ID, offset, size)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -193,14 +496,54 @@ func (m *SQLExpectationsStore) QueryLog(offset, size int) ([]*TriageLogEntry, in
 	result := make([]*TriageLogEntry, 0, size)
 	for rows.Next() {
 		entry := &TriageLogEntry{}
-		if err = rows.Scan(&entry.Name, &entry.TS, &entry.ChangeCount); err != nil {
+		if err = rows.Scan(&entry.ID, &entry.Name, &entry.TS, &entry.ChangeCount, &entry.UndoChangeID); err != nil {
 			return nil, 0, err
 		}
 		result = append(result, entry)
 	}
+
+	if details && len(result) > 0 {
+		if err := m.addDetails(result); err != nil {
+			return nil, 0, err
+		}
+	}
 	return result, total, nil
 }
 
+// addDetails loads the changed digests of the given log entries.
+func (m *SQLExpectationsStore) addDetails(entries []*TriageLogEntry) error {
+	const stmtDetails = `SELECT changeid, name, digest, label
+						 FROM exp_test_change
+						 WHERE changeid IN (%s)
+						 ORDER BY name, digest`
+
+	byId := make(map[int]*TriageLogEntry, len(entries))
+	placeHolders := make([]string, 0, len(entries))
+	ids := make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		byId[entry.ID] = entry
+		entry.Details = []*TriageDetail{}
+		placeHolders = append(placeHolders, "?")
+		ids = append(ids, entry.ID)
+	}
+
+	rows, err := m.vdb.DB.Query(fmt.Sprintf(stmtDetails, strings.Join(placeHolders, ",")), ids...)
+	if err != nil {
+		return err
+	}
+	defer util.Close(rows)
+
+	for rows.Next() {
+		var changeId int
+		detail := &TriageDetail{}
+		if err := rows.Scan(&changeId, &detail.TestName, &detail.Digest, &detail.Label); err != nil {
+			return err
+		}
+		byId[changeId].Details = append(byId[changeId].Details, detail)
+	}
+	return nil
+}
+
 // Wraps around an ExpectationsStore and caches the expectations using
 // MemExpecationsStore.
 type CachingExpectationStore struct {
@@ -225,20 +568,37 @@ func (c *CachingExpectationStore) Get() (exp *Expectations, err error) {
 		if err != nil {
 			return nil, err
 		}
-		if err = c.cache.AddChange(tempExp.Tests, ""); err != nil {
+		if err = c.cache.AddChange(tempExp.Tests, "", nil); err != nil {
 			return nil, err
 		}
 	}
 	return c.cache.Get()
 }
 
-// See ExpectationsStore interface.
-func (c *CachingExpectationStore) AddChange(changedTests map[string]types.TestClassification, userId string) error {
-	if err := c.store.AddChange(changedTests, userId); err != nil {
+// See ExpectationsStore interface. The versions are checked by the
+// underlying store.
+func (c *CachingExpectationStore) AddChange(changedTests map[string]types.TestClassification, userId string, versions map[string]int) error {
+	if err := c.store.AddChange(changedTests, userId, versions); err != nil {
 		return err
 	}
 
-	return c.cache.AddChange(changedTests, userId)
+	return c.cache.AddChange(changedTests, userId, nil)
+}
+
+// See ExpectationsStore interface.
+func (c *CachingExpectationStore) Versions() (map[string]int, error) {
+	return c.store.Versions()
+}
+
+// See ExpectationsStore interface. The cache does not know who labeled the
+// digests it was loaded with, so this is answered by the underlying store.
+func (c *CachingExpectationStore) LabeledBy() (map[string]map[string]string, error) {
+	return c.store.LabeledBy()
+}
+
+// See ExpectationsStore interface.
+func (c *CachingExpectationStore) RemovedBy() (map[string]map[string]string, error) {
+	return c.store.RemovedBy()
 }
 
 func (c *CachingExpectationStore) RemoveChange(changedDigests map[string][]string) error {
@@ -255,6 +615,19 @@ func (c *CachingExpectationStore) Changes() <-chan []string {
 }
 
 // See ExpectationsStore interface.
-func (c *CachingExpectationStore) QueryLog(offset, size int) ([]*TriageLogEntry, int, error) {
-	return c.store.QueryLog(offset, size)
+func (c *CachingExpectationStore) QueryLog(offset, size int, details bool) ([]*TriageLogEntry, int, error) {
+	return c.store.QueryLog(offset, size, details)
+}
+
+// See ExpectationsStore interface.
+func (c *CachingExpectationStore) UndoChange(changeId int, userId string) (map[string]types.TestClassification, []*TriageConflict, error) {
+	changes, conflicts, err := c.store.UndoChange(changeId, userId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := c.cache.AddChange(changes, userId, nil); err != nil {
+		return nil, nil, err
+	}
+	return changes, conflicts, nil
 }
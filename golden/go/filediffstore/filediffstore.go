@@ -13,6 +13,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	storage "code.google.com/p/google-api-go-client/storage/v1"
@@ -23,6 +24,7 @@ import (
 	"go.skia.org/infra/go/gs"
 	"go.skia.org/infra/go/util"
 	"go.skia.org/infra/golden/go/diff"
+	"go.skia.org/infra/golden/go/digestmeta"
 )
 
 const (
@@ -31,7 +33,7 @@ const (
 	DEFAULT_DIFFMETRICS_DIR_NAME = "diffmetrics"
 	DEFAULT_GS_IMG_DIR_NAME      = "dm-images-v1"
 	DEFAULT_TEMPFILE_DIR_NAME    = "__temp"
-	IMG_EXTENSION                = "png"
+	IMG_EXTENSION                = "png" // The extension of digests without metadata.
 	DIFF_EXTENSION               = "png"
 	DIFFMETRICS_EXTENSION        = "json"
 	RECOMMENDED_WORKER_POOL_SIZE = 2000
@@ -109,6 +111,19 @@ type FileDiffStore struct {
 	// The complete GS URL where images are stored.
 	storageBaseDir string
 
+	// metadataStore is used to look up the extension of digests. Can be nil
+	// in which case all digests are assumed to be PNGs.
+	metadataStore digestmeta.MetadataStore
+
+	// exts caches the extensions reported by metadataStore, protected by
+	// extMutex.
+	exts     map[string]string
+	extMutex sync.Mutex
+
+	// imageSource provides the images that are not cached locally. If nil
+	// they are downloaded from Google Storage.
+	imageSource ImageSource
+
 	// The channels workers pick up tasks from.
 	absPathCh chan *WorkerReq
 	getCh     chan *WorkerReq
@@ -137,7 +152,19 @@ type FileDiffStore struct {
 // workerPoolSize is the max number of simultaneous goroutines that will be
 // created when running Get or AbsPath.
 // Use RECOMMENDED_WORKER_POOL_SIZE if unsure what this value should be.
-func NewFileDiffStore(client *http.Client, baseDir, gsBucketName string, storageBaseDir string, cacheFactory CacheFactory, workerPoolSize int) (diff.DiffStore, error) {
+// The optional metadataStore is used to look up the extension of digests,
+// which names their images in Google Storage and the local cache and selects
+// the decoder, see diff.IMAGE_FORMATS. Digests without metadata are fetched
+// as PNGs, but are not reported as unavailable if that fails, since their
+// metadata might only be ingested later. Digests with an extension that
+// cannot be decoded are reported as unavailable instead of being fetched.
+func NewFileDiffStore(client *http.Client, baseDir, gsBucketName string, storageBaseDir string, cacheFactory CacheFactory, workerPoolSize int, metadataStore digestmeta.MetadataStore) (diff.DiffStore, error) {
+	return newFileDiffStore(client, baseDir, gsBucketName, storageBaseDir, cacheFactory, workerPoolSize, metadataStore)
+}
+
+// newFileDiffStore is the shared implementation of NewFileDiffStore and
+// NewOfflineDiffStore.
+func newFileDiffStore(client *http.Client, baseDir, gsBucketName string, storageBaseDir string, cacheFactory CacheFactory, workerPoolSize int, metadataStore digestmeta.MetadataStore) (*FileDiffStore, error) {
 	if client == nil {
 		client = util.NewTimeoutClient()
 	}
@@ -162,6 +189,8 @@ func NewFileDiffStore(client *http.Client, baseDir, gsBucketName string, storage
 		localTempFileDir:    fileutil.Must(fileutil.EnsureDirExists(filepath.Join(baseDir, DEFAULT_TEMPFILE_DIR_NAME))),
 		gsBucketName:        gsBucketName,
 		storageBaseDir:      storageBaseDir,
+		metadataStore:       metadataStore,
+		exts:                map[string]string{},
 		imageCache:          imageCache,
 		diffCache:           diffCache,
 		unavailableDigests:  map[string]bool{},
@@ -223,7 +252,9 @@ func (fs *FileDiffStore) activateWorkers(workerPoolSize int) {
 }
 
 // getOne uses the following algorithm:
-// 1. Look for the DiffMetrics of the digests in the local cache.
+// 1. Look for the DiffMetrics of the digests in the local cache. DiffMetrics
+//    that were calculated by an older version of the diff package or with a
+//    different tolerance are ignored.
 // If found:
 //     2. Return the DiffMetrics.
 // Else:
@@ -237,7 +268,7 @@ func (fs *FileDiffStore) getOne(dMain, dOther string) interface{} {
 
 	// 1. Check if the DiffMetrics exists in the memory cache.
 	baseName := getDiffBasename(dMain, dOther)
-	if obj, ok := fs.diffCache.Get(baseName); ok {
+	if obj, ok := fs.diffCache.Get(baseName); ok && obj.(*diff.DiffMetrics).Current() {
 		diffMetrics = obj.(*diff.DiffMetrics)
 	} else {
 		// Check if it's in the file cache.
@@ -246,6 +277,9 @@ func (fs *FileDiffStore) getOne(dMain, dOther string) interface{} {
 			glog.Errorf("Failed to getDiffMetricsFromFileCache for digest %s and digest %s: %s", dMain, dOther, err)
 			return nil
 		}
+		if diffMetrics != nil && !diffMetrics.Current() {
+			diffMetrics = nil
+		}
 
 		if diffMetrics != nil {
 			// 2. The DiffMetrics exists locally return it.
@@ -296,7 +330,12 @@ func (fs *FileDiffStore) absPathOne(digest string) interface{} {
 		return nil
 	}
 	// 2. Find and return the absolute path to the digest.
-	return fs.getDigestImagePath(digest)
+	ext, _, err := fs.digestExt(digest)
+	if err != nil {
+		glog.Errorf("Failed to find the extension of digest %s: %s", digest, err)
+		return nil
+	}
+	return fs.getDigestImagePath(digest, ext)
 }
 
 // Get documentation is found in the diff.DiffStore interface.
@@ -435,6 +474,62 @@ func (fs *FileDiffStore) CalculateDiffs(digests []string) {
 	wg.Wait()
 }
 
+// RenderPath is part of the diff.DiffStore interface. See details there.
+//
+// Rendered images are cached in a subdirectory of the diff directory named
+// after the render mode.
+func (fs *FileDiffStore) RenderPath(left, right, mode string) (string, error) {
+	if !diff.ValidDigest(left) || !diff.ValidDigest(right) {
+		return "", fmt.Errorf("Invalid digests: %q %q", left, right)
+	}
+	found := false
+	for _, m := range diff.RENDER_MODES {
+		found = found || (m == mode)
+	}
+	if !found {
+		return "", fmt.Errorf("Unknown render mode: %s", mode)
+	}
+
+	renderDir := filepath.Join(fs.localDiffDir, mode)
+	path := filepath.Join(renderDir, fmt.Sprintf("%s-%s.%s", left, right, diff.RenderExt(mode)))
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	images := make([]image.Image, 2)
+	for i, d := range []string{left, right} {
+		if err := fs.ensureDigestInCache(d); err != nil {
+			return "", err
+		}
+		var err error
+		if images[i], err = fs.getDigestImage(d); err != nil {
+			return "", err
+		}
+	}
+
+	// Render into a temporary file and move it into place, so concurrent
+	// requests never see a partially written image.
+	if _, err := fileutil.EnsureDirExists(renderDir); err != nil {
+		return "", fmt.Errorf("Unable to create render directory: %s", err)
+	}
+	tempOut, err := ioutil.TempFile(fs.localTempFileDir, fmt.Sprintf("render-%s-%s-%s", mode, left, right))
+	if err != nil {
+		return "", fmt.Errorf("Unable to create temp file: %s", err)
+	}
+	if err := diff.Render(mode, images[0], images[1], tempOut); err != nil {
+		util.Close(tempOut)
+		util.Remove(tempOut.Name())
+		return "", fmt.Errorf("Unable to render %s of %s and %s: %s", mode, left, right, err)
+	}
+	if err := tempOut.Close(); err != nil {
+		return "", fmt.Errorf("Error closing temp file: %s", err)
+	}
+	if err := os.Rename(tempOut.Name(), path); err != nil {
+		return "", fmt.Errorf("Unable to move file: %s", err)
+	}
+	return path, nil
+}
+
 func openDiffMetrics(filepath string) (*diff.DiffMetrics, error) {
 	f, err := ioutil.ReadFile(filepath)
 	if err != nil {
@@ -510,26 +605,80 @@ func (fs *FileDiffStore) getDiffMetricsFromFileCache(baseName string) (*diff.Dif
 }
 
 // ensureDigestInCache checks if the image corresponding to digest is cached
-// localy. If not it will download it from GS.
+// localy. If not it will download it from GS. A digest without metadata is
+// fetched as a PNG, but a failure is not counted against it, since it might
+// have another extension. It is fetched again once its metadata arrives.
 func (fs *FileDiffStore) ensureDigestInCache(d string) error {
-	exists, err := fs.isDigestInCache(d)
+	// Make sure we are able to handle the digest before downloading it.
+	ext, known, err := fs.digestExt(d)
 	if err != nil {
 		return err
 	}
-	if !exists {
-		// Digest does not exist locally, get it from Google Storage.
-		if err := fs.cacheImageFromGS(d); err != nil {
-			return err
-		}
+	exists, err := fs.isDigestInCache(d, ext)
+	if err != nil {
+		return err
 	}
-	return nil
+	if exists {
+		return nil
+	}
+
+	// Digest does not exist locally, get it from the image source or
+	// Google Storage.
+	if fs.imageSource != nil {
+		err = fs.cacheImageFromSource(d, ext)
+	} else if known {
+		err = fs.cacheImageFromGS(d, ext)
+	} else {
+		err = fs.fetchImageFromGS(d, ext)
+	}
+	if (err != nil) && !known {
+		return fmt.Errorf("Unable to fetch digest %s without metadata as %s, retrying once the metadata is ingested: %s", d, ext, err)
+	}
+	return err
+}
+
+// digestExt returns the extension of the digest reported by the metadata
+// store in lower case, or IMG_EXTENSION for digests without metadata. The
+// returned bool is false if the extension is only a guess because the
+// metadata of the digest has not been ingested yet. It returns an error and
+// marks the digest as unavailable if images with the extension cannot be
+// decoded, see diff.IMAGE_FORMATS.
+func (fs *FileDiffStore) digestExt(d string) (string, bool, error) {
+	if fs.metadataStore == nil {
+		return IMG_EXTENSION, true, nil
+	}
+	fs.extMutex.Lock()
+	ext, ok := fs.exts[d]
+	fs.extMutex.Unlock()
+	if ok {
+		return ext, true, nil
+	}
+
+	ext, err := fs.metadataStore.Ext(d)
+	if err != nil {
+		return "", false, fmt.Errorf("Unable to retrieve extension of digest %s: %s", d, err)
+	}
+	// The metadata might only be ingested later, so digests without it are
+	// not cached.
+	if ext == "" {
+		return IMG_EXTENSION, false, nil
+	}
+	ext = strings.ToLower(ext)
+	if !diff.SupportedExt(ext) {
+		fs.unavailableChan <- d
+		return "", true, fmt.Errorf("Digest %s has unsupported extension '%s'", d, ext)
+	}
+	fs.extMutex.Lock()
+	fs.exts[d] = ext
+	fs.extMutex.Unlock()
+	return ext, true, nil
 }
 
 // This method looks for the specified digest from the local image dir. It is
 // thread safe because it locks the diff store's mutext before accessing the digest
 // cache.
-func (fs *FileDiffStore) isDigestInCache(d string) (bool, error) {
-	digestFilePath := fs.getDigestImagePath(d)
+func (fs *FileDiffStore) isDigestInCache(d, ext string) (bool, error) {
+	digestFilePath := fs.getDigestImagePath(d, ext)
 	// Lock the mutex before reading from the local digest directory.
 	fs.digestDirLock.Lock()
 	defer fs.digestDirLock.Unlock()
@@ -550,16 +699,25 @@ func (fs *FileDiffStore) isDigestInCache(d string) (bool, error) {
 // digest cache. If the provided digest does not exist in Google Storage then
 // downloadFailureCount is incremented.
 //
-func (fs *FileDiffStore) cacheImageFromGS(d string) error {
+func (fs *FileDiffStore) cacheImageFromGS(d, ext string) error {
+	err := fs.fetchImageFromGS(d, ext)
+	if err != nil {
+		downloadFailureCount.Inc(1)
+	}
+	return err
+}
+
+// fetchImageFromGS does the work of cacheImageFromGS without counting
+// failures.
+func (fs *FileDiffStore) fetchImageFromGS(d, ext string) error {
 	storage, err := storage.New(fs.client)
 	if err != nil {
 		return fmt.Errorf("Failed to create interface to Google Storage: %s\n", err)
 	}
 
-	objLocation := filepath.Join(fs.storageBaseDir, fmt.Sprintf("%s.%s", d, IMG_EXTENSION))
+	objLocation := filepath.Join(fs.storageBaseDir, fmt.Sprintf("%s.%s", d, ext))
 	res, err := storage.Objects.Get(fs.gsBucketName, objLocation).Do()
 	if err != nil {
-		downloadFailureCount.Inc(1)
 		return err
 	}
 
@@ -606,7 +764,7 @@ func (fs *FileDiffStore) cacheImageFromGS(d string) error {
 			}
 
 			// Rename the file after we acquired a lock
-			outputFile := filepath.Join(fs.localImgDir, fmt.Sprintf("%s.png", d))
+			outputFile := fs.getDigestImagePath(d, ext)
 			fs.digestDirLock.Lock()
 			defer fs.digestDirLock.Unlock()
 			if err := os.Rename(tempOut.Name(), outputFile); err != nil {
@@ -625,7 +783,6 @@ func (fs *FileDiffStore) cacheImageFromGS(d string) error {
 
 	if err != nil {
 		glog.Errorf("Failed fetching file after %d attempts", MAX_URI_GET_TRIES)
-		downloadFailureCount.Inc(1)
 	}
 	return err
 }
@@ -666,7 +823,7 @@ func (fs *FileDiffStore) diff(d1, d2 string) (*diff.DiffMetrics, error) {
 	baseName := getDiffBasename(d1, d2)
 
 	// Write the diff image to disk.
-	diffFilename := fmt.Sprintf("%s.%s", baseName, IMG_EXTENSION)
+	diffFilename := fmt.Sprintf("%s.%s", baseName, DIFF_EXTENSION)
 	f, err := os.Create(filepath.Join(fs.localDiffDir, diffFilename))
 	if err != nil {
 		return nil, err
@@ -690,23 +847,32 @@ func (fs *FileDiffStore) getDigestImage(d string) (image.Image, error) {
 	if obj, ok := fs.imageCache.Get(d); ok {
 		return obj.(image.Image), nil
 	}
+	ext, known, err := fs.digestExt(d)
+	if err != nil {
+		return nil, err
+	}
 	// TODO Should be changed to a safe write that writes to a tmp file then renames it.
-	img, err = diff.OpenImage(fs.getDigestImagePath(d))
+	img, err = diff.OpenImage(fs.getDigestImagePath(d, ext))
 	if err == nil {
 		fs.imageCache.Add(d, img)
 		return img, nil
 	}
 
-	// Mark the image as unavailable since we were not able to decode it.
-	fs.unavailableChan <- d
+	// Mark the image as unavailable since we were not able to decode it,
+	// unless the extension was only guessed. Once the metadata arrives the
+	// digest is fetched again with the right extension.
+	if known {
+		fs.unavailableChan <- d
+	}
 
 	return nil, fmt.Errorf("Unable to read image for %s: %s", d, err)
 }
 
 // getDigestPath returns the filepath where the image corresponding to the
-// give digests should be stored.
-func (fs *FileDiffStore) getDigestImagePath(digest string) string {
-	return filepath.Join(fs.localImgDir, fmt.Sprintf("%s.%s", digest, IMG_EXTENSION))
+// give digests should be stored. The file keeps the extension of the digest,
+// see digestExt.
+func (fs *FileDiffStore) getDigestImagePath(digest, ext string) string {
+	return filepath.Join(fs.localImgDir, fmt.Sprintf("%s.%s", digest, ext))
 }
 
 // getDiffMetricPath returns the filename where the diffmetric should be
@@ -12,6 +12,7 @@ import (
 	assert "github.com/stretchr/testify/require"
 	"go.skia.org/infra/go/testutils"
 	"go.skia.org/infra/golden/go/diff"
+	"go.skia.org/infra/golden/go/digestmeta"
 )
 
 const (
@@ -54,7 +55,7 @@ func getTestFileDiffStore(t *testing.T, storageBaseDir string, cleanBaseDir bool
 	}
 
 	gsBucketName := "chromium-skia-gm"
-	temp, err := NewFileDiffStore(nil, baseDir, gsBucketName, storageBaseDir, MemCacheFactory, RECOMMENDED_WORKER_POOL_SIZE)
+	temp, err := NewFileDiffStore(nil, baseDir, gsBucketName, storageBaseDir, MemCacheFactory, RECOMMENDED_WORKER_POOL_SIZE, nil)
 	assert.Nil(t, err)
 	ret := temp.(*FileDiffStore)
 
@@ -67,6 +68,13 @@ func getTestFileDiffStore(t *testing.T, storageBaseDir string, cleanBaseDir bool
 		PixelDiffFilePath: diffpath1_2,
 		MaxRGBADiffs:      []int{0, 0, 1, 0},
 		DimDiffer:         false,
+		SSIM:              0.9999988586432543,
+		MeanDeltaE:        0.005542511316439293,
+		MaxDeltaE:         0.6808069736335919,
+		DeltaETolerance:   diff.DeltaETolerance,
+		BitDepth:          8,
+		ColorSpace:        "sRGB",
+		MetricsVersion:    diff.METRICS_VERSION,
 	}
 	relExpectedDiffMetrics1_2 = &diff.DiffMetrics{}
 	*relExpectedDiffMetrics1_2 = *expectedDiffMetrics1_2
@@ -80,6 +88,10 @@ func getTestFileDiffStore(t *testing.T, storageBaseDir string, cleanBaseDir bool
 		PixelDiffFilePath: diffpath1_3,
 		MaxRGBADiffs:      []int{248, 90, 113, 0},
 		DimDiffer:         true,
+		DeltaETolerance:   diff.DeltaETolerance,
+		BitDepth:          8,
+		ColorSpace:        "sRGB",
+		MetricsVersion:    diff.METRICS_VERSION,
 	}
 
 	return ret
@@ -94,7 +106,7 @@ func TestFindDigestFromDir(t *testing.T) {
 	fds := getTestFileDiffStore(t, "", true)
 
 	for digest, expectedValue := range digestsToExpectedResults {
-		ret, err := fds.isDigestInCache(digest)
+		ret, err := fds.isDigestInCache(digest, IMG_EXTENSION)
 		if err != nil {
 			t.Error("Unexpected error: ", err)
 		}
@@ -121,12 +133,53 @@ func TestGetDiffMetricFromDir(t *testing.T) {
 	}
 }
 
+func TestStaleDiffMetrics(t *testing.T) {
+	fds := getTestFileDiffStore(t, "", true)
+
+	// DiffMetrics written by an older version are recalculated.
+	stale := &diff.DiffMetrics{}
+	*stale = *relExpectedDiffMetrics1_2
+	stale.NumDiffPixels = 1
+	stale.MetricsVersion = 0
+	assert.False(t, stale.Current())
+	assert.Nil(t, fds.writeDiffMetricsToFileCache(getDiffBasename(TEST_DIGEST1, TEST_DIGEST2), stale))
+
+	diffMetricsMap, err := fds.Get(TEST_DIGEST1, []string{TEST_DIGEST2})
+	assert.Nil(t, err)
+	assert.Equal(t, expectedDiffMetrics1_2, diffMetricsMap[TEST_DIGEST2])
+}
+
+func TestRenderPath(t *testing.T) {
+	fds := getTestFileDiffStore(t, "", true)
+
+	for _, mode := range diff.RENDER_MODES {
+		path, err := fds.RenderPath(TEST_DIGEST1, TEST_DIGEST2, mode)
+		assert.Nil(t, err)
+		assert.Equal(t, filepath.Join(fds.localDiffDir, mode, fmt.Sprintf("%s-%s.%s", TEST_DIGEST1, TEST_DIGEST2, diff.RenderExt(mode))), path)
+		fi, err := os.Stat(path)
+		assert.Nil(t, err)
+
+		// The second request is served from the cache.
+		path2, err := fds.RenderPath(TEST_DIGEST1, TEST_DIGEST2, mode)
+		assert.Nil(t, err)
+		assert.Equal(t, path, path2)
+		fi2, err := os.Stat(path)
+		assert.Nil(t, err)
+		assert.Equal(t, fi.ModTime(), fi2.ModTime())
+	}
+
+	_, err := fds.RenderPath(TEST_DIGEST1, TEST_DIGEST2, "unknown")
+	assert.NotNil(t, err)
+	_, err = fds.RenderPath("../"+TEST_DIGEST1, TEST_DIGEST2, diff.RENDER_ZOOM)
+	assert.NotNil(t, err)
+}
+
 func TestCacheImageFromGS(t *testing.T) {
 	fds := getTestFileDiffStore(t, TESTDATA_DIR, true)
 	imgFilePath := filepath.Join(fds.localImgDir, fmt.Sprintf("%s.%s", TEST_DIGEST3, IMG_EXTENSION))
 	defer testutils.Remove(t, imgFilePath)
 
-	err := fds.cacheImageFromGS(TEST_DIGEST3)
+	err := fds.cacheImageFromGS(TEST_DIGEST3, IMG_EXTENSION)
 	assert.Nil(t, err)
 
 	if _, err := os.Stat(imgFilePath); err != nil {
@@ -136,7 +189,7 @@ func TestCacheImageFromGS(t *testing.T) {
 
 	// Test error and assert the download failures map.
 	for i := 1; i < 6; i++ {
-		if err := fds.cacheImageFromGS(MISSING_DIGEST); err == nil {
+		if err := fds.cacheImageFromGS(MISSING_DIGEST, IMG_EXTENSION); err == nil {
 			t.Error("Was expecting 404 error for missing digest")
 		}
 		assert.Equal(t, 1, downloadSuccessCount.Count())
@@ -160,6 +213,24 @@ func TestDiff(t *testing.T) {
 	assert.Equal(t, relExpectedDiffMetrics1_2, diffMetrics)
 }
 
+// assertDiffMetrics1_3 compares the given DiffMetrics to expectedDiffMetrics1_3.
+// TEST_DIGEST3 is only available in Google Storage, so the expected perceptual
+// metrics are calculated from the images in the cache of fds.
+func assertDiffMetrics1_3(t *testing.T, fds *FileDiffStore, actual *diff.DiffMetrics) {
+	img1, err := diff.OpenImage(fds.getDigestImagePath(TEST_DIGEST1, IMG_EXTENSION))
+	assert.Nil(t, err)
+	img3, err := diff.OpenImage(fds.getDigestImagePath(TEST_DIGEST3, IMG_EXTENSION))
+	assert.Nil(t, err)
+	dm, _ := diff.Diff(img1, img3)
+
+	expected := *expectedDiffMetrics1_3
+	expected.SSIM = dm.SSIM
+	expected.MeanDeltaE = dm.MeanDeltaE
+	expected.MaxDeltaE = dm.MaxDeltaE
+	expected.NumPixelsOverTolerance = dm.NumPixelsOverTolerance
+	assert.Equal(t, &expected, actual)
+}
+
 func assertFileExists(filePath string, t *testing.T) {
 	if _, err := os.Stat(filePath); err != nil {
 		_, _, line, _ := runtime.Caller(1)
@@ -179,6 +250,25 @@ func TestAbsPath(t *testing.T) {
 	assert.Equal(t, 0, len(digestToPaths))
 }
 
+func TestNonPNGDigest(t *testing.T) {
+	fds := getTestFileDiffStore(t, TESTDATA_DIR, true)
+	metadataStore := digestmeta.NewMemMetadataStore()
+	fds.metadataStore = metadataStore
+	assert.Nil(t, metadataStore.Update([]*digestmeta.DigestMetadata{
+		digestmeta.New("test1", TEST_DIGEST1, nil, map[string]string{"ext": "png"}),
+		digestmeta.New("test2", MISSING_DIGEST, nil, map[string]string{"ext": "pdf"}),
+	}))
+
+	// Digests that are PNGs or without metadata are still handled.
+	digestToPaths := fds.AbsPath([]string{TEST_DIGEST1, TEST_DIGEST2, MISSING_DIGEST})
+	assert.Equal(t, 2, len(digestToPaths))
+
+	// The PDF is reported as an error and never downloaded.
+	assert.NotNil(t, fds.ensureDigestInCache(MISSING_DIGEST))
+	_, err := os.Stat(fds.getDigestImagePath(MISSING_DIGEST, "pdf"))
+	assert.True(t, os.IsNotExist(err))
+}
+
 func timeTrack(start time.Time, name string) {
 	elapsed := time.Since(start)
 	fmt.Printf("%s took %s", name, elapsed)
@@ -287,7 +377,7 @@ func TestGet_e2e(t *testing.T) {
 	assertFileExists(diffFilePath, t)
 	assertFileExists(diffMetricsFilePath, t)
 	assert.Equal(t, 1, len(diffMetricsMap3))
-	assert.Equal(t, expectedDiffMetrics1_3, diffMetricsMap3[TEST_DIGEST3])
+	assertDiffMetrics1_3(t, fds3, diffMetricsMap3[TEST_DIGEST3])
 	assert.Equal(t, 1, downloadSuccessCount.Count())
 	assert.Equal(t, 1, downloadFailureCount.Count())
 
@@ -309,7 +399,7 @@ func TestGet_e2e(t *testing.T) {
 	assertFileExists(diffMetricsFilePath, t)
 	assert.Equal(t, 2, len(diffMetricsMap5))
 	assert.Equal(t, expectedDiffMetrics1_2, diffMetricsMap5[TEST_DIGEST2])
-	assert.Equal(t, expectedDiffMetrics1_3, diffMetricsMap5[TEST_DIGEST3])
+	assertDiffMetrics1_3(t, fds5, diffMetricsMap5[TEST_DIGEST3])
 	assert.Equal(t, 1, downloadFailureCount.Count())
 
 	// diffFilePath, diffMetricsFilePath, and newImageFilePath will be removed
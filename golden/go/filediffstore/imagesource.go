@@ -0,0 +1,151 @@
+package filediffstore
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/golden/go/diff"
+	"go.skia.org/infra/golden/go/digestmeta"
+	"go.skia.org/infra/golden/go/image/text"
+	"golang.org/x/image/bmp"
+)
+
+// ImageSource provides the images of digests that are not in the local image
+// directory of a FileDiffStore yet. It replaces Google Storage in a
+// FileDiffStore created by NewOfflineDiffStore.
+type ImageSource interface {
+	// Open returns the image of the given digest encoded in the format of
+	// the given extension, see diff.IMAGE_FORMATS. It returns an error for
+	// which os.IsNotExist is true if the digest is unknown. The caller must
+	// close the returned io.ReadCloser.
+	Open(digest, ext string) (io.ReadCloser, error)
+}
+
+// DirImageSource is an ImageSource that reads images named <digest>.<ext>
+// from a local directory, e.g. a copy of the images in Google Storage.
+type DirImageSource string
+
+// Open, see ImageSource interface.
+func (d DirImageSource) Open(digest, ext string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), fmt.Sprintf("%s.%s", digest, ext)))
+}
+
+// MemImageSource is an ImageSource that serves images from memory.
+type MemImageSource struct {
+	images map[string]image.Image
+	mutex  sync.Mutex
+}
+
+// NewMemImageSource returns a MemImageSource that serves the given images
+// keyed by digest.
+func NewMemImageSource(images map[string]image.Image) *MemImageSource {
+	ret := &MemImageSource{
+		images: map[string]image.Image{},
+	}
+	for digest, img := range images {
+		ret.Add(digest, img)
+	}
+	return ret
+}
+
+// Add adds or replaces the image of the given digest.
+func (m *MemImageSource) Add(digest string, img image.Image) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.images[digest] = img
+}
+
+// Open, see ImageSource interface.
+func (m *MemImageSource) Open(digest, ext string) (io.ReadCloser, error) {
+	m.mutex.Lock()
+	img, ok := m.images[digest]
+	m.mutex.Unlock()
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: digest, Err: os.ErrNotExist}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := encodeImage(buf, img, ext); err != nil {
+		return nil, fmt.Errorf("Unable to encode image of digest %s: %s", digest, err)
+	}
+	return ioutil.NopCloser(buf), nil
+}
+
+// encodeImage writes img to w in the format of the given extension.
+func encodeImage(w io.Writer, img image.Image, ext string) error {
+	switch ext {
+	case "png":
+		return png.Encode(w, img)
+	case "jpg", "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 100})
+	case "gif":
+		return gif.Encode(w, img, nil)
+	case "bmp":
+		return bmp.Encode(w, img)
+	case "sktext":
+		if img16, ok := img.(*image.NRGBA64); ok {
+			return text.Encode16(w, img16)
+		}
+		nrgba, ok := img.(*image.NRGBA)
+		if !ok {
+			nrgba = image.NewNRGBA(img.Bounds())
+			draw.Draw(nrgba, img.Bounds(), img, img.Bounds().Min, draw.Src)
+		}
+		return text.Encode(w, nrgba)
+	}
+	return fmt.Errorf("Unsupported extension '%s'", ext)
+}
+
+// NewOfflineDiffStore returns a FileDiffStore that retrieves images from
+// the given ImageSource instead of Google Storage. Apart from that it
+// behaves like a DiffStore returned by NewFileDiffStore, i.e. images, diff
+// images and DiffMetrics are cached in baseDir.
+func NewOfflineDiffStore(source ImageSource, baseDir string, cacheFactory CacheFactory, workerPoolSize int, metadataStore digestmeta.MetadataStore) (diff.DiffStore, error) {
+	fs, err := newFileDiffStore(nil, baseDir, "", "", cacheFactory, workerPoolSize, metadataStore)
+	if err != nil {
+		return nil, err
+	}
+	fs.imageSource = source
+	return fs, nil
+}
+
+// cacheImageFromSource copies the image of the given digest with the given
+// extension from the ImageSource to the local image directory.
+func (fs *FileDiffStore) cacheImageFromSource(d, ext string) error {
+	r, err := fs.imageSource.Open(d, ext)
+	if err != nil {
+		return err
+	}
+	defer util.Close(r)
+
+	tempOut, err := ioutil.TempFile(fs.localTempFileDir, fmt.Sprintf("tempfile-%s", d))
+	if err != nil {
+		return fmt.Errorf("Unable to create temp file: %s", err)
+	}
+	if _, err := io.Copy(tempOut, r); err != nil {
+		util.Close(tempOut)
+		util.Remove(tempOut.Name())
+		return fmt.Errorf("Unable to copy image of digest %s: %s", d, err)
+	}
+	if err := tempOut.Close(); err != nil {
+		return fmt.Errorf("Error closing temp file: %s", err)
+	}
+
+	fs.digestDirLock.Lock()
+	defer fs.digestDirLock.Unlock()
+	if err := os.Rename(tempOut.Name(), fs.getDigestImagePath(d, ext)); err != nil {
+		return fmt.Errorf("Unable to move file: %s", err)
+	}
+	return nil
+}
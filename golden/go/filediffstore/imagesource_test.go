@@ -0,0 +1,228 @@
+package filediffstore
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/go/testutils"
+	"go.skia.org/infra/golden/go/diff"
+	"go.skia.org/infra/golden/go/digestmeta"
+)
+
+func TestOfflineDiffStoreDir(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "offline-diffstore")
+	assert.Nil(t, err)
+	defer testutils.RemoveAll(t, baseDir)
+
+	store, err := NewOfflineDiffStore(DirImageSource(filepath.Join(TESTDATA_DIR, "images")), baseDir, MemCacheFactory, 10, nil)
+	assert.Nil(t, err)
+	fds := store.(*FileDiffStore)
+
+	diffMetrics, err := store.Get(TEST_DIGEST1, []string{TEST_DIGEST2, MISSING_DIGEST})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(diffMetrics))
+	dm := diffMetrics[TEST_DIGEST2]
+	assert.Equal(t, 2233, dm.NumDiffPixels)
+	assert.Equal(t, []int{0, 0, 1, 0}, dm.MaxRGBADiffs)
+	assert.Equal(t, filepath.Join(fds.localDiffDir, fmt.Sprintf("%s-%s.%s", TEST_DIGEST1, TEST_DIGEST2, DIFF_EXTENSION)), dm.PixelDiffFilePath)
+	assertFileExists(dm.PixelDiffFilePath, t)
+
+	// The images were copied into the local image directory.
+	paths := store.AbsPath([]string{TEST_DIGEST1, TEST_DIGEST2, MISSING_DIGEST})
+	assert.Equal(t, map[string]string{
+		TEST_DIGEST1: filepath.Join(baseDir, DEFAULT_IMG_DIR_NAME, TEST_DIGEST1+"."+IMG_EXTENSION),
+		TEST_DIGEST2: filepath.Join(baseDir, DEFAULT_IMG_DIR_NAME, TEST_DIGEST2+"."+IMG_EXTENSION),
+	}, paths)
+	_, err = os.Stat(paths[TEST_DIGEST2])
+	assert.Nil(t, err)
+
+	// The main digest must exist.
+	_, err = store.Get(MISSING_DIGEST, []string{TEST_DIGEST1})
+	assert.NotNil(t, err)
+}
+
+func TestOfflineDiffStoreMem(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "offline-diffstore")
+	assert.Nil(t, err)
+	defer testutils.RemoveAll(t, baseDir)
+
+	white := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := range white.Pix {
+		white.Pix[i] = 0xff
+	}
+	dot := image.NewNRGBA(white.Bounds())
+	copy(dot.Pix, white.Pix)
+	dot.Set(1, 1, color.NRGBA{0xfe, 0xff, 0xff, 0xff})
+
+	source := NewMemImageSource(map[string]image.Image{"white": white})
+	store, err := NewOfflineDiffStore(source, baseDir, MemCacheFactory, 10, nil)
+	assert.Nil(t, err)
+
+	// Images can be added after the store was created.
+	source.Add("dot", dot)
+	source.Add("wide", image.NewNRGBA(image.Rect(0, 0, 8, 4)))
+
+	diffMetrics, err := store.Get("white", []string{"dot", "wide"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(diffMetrics))
+	assert.Equal(t, 1, diffMetrics["dot"].NumDiffPixels)
+	assert.Equal(t, []int{1, 0, 0, 0}, diffMetrics["dot"].MaxRGBADiffs)
+	assert.True(t, diffMetrics["wide"].DimDiffer)
+
+	// CalculateDiffs populates the caches for all pairs.
+	store.CalculateDiffs([]string{"white", "dot", "wide"})
+	_, err = os.Stat(filepath.Join(baseDir, DEFAULT_DIFFMETRICS_DIR_NAME, getDiffBasename("dot", "wide")+"."+DIFFMETRICS_EXTENSION))
+	for i := 0; os.IsNotExist(err) && i < 10; i++ {
+		// DiffMetrics are written to disk in the background.
+		time.Sleep(10 * time.Millisecond)
+		_, err = os.Stat(filepath.Join(baseDir, DEFAULT_DIFFMETRICS_DIR_NAME, getDiffBasename("dot", "wide")+"."+DIFFMETRICS_EXTENSION))
+	}
+	assert.Nil(t, err)
+
+	// Images that cannot be decoded are reported as unavailable.
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(baseDir, DEFAULT_IMG_DIR_NAME, "broken."+IMG_EXTENSION), []byte("not a png"), 0644))
+	diffMetrics, err = store.Get("white", []string{"broken"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(diffMetrics))
+	for i := 0; !store.UnavailableDigests()["broken"] && i < 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, store.UnavailableDigests()["broken"])
+
+	// Rendering works on the images from the source, but only for valid
+	// digests.
+	_, err = store.RenderPath("white", "dot", diff.RENDER_ZOOM)
+	assert.NotNil(t, err)
+	source.Add("aaaa", white)
+	source.Add("bbbb", dot)
+	path, err := store.RenderPath("aaaa", "bbbb", diff.RENDER_ZOOM)
+	assert.Nil(t, err)
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+}
+
+func TestOfflineDiffStoreFormats(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "offline-diffstore")
+	assert.Nil(t, err)
+	defer testutils.RemoveAll(t, baseDir)
+
+	white := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := range white.Pix {
+		white.Pix[i] = 0xff
+	}
+	dot := image.NewNRGBA(white.Bounds())
+	copy(dot.Pix, white.Pix)
+	dot.Set(1, 1, color.NRGBA{0x00, 0x00, 0x00, 0xff})
+
+	// The same images in all formats, keyed by digest.
+	digests := map[string]string{
+		"white": "png",
+		"dot":   "png",
+	}
+	images := map[string]image.Image{"white": white, "dot": dot}
+	metadata := []*digestmeta.DigestMetadata{}
+	for _, ext := range []string{"jpg", "gif", "bmp", "sktext"} {
+		digests["dot-"+ext] = ext
+		images["dot-"+ext] = dot
+		metadata = append(metadata, digestmeta.New("test", "dot-"+ext, nil, map[string]string{"ext": ext}))
+	}
+	metadata = append(metadata, digestmeta.New("test", "dot-tiff", nil, map[string]string{"ext": "tiff"}))
+	images["dot-tiff"] = dot
+	metadataStore := digestmeta.NewMemMetadataStore()
+	assert.Nil(t, metadataStore.Update(metadata))
+
+	store, err := NewOfflineDiffStore(NewMemImageSource(images), baseDir, MemCacheFactory, 10, metadataStore)
+	assert.Nil(t, err)
+
+	others := []string{}
+	for digest := range digests {
+		others = append(others, digest)
+	}
+	diffMetrics, err := store.Get("white", append(others, "dot-tiff"))
+	assert.Nil(t, err)
+	assert.Equal(t, len(digests), len(diffMetrics))
+	assert.Equal(t, 0, diffMetrics["white"].NumDiffPixels)
+	for digest, ext := range digests {
+		if digest == "white" {
+			continue
+		}
+		if ext == "jpg" {
+			// JPEG is lossy.
+			assert.True(t, diffMetrics[digest].NumDiffPixels >= 1, digest)
+		} else {
+			assert.Equal(t, 1, diffMetrics[digest].NumDiffPixels, digest)
+		}
+	}
+
+	// The images are cached with their extension.
+	paths := store.AbsPath(others)
+	for digest, ext := range digests {
+		assert.Equal(t, filepath.Join(baseDir, DEFAULT_IMG_DIR_NAME, digest+"."+ext), paths[digest])
+	}
+
+	// Only the digest with the unsupported extension is unavailable.
+	for i := 0; !store.UnavailableDigests()["dot-tiff"] && i < 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	unavailable := store.UnavailableDigests()
+	assert.True(t, unavailable["dot-tiff"])
+	for digest := range digests {
+		assert.False(t, unavailable[digest], digest)
+	}
+}
+
+func TestOfflineDiffStoreMissingMetadata(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "offline-diffstore")
+	assert.Nil(t, err)
+	defer testutils.RemoveAll(t, baseDir)
+	sourceDir, err := ioutil.TempDir("", "offline-diffstore-source")
+	assert.Nil(t, err)
+	defer testutils.RemoveAll(t, sourceDir)
+
+	white := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := range white.Pix {
+		white.Pix[i] = 0xff
+	}
+	metadataStore := digestmeta.NewMemMetadataStore()
+	assert.Nil(t, metadataStore.Update([]*digestmeta.DigestMetadata{digestmeta.New("test", "white", nil, map[string]string{"ext": "png"})}))
+	// misnamed.png is a JPEG.
+	files := map[string]string{"white.png": "png", "dot.jpg": "jpg", "misnamed.png": "jpg", "misnamed.jpg": "jpg"}
+	for name, ext := range files {
+		f, err := os.Create(filepath.Join(sourceDir, name))
+		assert.Nil(t, err)
+		assert.Nil(t, encodeImage(f, white, ext))
+		assert.Nil(t, f.Close())
+	}
+
+	store, err := NewOfflineDiffStore(DirImageSource(sourceDir), baseDir, MemCacheFactory, 10, metadataStore)
+	assert.Nil(t, err)
+
+	// Without metadata the JPEGs are fetched as PNGs, which either does not
+	// exist or cannot be decoded. Neither makes them unavailable.
+	diffMetrics, err := store.Get("white", []string{"dot", "misnamed"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(diffMetrics))
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, store.UnavailableDigests()["dot"])
+	assert.False(t, store.UnavailableDigests()["misnamed"])
+
+	// They are fetched once the metadata arrives.
+	assert.Nil(t, metadataStore.Update([]*digestmeta.DigestMetadata{
+		digestmeta.New("test", "dot", nil, map[string]string{"ext": "jpg"}),
+		digestmeta.New("test", "misnamed", nil, map[string]string{"ext": "jpg"}),
+	}))
+	diffMetrics, err = store.Get("white", []string{"dot", "misnamed"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(diffMetrics))
+	assert.Equal(t, map[string]string{
+		"dot":      filepath.Join(baseDir, DEFAULT_IMG_DIR_NAME, "dot.jpg"),
+		"misnamed": filepath.Join(baseDir, DEFAULT_IMG_DIR_NAME, "misnamed.jpg"),
+	}, store.AbsPath([]string{"dot", "misnamed"}))
+}
@@ -0,0 +1,107 @@
+// Package flaky finds traces that cycle between several digests from commit
+// to commit, e.g. because a GM draws nondeterministically. Every new digest
+// of such a trace shows up as untriaged, even though nothing changed.
+package flaky
+
+import (
+	"sort"
+
+	"go.skia.org/infra/golden/go/types"
+	ptypes "go.skia.org/infra/perf/go/types"
+)
+
+const (
+	// DEFAULT_THRESHOLD is the score above which a trace is considered
+	// flaky if no other threshold is given.
+	DEFAULT_THRESHOLD = 0.3
+
+	// MIN_SAMPLES is the minimum number of digests a trace needs before it
+	// can be considered flaky.
+	MIN_SAMPLES = 5
+)
+
+// FlakyTrace is a trace whose flakiness score is above the threshold.
+type FlakyTrace struct {
+	ID       string            `json:"id"`
+	TestName string            `json:"test"`
+	Params   map[string]string `json:"params"`
+	Score    float64           `json:"score"`
+
+	// Distinct is the number of distinct digests in the trace and Changes
+	// is the number of times the digest changed from one sample to the next.
+	Distinct int `json:"distinct"`
+	Changes  int `json:"changes"`
+}
+
+// Score returns the flakiness score of the given digests of a trace, ordered
+// by commit, together with the number of distinct digests and changes.
+// Missing digests are skipped. The score is the fraction of samples at which
+// the digest changes, scaled by 1-1/distinct. It is 0 for a trace that never
+// changes, small for a trace that changed once because of a real change and
+// close to 1 for a trace that has a different digest at every commit.
+func Score(values []string) (float64, int, int) {
+	distinct := map[string]bool{}
+	changes := 0
+	n := 0
+	last := ptypes.MISSING_DIGEST
+	for _, digest := range values {
+		if digest == ptypes.MISSING_DIGEST {
+			continue
+		}
+		if (last != ptypes.MISSING_DIGEST) && (digest != last) {
+			changes++
+		}
+		distinct[digest] = true
+		last = digest
+		n++
+	}
+	if n < MIN_SAMPLES {
+		return 0, len(distinct), changes
+	}
+
+	score := float64(changes) / float64(n-1) * (1 - 1/float64(len(distinct)))
+	return score, len(distinct), changes
+}
+
+// FindFlaky returns the traces in the tile whose score is above the given
+// threshold, keyed by trace id.
+func FindFlaky(tile *ptypes.Tile, threshold float64) map[string]*FlakyTrace {
+	ret := map[string]*FlakyTrace{}
+	tileLen := tile.LastCommitIndex() + 1
+	for id, trace := range tile.Traces {
+		gTrace := trace.(*ptypes.GoldenTrace)
+		score, distinct, changes := Score(gTrace.Values[:tileLen])
+		if score > threshold {
+			ret[id] = &FlakyTrace{
+				ID:       id,
+				TestName: gTrace.Params()[types.PRIMARY_KEY_FIELD],
+				Params:   gTrace.Params(),
+				Score:    score,
+				Distinct: distinct,
+				Changes:  changes,
+			}
+		}
+	}
+	return ret
+}
+
+// Sorted returns the given flaky traces sorted by decreasing score and id.
+func Sorted(flakyTraces map[string]*FlakyTrace) []*FlakyTrace {
+	ret := make([]*FlakyTrace, 0, len(flakyTraces))
+	for _, ft := range flakyTraces {
+		ret = append(ret, ft)
+	}
+	sort.Sort(flakyTraceSlice(ret))
+	return ret
+}
+
+type flakyTraceSlice []*FlakyTrace
+
+func (p flakyTraceSlice) Len() int { return len(p) }
+func (p flakyTraceSlice) Less(i, j int) bool {
+	if p[i].Score != p[j].Score {
+		return p[i].Score > p[j].Score
+	}
+	return p[i].ID < p[j].ID
+}
+func (p flakyTraceSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
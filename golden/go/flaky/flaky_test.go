@@ -0,0 +1,66 @@
+package flaky
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	ptypes "go.skia.org/infra/perf/go/types"
+)
+
+func TestScore(t *testing.T) {
+	MISS := ptypes.MISSING_DIGEST
+
+	// Traces that never change or are too short are not flaky.
+	score, distinct, changes := Score([]string{"a", "a", "a", "a", "a", "a"})
+	assert.Equal(t, 0.0, score)
+	assert.Equal(t, 1, distinct)
+	assert.Equal(t, 0, changes)
+	score, _, _ = Score([]string{"a", "b", "a", MISS, MISS, MISS})
+	assert.Equal(t, 0.0, score)
+
+	// A single change scores low.
+	score, distinct, changes = Score([]string{"a", "a", "a", "a", "a", "b", "b", "b", "b", "b", "b"})
+	assert.InDelta(t, 0.05, score, 0.0001)
+	assert.Equal(t, 2, distinct)
+	assert.Equal(t, 1, changes)
+
+	// Alternating digests score high, missing digests are skipped.
+	score, distinct, changes = Score([]string{"a", "b", MISS, "a", "b", "a"})
+	assert.InDelta(t, 0.5, score, 0.0001)
+	assert.Equal(t, 2, distinct)
+	assert.Equal(t, 4, changes)
+
+	// A new digest at every commit scores highest.
+	score, distinct, changes = Score([]string{"a", "b", "c", "d", "e"})
+	assert.InDelta(t, 0.8, score, 0.0001)
+	assert.Equal(t, 5, distinct)
+	assert.Equal(t, 4, changes)
+}
+
+func TestFindFlaky(t *testing.T) {
+	tile := ptypes.NewTile()
+	for i := 0; i < 6; i++ {
+		tile.Commits[i].CommitTime = int64(i + 1)
+	}
+	addTrace := func(id, name string, digests ...string) {
+		tr := ptypes.NewGoldenTrace()
+		tr.Params_["name"] = name
+		copy(tr.Values, digests)
+		tile.Traces[id] = tr
+	}
+	addTrace("t1", "foo", "a", "a", "a", "b", "b", "b")
+	addTrace("t2", "foo", "a", "b", "a", "b", "a", "b")
+	addTrace("t3", "bar", "a", "b", "c", "d", "e", "f")
+
+	found := FindFlaky(tile, DEFAULT_THRESHOLD)
+	assert.Equal(t, 2, len(found))
+	assert.Equal(t, "foo", found["t2"].TestName)
+	assert.Equal(t, 2, found["t2"].Distinct)
+	assert.Equal(t, 5, found["t2"].Changes)
+
+	sorted := Sorted(found)
+	assert.Equal(t, "t3", sorted[0].ID)
+	assert.Equal(t, "t2", sorted[1].ID)
+
+	assert.Equal(t, 0, len(FindFlaky(tile, 0.9)))
+}
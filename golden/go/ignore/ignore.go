@@ -0,0 +1,162 @@
+// Package ignore reports what ignore rules hide and reminds the owners of
+// ignore rules before their rules expire. Stale ignore rules can hide real
+// regressions for a long time.
+package ignore
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skia-dev/glog"
+	"go.skia.org/infra/golden/go/expstorage"
+	"go.skia.org/infra/golden/go/types"
+	ptypes "go.skia.org/infra/perf/go/types"
+)
+
+// AddCounts sets Count and UntriagedCount of the given rules. Count is the
+// number of traces in the tile a rule matches. UntriagedCount is the number
+// of untriaged digests in the traces a rule matches that do not appear in
+// any trace that is not ignored, i.e. the digests nobody sees because of the
+// ignore rules.
+func AddCounts(rules []*types.IgnoreRule, tile *ptypes.Tile, exp *expstorage.Expectations) error {
+	matcher, err := types.NewRuleMatcher(rules)
+	if err != nil {
+		return err
+	}
+
+	// The untriaged digests per rule and the ones that are visible, keyed by
+	// test name and digest.
+	untriagedByRule := make(map[*types.IgnoreRule]map[string]bool, len(rules))
+	visible := map[string]bool{}
+	for _, rule := range rules {
+		rule.Count = 0
+		rule.UntriagedCount = 0
+		untriagedByRule[rule] = map[string]bool{}
+	}
+
+	for _, trace := range tile.Traces {
+		gTrace := trace.(*ptypes.GoldenTrace)
+		testName := gTrace.Params()[types.PRIMARY_KEY_FIELD]
+		matched, isIgnored := matcher(gTrace.Params())
+		for _, rule := range matched {
+			rule.Count++
+		}
+		for _, digest := range gTrace.Values {
+			if digest == ptypes.MISSING_DIGEST {
+				continue
+			}
+			key := testName + ":" + digest
+			if !isIgnored {
+				visible[key] = true
+				continue
+			}
+			if exp.Classification(testName, digest) == types.UNTRIAGED {
+				for _, rule := range matched {
+					untriagedByRule[rule][key] = true
+				}
+			}
+		}
+	}
+
+	for rule, untriaged := range untriagedByRule {
+		for key := range untriaged {
+			if !visible[key] {
+				rule.UntriagedCount++
+			}
+		}
+	}
+	return nil
+}
+
+// Sender sends emails. It is implemented by email.GMail.
+type Sender interface {
+	Send(to []string, subject string, body string) error
+}
+
+// ExpiryNotifier emails the owner of an ignore rule, i.e. the user in
+// IgnoreRule.Name, when the rule is about to expire. A reminder is sent once
+// per expiration time, so extending a rule arms the reminder again. The sent
+// reminders are only tracked in memory, a restart can cause a reminder to be
+// sent again.
+type ExpiryNotifier struct {
+	store      types.IgnoreStore
+	sender     Sender
+	warnBefore time.Duration
+	ignoresURL string
+
+	// notified maps rule ids to the expiration time the last reminder was
+	// sent for.
+	notified map[int]time.Time
+	mutex    sync.Mutex
+}
+
+// NewExpiryNotifier returns an ExpiryNotifier that reminds owners the given
+// duration before their rules expire. ignoresURL is the page where the rules
+// can be extended and is included in the emails.
+func NewExpiryNotifier(store types.IgnoreStore, sender Sender, warnBefore time.Duration, ignoresURL string) *ExpiryNotifier {
+	return &ExpiryNotifier{
+		store:      store,
+		sender:     sender,
+		warnBefore: warnBefore,
+		ignoresURL: ignoresURL,
+		notified:   map[int]time.Time{},
+	}
+}
+
+// Start calls Notify in the given interval.
+func (e *ExpiryNotifier) Start(interval time.Duration) {
+	go func() {
+		for _ = range time.Tick(interval) {
+			if err := e.Notify(time.Now()); err != nil {
+				glog.Errorf("Unable to send ignore rule expiry reminders: %s", err)
+			}
+		}
+	}()
+}
+
+// Notify sends a reminder for every rule that expires within the warning
+// period after now and has not been reminded about yet. It returns the
+// first error encountered, but tries to send all reminders.
+func (e *ExpiryNotifier) Notify(now time.Time) error {
+	rules, err := e.store.List()
+	if err != nil {
+		return err
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var firstErr error
+	for _, rule := range rules {
+		if rule.Expires.After(now.Add(e.warnBefore)) || e.notified[rule.ID].Equal(rule.Expires) {
+			continue
+		}
+		if !strings.Contains(rule.Name, "@") {
+			glog.Warningf("Ignore rule %d has no owner with an email address: %q", rule.ID, rule.Name)
+			continue
+		}
+		subject, body := e.message(rule, now)
+		if err := e.sender.Send([]string{rule.Name}, subject, body); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Unable to send reminder for ignore rule %d: %s", rule.ID, err)
+			}
+			continue
+		}
+		e.notified[rule.ID] = rule.Expires
+	}
+	return firstErr
+}
+
+// message returns the subject and body of the reminder for the given rule.
+func (e *ExpiryNotifier) message(rule *types.IgnoreRule, now time.Time) (string, string) {
+	when := "expires on " + rule.Expires.UTC().Format(time.RFC1123)
+	if !rule.Expires.After(now) {
+		when = "expired on " + rule.Expires.UTC().Format(time.RFC1123)
+	}
+	subject := fmt.Sprintf("Gold ignore rule %s", when)
+	body := fmt.Sprintf("Your ignore rule %d %s.\n\nQuery: %s\nNote: %s\n\nIf the rule is still needed, extend it at %s, otherwise the traces it hides will show up for triage again.\n",
+		rule.ID, when, rule.Query, rule.Note, e.ignoresURL)
+	return subject, body
+}
@@ -0,0 +1,101 @@
+package ignore
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/golden/go/expstorage"
+	"go.skia.org/infra/golden/go/types"
+	ptypes "go.skia.org/infra/perf/go/types"
+)
+
+func TestAddCounts(t *testing.T) {
+	tile := ptypes.NewTile()
+	addTrace := func(id, testName, config string, digests ...string) {
+		tr := ptypes.NewGoldenTrace()
+		tr.Params_[types.PRIMARY_KEY_FIELD] = testName
+		tr.Params_["config"] = config
+		copy(tr.Values, digests)
+		tile.Traces[id] = tr
+	}
+	addTrace("t1", "foo", "gpu", "aaa", "bbb")
+	addTrace("t2", "foo", "8888", "aaa", "ccc")
+	addTrace("t3", "bar", "gpu", "ddd", "eee")
+	addTrace("t4", "bar", "565", "eee")
+
+	exp := expstorage.NewExpectations()
+	exp.AddDigests(map[string]types.TestClassification{
+		"bar": types.TestClassification{"ddd": types.POSITIVE},
+	})
+
+	r1 := types.NewIgnoreRule("jon@example.com", time.Now().Add(time.Hour), "config=gpu", "")
+	r2 := types.NewIgnoreRule("jon@example.com", time.Now().Add(time.Hour), "config=gpu&name=bar", "")
+	r3 := types.NewIgnoreRule("jon@example.com", time.Now().Add(time.Hour), "config=none", "")
+	rules := []*types.IgnoreRule{r1, r2, r3}
+	assert.NoError(t, AddCounts(rules, tile, exp))
+
+	// foo:aaa and bar:eee are also in traces that are not ignored and
+	// bar:ddd is positive.
+	assert.Equal(t, 2, r1.Count)
+	assert.Equal(t, 1, r1.UntriagedCount)
+	assert.Equal(t, 1, r2.Count)
+	assert.Equal(t, 0, r2.UntriagedCount)
+	assert.Equal(t, 0, r3.Count)
+	assert.Equal(t, 0, r3.UntriagedCount)
+
+	// Counts are reset on every call.
+	assert.NoError(t, AddCounts(rules, tile, exp))
+	assert.Equal(t, 2, r1.Count)
+	assert.Equal(t, 1, r1.UntriagedCount)
+}
+
+type mockSender struct {
+	sent []string
+	fail bool
+}
+
+func (m *mockSender) Send(to []string, subject string, body string) error {
+	if m.fail {
+		return fmt.Errorf("Unable to send.")
+	}
+	m.sent = append(m.sent, strings.Join(to, ",")+": "+subject)
+	return nil
+}
+
+func TestExpiryNotifier(t *testing.T) {
+	now := time.Now()
+	store := types.NewMemIgnoreStore()
+	r1 := types.NewIgnoreRule("jon@example.com", now.Add(time.Hour), "config=gpu", "")
+	r2 := types.NewIgnoreRule("jim@example.com", now.Add(72*time.Hour), "config=8888", "")
+	r3 := types.NewIgnoreRule("nobody", now.Add(time.Hour), "config=565", "")
+	for _, r := range []*types.IgnoreRule{r1, r2, r3} {
+		assert.NoError(t, store.Create(r))
+	}
+
+	sender := &mockSender{}
+	notifier := NewExpiryNotifier(store, sender, 24*time.Hour, "https://gold.skia.org/2/ignores")
+	assert.NoError(t, notifier.Notify(now))
+	assert.Equal(t, 1, len(sender.sent))
+	assert.True(t, strings.HasPrefix(sender.sent[0], "jon@example.com: Gold ignore rule expires on"))
+
+	// Reminders are only sent once.
+	assert.NoError(t, notifier.Notify(now))
+	assert.Equal(t, 1, len(sender.sent))
+
+	// Until the rule gets a new expiration time.
+	r1.Expires = now.Add(2 * time.Hour)
+	assert.NoError(t, store.Update(r1.ID, r1))
+	assert.NoError(t, notifier.Notify(now))
+	assert.Equal(t, 2, len(sender.sent))
+
+	// Failed reminders are retried.
+	sender.fail = true
+	assert.Error(t, notifier.Notify(now.Add(48*time.Hour)))
+	sender.fail = false
+	assert.NoError(t, notifier.Notify(now.Add(48*time.Hour)))
+	assert.Equal(t, 3, len(sender.sent))
+	assert.True(t, strings.HasPrefix(sender.sent[2], "jim@example.com:"))
+}
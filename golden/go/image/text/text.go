@@ -9,6 +9,9 @@
 // ...
 //
 // Where the pixel values are encoded as 0xRRGGBBAA.
+//
+// Images with 16 bits per channel use the header "! SKTEXTSIMPLE16" and
+// encode the pixel values as 0xRRRRGGGGBBBBAAAA.
 package text
 
 import (
@@ -21,42 +24,60 @@ import (
 	"strings"
 )
 
-const skTextHeader = "! SKTEXTSIMPLE\n"
+const (
+	skTextHeader   = "! SKTEXTSIMPLE\n"
+	skText16Header = "! SKTEXTSIMPLE16\n"
+)
 
-// dim returns the dimensions of the image.
-func dim(reader *bufio.Reader) (int, int, error) {
+// dim returns the dimensions of the image and the number of bytes per
+// channel.
+func dim(reader *bufio.Reader) (int, int, int, error) {
 	line, err := reader.ReadString('\n')
 	if err != nil {
-		return 0, 0, fmt.Errorf("Failed to read header from SKTEXT file: %s", err)
+		return 0, 0, 0, fmt.Errorf("Failed to read header from SKTEXT file: %s", err)
 	}
-	if line != skTextHeader {
-		return 0, 0, fmt.Errorf("Not a valid SKTEXT file: %q %q", line, skTextHeader)
+	channelBytes := 1
+	if line == skText16Header {
+		channelBytes = 2
+	} else if line != skTextHeader {
+		return 0, 0, 0, fmt.Errorf("Not a valid SKTEXT file: %q %q", line, skTextHeader)
 	}
 	line, err = reader.ReadString('\n')
 	if err != nil && err != io.EOF {
-		return 0, 0, fmt.Errorf("Failed to read dimenstions from SKTEXT file: %s", err)
+		return 0, 0, 0, fmt.Errorf("Failed to read dimenstions from SKTEXT file: %s", err)
 	}
 	width := 0
 	height := 0
 	n, err := fmt.Sscanf(line, "%d %d", &width, &height)
 	if err != nil {
-		return 0, 0, fmt.Errorf("Not a valid SKTEXT file: %s", err)
+		return 0, 0, 0, fmt.Errorf("Not a valid SKTEXT file: %s", err)
 	}
 	if n != 2 {
-		return 0, 0, fmt.Errorf("Not a valid SKTEXT file, couldn't find width and height.")
+		return 0, 0, 0, fmt.Errorf("Not a valid SKTEXT file, couldn't find width and height.")
 	}
-	return width, height, nil
+	return width, height, channelBytes, nil
 }
 
 // Decode reads an SKTEXT image from r and returns it as an image.Image.
-// The type of Image returned will always be NRGBA.
+// The type of Image returned will be NRGBA, or NRGBA64 for images with 16
+// bits per channel.
 func Decode(r io.Reader) (image.Image, error) {
 	reader := bufio.NewReader(r)
-	width, height, err := dim(reader)
+	width, height, channelBytes, err := dim(reader)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to decode SKTEXT config: %s", err)
 	}
-	ret := image.NewNRGBA(image.Rect(0, 0, width, height))
+	var ret image.Image
+	var pix []uint8
+	var stride int
+	if channelBytes == 2 {
+		img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+		ret, pix, stride = img, img.Pix, img.Stride
+	} else {
+		img := image.NewNRGBA(image.Rect(0, 0, width, height))
+		ret, pix, stride = img, img.Pix, img.Stride
+	}
+	pixelBytes := 4 * channelBytes
 	lineNum := 0
 	for {
 		if lineNum > height {
@@ -73,18 +94,20 @@ func Decode(r io.Reader) (image.Image, error) {
 		for i, h := range hexline {
 			h = strings.TrimSpace(h)
 			if h != "" {
-				if !strings.HasPrefix(h, "0x") || len(h) != 10 {
+				if !strings.HasPrefix(h, "0x") || len(h) != 2+2*pixelBytes {
+					if channelBytes == 2 {
+						return nil, fmt.Errorf("Invalid pixel format, must be 0xRRRRGGGGBBBBAAAA, got %q", h)
+					}
 					return nil, fmt.Errorf("Invalid pixel format, must be 0xRRGGBBAA, got %q", h)
 				}
-				rgba, err := strconv.ParseUint(strings.TrimSpace(h), 0, 32)
+				rgba, err := strconv.ParseUint(strings.TrimSpace(h), 0, 8*pixelBytes)
 				if err != nil {
 					return nil, err
 				}
-				offset := lineNum*ret.Stride + i*4
-				ret.Pix[offset+0] = uint8((rgba >> 24) & 0xff)
-				ret.Pix[offset+1] = uint8((rgba >> 16) & 0xff)
-				ret.Pix[offset+2] = uint8((rgba >> 8) & 0xff)
-				ret.Pix[offset+3] = uint8((rgba >> 0) & 0xff)
+				offset := lineNum*stride + i*pixelBytes
+				for b := 0; b < pixelBytes; b++ {
+					pix[offset+b] = uint8((rgba >> uint(8*(pixelBytes-1-b))) & 0xff)
+				}
 			}
 		}
 		lineNum += 1
@@ -102,13 +125,17 @@ func Decode(r io.Reader) (image.Image, error) {
 // decoding the entire image.
 func DecodeConfig(r io.Reader) (image.Config, error) {
 	reader := bufio.NewReader(r)
-	width, height, err := dim(reader)
+	width, height, channelBytes, err := dim(reader)
 	if err != nil {
 		return image.Config{}, fmt.Errorf("Failed to Decode SKTEXT file: %s", err)
 	}
 
+	model := color.NRGBAModel
+	if channelBytes == 2 {
+		model = color.NRGBA64Model
+	}
 	return image.Config{
-		ColorModel: color.NRGBAModel,
+		ColorModel: model,
 		Width:      width,
 		Height:     height,
 	}, nil
@@ -116,17 +143,27 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 
 // Encode encoded the image in SKTEXT format.
 func Encode(w io.Writer, m *image.NRGBA) error {
-	fmt.Fprintf(w, "%s%d %d\n", skTextHeader, m.Rect.Dx(), m.Rect.Dy())
-	height := m.Bounds().Dy()
-	for i := 0; i < len(m.Pix); i += 4 {
-		_, err := fmt.Fprintf(w, "0x%02x%02x%02x%02x", m.Pix[i+0], m.Pix[i+1], m.Pix[i+2], m.Pix[i+3])
+	return encode(w, skTextHeader, m.Pix, m.Stride, m.Rect, 4)
+}
+
+// Encode16 encodes the image in the SKTEXT format with 16 bits per channel.
+func Encode16(w io.Writer, m *image.NRGBA64) error {
+	return encode(w, skText16Header, m.Pix, m.Stride, m.Rect, 8)
+}
+
+// encode writes the pixels with pixelBytes bytes each in SKTEXT format.
+func encode(w io.Writer, header string, pix []uint8, stride int, rect image.Rectangle, pixelBytes int) error {
+	fmt.Fprintf(w, "%s%d %d\n", header, rect.Dx(), rect.Dy())
+	height := rect.Dy()
+	for i := 0; i < len(pix); i += pixelBytes {
+		_, err := fmt.Fprintf(w, "0x%x", pix[i:i+pixelBytes])
 		if err != nil {
 			return err
 		}
 		// Add whitespace.
-		if (i > 0 || m.Stride == 4) && (i+4)%m.Stride == 0 {
+		if (i > 0 || stride == pixelBytes) && (i+pixelBytes)%stride == 0 {
 			// Don't add a trailing \n to the very last line.
-			if (i+4)/m.Stride < height {
+			if (i+pixelBytes)/stride < height {
 				fmt.Fprintln(w)
 			}
 		} else {
@@ -138,4 +175,5 @@ func Encode(w io.Writer, m *image.NRGBA) error {
 
 func init() {
 	image.RegisterFormat("sktext", skTextHeader, Decode, DecodeConfig)
+	image.RegisterFormat("sktext16", skText16Header, Decode, DecodeConfig)
 }
@@ -3,6 +3,7 @@ package text
 import (
 	"bytes"
 	"image"
+	"image/color"
 	"testing"
 )
 
@@ -140,3 +141,55 @@ func TestRoundTrip(t *testing.T) {
 		}
 	}
 }
+
+const IMAGE_16 = `! SKTEXTSIMPLE16
+2 2
+0x1111222233334444 0xffffffffffffffff
+0xddddeeeeffff0000 0xffffffffffff8888`
+
+const BAD_IMAGE_16 = `! SKTEXTSIMPLE16
+1 1
+0x112233ff`
+
+func TestDecoder16(t *testing.T) {
+	img, err := Decode(bytes.NewBufferString(IMAGE_16))
+	if err != nil {
+		t.Fatalf("Failed to decode a valid image: %s", err)
+	}
+	nrgba := img.(*image.NRGBA64)
+	if got, want := nrgba.Bounds(), image.Rect(0, 0, 2, 2); got != want {
+		t.Errorf("Wrong dims: Got %v Want %v", got, want)
+	}
+	if got, want := nrgba.NRGBA64At(0, 0), (color.NRGBA64{R: 0x1111, G: 0x2222, B: 0x3333, A: 0x4444}); got != want {
+		t.Errorf("Wrong pixel: Got %v Want %v", got, want)
+	}
+	if got, want := nrgba.NRGBA64At(1, 1), (color.NRGBA64{R: 0xffff, G: 0xffff, B: 0xffff, A: 0x8888}); got != want {
+		t.Errorf("Wrong pixel: Got %v Want %v", got, want)
+	}
+
+	config, err := DecodeConfig(bytes.NewBufferString(IMAGE_16))
+	if err != nil {
+		t.Fatalf("Failed to decode config: %s", err)
+	}
+	if config.ColorModel != color.NRGBA64Model {
+		t.Errorf("Wrong color model for a 16 bit image.")
+	}
+
+	if _, err := Decode(bytes.NewBufferString(BAD_IMAGE_16)); err == nil {
+		t.Errorf("Decoded 8 bit pixels in a 16 bit image.")
+	}
+}
+
+func TestRoundTrip16(t *testing.T) {
+	img, err := Decode(bytes.NewBufferString(IMAGE_16))
+	if err != nil {
+		t.Fatalf("Failed to decode a valid image: %s", err)
+	}
+	wbuf := &bytes.Buffer{}
+	if err := Encode16(wbuf, img.(*image.NRGBA64)); err != nil {
+		t.Fatalf("Failed to encode a valid image: %s", err)
+	}
+	if got, want := wbuf.String(), IMAGE_16; got != want {
+		t.Errorf("Roundtrip mismatch: Got %q Want %q", got, want)
+	}
+}
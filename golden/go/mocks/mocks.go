@@ -51,6 +51,10 @@ func (m MockDiffStore) UnavailableDigests() map[string]bool {
 
 func (m MockDiffStore) CalculateDiffs([]string) {}
 
+func (m MockDiffStore) RenderPath(left, right, mode string) (string, error) {
+	return fmt.Sprintf("renderpath/%s/%s-%s.%s", mode, left, right, diff.RenderExt(mode)), nil
+}
+
 func NewMockDiffStore() diff.DiffStore {
 	return MockDiffStore{}
 }
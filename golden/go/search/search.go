@@ -0,0 +1,571 @@
+// search implements a single search over the digests in the last tile that
+// combines the filters of the different views of the UI and supports cursor
+// based pagination, so tools can be built on top of Gold.
+package search
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"go.skia.org/infra/go/timer"
+	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/golden/go/blame"
+	"go.skia.org/infra/golden/go/expstorage"
+	"go.skia.org/infra/golden/go/storage"
+	"go.skia.org/infra/golden/go/types"
+	ptypes "go.skia.org/infra/perf/go/types"
+)
+
+// Fields the results can be sorted by.
+const (
+	SORT_TEST       = "test"
+	SORT_N          = "n"
+	SORT_FIRST_SEEN = "firstSeen"
+	SORT_DIFF       = "diff"
+	SORT_BLAME      = "blame"
+
+	// DEFAULT_LIMIT is the page size if the query does not specify one.
+	DEFAULT_LIMIT = 50
+
+	// MAX_LIMIT is the largest page size.
+	MAX_LIMIT = 1000
+)
+
+// SORT_FIELDS contains all fields the results can be sorted by.
+var SORT_FIELDS = []string{SORT_TEST, SORT_N, SORT_FIRST_SEEN, SORT_DIFF, SORT_BLAME}
+
+// Query contains the filters, the sort order and the page of a search. The
+// zero value of each filter does not filter.
+type Query struct {
+	// Query is a URL encoded paramset the traces have to match.
+	Query url.Values
+
+	// Labels are the labels the digests can have. Empty means all labels.
+	Labels []types.Label
+
+	// Head restricts the results to the digests at head, otherwise all
+	// digests in the tile are considered.
+	Head bool
+
+	// IncludeIgnores includes the traces matched by ignore rules.
+	IncludeIgnores bool
+
+	// FirstSeenBegin and FirstSeenEnd restrict the time in seconds the
+	// digest was first seen to [FirstSeenBegin, FirstSeenEnd). Zero values
+	// are unbounded.
+	FirstSeenBegin int64
+	FirstSeenEnd   int64
+
+	// DiffMin and DiffMax restrict the distance to the closest positive
+	// digest of the same test under Metric. Digests without a positive
+	// digest to compare against only match if neither is set. DiffMax
+	// smaller than zero is unbounded.
+	DiffMin float64
+	DiffMax float64
+	Metric  string
+
+	// BlameCommit restricts the results to the untriaged and negative
+	// digests that were likely introduced by the commit with this hash.
+	BlameCommit string
+
+	// Sort is one of SORT_FIELDS and Desc reverses the order.
+	Sort string
+	Desc bool
+
+	// Cursor is the NextCursor of the previous page, or empty for the first
+	// page. Limit is the page size.
+	Cursor string
+	Limit  int
+}
+
+// ParseQuery parses a Query from URL query parameters. The parameters are
+// named like the fields of Query in lower camel case, labels are given in
+// repeated 'label' parameters and 'dir' is either 'asc' or 'desc'.
+func ParseQuery(v url.Values) (*Query, error) {
+	ret := &Query{
+		Head:           v.Get("head") == "true",
+		IncludeIgnores: v.Get("include") == "true",
+		DiffMax:        -1,
+		Metric:         v.Get("metric"),
+		BlameCommit:    v.Get("blame"),
+		Sort:           v.Get("sort"),
+		Desc:           v.Get("dir") == "desc",
+		Cursor:         v.Get("cursor"),
+		Limit:          DEFAULT_LIMIT,
+	}
+	var err error
+	if ret.Query, err = url.ParseQuery(v.Get("query")); err != nil {
+		return nil, fmt.Errorf("Invalid query: %s", err)
+	}
+	for _, l := range v["label"] {
+		label := types.LabelFromString(l)
+		if label.String() != l {
+			return nil, fmt.Errorf("Invalid label: %s", l)
+		}
+		ret.Labels = append(ret.Labels, label)
+	}
+	if ret.Sort == "" {
+		ret.Sort = SORT_TEST
+	}
+	if !util.In(ret.Sort, SORT_FIELDS) {
+		return nil, fmt.Errorf("Invalid sort field %s, must be one of %v.", ret.Sort, SORT_FIELDS)
+	}
+	if (ret.Sort == SORT_BLAME) && (ret.BlameCommit == "") {
+		return nil, fmt.Errorf("Sorting by blame requires a blame commit.")
+	}
+
+	ints := map[string]*int64{"firstSeenBegin": &ret.FirstSeenBegin, "firstSeenEnd": &ret.FirstSeenEnd}
+	for name, target := range ints {
+		if s := v.Get(name); s != "" {
+			if *target, err = strconv.ParseInt(s, 10, 64); err != nil {
+				return nil, fmt.Errorf("Invalid %s: %s", name, err)
+			}
+		}
+	}
+	floats := map[string]*float64{"diffMin": &ret.DiffMin, "diffMax": &ret.DiffMax}
+	for name, target := range floats {
+		if s := v.Get(name); s != "" {
+			if *target, err = strconv.ParseFloat(s, 64); err != nil {
+				return nil, fmt.Errorf("Invalid %s: %s", name, err)
+			}
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if ret.Limit, err = strconv.Atoi(s); err != nil {
+			return nil, fmt.Errorf("Invalid limit: %s", err)
+		}
+	}
+	if (ret.Limit <= 0) || (ret.Limit > MAX_LIMIT) {
+		return nil, fmt.Errorf("The limit must be between 1 and %d.", MAX_LIMIT)
+	}
+	return ret, nil
+}
+
+// diffNeeded returns true if the distance to the closest positive has to be
+// calculated for all candidates, not just the returned page.
+func (q *Query) diffNeeded() bool {
+	return (q.Sort == SORT_DIFF) || (q.DiffMin > 0) || (q.DiffMax >= 0)
+}
+
+// Result is a single digest of a test.
+type Result struct {
+	Test   string              `json:"test"`
+	Digest string              `json:"digest"`
+	Label  string              `json:"label"`
+	Params map[string][]string `json:"params"`
+
+	// N is the number of times the digest appears in the matching traces.
+	N int `json:"n"`
+
+	// FirstSeen and LastSeen are the commit times in seconds, see
+	// digeststore.DigestInfo.
+	FirstSeen int64 `json:"firstSeen"`
+	LastSeen  int64 `json:"lastSeen"`
+
+	// ClosestPositive is the most similar positive digest of the test under
+	// the metric of the query, Diff the distance to it. Diff is -1 if there
+	// is no positive digest to compare against.
+	ClosestPositive string  `json:"closestPositive"`
+	Diff            float64 `json:"diff"`
+
+	// BlameProb is the probability that the blame commit of the query
+	// introduced the digest.
+	BlameProb float64 `json:"blameProb"`
+
+	ImgURL     string `json:"imgUrl"`
+	DiffImgURL string `json:"diffImgUrl"`
+}
+
+// Response is one page of search results.
+type Response struct {
+	Results []*Result `json:"results"`
+
+	// Total is the number of results of all pages.
+	Total int `json:"total"`
+
+	// NextCursor retrieves the next page, it is empty on the last page.
+	NextCursor string `json:"nextCursor"`
+}
+
+// BlameLookup returns the digests a commit likely introduced. It is
+// implemented by blame.Blamer.
+type BlameLookup interface {
+	GetCommitBlame(hash string) []*blame.CommitBlame
+}
+
+// Searcher searches the digests in the last tile of a Storage.
+type Searcher struct {
+	storages  *storage.Storage
+	blamer    BlameLookup
+	pathToURL func(string) string
+}
+
+// New returns a Searcher. blamer may be nil, in which case queries with a
+// blame commit fail. pathToURL converts the image paths of the DiffStore to
+// URLs.
+func New(storages *storage.Storage, blamer BlameLookup, pathToURL func(string) string) *Searcher {
+	return &Searcher{
+		storages:  storages,
+		blamer:    blamer,
+		pathToURL: pathToURL,
+	}
+}
+
+// Search returns the page of digests that match the query, classified by
+// the given expectations.
+func (s *Searcher) Search(q *Query, exp *expstorage.Expectations) (*Response, error) {
+	defer timer.New("search").Stop()
+
+	results, err := s.Matches(q, exp)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip the results up to and including the cursor.
+	less := lessFunc(q.Sort, q.Desc)
+	start := 0
+	if q.Cursor != "" {
+		cursor, err := decodeCursor(q.Cursor, q.Sort)
+		if err != nil {
+			return nil, err
+		}
+		start = sort.Search(len(results), func(i int) bool { return less(cursor, results[i]) })
+	}
+	end := util.MinInt(len(results), start+q.Limit)
+	page := results[start:end]
+
+	if !q.diffNeeded() {
+		if err := s.addClosestPositive(page, exp, q.Metric); err != nil {
+			return nil, err
+		}
+	}
+	s.addURLs(page)
+
+	ret := &Response{
+		Results: page,
+		Total:   len(results),
+	}
+	if end < len(results) {
+		ret.NextCursor = encodeCursor(page[len(page)-1], q.Sort)
+	}
+	return ret, nil
+}
+
+// Matches returns all digests that match the filters of the query in the
+// sort order of the query. Cursor and Limit are ignored. ClosestPositive
+// and Diff are only set if they were needed to filter or sort the results,
+// the image URLs are not set.
+func (s *Searcher) Matches(q *Query, exp *expstorage.Expectations) ([]*Result, error) {
+	var blamed map[string]float64
+	if q.BlameCommit != "" {
+		if s.blamer == nil {
+			return nil, fmt.Errorf("Blame is not available.")
+		}
+		blamed = map[string]float64{}
+		for _, cb := range s.blamer.GetCommitBlame(q.BlameCommit) {
+			blamed[cb.TestName+":"+cb.Digest] = cb.Prob
+		}
+	}
+
+	candidates, err := s.candidates(q, exp)
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply the cheap filters first.
+	labels := map[types.Label]bool{}
+	for _, l := range q.Labels {
+		labels[l] = true
+	}
+	results := make([]*Result, 0, len(candidates))
+	for _, r := range candidates {
+		if (len(labels) > 0) && !labels[types.LabelFromString(r.Label)] {
+			continue
+		}
+		if blamed != nil {
+			prob, ok := blamed[r.Test+":"+r.Digest]
+			if !ok {
+				continue
+			}
+			r.BlameProb = prob
+		}
+		info := s.storages.DigestStore.GetDigestInfo(r.Test, r.Digest)
+		r.FirstSeen, r.LastSeen = info.First, info.Last
+		if ((q.FirstSeenBegin > 0) && (r.FirstSeen < q.FirstSeenBegin)) || ((q.FirstSeenEnd > 0) && (r.FirstSeen >= q.FirstSeenEnd)) {
+			continue
+		}
+		results = append(results, r)
+	}
+
+	// The diff to the closest positive is expensive, so it is only
+	// calculated for all results if it is needed to filter or sort.
+	if q.diffNeeded() {
+		if err := s.addClosestPositive(results, exp, q.Metric); err != nil {
+			return nil, err
+		}
+		filtered := results[:0]
+		for _, r := range results {
+			if q.matchesDiff(r) {
+				filtered = append(filtered, r)
+			}
+		}
+		results = filtered
+	}
+
+	sort.Sort(resultSlice{results: results, less: lessFunc(q.Sort, q.Desc)})
+	return results, nil
+}
+
+// TriageChanges returns the expectation changes that label the given results
+// with label. Results that already have the label are left out.
+func TriageChanges(results []*Result, label types.Label) map[string]types.TestClassification {
+	ret := map[string]types.TestClassification{}
+	for _, r := range results {
+		if types.LabelFromString(r.Label) == label {
+			continue
+		}
+		if _, ok := ret[r.Test]; !ok {
+			ret[r.Test] = types.TestClassification{}
+		}
+		ret[r.Test][r.Digest] = label
+	}
+	return ret
+}
+
+// ChangesHash returns a hash of the given expectation changes, see
+// TriageChanges. Equal changes have the same hash independent of the map
+// order, so a client can confirm that the changes it previewed are the ones
+// that are applied.
+func ChangesHash(changes map[string]types.TestClassification) string {
+	lines := []string{}
+	for testName, digests := range changes {
+		for digest, label := range digests {
+			lines = append(lines, fmt.Sprintf("%s:%s:%s\n", testName, digest, label.String()))
+		}
+	}
+	sort.Strings(lines)
+	h := md5.New()
+	for _, line := range lines {
+		_, _ = h.Write([]byte(line))
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// candidates returns a Result for every digest of the traces that match the
+// param query and the ignore rules.
+func (s *Searcher) candidates(q *Query, exp *expstorage.Expectations) ([]*Result, error) {
+	tile, err := s.storages.GetLastTileTrimmed()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to retrieve tile: %s", err)
+	}
+
+	ignores := []url.Values{}
+	if !q.IncludeIgnores {
+		allIgnores, err := s.storages.IgnoreStore.List()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load ignore rules: %s", err)
+		}
+		if ignores, err = types.ToQuery(allIgnores); err != nil {
+			return nil, err
+		}
+	}
+
+	byKey := map[string]*Result{}
+	lastCommitIndex := tile.LastCommitIndex()
+	for _, tr := range tile.Traces {
+		if !ptypes.MatchesWithIgnores(tr, q.Query, ignores...) {
+			continue
+		}
+		gTrace := tr.(*ptypes.GoldenTrace)
+		testName := gTrace.Params()[types.PRIMARY_KEY_FIELD]
+		for i := lastCommitIndex; i >= 0; i-- {
+			digest := gTrace.Values[i]
+			if digest == ptypes.MISSING_DIGEST {
+				continue
+			}
+			key := testName + ":" + digest
+			r, ok := byKey[key]
+			if !ok {
+				r = &Result{
+					Test:   testName,
+					Digest: digest,
+					Label:  exp.Classification(testName, digest).String(),
+					Params: map[string][]string{},
+					Diff:   -1,
+				}
+				byKey[key] = r
+			}
+			r.N++
+			for k, v := range gTrace.Params() {
+				if !util.In(v, r.Params[k]) {
+					r.Params[k] = append(r.Params[k], v)
+				}
+			}
+			if q.Head {
+				break
+			}
+		}
+	}
+
+	ret := make([]*Result, 0, len(byKey))
+	for _, r := range byKey {
+		for _, values := range r.Params {
+			sort.Strings(values)
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+// addClosestPositive sets ClosestPositive and Diff of the given results.
+func (s *Searcher) addClosestPositive(results []*Result, exp *expstorage.Expectations, metric string) error {
+	for _, r := range results {
+		positives := []string{}
+		for digest, label := range exp.Tests[r.Test] {
+			if (label == types.POSITIVE) && (digest != r.Digest) {
+				positives = append(positives, digest)
+			}
+		}
+		if len(positives) == 0 {
+			continue
+		}
+		diffs, err := s.storages.DiffStore.Get(r.Digest, positives)
+		if err != nil {
+			return fmt.Errorf("Failed to calculate diffs of %s: %s", r.Digest, err)
+		}
+		r.Diff = -1
+		for digest, dm := range diffs {
+			if dm.DimDiffer {
+				continue
+			}
+			dist := dm.Distance(metric)
+			if (r.Diff < 0) || (dist < r.Diff) || ((dist == r.Diff) && (digest < r.ClosestPositive)) {
+				r.ClosestPositive, r.Diff = digest, dist
+			}
+		}
+	}
+	return nil
+}
+
+// matchesDiff returns true if the diff of the result is within the range of
+// the query.
+func (q *Query) matchesDiff(r *Result) bool {
+	if r.Diff < 0 {
+		return (q.DiffMin <= 0) && (q.DiffMax < 0)
+	}
+	return (r.Diff >= q.DiffMin) && ((q.DiffMax < 0) || (r.Diff <= q.DiffMax))
+}
+
+// addURLs sets the image URLs of the given results.
+func (s *Searcher) addURLs(results []*Result) {
+	digests := make([]string, 0, len(results))
+	for _, r := range results {
+		digests = append(digests, r.Digest)
+	}
+	paths := s.storages.DiffStore.AbsPath(digests)
+	for _, r := range results {
+		r.ImgURL = s.pathToURL(paths[r.Digest])
+		if r.ClosestPositive == "" {
+			continue
+		}
+		diffs, err := s.storages.DiffStore.Get(r.Digest, []string{r.ClosestPositive})
+		if err != nil {
+			continue
+		}
+		if dm, ok := diffs[r.ClosestPositive]; ok {
+			r.DiffImgURL = s.pathToURL(dm.PixelDiffFilePath)
+		}
+	}
+}
+
+// sortKey returns the value of the given sort field of the result.
+func sortKey(r *Result, field string) float64 {
+	switch field {
+	case SORT_N:
+		return float64(r.N)
+	case SORT_FIRST_SEEN:
+		return float64(r.FirstSeen)
+	case SORT_DIFF:
+		// Results without a diff sort last.
+		if r.Diff < 0 {
+			return math.MaxFloat64
+		}
+		return r.Diff
+	case SORT_BLAME:
+		return r.BlameProb
+	}
+	return 0
+}
+
+// lessFunc returns the order of the results for the given sort field. Ties
+// are broken by test name and digest, so the order is total and cursors are
+// stable.
+func lessFunc(field string, desc bool) func(a, b *Result) bool {
+	asc := func(a, b *Result) bool {
+		if ka, kb := sortKey(a, field), sortKey(b, field); ka != kb {
+			return ka < kb
+		}
+		if a.Test != b.Test {
+			return a.Test < b.Test
+		}
+		return a.Digest < b.Digest
+	}
+	if desc {
+		return func(a, b *Result) bool { return asc(b, a) }
+	}
+	return asc
+}
+
+type resultSlice struct {
+	results []*Result
+	less    func(a, b *Result) bool
+}
+
+func (p resultSlice) Len() int           { return len(p.results) }
+func (p resultSlice) Less(i, j int) bool { return p.less(p.results[i], p.results[j]) }
+func (p resultSlice) Swap(i, j int)      { p.results[i], p.results[j] = p.results[j], p.results[i] }
+
+// cursor is the position of the last result of a page in the sort order.
+type cursor struct {
+	Key    float64 `json:"k"`
+	Test   string  `json:"t"`
+	Digest string  `json:"d"`
+}
+
+func encodeCursor(r *Result, field string) string {
+	b, _ := json.Marshal(&cursor{Key: sortKey(r, field), Test: r.Test, Digest: r.Digest})
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+// decodeCursor returns a Result that has the same position in the sort
+// order as the result the cursor was created from.
+func decodeCursor(s string, field string) (*Result, error) {
+	b, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor: %s", err)
+	}
+	c := &cursor{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("Invalid cursor: %s", err)
+	}
+	ret := &Result{Test: c.Test, Digest: c.Digest, Diff: -1}
+	switch field {
+	case SORT_N:
+		ret.N = int(c.Key)
+	case SORT_FIRST_SEEN:
+		ret.FirstSeen = int64(c.Key)
+	case SORT_DIFF:
+		if c.Key != math.MaxFloat64 {
+			ret.Diff = c.Key
+		}
+	case SORT_BLAME:
+		ret.BlameProb = c.Key
+	}
+	return ret, nil
+}
@@ -0,0 +1,245 @@
+package search
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/golden/go/blame"
+	"go.skia.org/infra/golden/go/diff"
+	"go.skia.org/infra/golden/go/digeststore"
+	"go.skia.org/infra/golden/go/expstorage"
+	"go.skia.org/infra/golden/go/mocks"
+	"go.skia.org/infra/golden/go/storage"
+	"go.skia.org/infra/golden/go/types"
+	ptypes "go.skia.org/infra/perf/go/types"
+)
+
+// mockDiffStore returns the pixel diff percentages in diffs, keyed by the
+// two digests in either order.
+type mockDiffStore struct {
+	diff.DiffStore
+	diffs map[[2]string]float32
+}
+
+func (m mockDiffStore) Get(dMain string, dRest []string) (map[string]*diff.DiffMetrics, error) {
+	ret := map[string]*diff.DiffMetrics{}
+	for _, d := range dRest {
+		percent, ok := m.diffs[[2]string{dMain, d}]
+		if !ok {
+			percent, ok = m.diffs[[2]string{d, dMain}]
+		}
+		if ok {
+			ret[d] = &diff.DiffMetrics{PixelDiffPercent: percent, PixelDiffFilePath: dMain + "-" + d + ".png"}
+		}
+	}
+	return ret, nil
+}
+
+func (m mockDiffStore) AbsPath(digests []string) map[string]string {
+	ret := map[string]string{}
+	for _, d := range digests {
+		ret[d] = d + ".png"
+	}
+	return ret
+}
+
+// mockDigestStore reports the digests as first seen at the times in first.
+type mockDigestStore struct {
+	first map[string]int64
+}
+
+func (m mockDigestStore) GetDigestInfo(testName, digest string) *digeststore.DigestInfo {
+	return &digeststore.DigestInfo{TestName: testName, Digest: digest, First: m.first[digest], Last: m.first[digest]}
+}
+
+func (m mockDigestStore) UpdateDigestInfo(digestInfos []*digeststore.DigestInfo) error {
+	return nil
+}
+
+type mockBlamer map[string][]*blame.CommitBlame
+
+func (m mockBlamer) GetCommitBlame(hash string) []*blame.CommitBlame {
+	return m[hash]
+}
+
+func newTestSearcher(t *testing.T) (*Searcher, *expstorage.Expectations) {
+	commits := []*ptypes.Commit{
+		&ptypes.Commit{CommitTime: 10, Hash: "h1"},
+		&ptypes.Commit{CommitTime: 20, Hash: "h2"},
+		&ptypes.Commit{CommitTime: 30, Hash: "h3"},
+	}
+	params := []map[string]string{
+		map[string]string{"name": "foo", "config": "8888", "source_type": "gm"},
+		map[string]string{"name": "foo", "config": "565", "source_type": "gm"},
+		map[string]string{"name": "bar", "config": "8888", "source_type": "gm"},
+		map[string]string{"name": "bar", "config": "gpu", "source_type": "gm"},
+	}
+	digests := [][]string{
+		[]string{"aaa", "bbb", "bbb"},
+		[]string{"aaa", "aaa", "ccc"},
+		[]string{"ddd", "ddd", "eee"},
+		[]string{"fff", "fff", "fff"},
+	}
+
+	storages := &storage.Storage{
+		DiffStore: mockDiffStore{diffs: map[[2]string]float32{
+			{"aaa", "bbb"}: 0.5,
+			{"aaa", "ccc"}: 2,
+			{"ddd", "eee"}: 1,
+		}},
+		IgnoreStore: types.NewMemIgnoreStore(),
+		TileStore:   mocks.NewMockTileStore(t, digests, params, commits),
+		DigestStore: mockDigestStore{first: map[string]int64{
+			"aaa": 10, "bbb": 20, "ccc": 30, "ddd": 10, "eee": 30, "fff": 10,
+		}},
+	}
+	assert.Nil(t, storages.IgnoreStore.Create(types.NewIgnoreRule("jon@example.com", time.Now().Add(time.Hour), "config=gpu", "")))
+
+	exp := expstorage.NewExpectations()
+	exp.AddDigests(map[string]types.TestClassification{
+		"foo": types.TestClassification{"aaa": types.POSITIVE},
+		"bar": types.TestClassification{"ddd": types.POSITIVE, "fff": types.NEGATIVE},
+	})
+
+	blamer := mockBlamer{
+		"h3": []*blame.CommitBlame{
+			&blame.CommitBlame{TestName: "foo", Digest: "ccc", Prob: 1},
+			&blame.CommitBlame{TestName: "bar", Digest: "eee", Prob: 0.5},
+		},
+	}
+	return New(storages, blamer, func(path string) string { return "/img/" + path }), exp
+}
+
+func digestsOf(resp *Response) []string {
+	ret := []string{}
+	for _, r := range resp.Results {
+		ret = append(ret, r.Test+":"+r.Digest)
+	}
+	return ret
+}
+
+func search(t *testing.T, searcher *Searcher, exp *expstorage.Expectations, params string) *Response {
+	v, err := url.ParseQuery(params)
+	assert.Nil(t, err)
+	q, err := ParseQuery(v)
+	assert.Nil(t, err)
+	resp, err := searcher.Search(q, exp)
+	assert.Nil(t, err)
+	return resp
+}
+
+func TestSearch(t *testing.T) {
+	searcher, exp := newTestSearcher(t)
+
+	// All digests that are not ignored, sorted by test and digest.
+	resp := search(t, searcher, exp, "")
+	assert.Equal(t, []string{"bar:ddd", "bar:eee", "foo:aaa", "foo:bbb", "foo:ccc"}, digestsOf(resp))
+	assert.Equal(t, 5, resp.Total)
+	assert.Equal(t, "", resp.NextCursor)
+	aaa := resp.Results[2]
+	assert.Equal(t, "positive", aaa.Label)
+	assert.Equal(t, 3, aaa.N)
+	assert.Equal(t, []string{"565", "8888"}, aaa.Params["config"])
+	assert.Equal(t, "/img/aaa.png", aaa.ImgURL)
+	bbb := resp.Results[3]
+	assert.Equal(t, "aaa", bbb.ClosestPositive)
+	assert.Equal(t, float64(float32(0.5)), bbb.Diff)
+	assert.Equal(t, "/img/bbb-aaa.png", bbb.DiffImgURL)
+	assert.Equal(t, int64(20), bbb.FirstSeen)
+
+	// Labels, head, ignores and params.
+	assert.Equal(t, []string{"bar:eee", "foo:bbb", "foo:ccc"}, digestsOf(search(t, searcher, exp, "label=untriaged")))
+	assert.Equal(t, []string{"bar:eee", "foo:bbb", "foo:ccc"}, digestsOf(search(t, searcher, exp, "head=true")))
+	assert.Equal(t, []string{"bar:fff"}, digestsOf(search(t, searcher, exp, "include=true&label=negative")))
+	assert.Equal(t, []string{"foo:aaa", "foo:ccc"}, digestsOf(search(t, searcher, exp, "query=config%3D565")))
+
+	// First seen window.
+	assert.Equal(t, []string{"foo:bbb", "foo:ccc"}, digestsOf(search(t, searcher, exp, "firstSeenBegin=20&query=name%3Dfoo")))
+	assert.Equal(t, []string{"bar:ddd", "foo:aaa", "foo:bbb"}, digestsOf(search(t, searcher, exp, "firstSeenEnd=30")))
+
+	// Diff to the closest positive.
+	assert.Equal(t, []string{"bar:eee", "foo:ccc"}, digestsOf(search(t, searcher, exp, "diffMin=1")))
+	assert.Equal(t, []string{"foo:bbb", "bar:eee", "foo:ccc"}, digestsOf(search(t, searcher, exp, "label=untriaged&sort=diff")))
+
+	// Blame.
+	resp = search(t, searcher, exp, "blame=h3&sort=blame&dir=desc")
+	assert.Equal(t, []string{"foo:ccc", "bar:eee"}, digestsOf(resp))
+	assert.Equal(t, 0.5, resp.Results[1].BlameProb)
+}
+
+func TestSearchPagination(t *testing.T) {
+	searcher, exp := newTestSearcher(t)
+
+	all := []string{}
+	params := "sort=n&dir=desc&limit=2"
+	resp := search(t, searcher, exp, params)
+	for {
+		assert.Equal(t, 5, resp.Total)
+		all = append(all, digestsOf(resp)...)
+		if resp.NextCursor == "" {
+			break
+		}
+		resp = search(t, searcher, exp, params+"&cursor="+resp.NextCursor)
+	}
+	assert.Equal(t, []string{"foo:aaa", "foo:bbb", "bar:ddd", "foo:ccc", "bar:eee"}, all)
+}
+
+func TestTriageChanges(t *testing.T) {
+	searcher, exp := newTestSearcher(t)
+
+	v, err := url.ParseQuery("head=true&query=name%3Dfoo")
+	assert.Nil(t, err)
+	q, err := ParseQuery(v)
+	assert.Nil(t, err)
+	results, err := searcher.Matches(q, exp)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"foo:bbb", "foo:ccc"}, digestsOf(&Response{Results: results}))
+
+	// Digests that already have the label are left out.
+	v, err = url.ParseQuery("query=name%3Dfoo")
+	assert.Nil(t, err)
+	q, err = ParseQuery(v)
+	assert.Nil(t, err)
+	results, err = searcher.Matches(q, exp)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]types.TestClassification{
+		"foo": types.TestClassification{"bbb": types.POSITIVE, "ccc": types.POSITIVE},
+	}, TriageChanges(results, types.POSITIVE))
+	assert.Equal(t, map[string]types.TestClassification{}, TriageChanges(results[:1], types.POSITIVE))
+}
+
+func TestChangesHash(t *testing.T) {
+	changes := map[string]types.TestClassification{
+		"foo": types.TestClassification{"bbb": types.POSITIVE, "ccc": types.POSITIVE},
+		"bar": types.TestClassification{"ddd": types.POSITIVE},
+	}
+	same := map[string]types.TestClassification{
+		"bar": types.TestClassification{"ddd": types.POSITIVE},
+		"foo": types.TestClassification{"ccc": types.POSITIVE, "bbb": types.POSITIVE},
+	}
+	assert.Equal(t, ChangesHash(changes), ChangesHash(same))
+
+	// Any added digest or other label changes the hash.
+	same["foo"]["eee"] = types.POSITIVE
+	assert.NotEqual(t, ChangesHash(changes), ChangesHash(same))
+	changes["foo"]["eee"] = types.NEGATIVE
+	assert.NotEqual(t, ChangesHash(changes), ChangesHash(same))
+	assert.NotEqual(t, ChangesHash(changes), ChangesHash(map[string]types.TestClassification{}))
+}
+
+func TestParseQuery(t *testing.T) {
+	q, err := ParseQuery(url.Values{})
+	assert.Nil(t, err)
+	assert.Equal(t, SORT_TEST, q.Sort)
+	assert.Equal(t, DEFAULT_LIMIT, q.Limit)
+	assert.Equal(t, -1.0, q.DiffMax)
+
+	for _, params := range []string{"label=bad", "sort=bad", "sort=blame", "limit=0", "diffMin=x", "firstSeenEnd=x", "query=%25"} {
+		v, err := url.ParseQuery(params)
+		assert.Nil(t, err)
+		_, err = ParseQuery(v)
+		assert.Error(t, err, params)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime/pprof"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -16,16 +17,26 @@ import (
 	"go.skia.org/infra/go/auth"
 	"go.skia.org/infra/go/common"
 	"go.skia.org/infra/go/database"
+	"go.skia.org/infra/go/email"
 	"go.skia.org/infra/go/login"
 	"go.skia.org/infra/go/metadata"
 	"go.skia.org/infra/go/redisutil"
+	"go.skia.org/infra/go/rietveld"
 	"go.skia.org/infra/go/skiaversion"
 	"go.skia.org/infra/go/timer"
 	"go.skia.org/infra/go/util"
 	"go.skia.org/infra/golden/go/analysis"
+	"go.skia.org/infra/golden/go/autotriage"
+	"go.skia.org/infra/golden/go/blame"
 	"go.skia.org/infra/golden/go/db"
+	"go.skia.org/infra/golden/go/diff"
+	"go.skia.org/infra/golden/go/digestmeta"
+	"go.skia.org/infra/golden/go/digeststore"
 	"go.skia.org/infra/golden/go/expstorage"
 	"go.skia.org/infra/golden/go/filediffstore"
+	"go.skia.org/infra/golden/go/ignore"
+	"go.skia.org/infra/golden/go/status"
+	"go.skia.org/infra/golden/go/statushistory"
 	"go.skia.org/infra/golden/go/storage"
 	"go.skia.org/infra/golden/go/summary"
 	"go.skia.org/infra/golden/go/tally"
@@ -43,6 +54,7 @@ var (
 	tileStoreDir      = flag.String("tile_store_dir", "/tmp/tileStore", "What directory to look for tiles in.")
 	imageDir          = flag.String("image_dir", "/tmp/imagedir", "What directory to store test and diff images in.")
 	gsBucketName      = flag.String("gs_bucket", "chromium-skia-gm", "Name of the google storage bucket that holds uploaded images.")
+	imageSourceDir    = flag.String("image_source_dir", "", "If set, images are read from this directory instead of the gs_bucket. Each image is named by its digest and the extension of any supported image format, e.g. <digest>.png or <digest>.jpg.")
 	doOauth           = flag.Bool("oauth", true, "Run through the OAuth 2.0 flow on startup, otherwise use a GCE service account.")
 	oauthCacheFile    = flag.String("oauth_cache_file", "/home/perf/google_storage_token.data", "Path to the file where to cache cache the oauth credentials.")
 	memProfile        = flag.Duration("memprofile", 0, "Duration for which to profile memory. After this duration the program writes the memory profile and exits.")
@@ -53,13 +65,57 @@ var (
 	redisDB           = flag.Int("redis_db", 0, "The index of the Redis database we should use. Default will work fine in most cases.")
 	startAnalyzer     = flag.Bool("start_analyzer", true, "Create an instance of the analyzer and start it running.")
 	startExperimental = flag.Bool("start_experimental", true, "Start experimental features.")
+	startAutoTriage   = flag.Bool("start_auto_triage", false, "Label untriaged digests that are within the tolerance rules as positive.")
 	cpuProfile        = flag.Duration("cpu_profile", 0, "Duration for which to profile the CPU usage. After this duration the program writes the CPU profile and exits.")
+	digestStoreDir    = flag.String("digest_store_dir", "/tmp/digeststore", "What directory to store the first and last seen timestamps of digests in.")
+	metadataDir       = flag.String("digest_metadata_dir", "", "Directory where the ingester writes the metadata of digests. If empty no metadata is available.")
+	branches          = flag.String("branches", "", "Comma separated list of additional branches that have been ingested into their own datasets. Requires start_experimental.")
+	rietveldURL       = flag.String("rietveld_url", "https://codereview.chromium.org", "The Rietveld instance that is queried to find out whether an issue with expectations has landed.")
+	deltaETolerance   = flag.Float64("delta_e_tolerance", diff.DeltaETolerance, "Color distance (CIE76 Delta E) above which a pixel is counted as perceptibly different. Changing it recalculates cached diff metrics.")
+	flakyThreshold    = flag.Float64("flaky_threshold", 0, "If larger than 0, untriaged digests of traces with a higher flakiness score are not counted in the summaries and the status. A good value is 0.3.")
+	emailClientId     = flag.String("email_clientid", "", "OAuth Client ID for sending ignore rule expiry reminders. Only used when local=true, otherwise it is read from metadata.")
+	emailClientSecret = flag.String("email_clientsecret", "", "OAuth Client Secret for sending ignore rule expiry reminders. Only used when local=true, otherwise it is read from metadata.")
+	emailTokenFile    = flag.String("email_token_cache_file", "/home/perf/google_email_token.data", "Path to the file where to cache the email credentials.")
+	ignoreWarning     = flag.Duration("ignore_expiry_warning", 72*time.Hour, "How long before an ignore rule expires its owner gets a reminder email.")
+	ignoresURL        = flag.String("ignores_url", "https://gold.skia.org/2/ignores", "The URL of the ignores page that is linked in ignore rule expiry reminders.")
+	fullRecompute     = flag.Duration("full_recompute_interval", time.Hour, "Tallies, summaries, blame lists and the analyzer are updated with the changes of each new tile and recomputed from the whole tile in this interval as a consistency check. If 0, every tile is processed in full.")
 )
 
 const (
 	IMAGE_URL_PREFIX = "/img/"
 )
 
+// startIgnoreReminders emails the owners of ignore rules before their rules
+// expire. Without email credentials no reminders are sent.
+func startIgnoreReminders() {
+	clientId, clientSecret := *emailClientId, *emailClientSecret
+	if !*local {
+		values := map[string]string{}
+		for _, key := range []string{metadata.GMAIL_CLIENT_ID, metadata.GMAIL_CLIENT_SECRET, metadata.GMAIL_CACHED_TOKEN} {
+			value, err := metadata.ProjectGet(key)
+			if err != nil {
+				glog.Warningf("Unable to read %s from metadata, ignore rule expiry reminders are disabled: %s", key, err)
+				return
+			}
+			values[key] = value
+		}
+		clientId, clientSecret = values[metadata.GMAIL_CLIENT_ID], values[metadata.GMAIL_CLIENT_SECRET]
+		if err := ioutil.WriteFile(*emailTokenFile, []byte(values[metadata.GMAIL_CACHED_TOKEN]), os.ModePerm); err != nil {
+			glog.Warningf("Failed to cache email token, ignore rule expiry reminders are disabled: %s", err)
+			return
+		}
+	}
+	if clientId == "" || clientSecret == "" {
+		glog.Warning("No email credentials provided, ignore rule expiry reminders are disabled.")
+		return
+	}
+	gmail, err := email.NewGMail(clientId, clientSecret, *emailTokenFile)
+	if err != nil {
+		glog.Fatalf("Failed to create email auth: %s", err)
+	}
+	ignore.NewExpiryNotifier(storages.IgnoreStore, gmail, *ignoreWarning, *ignoresURL).Start(time.Hour)
+}
+
 // ResponseEnvelope wraps all responses. Some fields might be empty depending
 // on context or whether there was an error or not.
 type ResponseEnvelope struct {
@@ -83,6 +139,12 @@ var (
 	pathToURLConverter analysis.PathToURLConverter
 	tallies            *tally.Tallies
 	summaries          *summary.Summaries
+	blamer             *blame.Blamer
+	statusWatcher      *status.StatusWatcher
+
+	// branchViews contains the views of the additional branches keyed by
+	// branch name. The master branch is not included.
+	branchViews = map[string]*branchView{}
 )
 
 // tileCountsHandler handles GET requests for the classification counts over
@@ -143,7 +205,7 @@ func triageDigestsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Update the labeling of the given tests and digests.
-	result, err := analyzer.SetDigestLabels(tc, userId)
+	result, err := analyzer.SetDigestLabels(tc, userId, nil)
 	if err != nil {
 		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
 		return
@@ -349,8 +411,22 @@ func main() {
 		}
 	}
 
+	// Get the metadata store that is populated by the ingester.
+	metadataStore := digestmeta.NewMemMetadataStore()
+	if *metadataDir != "" {
+		if metadataStore, err = digestmeta.NewFileMetadataStore(*metadataDir); err != nil {
+			glog.Fatalf("Allocating MetadataStore failed: %s", err)
+		}
+	}
+
 	// Get the expecations storage, the filediff storage and the tilestore.
-	diffStore, err := filediffstore.NewFileDiffStore(client, *imageDir, *gsBucketName, filediffstore.DEFAULT_GS_IMG_DIR_NAME, cacheFactory, filediffstore.RECOMMENDED_WORKER_POOL_SIZE)
+	diff.DeltaETolerance = *deltaETolerance
+	var diffStore diff.DiffStore
+	if *imageSourceDir != "" {
+		diffStore, err = filediffstore.NewOfflineDiffStore(filediffstore.DirImageSource(*imageSourceDir), *imageDir, cacheFactory, filediffstore.RECOMMENDED_WORKER_POOL_SIZE, metadataStore)
+	} else {
+		diffStore, err = filediffstore.NewFileDiffStore(client, *imageDir, *gsBucketName, filediffstore.DEFAULT_GS_IMG_DIR_NAME, cacheFactory, filediffstore.RECOMMENDED_WORKER_POOL_SIZE, metadataStore)
+	}
 	if err != nil {
 		glog.Fatalf("Allocating DiffStore failed: %s", err)
 	}
@@ -360,13 +436,35 @@ func main() {
 	}
 	vdb := database.NewVersionedDB(conf)
 
+	digestStore, err := digeststore.NewLevelDBDigestStore(*digestStoreDir)
+	if err != nil {
+		glog.Fatalf("Allocating DigestStore failed: %s", err)
+	}
+
 	storages = &storage.Storage{
-		DiffStore:         diffStore,
-		ExpectationsStore: expstorage.NewCachingExpectationStore(expstorage.NewSQLExpectationStore(vdb)),
-		IgnoreStore:       types.NewSQLIgnoreStore(vdb),
-		TileStore:         filetilestore.NewFileTileStore(*tileStoreDir, pconfig.DATASET_GOLD, 2*time.Minute),
-		NCommits:          *nCommits,
+		DiffStore:              diffStore,
+		ExpectationsStore:      expstorage.NewCachingExpectationStore(expstorage.NewSQLExpectationStore(vdb)),
+		IssueExpectationsStore: expstorage.NewSQLIssueExpectationsStore(vdb),
+		IgnoreStore:            types.NewSQLIgnoreStore(vdb),
+		ToleranceStore:         types.NewSQLToleranceStore(vdb),
+		TileStore:              filetilestore.NewFileTileStore(*tileStoreDir, pconfig.DATASET_GOLD, 2*time.Minute),
+		DigestStore:            digestStore,
+		MetadataStore:          metadataStore,
+		NCommits:               *nCommits,
+		FlakyThreshold:         *flakyThreshold,
+		FullRecomputeInterval:  *fullRecompute,
+	}
+
+	// Fill the digest store before the Blamer and the status watcher read the
+	// first seen timestamps from it.
+	tile, err := storages.TileStore.Get(0, -1)
+	if err != nil {
+		glog.Fatalf("Failed to load tile: %s", err)
+	}
+	if err := digeststore.Update(storages.DigestStore, tile, storages.DiffStore); err != nil {
+		glog.Fatalf("Failed to fill the digest store: %s", err)
 	}
+	digeststore.StartUpdater(storages.DigestStore, storage.GetTileStreamNow(storages.TileStore, 2*time.Minute), storages.DiffStore)
 
 	// Enable the experimental features.
 	if *startExperimental {
@@ -379,8 +477,40 @@ func main() {
 		if err != nil {
 			glog.Fatalf("Failed to build summary: %s", err)
 		}
+
+		blamer, err = blame.New(storages)
+		if err != nil {
+			glog.Fatalf("Failed to build blame lists: %s", err)
+		}
+
+		// The status watcher records the status history on every change.
+		storages.StatusHistory = statushistory.NewSQLStatusHistory(vdb)
+		statusWatcher, err = status.New(storages)
+		if err != nil {
+			glog.Fatalf("Failed to start status watcher: %s", err)
+		}
+
+		// Every additional branch gets its own tiles, tallies and summaries.
+		// All other storage is shared with the master branch.
+		for _, branch := range strings.Split(*branches, ",") {
+			branch = strings.TrimSpace(branch)
+			if branch == "" || branch == pconfig.MASTER_BRANCH {
+				continue
+			}
+			if branchViews[branch], err = newBranchView(branch); err != nil {
+				glog.Fatalf("Failed to set up branch %s: %s", branch, err)
+			}
+		}
 	}
 
+	if *startAutoTriage {
+		autotriage.New(storages)
+	}
+
+	startIgnoreReminders()
+
+	expstorage.StartIssueMerger(storages.ExpectationsStore, storages.IssueExpectationsStore, rietveld.New(*rietveldURL), 10*time.Minute)
+
 	// Initialize the Analyzer
 	imgFS := NewURLAwareFileServer(*imageDir, IMAGE_URL_PREFIX)
 	pathToURLConverter = imgFS.GetURL
@@ -421,21 +551,38 @@ func main() {
 	router.HandleFunc("/2/detail", polySingleDigestHandler).Methods("GET")
 	router.HandleFunc("/2/diff", polyDiffDigestHandler).Methods("GET")
 	router.HandleFunc("/2/_/diff", polyDiffJSONDigestHandler).Methods("GET")
+	router.HandleFunc("/2/_/diff/{mode}", polyDiffRenderHandler).Methods("GET")
 	router.HandleFunc("/2/_/list", polyListTestsHandler).Methods("GET")
 	router.HandleFunc("/2/_/paramset", polyParamsHandler).Methods("GET")
 	router.HandleFunc("/2/_/ignores", polyIgnoresJSONHandler).Methods("GET")
 	router.HandleFunc("/2/_/ignores/del/{id}", polyIgnoresDeleteHandler).Methods("POST")
 	router.HandleFunc("/2/_/ignores/add/", polyIgnoresAddHandler).Methods("POST")
 	router.HandleFunc("/2/_/ignores/save/{id}", polyIgnoresUpdateHandler).Methods("POST")
+	router.HandleFunc("/2/_/ignores/history", polyIgnoresHistoryHandler).Methods("GET")
+	router.HandleFunc("/2/_/tolerances", polyTolerancesJSONHandler).Methods("GET")
+	router.HandleFunc("/2/_/tolerances/del/{id}", polyTolerancesDeleteHandler).Methods("POST")
+	router.HandleFunc("/2/_/tolerances/add/", polyTolerancesAddHandler).Methods("POST")
+	router.HandleFunc("/2/_/tolerances/save/{id}", polyTolerancesUpdateHandler).Methods("POST")
 	router.HandleFunc("/2/_/test", polyTestHandler).Methods("POST")
 	router.HandleFunc("/2/_/details", polyDetailsHandler).Methods("GET")
+	router.HandleFunc("/2/_/details/issues", polyDigestIssuesHandler).Methods("POST")
 	router.HandleFunc("/2/_/triage", polyTriageHandler).Methods("POST")
+	router.HandleFunc("/2/_/triage/query", polyTriageQueryHandler).Methods("POST")
+	router.HandleFunc("/2/_/clusters", polyClustersHandler).Methods("GET")
 	router.HandleFunc("/2/_/status/{test}", polyTestStatusHandler).Methods("GET")
 
 	router.HandleFunc("/2/triagelog", polyTriageLogView).Methods("GET")
 	router.HandleFunc("/2/_/triagelog", polyTriageLogHandler).Methods("GET")
+	router.HandleFunc("/2/_/triagelog/undo", polyTriageUndoHandler).Methods("POST")
+	router.HandleFunc("/2/_/baseline", polyBaselineHandler).Methods("GET")
 
 	router.HandleFunc("/2/_/hashes", polyAllHashesHandler).Methods("GET")
+	router.HandleFunc("/2/_/branches", polyBranchesHandler).Methods("GET")
+	router.HandleFunc("/2/_/blame/commit/{hash}", polyCommitBlameHandler).Methods("GET")
+	router.HandleFunc("/2/_/flaky", polyFlakyHandler).Methods("GET")
+	router.HandleFunc("/2/_/statushistory", polyStatusHistoryHandler).Methods("GET")
+	router.HandleFunc("/2/_/search", polySearchHandler).Methods("GET")
+	router.HandleFunc("/2/_/verdict", polyVerdictHandler).Methods("GET")
 
 	// Everything else is served out of the static directory.
 	router.PathPrefix("/").Handler(http.FileServer(http.Dir(*staticDir)))
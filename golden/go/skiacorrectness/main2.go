@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
 	"regexp"
 	"runtime"
@@ -19,11 +20,24 @@ import (
 	"go.skia.org/infra/go/login"
 	"go.skia.org/infra/go/timer"
 	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/golden/go/blame"
 	"go.skia.org/infra/golden/go/diff"
+	"go.skia.org/infra/golden/go/digestcluster"
+	"go.skia.org/infra/golden/go/digestmeta"
+	"go.skia.org/infra/golden/go/digeststore"
 	"go.skia.org/infra/golden/go/expstorage"
+	"go.skia.org/infra/golden/go/filediffstore"
+	"go.skia.org/infra/golden/go/flaky"
+	"go.skia.org/infra/golden/go/ignore"
+	"go.skia.org/infra/golden/go/search"
+	"go.skia.org/infra/golden/go/statushistory"
+	"go.skia.org/infra/golden/go/storage"
 	"go.skia.org/infra/golden/go/summary"
 	"go.skia.org/infra/golden/go/tally"
 	"go.skia.org/infra/golden/go/types"
+	"go.skia.org/infra/golden/go/verdict"
+	pconfig "go.skia.org/infra/perf/go/config"
+	"go.skia.org/infra/perf/go/filetilestore"
 	ptypes "go.skia.org/infra/perf/go/types"
 )
 
@@ -112,6 +126,293 @@ func loadTemplates() {
 	))
 }
 
+// branchView bundles the data structures that depend on the tiles of a
+// single branch.
+type branchView struct {
+	storages  *storage.Storage
+	tallies   *tally.Tallies
+	summaries *summary.Summaries
+}
+
+// newBranchView creates a branchView for the given branch. It reads the tiles
+// of the branch's dataset and shares all other storage with the master
+// branch.
+func newBranchView(branch string) (*branchView, error) {
+	branchStorages := &storage.Storage{
+		DiffStore:              storages.DiffStore,
+		ExpectationsStore:      storages.ExpectationsStore,
+		IssueExpectationsStore: storages.IssueExpectationsStore,
+		IgnoreStore:            storages.IgnoreStore,
+		ToleranceStore:         storages.ToleranceStore,
+		TileStore:              filetilestore.NewFileTileStore(*tileStoreDir, pconfig.BranchDataset(pconfig.DATASET_GOLD, branch), 2*time.Minute),
+		DigestStore:            storages.DigestStore,
+		MetadataStore:          storages.MetadataStore,
+		NCommits:               storages.NCommits,
+		FlakyThreshold:         storages.FlakyThreshold,
+		FullRecomputeInterval:  storages.FullRecomputeInterval,
+	}
+	branchTallies, err := tally.New(branchStorages)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to build tallies: %s", err)
+	}
+	branchSummaries, err := summary.New(branchStorages, branchTallies)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to build summary: %s", err)
+	}
+	return &branchView{
+		storages:  branchStorages,
+		tallies:   branchTallies,
+		summaries: branchSummaries,
+	}, nil
+}
+
+// getBranchView returns the branchView of the given branch. An empty branch
+// name selects the master branch.
+func getBranchView(branch string) (*branchView, error) {
+	if branch == "" || branch == pconfig.MASTER_BRANCH {
+		return &branchView{
+			storages:  storages,
+			tallies:   tallies,
+			summaries: summaries,
+		}, nil
+	}
+	if view, ok := branchViews[branch]; ok {
+		return view, nil
+	}
+	return nil, fmt.Errorf("Unknown branch: %s", branch)
+}
+
+// polyBranchesHandler returns the list of branches that can be selected via
+// the 'branch' query parameter or the 'branch' field of JSON requests.
+func polyBranchesHandler(w http.ResponseWriter, r *http.Request) {
+	ret := []string{pconfig.MASTER_BRANCH}
+	for branch := range branchViews {
+		ret = append(ret, branch)
+	}
+	sort.Strings(ret[1:])
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(ret); err != nil {
+		util.ReportError(w, r, err, "Failed to encode result")
+	}
+}
+
+// CommitBlameResponse is the response of polyCommitBlameHandler.
+type CommitBlameResponse struct {
+	Commit  *ptypes.Commit       `json:"commit"`
+	Digests []*blame.CommitBlame `json:"digests"`
+}
+
+// polyCommitBlameHandler returns the untriaged and negative digests that were
+// likely introduced by the commit with the given hash.
+func polyCommitBlameHandler(w http.ResponseWriter, r *http.Request) {
+	if blamer == nil {
+		util.ReportError(w, r, fmt.Errorf("Blamer not running."), "Commit blame requires start_experimental.")
+		return
+	}
+	hash := mux.Vars(r)["hash"]
+	ret := &CommitBlameResponse{
+		Digests: blamer.GetCommitBlame(hash),
+	}
+	_, commits := blamer.GetAllBlameLists()
+	for _, c := range commits {
+		if c.Hash == hash {
+			ret.Commit = c
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(ret); err != nil {
+		util.ReportError(w, r, err, "Failed to encode result")
+	}
+}
+
+// polyFlakyHandler returns the flaky traces in the last tile, most flaky
+// first. The optional 'threshold' query parameter is the minimum flakiness
+// score, it defaults to the flaky_threshold flag or flaky.DEFAULT_THRESHOLD.
+func polyFlakyHandler(w http.ResponseWriter, r *http.Request) {
+	threshold := storages.FlakyThreshold
+	if threshold <= 0 {
+		threshold = flaky.DEFAULT_THRESHOLD
+	}
+	if thresholdStr := r.FormValue("threshold"); thresholdStr != "" {
+		var err error
+		if threshold, err = strconv.ParseFloat(thresholdStr, 64); err != nil {
+			util.ReportError(w, r, err, "Threshold must be a valid number.")
+			return
+		}
+	}
+	tile, err := storages.GetLastTileTrimmed()
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to load tile.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(flaky.Sorted(flaky.FindFlaky(tile, threshold))); err != nil {
+		util.ReportError(w, r, err, "Failed to encode result")
+	}
+}
+
+// polyStatusHistoryHandler returns the number of untriaged, positive and
+// negative digests at head per corpus over time. The optional 'since' query
+// parameter is how far back to go, e.g. '4w', and defaults to 4 weeks. Only
+// the last snapshot of each corpus in each 'interval', e.g. '1d', is
+// returned. The interval defaults to one hour.
+func polyStatusHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if storages.StatusHistory == nil {
+		util.ReportError(w, r, fmt.Errorf("No status history available."), "The status history requires start_experimental.")
+		return
+	}
+	since := 4 * 7 * 24 * time.Hour
+	interval := time.Hour
+	var err error
+	if sinceStr := r.FormValue("since"); sinceStr != "" {
+		if since, err = human.ParseDuration(sinceStr); err != nil {
+			util.ReportError(w, r, err, "Failed to parse since.")
+			return
+		}
+	}
+	if intervalStr := r.FormValue("interval"); intervalStr != "" {
+		if interval, err = human.ParseDuration(intervalStr); err != nil {
+			util.ReportError(w, r, err, "Failed to parse interval.")
+			return
+		}
+	}
+
+	now := util.TimeStampMs()
+	snapshots, err := storages.StatusHistory.Range(now-int64(since/time.Millisecond), now+1)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to load the status history.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(statushistory.Downsample(snapshots, int64(interval/time.Millisecond))); err != nil {
+		util.ReportError(w, r, err, "Failed to encode result")
+	}
+}
+
+// polySearchHandler searches the digests in the last tile, combining the
+// filters of the other views. See search.ParseQuery for the query parameters.
+// The optional 'branch' and 'issue' query parameters select the branch and
+// the code review issue whose expectations overlay the master expectations.
+func polySearchHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := search.ParseQuery(r.URL.Query())
+	if err != nil {
+		util.ReportError(w, r, err, "Invalid search query.")
+		return
+	}
+	view, err := getBranchView(r.FormValue("branch"))
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to find branch.")
+		return
+	}
+	issue := 0
+	if issueStr := r.FormValue("issue"); issueStr != "" {
+		if issue, err = strconv.Atoi(issueStr); err != nil {
+			util.ReportError(w, r, err, "Issue must be a valid integer.")
+			return
+		}
+	}
+	exp, err := getExpectations(issue)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to load expectations.")
+		return
+	}
+
+	resp, err := newSearcher(view).Search(q, exp)
+	if err != nil {
+		util.ReportError(w, r, err, "Search failed.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(resp); err != nil {
+		util.ReportError(w, r, err, "Failed to encode result")
+	}
+}
+
+// newSearcher returns a search.Searcher for the given branch.
+func newSearcher(view *branchView) *search.Searcher {
+	// Blame is only calculated for the master branch.
+	var blameLookup search.BlameLookup
+	if (blamer != nil) && (view.storages == storages) {
+		blameLookup = blamer
+	}
+	return search.New(view.storages, blameLookup, pathToURLConverter)
+}
+
+// polyVerdictHandler returns a pass/fail verdict for the digests produced at
+// a commit, see verdict.Verdict. A commit fails if any of its digests are
+// untriaged or negative. The optional query parameters are 'commit', the
+// hash of the commit which defaults to the last commit, 'query' and
+// 'include' which filter the traces like for polyListTestsHandler, 'branch'
+// and 'format', which is either json (the default) or junit. Gold does not
+// ingest trybot results, so verdicts for code review issues are rejected.
+func polyVerdictHandler(w http.ResponseWriter, r *http.Request) {
+	view, err := getBranchView(r.FormValue("branch"))
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to find branch.")
+		return
+	}
+	if view.summaries == nil {
+		util.ReportError(w, r, fmt.Errorf("No summaries available."), "The verdict requires start_experimental.")
+		return
+	}
+	format := r.FormValue("format")
+	if format == "" {
+		format = verdict.FORMAT_JSON
+	}
+	if (format != verdict.FORMAT_JSON) && (format != verdict.FORMAT_JUNIT) {
+		util.ReportError(w, r, fmt.Errorf("Unknown format: %s", format), "Format must be json or junit.")
+		return
+	}
+	if r.FormValue("issue") != "" {
+		util.ReportError(w, r, fmt.Errorf("Verdicts for issues are not supported."), "Gold does not ingest trybot results.")
+		return
+	}
+	exp, err := storages.ExpectationsStore.Get()
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to load expectations.")
+		return
+	}
+
+	commit := r.FormValue("commit")
+	if commit == "" {
+		tile, err := view.storages.GetLastTileTrimmed()
+		if err != nil {
+			util.ReportError(w, r, err, "Failed to load tile.")
+			return
+		}
+		commit = tile.Commits[tile.LastCommitIndex()].Hash
+	}
+	sumMap, err := view.summaries.CalcCommitSummaries(commit, r.FormValue("query"), r.FormValue("include") == "true", exp)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to calculate summaries.")
+		return
+	}
+	v := verdict.New(commit, sumMap)
+
+	if format == verdict.FORMAT_JUNIT {
+		w.Header().Set("Content-Type", "application/xml")
+		if err := verdict.WriteJUnit(w, v); err != nil {
+			glog.Errorf("Failed to write JUnit report: %s", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(v); err != nil {
+		util.ReportError(w, r, err, "Failed to encode result")
+	}
+}
+
 type SummarySlice []*summary.Summary
 
 func (p SummarySlice) Len() int           { return len(p) }
@@ -125,6 +426,7 @@ func (p SummarySlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 //  include - True if ignored digests should be included. (true, false)
 //  query   - A query to restrict the responses to, encoded as a URL encoded paramset.
 //  head    - True if only digest that appear at head should be included.
+//  branch  - The branch to use, defaults to master.
 //
 // The return format looks like:
 //
@@ -154,10 +456,15 @@ func polyListTestsHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		util.ReportError(w, r, err, "Invalid query in request.")
 	}
+	view, err := getBranchView(r.FormValue("branch"))
+	if err != nil {
+		util.ReportError(w, r, err, "Invalid branch in request.")
+		return
+	}
 	_, hasSourceType := q["source_type"]
 	sumSlice := []*summary.Summary{}
 	if r.FormValue("include") == "false" && r.FormValue("head") == "true" && len(q) == 1 && hasSourceType {
-		sumMap := summaries.Get()
+		sumMap := view.summaries.Get()
 		corpus := q["source_type"]
 		for _, s := range sumMap {
 			if util.In(s.Corpus, corpus) {
@@ -166,7 +473,7 @@ func polyListTestsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		glog.Infof("%q %q %q", r.FormValue("query"), r.FormValue("include"), r.FormValue("head"))
-		sumMap, err := summaries.CalcSummaries(nil, r.FormValue("query"), r.FormValue("include") == "true", r.FormValue("head") == "true")
+		sumMap, err := view.summaries.CalcSummaries(nil, r.FormValue("query"), r.FormValue("include") == "true", r.FormValue("head") == "true")
 		if err != nil {
 			util.ReportError(w, r, err, "Failed to calculate summaries.")
 		}
@@ -185,9 +492,14 @@ func polyListTestsHandler(w http.ResponseWriter, r *http.Request) {
 // polyTestStatusHandler returns the status of the requested test.
 func polyTestStatusHandler(w http.ResponseWriter, r *http.Request) {
 	test := mux.Vars(r)["test"]
+	view, err := getBranchView(r.FormValue("branch"))
+	if err != nil {
+		util.ReportError(w, r, err, "Invalid branch in request.")
+		return
+	}
 	var summary *summary.Summary
 	var ok bool
-	if summary, ok = summaries.Get()[test]; !ok {
+	if summary, ok = view.summaries.Get()[test]; !ok {
 		util.ReportError(w, r, fmt.Errorf("Unknown test: %q", test), "No summaries for test.")
 	}
 
@@ -211,6 +523,12 @@ func polyIgnoresJSONHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	if err != nil {
 		util.ReportError(w, r, err, "Failed to retrieve ignored traces.")
+		return
+	}
+
+	// Add the number of matched traces and hidden untriaged digests.
+	if err := addIgnoreCounts(ignores); err != nil {
+		glog.Errorf("Unable to count the traces matched by ignore rules: %s", err)
 	}
 
 	// TODO(stephana): Wrap in response envelope if it makes sense !
@@ -220,6 +538,44 @@ func polyIgnoresJSONHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// addIgnoreCounts sets the counts of the given ignore rules based on the
+// last tile and the current expectations.
+func addIgnoreCounts(ignores []*types.IgnoreRule) error {
+	tile, err := storages.GetLastTileTrimmed()
+	if err != nil {
+		return err
+	}
+	exp, err := storages.ExpectationsStore.Get()
+	if err != nil {
+		return err
+	}
+	return ignore.AddCounts(ignores, tile, exp)
+}
+
+// polyIgnoresHistoryHandler returns the history of the ignore rule given in
+// the 'id' query parameter, or of all ignore rules if it is missing.
+func polyIgnoresHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id := -1
+	if idStr := r.FormValue("id"); idStr != "" {
+		var err error
+		if id, err = strconv.Atoi(idStr); err != nil {
+			util.ReportError(w, r, err, "ID must be valid integer.")
+			return
+		}
+	}
+	history, err := storages.IgnoreStore.History(id)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to retrieve the history of ignore rules.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(history); err != nil {
+		util.ReportError(w, r, err, "Failed to encode result")
+	}
+}
+
 func polyIgnoresUpdateHandler(w http.ResponseWriter, r *http.Request) {
 	user := login.LoggedInAs(r)
 	if user == "" {
@@ -332,6 +688,111 @@ func polyIgnoresAddHandler(w http.ResponseWriter, r *http.Request) {
 	polyIgnoresJSONHandler(w, r)
 }
 
+// polyTolerancesJSONHandler returns the current tolerance rules.
+func polyTolerancesJSONHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rules, err := storages.ToleranceStore.List()
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to retrieve tolerance rules.")
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(rules); err != nil {
+		util.ReportError(w, r, err, "Failed to encode result")
+	}
+}
+
+// TolerancesRequest is the POST'd request body handled by
+// polyTolerancesAddHandler and polyTolerancesUpdateHandler.
+type TolerancesRequest struct {
+	Filter              string  `json:"filter"`
+	Note                string  `json:"note"`
+	MaxChannelDelta     int     `json:"maxChannelDelta"`
+	MaxPixelDiffPercent float32 `json:"maxPixelDiffPercent"`
+}
+
+// parseToleranceRule returns the rule described by the POST'd request body.
+func parseToleranceRule(r *http.Request, user string) (*types.ToleranceRule, error) {
+	req := &TolerancesRequest{}
+	if err := parseJson(r, req); err != nil {
+		return nil, err
+	}
+	if _, err := url.ParseQuery(req.Filter); err != nil {
+		return nil, fmt.Errorf("Invalid filter %q: %s", req.Filter, err)
+	}
+	if req.Filter == "" {
+		return nil, fmt.Errorf("A tolerance rule requires a filter.")
+	}
+	if req.MaxChannelDelta < 0 || req.MaxPixelDiffPercent < 0 {
+		return nil, fmt.Errorf("Tolerances must not be negative.")
+	}
+	return types.NewToleranceRule(user, req.Filter, req.MaxChannelDelta, req.MaxPixelDiffPercent, req.Note), nil
+}
+
+// polyTolerancesAddHandler is for adding a new tolerance rule.
+func polyTolerancesAddHandler(w http.ResponseWriter, r *http.Request) {
+	user := login.LoggedInAs(r)
+	if user == "" {
+		util.ReportError(w, r, fmt.Errorf("Not logged in."), "You must be logged in to add a tolerance rule.")
+		return
+	}
+	rule, err := parseToleranceRule(r, user)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to parse submitted data.")
+		return
+	}
+	if err := storages.ToleranceStore.Create(rule); err != nil {
+		util.ReportError(w, r, err, "Failed to create tolerance rule.")
+		return
+	}
+	polyTolerancesJSONHandler(w, r)
+}
+
+// polyTolerancesUpdateHandler is for updating a tolerance rule.
+func polyTolerancesUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	user := login.LoggedInAs(r)
+	if user == "" {
+		util.ReportError(w, r, fmt.Errorf("Not logged in."), "You must be logged in to update a tolerance rule.")
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 0)
+	if err != nil {
+		util.ReportError(w, r, err, "ID must be valid integer.")
+		return
+	}
+	rule, err := parseToleranceRule(r, user)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to parse submitted data.")
+		return
+	}
+	if err := storages.ToleranceStore.Update(int(id), rule); err != nil {
+		util.ReportError(w, r, err, "Unable to update tolerance rule.")
+		return
+	}
+	polyTolerancesJSONHandler(w, r)
+}
+
+// polyTolerancesDeleteHandler is for deleting a tolerance rule.
+func polyTolerancesDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	user := login.LoggedInAs(r)
+	if user == "" {
+		util.ReportError(w, r, fmt.Errorf("Not logged in."), "You must be logged in to delete a tolerance rule.")
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 0)
+	if err != nil {
+		util.ReportError(w, r, err, "ID must be valid integer.")
+		return
+	}
+	if _, err := storages.ToleranceStore.Delete(int(id), user); err != nil {
+		util.ReportError(w, r, err, "Unable to delete tolerance rule.")
+		return
+	}
+	polyTolerancesJSONHandler(w, r)
+}
+
 // polyIgnoresHandler is for setting up ignores rules.
 func polyIgnoresHandler(w http.ResponseWriter, r *http.Request) {
 	glog.Infof("Poly Ignores Handler: %q\n", r.URL.Path)
@@ -368,6 +829,35 @@ func polyDiffDigestHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// polyDiffRenderHandler serves an image that visualizes the difference
+// between two digests in the render mode given in the URL, see
+// diff.RENDER_MODES. Takes the two query parameters left and right. The
+// images are rendered on the first request and cached by the DiffStore.
+func polyDiffRenderHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		util.ReportError(w, r, err, "Failed to parse form values")
+		return
+	}
+	mode := mux.Vars(r)["mode"]
+	left := r.Form.Get("left")
+	right := r.Form.Get("right")
+	if left == "" || right == "" {
+		util.ReportError(w, r, fmt.Errorf("Some query parameters are missing: %q %q", left, right), "Missing query parameters.")
+		return
+	}
+	if !diff.ValidDigest(left) || !diff.ValidDigest(right) {
+		util.ReportError(w, r, fmt.Errorf("Invalid digests: %q %q", left, right), "Invalid query parameters.")
+		return
+	}
+
+	path, err := storages.DiffStore.RenderPath(left, right, mode)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to render diff.")
+		return
+	}
+	http.ServeFile(w, r, path)
+}
+
 // polyDiffJSONDigestHandler takes three parameters (top, left, and test), and
 // returns a JSON serialized PolyTestDiffInfo as the response.
 func polyDiffJSONDigestHandler(w http.ResponseWriter, r *http.Request) {
@@ -400,6 +890,19 @@ func polyDiffJSONDigestHandler(w http.ResponseWriter, r *http.Request) {
 		DiffImg:          pathToURLConverter(d.PixelDiffFilePath),
 		TopImg:           pathToURLConverter(full[top]),
 		LeftImg:          pathToURLConverter(full[left]),
+
+		SSIM:                   d.SSIM,
+		MeanDeltaE:             d.MeanDeltaE,
+		MaxDeltaE:              d.MaxDeltaE,
+		NumPixelsOverTolerance: d.NumPixelsOverTolerance,
+
+		TopMeta:  getDigestMetadata(test, top),
+		LeftMeta: getDigestMetadata(test, left),
+
+		RenderImgs: map[string]string{},
+	}
+	for _, mode := range diff.RENDER_MODES {
+		ret.RenderImgs[mode] = fmt.Sprintf("/2/_/diff/%s?%s", mode, url.Values{"left": []string{left}, "right": []string{top}}.Encode())
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -447,15 +950,17 @@ func polyTriageLogView(w http.ResponseWriter, r *http.Request) {
 }
 
 // polyTriageLogHandler returns the entries in the triagelog paginated
-// in reverse chronological order.
+// in reverse chronological order. If the 'details' query parameter is true
+// the changed digests are included in each entry.
 func polyTriageLogHandler(w http.ResponseWriter, r *http.Request) {
 	// Get the pagination params.
 	var logEntries []*expstorage.TriageLogEntry
 	var total int
 
-	offset, size, err := util.PaginationParams(r.URL.Query(), 0, DEFAULT_PAGE_SIZE, MAX_PAGE_SIZE)
+	q := r.URL.Query()
+	offset, size, err := util.PaginationParams(q, 0, DEFAULT_PAGE_SIZE, MAX_PAGE_SIZE)
 	if err == nil {
-		logEntries, total, err = storages.ExpectationsStore.QueryLog(offset, size)
+		logEntries, total, err = storages.ExpectationsStore.QueryLog(offset, size, q.Get("details") == "true")
 	}
 
 	if err != nil {
@@ -472,6 +977,52 @@ func polyTriageLogHandler(w http.ResponseWriter, r *http.Request) {
 	sendResponse(w, logEntries, http.StatusOK, pagination)
 }
 
+// PolyTriageUndoConflict is the response of polyTriageUndoHandler with status
+// 409 Conflict if some of the digests of the change were labeled again since.
+// Those digests are listed in Conflicts and keep their labels, the others
+// were reverted to the labels in Restored.
+type PolyTriageUndoConflict struct {
+	Message   string                              `json:"message"`
+	Conflicts []*expstorage.TriageConflict        `json:"conflicts"`
+	Restored  map[string]types.TestClassification `json:"restored"`
+}
+
+// polyTriageUndoHandler reverts the change given in the 'id' query parameter
+// and returns the first page of the triage log, like polyTriageLogHandler.
+// If digests of the change were labeled again since, a
+// PolyTriageUndoConflict is returned instead.
+func polyTriageUndoHandler(w http.ResponseWriter, r *http.Request) {
+	user := login.LoggedInAs(r)
+	if user == "" {
+		util.ReportError(w, r, fmt.Errorf("Not logged in."), "You must be logged in to undo a change.")
+		return
+	}
+	changeId, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 0)
+	if err != nil {
+		util.ReportError(w, r, err, "ID must be valid integer.")
+		return
+	}
+	restored, conflicts, err := storages.ExpectationsStore.UndoChange(int(changeId), user)
+	if err != nil {
+		util.ReportError(w, r, err, "Unable to undo change.")
+		return
+	}
+	if len(conflicts) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		resp := &PolyTriageUndoConflict{
+			Message:   fmt.Sprintf("%d digests were labeled again since change %d and were not reverted.", len(conflicts), changeId),
+			Conflicts: conflicts,
+			Restored:  restored,
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			glog.Errorf("Failed to encode undo conflict: %s", err)
+		}
+		return
+	}
+	polyTriageLogHandler(w, r)
+}
+
 // PolyTestRequest is the POST'd request body handled by polyTestHandler.
 type PolyTestRequest struct {
 	Test               string `json:"test"`
@@ -487,13 +1038,17 @@ type PolyTestRequest struct {
 	Dir                string `json:"dir"`    // Direction to sort, ["", "asc", "desc"]
 	Digest             string `json:"digest"` // The digest to sort against.
 	Head               bool   `json:"head"`   // If true only return digests at head.
+	Branch             string `json:"branch"` // The branch to use, defaults to master.
+	Metric             string `json:"metric"` // The metric to sort by, one of diff.METRICS. Defaults to the pixel diff percent.
+	Issue              int    `json:"issue"`  // The code review issue whose expectations overlay master, 0 for none.
 }
 
 // PolyTestImgInfo info about a single source digest. Used in PolyTestGUI.
 type PolyTestImgInfo struct {
 	Digest           string  `json:"digest"`
-	N                int     `json:"n"`    // The number of images with this digest.
-	PixelDiffPercent float32 `json:"diff"` // Diff from the given digest to compare against, otherwise zero.
+	N                int     `json:"n"`        // The number of images with this digest.
+	PixelDiffPercent float32 `json:"diff"`     // Diff from the given digest to compare against, otherwise zero.
+	Distance         float64 `json:"distance"` // Distance from the given digest under the requested metric, otherwise zero.
 }
 
 // PolyTestImgInfoSlice is for sorting slices of PolyTestImgInfo.
@@ -509,13 +1064,13 @@ func (p PolyTestImgInfoSlice) Less(i, j int) bool {
 }
 func (p PolyTestImgInfoSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
 
-// PolyTestImgInfoDiffAscSlice is for sorting slices of PolyTestImgInfo by PixelDiffPercent.
+// PolyTestImgInfoDiffAscSlice is for sorting slices of PolyTestImgInfo by Distance.
 type PolyTestImgInfoDiffAscSlice []*PolyTestImgInfo
 
 func (p PolyTestImgInfoDiffAscSlice) Len() int { return len(p) }
 func (p PolyTestImgInfoDiffAscSlice) Less(i, j int) bool {
-	if p[i].PixelDiffPercent != p[j].PixelDiffPercent {
-		return p[i].PixelDiffPercent < p[j].PixelDiffPercent
+	if p[i].Distance != p[j].Distance {
+		return p[i].Distance < p[j].Distance
 	} else {
 		return p[i].Digest < p[j].Digest
 	}
@@ -534,6 +1089,20 @@ type PolyTestDiffInfo struct {
 	DiffImg          string  `json:"diffImgUrl"`
 	TopImg           string  `json:"topImgUrl"`
 	LeftImg          string  `json:"leftImgUrl"`
+
+	// Perceptual metrics, see diff.DiffMetrics.
+	SSIM                   float64 `json:"ssim"`
+	MeanDeltaE             float64 `json:"meanDeltaE"`
+	MaxDeltaE              float64 `json:"maxDeltaE"`
+	NumPixelsOverTolerance int     `json:"numPixelsOverTolerance"`
+
+	// Metadata of the digests. Only set by polyDiffJSONDigestHandler.
+	TopMeta  *digestmeta.DigestMetadata `json:"topMeta,omitempty"`
+	LeftMeta *digestmeta.DigestMetadata `json:"leftMeta,omitempty"`
+
+	// RenderImgs maps the render modes in diff.RENDER_MODES to the URLs of
+	// the corresponding images. Only set by polyDiffJSONDigestHandler.
+	RenderImgs map[string]string `json:"renderImgUrls,omitempty"`
 }
 
 // PolyTestGUI serialized as JSON is the response body from polyTestHandler.
@@ -544,6 +1113,10 @@ type PolyTestGUI struct {
 	Message   string                `json:"message"`
 	TopTotal  int                   `json:"topTotal"`
 	LeftTotal int                   `json:"leftTotal"`
+
+	// Version is the version of the expectations of the test in master, see
+	// PolyTriageRequest.
+	Version int `json:"version"`
 }
 
 // imgInfo returns a populated slice of PolyTestImgInfo based on the filter and
@@ -551,10 +1124,13 @@ type PolyTestGUI struct {
 //
 // max maybe set to -1, which means to not truncate the response digest slice.
 // If sortAgainstHash is true then the result will be sorted in direction 'dir' versus the given 'digest',
+// by the distance under the given metric (see diff.DiffMetrics.Distance),
 // otherwise the results will be sorted in terms of ascending N.
 //
 // If head is true then only return digests that appear at head.
-func imgInfo(filter, queryString, testName string, e types.TestClassification, max int, includeIgnores bool, ignores []url.Values, sortAgainstHash bool, dir string, digest string, head bool) ([]*PolyTestImgInfo, int, error) {
+//
+// The digests are looked up in the tiles of the given branchView.
+func imgInfo(view *branchView, filter, queryString, testName string, e types.TestClassification, max int, includeIgnores bool, ignores []url.Values, sortAgainstHash bool, dir string, digest string, metric string, head bool) ([]*PolyTestImgInfo, int, error) {
 	query, err := url.ParseQuery(queryString)
 	if err != nil {
 		return nil, 0, fmt.Errorf("Failed to parse Query in imgInfo: %s", err)
@@ -567,7 +1143,7 @@ func imgInfo(filter, queryString, testName string, e types.TestClassification, m
 	t := timer.New("finding digests")
 	digests := map[string]int{}
 	if head {
-		tile, err := storages.GetLastTileTrimmed()
+		tile, err := view.storages.GetLastTileTrimmed()
 		if err != nil {
 			return nil, 0, fmt.Errorf("Failed to retrieve tallies in imgInfo: %s", err)
 		}
@@ -585,7 +1161,7 @@ func imgInfo(filter, queryString, testName string, e types.TestClassification, m
 			}
 		}
 	} else {
-		digests, err = tallies.ByQuery(query, ignores...)
+		digests, err = view.tallies.ByQuery(query, ignores...)
 		if err != nil {
 			return nil, 0, fmt.Errorf("Failed to retrieve tallies in imgInfo: %s", err)
 		}
@@ -620,8 +1196,9 @@ func imgInfo(filter, queryString, testName string, e types.TestClassification, m
 			Digest: digest,
 			N:      n,
 		}
-		if sortAgainstHash {
-			p.PixelDiffPercent = diffMetrics[digest].PixelDiffPercent
+		if dm, ok := diffMetrics[digest]; sortAgainstHash && ok {
+			p.PixelDiffPercent = dm.PixelDiffPercent
+			p.Distance = dm.Distance(metric)
 		}
 		ret = append(ret, p)
 	}
@@ -659,6 +1236,8 @@ func imgInfo(filter, queryString, testName string, e types.TestClassification, m
 //      topN: topN,
 //      leftN: leftN,
 //      head: [true, false],
+//      branch: "",
+//      metric: ["percent", "ssim", "meanDeltaE", "maxDeltaE", "overTolerance"],
 //   }
 //
 //
@@ -685,7 +1264,14 @@ func polyTestHandler(w http.ResponseWriter, r *http.Request) {
 		util.ReportError(w, r, err, "Failed to parse JSON request.")
 		return
 	}
-	exp, err := storages.ExpectationsStore.Get()
+	// Read the version before the expectations, so a change in between is
+	// detected when the client triages.
+	versions, err := storages.ExpectationsStore.Versions()
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to load expectation versions.")
+		return
+	}
+	exp, err := getExpectations(req.Issue)
 	if err != nil {
 		util.ReportError(w, r, err, "Failed to load expectations.")
 		return
@@ -704,8 +1290,14 @@ func polyTestHandler(w http.ResponseWriter, r *http.Request) {
 		ignores = append(ignores, q)
 	}
 
-	topDigests, topTotal, err := imgInfo(req.TopFilter, req.TopQuery, req.Test, e, req.TopN, req.TopIncludeIgnores, ignores, req.Sort == "top", req.Dir, req.Digest, req.Head)
-	leftDigests, leftTotal, err := imgInfo(req.LeftFilter, req.LeftQuery, req.Test, e, req.LeftN, req.LeftIncludeIgnores, ignores, req.Sort == "left", req.Dir, req.Digest, req.Head)
+	view, err := getBranchView(req.Branch)
+	if err != nil {
+		util.ReportError(w, r, err, "Invalid branch in request.")
+		return
+	}
+
+	topDigests, topTotal, err := imgInfo(view, req.TopFilter, req.TopQuery, req.Test, e, req.TopN, req.TopIncludeIgnores, ignores, req.Sort == "top", req.Dir, req.Digest, req.Metric, req.Head)
+	leftDigests, leftTotal, err := imgInfo(view, req.LeftFilter, req.LeftQuery, req.Test, e, req.LeftN, req.LeftIncludeIgnores, ignores, req.Sort == "left", req.Dir, req.Digest, req.Metric, req.Head)
 
 	// Extract out string slices of digests to pass to *AbsPath and storages.DiffStore.Get().
 	allDigests := map[string]bool{}
@@ -748,6 +1340,11 @@ func polyTestHandler(w http.ResponseWriter, r *http.Request) {
 				DiffImg:          pathToURLConverter(d.PixelDiffFilePath),
 				TopImg:           pathToURLConverter(full[t.Digest]),
 				LeftImg:          pathToURLConverter(full[l.Digest]),
+
+				SSIM:                   d.SSIM,
+				MeanDeltaE:             d.MeanDeltaE,
+				MaxDeltaE:              d.MaxDeltaE,
+				NumPixelsOverTolerance: d.NumPixelsOverTolerance,
 			})
 		}
 		grid = append(grid, row)
@@ -759,6 +1356,7 @@ func polyTestHandler(w http.ResponseWriter, r *http.Request) {
 		Grid:      grid,
 		TopTotal:  topTotal,
 		LeftTotal: leftTotal,
+		Version:   versions[req.Test],
 	}
 	if len(p.Top) == 0 || len(p.Left) == 0 {
 		p.Message = "Failed to find images that match those filters."
@@ -770,6 +1368,170 @@ func polyTestHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// getExpectations returns the master expectations overlaid with the
+// expectations of the given code review issue. If issue is 0 only the master
+// expectations are returned.
+func getExpectations(issue int) (*expstorage.Expectations, error) {
+	exp, err := storages.ExpectationsStore.Get()
+	if err != nil || issue == 0 {
+		return exp, err
+	}
+	issueExp, err := storages.IssueExpectationsStore.Get(issue)
+	if err != nil {
+		return nil, err
+	}
+	return expstorage.Overlay(exp, issueExp), nil
+}
+
+// polyBaselineHandler exports the expectations in the baseline format, see
+// expstorage.Baseline. If the optional 'issue' query parameter is given the
+// expectations of that code review issue overlay the master expectations.
+func polyBaselineHandler(w http.ResponseWriter, r *http.Request) {
+	issue := 0
+	if issueStr := r.URL.Query().Get("issue"); issueStr != "" {
+		var err error
+		if issue, err = strconv.Atoi(issueStr); err != nil {
+			util.ReportError(w, r, err, "Issue must be a valid integer.")
+			return
+		}
+	}
+	exp, err := getExpectations(issue)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to load expectations.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := expstorage.WriteBaseline(w, exp); err != nil {
+		glog.Errorf("Failed to write baseline: %s", err)
+	}
+}
+
+// PolyCluster is a single cluster in the response of polyClustersHandler.
+type PolyCluster struct {
+	*digestcluster.Cluster
+	RepresentativeImg string `json:"representativeImg"`
+}
+
+// polyClustersHandler groups the digests of a test that are similar to each
+// other, see digestcluster.ClusterDigests. The digests of a cluster can then
+// be labeled in one request to polyTriageHandler.
+//
+// It expects a request with the following query parameters:
+//
+//   test - The name of the test.
+//   filter - The label of the digests to cluster, defaults to untriaged.
+//   query - Restricts the traces the digests are taken from.
+//   include - Include ignored digests if true.
+//   head - Only include digests at head if true.
+//   metric - The metric of the distance, see diff.METRICS.
+//   threshold - The maximum distance between two digests in a cluster,
+//               defaults to digestcluster.DefaultThreshold of the metric.
+//   branch - The branch to use, defaults to master.
+//   issue - Optional code review issue whose expectations overlay master.
+//
+// At most digestcluster.MAX_DIGESTS digests can be clustered, the request
+// fails if the query matches more.
+//
+// The response looks like:
+//   {
+//     clusters: [
+//       {
+//         representative: "aaa...",
+//         representativeImg: "/img/...",
+//         digests: ["aaa...", "bbb...", ...],
+//         maxDistance: 0.25
+//       },
+//       ...
+//     ]
+//   }
+func polyClustersHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	test := q.Get("test")
+	if test == "" {
+		util.ReportError(w, r, fmt.Errorf("Missing the test query parameter."), "No test name specified.")
+		return
+	}
+	filter := q.Get("filter")
+	if filter == "" {
+		filter = types.UNTRIAGED.String()
+	}
+	metric := q.Get("metric")
+	threshold := digestcluster.DefaultThreshold(metric)
+	if thresholdStr := q.Get("threshold"); thresholdStr != "" {
+		var err error
+		if threshold, err = strconv.ParseFloat(thresholdStr, 64); err != nil {
+			util.ReportError(w, r, err, "Threshold must be a valid number.")
+			return
+		}
+	}
+	issue := 0
+	if issueStr := q.Get("issue"); issueStr != "" {
+		var err error
+		if issue, err = strconv.Atoi(issueStr); err != nil {
+			util.ReportError(w, r, err, "Issue must be a valid integer.")
+			return
+		}
+	}
+	view, err := getBranchView(q.Get("branch"))
+	if err != nil {
+		util.ReportError(w, r, err, "Invalid branch in request.")
+		return
+	}
+	exp, err := getExpectations(issue)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to load expectations.")
+		return
+	}
+	ignores := []url.Values{}
+	allIgnores, err := storages.IgnoreStore.List()
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to load ignore rules.")
+		return
+	}
+	for _, i := range allIgnores {
+		ignoreQuery, _ := url.ParseQuery(i.Query)
+		ignores = append(ignores, ignoreQuery)
+	}
+
+	ii, _, err := imgInfo(view, filter, q.Get("query"), test, exp.Tests[test], -1, q.Get("include") == "true", ignores, false, "", "", "", q.Get("head") == "true")
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to find digests.")
+		return
+	}
+	if len(ii) > digestcluster.MAX_DIGESTS {
+		util.ReportError(w, r, fmt.Errorf("Too many digests to cluster: %d > %d", len(ii), digestcluster.MAX_DIGESTS), "Too many digests, narrow down the query.")
+		return
+	}
+	digests := make([]string, 0, len(ii))
+	for _, d := range ii {
+		digests = append(digests, d.Digest)
+	}
+	clusters, err := digestcluster.ClusterDigests(digests, storages.DiffStore, metric, threshold)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to cluster digests.")
+		return
+	}
+
+	reps := make([]string, 0, len(clusters))
+	for _, c := range clusters {
+		reps = append(reps, c.Representative)
+	}
+	full := storages.DiffStore.AbsPath(reps)
+	ret := make([]*PolyCluster, 0, len(clusters))
+	for _, c := range clusters {
+		ret = append(ret, &PolyCluster{
+			Cluster:           c,
+			RepresentativeImg: pathToURLConverter(full[c.Representative]),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(map[string][]*PolyCluster{"clusters": ret}); err != nil {
+		util.ReportError(w, r, err, "Failed to encode result")
+	}
+}
+
 // PolyTriageRequest is the form of the JSON posted to polyTriageHandler.
 type PolyTriageRequest struct {
 	Test    string   `json:"test"`
@@ -780,6 +1542,29 @@ type PolyTriageRequest struct {
 	Filter  string   `json:"filter"`
 	Include bool     `json:"include"` // Include ignored digests.
 	Head    bool     `json:"head"`    // Only include digests at head if true.
+	Branch  string   `json:"branch"`  // The branch the query is run against, defaults to master.
+	Issue   int      `json:"issue"`   // If not 0 the labels only apply to this code review issue.
+
+	// Version is the version of the test's expectations the client last saw,
+	// see PolyTestGUI. If it is given and another user has changed the
+	// expectations of the test since, nothing is changed and the request
+	// fails with a PolyTriageConflict. Versions are only checked for master.
+	Version *int `json:"version"`
+}
+
+// PolyTriageResponse is the response of polyTriageHandler. Version is the
+// version of the test's expectations after the change.
+type PolyTriageResponse struct {
+	Version int `json:"version"`
+}
+
+// PolyTriageConflict is the response of polyTriageHandler with status 409
+// Conflict if the expectations of the test were changed concurrently. It
+// lists the digests that were labeled since the version in the request.
+type PolyTriageConflict struct {
+	Message   string                       `json:"message"`
+	Conflicts []*expstorage.TriageConflict `json:"conflicts"`
+	Version   int                          `json:"version"`
 }
 
 // polyTriageHandler handles a request to change the triage status of one or more
@@ -805,7 +1590,12 @@ func polyTriageHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Or build the expectations change request from filter, query, and include.
 	if req.All {
-		exp, err := storages.ExpectationsStore.Get()
+		view, err := getBranchView(req.Branch)
+		if err != nil {
+			util.ReportError(w, r, err, "Invalid branch in request.")
+			return
+		}
+		exp, err := getExpectations(req.Issue)
 		if err != nil {
 			util.ReportError(w, r, err, "Failed to load expectations.")
 			return
@@ -824,7 +1614,7 @@ func polyTriageHandler(w http.ResponseWriter, r *http.Request) {
 				ignores = append(ignores, q)
 			}
 		}
-		ii, _, err := imgInfo(req.Filter, req.Query, req.Test, e, -1, req.Include, ignores, false, "", "", req.Head)
+		ii, _, err := imgInfo(view, req.Filter, req.Query, req.Test, e, -1, req.Include, ignores, false, "", "", "", req.Head)
 		digests = []string{}
 		for _, d := range ii {
 			digests = append(digests, d.Digest)
@@ -840,23 +1630,250 @@ func polyTriageHandler(w http.ResponseWriter, r *http.Request) {
 	tc := map[string]types.TestClassification{
 		req.Test: labelledDigests,
 	}
-	// If the analyzer is running then use that to update the expectations.
-	if *startAnalyzer {
-		_, err := analyzer.SetDigestLabels(tc, user)
-		if err != nil {
-			util.ReportError(w, r, err, "Failed to set the expectations.")
+	if req.Issue != 0 {
+		// Labels for an issue are kept apart until the issue lands.
+		if err := storages.IssueExpectationsStore.AddChange(req.Issue, tc, user); err != nil {
+			util.ReportError(w, r, err, "Failed to store the expectations of the issue.")
 			return
 		}
 	} else {
-		// Otherwise update the expectations directly.
-		if err := storages.ExpectationsStore.AddChange(tc, user); err != nil {
+		var versions map[string]int
+		if req.Version != nil {
+			versions = map[string]int{req.Test: *req.Version}
+		}
+		var err error
+		if *startAnalyzer {
+			// If the analyzer is running then use that to update the expectations.
+			_, err = analyzer.SetDigestLabels(tc, user, versions)
+		} else {
+			// Otherwise update the expectations directly.
+			err = storages.ExpectationsStore.AddChange(tc, user, versions)
+		}
+		if err != nil {
+			if conflictErr, ok := err.(*expstorage.ConflictError); ok {
+				reportTriageConflict(w, conflictErr, req.Test)
+				return
+			}
 			util.ReportError(w, r, err, "Failed to store the updated expectations.")
 			return
 		}
 	}
+
+	// If someone else changes the test right after us the client gets their
+	// version, which is rare enough to accept.
+	resp := &PolyTriageResponse{}
+	if req.Issue == 0 {
+		versions, err := storages.ExpectationsStore.Versions()
+		if err != nil {
+			util.ReportError(w, r, err, "Failed to load expectation versions.")
+			return
+		}
+		resp.Version = versions[req.Test]
+	}
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
-	if err := enc.Encode(map[string]string{}); err != nil {
+	if err := enc.Encode(resp); err != nil {
+		util.ReportError(w, r, err, "Failed to encode result")
+	}
+}
+
+// reportTriageConflict writes a PolyTriageConflict with status 409 Conflict.
+func reportTriageConflict(w http.ResponseWriter, conflictErr *expstorage.ConflictError, test string) {
+	glog.Infof("Triage conflict: %s", conflictErr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	enc := json.NewEncoder(w)
+	resp := &PolyTriageConflict{
+		Message:   conflictErr.Error(),
+		Conflicts: conflictErr.Conflicts,
+		Version:   conflictErr.Versions[test],
+	}
+	if err := enc.Encode(resp); err != nil {
+		glog.Errorf("Failed to encode triage conflict: %s", err)
+	}
+}
+
+// PolyTriageQueryRequest is the request of polyTriageQueryHandler.
+type PolyTriageQueryRequest struct {
+	// Search are the URL encoded search parameters that select the digests,
+	// see search.ParseQuery. The sort order and the page are ignored.
+	Search string `json:"search"`
+	Status string `json:"status"`
+	Branch string `json:"branch"`
+	Issue  int    `json:"issue"` // If not 0 the labels only apply to this code review issue.
+
+	// Preview returns the changes without applying them.
+	Preview bool `json:"preview"`
+
+	// Hash is the hash of the changes returned by the preview, see
+	// PolyTriageQueryResponse. It is required to apply the changes. If the
+	// digests that match the search changed since the preview, nothing is
+	// changed and the request fails with a PolyTriageQueryConflict.
+	Hash string `json:"hash"`
+
+	// Versions are the versions of the expectations of the tests returned by
+	// the preview. If they are given and another user has changed the
+	// expectations of one of the tests since, nothing is changed and the
+	// request fails with a PolyTriageQueryConflict. Like for
+	// PolyTriageRequest versions are only checked for master.
+	Versions map[string]int `json:"versions"`
+}
+
+// PolyTriageQueryResponse is the response of polyTriageQueryHandler.
+type PolyTriageQueryResponse struct {
+	// Changes are the digests whose label changes, with their current label.
+	Changes []*search.Result `json:"changes"`
+
+	// Versions are the versions of the expectations of the changed tests,
+	// before the change for a preview and after it otherwise.
+	Versions map[string]int `json:"versions"`
+
+	// Hash identifies the changes, see search.ChangesHash.
+	Hash    string `json:"hash"`
+	Applied bool   `json:"applied"`
+}
+
+// PolyTriageQueryConflict is the response of polyTriageQueryHandler with
+// status 409 Conflict if the expectations of any of the tests were changed
+// since the versions in the request, or if the digests that match the search
+// changed since the preview. In the latter case Changes and Hash are the
+// changes as they are now, so the client can confirm them again.
+type PolyTriageQueryConflict struct {
+	Message   string                       `json:"message"`
+	Conflicts []*expstorage.TriageConflict `json:"conflicts"`
+	Versions  map[string]int               `json:"versions"`
+	Changes   []*search.Result             `json:"changes"`
+	Hash      string                       `json:"hash"`
+}
+
+// polyTriageQueryHandler labels all digests that match a search, e.g. all
+// untriaged digests at head of a config or all digests blamed on a commit,
+// with the same label in a single change of the expectations.
+//
+// It accepts a POST'd JSON serialization of PolyTriageQueryRequest. The
+// digests are resolved again when the change is applied. Only the changes
+// that were previewed are applied, so if digests arrived or were triaged
+// since the preview the request is rejected.
+func polyTriageQueryHandler(w http.ResponseWriter, r *http.Request) {
+	req := &PolyTriageQueryRequest{}
+	if err := parseJson(r, req); err != nil {
+		util.ReportError(w, r, err, "Failed to parse JSON request.")
+		return
+	}
+	glog.Infof("Triage query request: %#v", req)
+	user := login.LoggedInAs(r)
+	if (user == "") && !req.Preview {
+		util.ReportError(w, r, fmt.Errorf("Not logged in."), "You must be logged in to triage.")
+		return
+	}
+	label := types.LabelFromString(req.Status)
+	if label.String() != req.Status {
+		util.ReportError(w, r, fmt.Errorf("Invalid label: %s", req.Status), "Invalid triage status.")
+		return
+	}
+	v, err := url.ParseQuery(req.Search)
+	if err != nil {
+		util.ReportError(w, r, err, "Invalid search parameters.")
+		return
+	}
+	q, err := search.ParseQuery(v)
+	if err != nil {
+		util.ReportError(w, r, err, "Invalid search query.")
+		return
+	}
+	view, err := getBranchView(req.Branch)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to find branch.")
+		return
+	}
+	exp, err := getExpectations(req.Issue)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to load expectations.")
+		return
+	}
+	results, err := newSearcher(view).Matches(q, exp)
+	if err != nil {
+		util.ReportError(w, r, err, "Search failed.")
+		return
+	}
+
+	resp := &PolyTriageQueryResponse{
+		Changes:  []*search.Result{},
+		Versions: map[string]int{},
+	}
+	for _, res := range results {
+		if types.LabelFromString(res.Label) != label {
+			resp.Changes = append(resp.Changes, res)
+		}
+	}
+	tc := search.TriageChanges(results, label)
+	resp.Hash = search.ChangesHash(tc)
+
+	if !req.Preview && (req.Hash == "") {
+		util.ReportError(w, r, fmt.Errorf("Missing hash of the previewed changes."), "Changes must be previewed before they are applied.")
+		return
+	}
+	if !req.Preview && (req.Hash != resp.Hash) {
+		glog.Infof("Triage query changed since the preview: %s != %s", req.Hash, resp.Hash)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		enc := json.NewEncoder(w)
+		conflict := &PolyTriageQueryConflict{
+			Message:   "The digests that match the search changed since the preview.",
+			Conflicts: []*expstorage.TriageConflict{},
+			Versions:  map[string]int{},
+			Changes:   resp.Changes,
+			Hash:      resp.Hash,
+		}
+		if err := enc.Encode(conflict); err != nil {
+			glog.Errorf("Failed to encode triage conflict: %s", err)
+		}
+		return
+	}
+
+	if !req.Preview && (len(tc) > 0) {
+		if req.Issue != 0 {
+			err = storages.IssueExpectationsStore.AddChange(req.Issue, tc, user)
+		} else if *startAnalyzer {
+			_, err = analyzer.SetDigestLabels(tc, user, req.Versions)
+		} else {
+			err = storages.ExpectationsStore.AddChange(tc, user, req.Versions)
+		}
+		if conflictErr, ok := err.(*expstorage.ConflictError); ok {
+			glog.Infof("Triage conflict: %s", conflictErr)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			enc := json.NewEncoder(w)
+			conflict := &PolyTriageQueryConflict{
+				Message:   conflictErr.Error(),
+				Conflicts: conflictErr.Conflicts,
+				Versions:  conflictErr.Versions,
+			}
+			if err := enc.Encode(conflict); err != nil {
+				glog.Errorf("Failed to encode triage conflict: %s", err)
+			}
+			return
+		}
+		if err != nil {
+			util.ReportError(w, r, err, "Failed to store the updated expectations.")
+			return
+		}
+		resp.Applied = true
+	}
+
+	if req.Issue == 0 {
+		versions, err := storages.ExpectationsStore.Versions()
+		if err != nil {
+			util.ReportError(w, r, err, "Failed to load expectation versions.")
+			return
+		}
+		for testName := range tc {
+			resp.Versions[testName] = versions[testName]
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(resp); err != nil {
 		util.ReportError(w, r, err, "Failed to encode result")
 	}
 }
@@ -900,6 +1917,14 @@ type PolyDetailsGUI struct {
 	Commits     []*ptypes.Commit   `json:"commits"`
 	OtherHashes []string           `json:"otherHashes"`
 	TileSize    int                `json:"tileSize"`
+
+	// Metadata of the digests, nil if it is not known.
+	TopMeta  *digestmeta.DigestMetadata `json:"topMeta"`
+	LeftMeta *digestmeta.DigestMetadata `json:"leftMeta"`
+
+	// When the digests were first and last seen and their linked issues.
+	TopInfo  *digeststore.DigestInfo `json:"topInfo"`
+	LeftInfo *digeststore.DigestInfo `json:"leftInfo"`
 }
 
 // polyDetailsHandler handles requests about individual digests in a test.
@@ -910,6 +1935,8 @@ type PolyDetailsGUI struct {
 //   top  - A digest in the test.
 //   left - A digest in the test.
 //   graphs - Boolean that's true if graph data should be returned.
+//   branch - The branch to use, defaults to master.
+//   issue - Optional code review issue whose expectations overlay master.
 //
 // The response looks like:
 //   {
@@ -930,16 +1957,40 @@ type PolyDetailsGUI struct {
 //          _params: {"os: "Android", ...}
 //        },
 //        ...
-//     ]
+//     ],
+//     topMeta: {
+//       testName: "...",
+//       digest: "...",
+//       ext: "png",
+//       sourceType: "gm",
+//       width: 128,
+//       height: 128,
+//       options: {"ext": "png", ...}
+//     },
+//     leftMeta: {...},
+//     topInfo: {
+//       TestName: "...",
+//       Digest: "...",
+//       First: 1433954361,
+//       Last: 1434030000,
+//       Exception: "",
+//       IssueIDs: [1234]
+//     },
+//     leftInfo: {...}
 //   }
 func polyDetailsHandler(w http.ResponseWriter, r *http.Request) {
-	tile, err := storages.GetLastTileTrimmed()
+	if err := r.ParseForm(); err != nil {
+		util.ReportError(w, r, err, "Failed to parse form values")
+		return
+	}
+	view, err := getBranchView(r.Form.Get("branch"))
 	if err != nil {
-		util.ReportError(w, r, err, "Failed to load tile")
+		util.ReportError(w, r, err, "Invalid branch in request.")
 		return
 	}
-	if err := r.ParseForm(); err != nil {
-		util.ReportError(w, r, err, "Failed to parse form values")
+	tile, err := view.storages.GetLastTileTrimmed()
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to load tile")
 		return
 	}
 	top := r.Form.Get("top")
@@ -953,7 +2004,14 @@ func polyDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		util.ReportError(w, r, fmt.Errorf("Missing the test query parameter."), "No test name specified.")
 		return
 	}
-	exp, err := storages.ExpectationsStore.Get()
+	issue := 0
+	if issueStr := r.Form.Get("issue"); issueStr != "" {
+		if issue, err = strconv.Atoi(issueStr); err != nil {
+			util.ReportError(w, r, err, "Issue must be a valid integer.")
+			return
+		}
+	}
+	exp, err := getExpectations(issue)
 	if err != nil {
 		util.ReportError(w, r, err, "Failed to load expectations.")
 		return
@@ -971,7 +2029,7 @@ func polyDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	leftParamSet := map[string][]string{}
 
 	// Now build out the ParamSet for each digest.
-	tally := tallies.ByTrace()
+	tally := view.tallies.ByTrace()
 	traceNames := []string{}
 	for id, tr := range tile.Traces {
 		traceTally, ok := tally[id]
@@ -998,6 +2056,11 @@ func polyDetailsHandler(w http.ResponseWriter, r *http.Request) {
 			Left: safeGet(leftParamSet, k),
 		})
 	}
+	ret.TopMeta = getDigestMetadata(test, top)
+	ret.LeftMeta = getDigestMetadata(test, left)
+	ret.TopInfo = storages.DigestStore.GetDigestInfo(test, top)
+	ret.LeftInfo = storages.DigestStore.GetDigestInfo(test, left)
+
 	// Now build the trace data.
 	if r.Form.Get("graphs") == "true" {
 		ret.Traces, ret.OtherHashes = buildTraceData(top, traceNames, tile, tally)
@@ -1011,6 +2074,74 @@ func polyDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// DigestIssuesRequest is the JSON sent to polyDigestIssuesHandler.
+type DigestIssuesRequest struct {
+	Test     string `json:"test"`
+	Digest   string `json:"digest"`
+	IssueIDs []int  `json:"issueIDs"`
+}
+
+// polyDigestIssuesHandler links issues to a digest. The issues are added to
+// the ones already linked and the updated DigestInfo is returned.
+func polyDigestIssuesHandler(w http.ResponseWriter, r *http.Request) {
+	user := login.LoggedInAs(r)
+	if user == "" {
+		util.ReportError(w, r, fmt.Errorf("Not logged in."), "You must be logged in to link issues.")
+		return
+	}
+	req := &DigestIssuesRequest{}
+	if err := parseJson(r, req); err != nil {
+		util.ReportError(w, r, err, "Failed to parse JSON request.")
+		return
+	}
+	if req.Test == "" || req.Digest == "" {
+		util.ReportError(w, r, fmt.Errorf("Missing test or digest: %s %s", req.Test, req.Digest), "No digest specified.")
+		return
+	}
+	update := &digeststore.DigestInfo{TestName: req.Test, Digest: req.Digest, IssueIDs: req.IssueIDs}
+	if err := storages.DigestStore.UpdateDigestInfo([]*digeststore.DigestInfo{update}); err != nil {
+		util.ReportError(w, r, err, "Failed to link issues.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(storages.DigestStore.GetDigestInfo(req.Test, req.Digest)); err != nil {
+		util.ReportError(w, r, err, "Failed to encode result")
+	}
+}
+
+// getDigestMetadata returns the metadata of the given test and digest or nil
+// if none is known. If the dimensions of the image are not known yet they are
+// read from the local image cache and written back to the MetadataStore.
+// Images that are not cached yet are not fetched, their dimensions are added
+// by a later request.
+func getDigestMetadata(test, digest string) *digestmeta.DigestMetadata {
+	md, err := storages.MetadataStore.Get(test, digest)
+	if err != nil {
+		glog.Errorf("Unable to retrieve metadata for %s/%s: %s", test, digest, err)
+		return nil
+	}
+	if md == nil || md.Width > 0 || !diff.ValidDigest(digest) {
+		return md
+	}
+
+	imgPath := filepath.Join(*imageDir, filediffstore.DEFAULT_IMG_DIR_NAME, fmt.Sprintf("%s.%s", digest, md.Ext))
+	if _, err := os.Stat(imgPath); err != nil {
+		return md
+	}
+	width, height, err := diff.ImageSize(imgPath)
+	if err != nil {
+		glog.Errorf("Unable to determine the size of %s/%s: %s", test, digest, err)
+		return md
+	}
+	md.Width, md.Height = width, height
+	update := &digestmeta.DigestMetadata{TestName: test, Digest: digest, Width: width, Height: height}
+	if err := storages.MetadataStore.Update([]*digestmeta.DigestMetadata{update}); err != nil {
+		glog.Errorf("Unable to update metadata for %s/%s: %s", test, digest, err)
+	}
+	return md
+}
+
 // buildTraceData returns a populated []*Trace for all the traces that contain 'digest'.
 func buildTraceData(digest string, traceNames []string, tile *ptypes.Tile, tally tally.TraceTally) ([]*Trace, []string) {
 	sort.Strings(traceNames)
@@ -1064,7 +2195,12 @@ func buildTraceData(digest string, traceNames []string, tile *ptypes.Tile, tally
 }
 
 func polyParamsHandler(w http.ResponseWriter, r *http.Request) {
-	tile, err := storages.GetLastTileTrimmed()
+	view, err := getBranchView(r.FormValue("branch"))
+	if err != nil {
+		util.ReportError(w, r, err, "Invalid branch in request.")
+		return
+	}
+	tile, err := view.storages.GetLastTileTrimmed()
 	if err != nil {
 		util.ReportError(w, r, err, "Failed to load tile")
 		return
@@ -1080,7 +2216,12 @@ func polyParamsHandler(w http.ResponseWriter, r *http.Request) {
 //
 // Endpoint used by the Android buildbots to avoid transferring already known images.
 func polyAllHashesHandler(w http.ResponseWriter, r *http.Request) {
-	byTest := tallies.ByTest()
+	view, err := getBranchView(r.FormValue("branch"))
+	if err != nil {
+		util.ReportError(w, r, err, "Invalid branch in request.")
+		return
+	}
+	byTest := view.tallies.ByTest()
 	hashes := map[string]bool{}
 	for _, test := range byTest {
 		for k, _ := range *test {
@@ -9,6 +9,8 @@ import (
 	"github.com/skia-dev/glog"
 	"go.skia.org/infra/go/timer"
 	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/golden/go/flaky"
+	"go.skia.org/infra/golden/go/statushistory"
 	"go.skia.org/infra/golden/go/storage"
 	"go.skia.org/infra/golden/go/types"
 	ptypes "go.skia.org/infra/perf/go/types"
@@ -19,6 +21,19 @@ const (
 	METRIC_TOTAL       = "gold.digests.total"
 	METRIC_ALL_TMPL    = "gold.%s.all"
 	METRIC_CORPUS_TMPL = "gold.%s.by_corpus.%s"
+
+	// METRIC_INCREASE_TMPL is the increase of untriaged digests in a corpus
+	// within INCREASE_WINDOW, see StatusHistory. Alerts on it catch jumps in
+	// the number of untriaged digests.
+	METRIC_INCREASE_TMPL = "gold.untriaged_increase.by_corpus.%s"
+
+	// INCREASE_WINDOW is the time window in which the increase of untriaged
+	// digests is measured.
+	INCREASE_WINDOW = time.Hour
+
+	// HISTORY_RETENTION is how long snapshots are kept in the status history.
+	// Older snapshots are removed whenever a new one is recorded.
+	HISTORY_RETENTION = 365 * 24 * time.Hour
 )
 
 var (
@@ -30,6 +45,9 @@ var (
 
 	// Gauges to track counts of digests by corpus / label
 	corpusGauges = map[string]map[types.Label]metrics.Gauge{}
+
+	// Gauges to track the increase of untriaged digests by corpus.
+	increaseGauges = map[string]metrics.Gauge{}
 )
 
 // GUIStatus reflects the current rebaseline status. In particular whether
@@ -130,9 +148,15 @@ func (s *StatusWatcher) calcStatus(tile *ptypes.Tile) error {
 	// Gathers unique labels by corpus and label.
 	byCorpus := map[string]map[types.Label]map[string]bool{}
 
+	// Untriaged digests of flaky traces are not counted.
+	flakyTraces := map[string]*flaky.FlakyTrace{}
+	if s.storages.FlakyThreshold > 0 {
+		flakyTraces = flaky.FindFlaky(tile, s.storages.FlakyThreshold)
+	}
+
 	// Iterate over the current traces
 	tileLen := tile.LastCommitIndex() + 1
-	for _, trace := range tile.Traces {
+	for id, trace := range tile.Traces {
 		gTrace := trace.(*ptypes.GoldenTrace)
 
 		idx := tileLen - 1
@@ -169,6 +193,9 @@ func (s *StatusWatcher) calcStatus(tile *ptypes.Tile) error {
 		digest := gTrace.Values[idx]
 		testName := gTrace.Params()[types.PRIMARY_KEY_FIELD]
 		status := expectations.Classification(testName, digest)
+		if _, ok := flakyTraces[id]; ok && (status == types.UNTRIAGED) {
+			continue
+		}
 		digestInfo := s.storages.DigestStore.GetDigestInfo(testName, digest)
 
 		okByCorpus[corpus] = okByCorpus[corpus] && ((status == types.POSITIVE) ||
@@ -201,6 +228,12 @@ func (s *StatusWatcher) calcStatus(tile *ptypes.Tile) error {
 		corpusGauges[corpus][types.NEGATIVE].Update(int64(negativeCount))
 		corpusGauges[corpus][types.UNTRIAGED].Update(int64(untriagedCount))
 	}
+	if s.storages.StatusHistory != nil {
+		if err := s.recordHistory(byCorpus); err != nil {
+			glog.Errorf("Unable to record the status history: %s", err)
+		}
+	}
+
 	allUntriagedGauge.Update(int64(allUntriagedCount))
 	allPositiveGauge.Update(int64(allPositiveCount))
 	allNegativeGauge.Update(int64(allNegativeCount))
@@ -218,3 +251,47 @@ func (s *StatusWatcher) calcStatus(tile *ptypes.Tile) error {
 
 	return nil
 }
+
+// recordHistory adds a snapshot of the counts per corpus to the status
+// history and updates the gauges that track the increase of untriaged
+// digests within INCREASE_WINDOW. Snapshots older than HISTORY_RETENTION are
+// removed.
+func (s *StatusWatcher) recordHistory(byCorpus map[string]map[types.Label]map[string]bool) error {
+	now := util.TimeStampMs()
+	snapshots := make([]*statushistory.Snapshot, 0, len(byCorpus))
+	for corpus, labels := range byCorpus {
+		snapshots = append(snapshots, &statushistory.Snapshot{
+			TS:        now,
+			Corpus:    corpus,
+			Untriaged: len(labels[types.UNTRIAGED]),
+			Positive:  len(labels[types.POSITIVE]),
+			Negative:  len(labels[types.NEGATIVE]),
+		})
+	}
+	if err := s.storages.StatusHistory.Add(snapshots); err != nil {
+		return err
+	}
+	if _, err := s.storages.StatusHistory.Prune(now - int64(HISTORY_RETENTION/time.Millisecond)); err != nil {
+		return err
+	}
+
+	// Find the oldest snapshot of each corpus within the window.
+	recent, err := s.storages.StatusHistory.Range(now-int64(INCREASE_WINDOW/time.Millisecond), now+1)
+	if err != nil {
+		return err
+	}
+	oldest := map[string]*statushistory.Snapshot{}
+	for _, snap := range recent {
+		if _, ok := oldest[snap.Corpus]; !ok {
+			oldest[snap.Corpus] = snap
+		}
+	}
+
+	for _, snap := range snapshots {
+		if _, ok := increaseGauges[snap.Corpus]; !ok {
+			increaseGauges[snap.Corpus] = metrics.NewRegisteredGauge(fmt.Sprintf(METRIC_INCREASE_TMPL, snap.Corpus), nil)
+		}
+		increaseGauges[snap.Corpus].Update(int64(snap.Untriaged - oldest[snap.Corpus].Untriaged))
+	}
+	return nil
+}
@@ -8,9 +8,11 @@ import (
 
 	assert "github.com/stretchr/testify/require"
 	"go.skia.org/infra/go/testutils"
+	"go.skia.org/infra/go/util"
 	"go.skia.org/infra/golden/go/digeststore"
 	"go.skia.org/infra/golden/go/expstorage"
 	"go.skia.org/infra/golden/go/mocks"
+	"go.skia.org/infra/golden/go/statushistory"
 	"go.skia.org/infra/golden/go/storage"
 	"go.skia.org/infra/golden/go/types"
 	pconfig "go.skia.org/infra/perf/go/config"
@@ -97,7 +99,7 @@ func testStatusWatcher(t assert.TestingT, tileStore ptypes.TileStore) {
 		}
 
 		// Update the expecations and wait for the status to change.
-		assert.Nil(t, storages.ExpectationsStore.AddChange(changes, ""))
+		assert.Nil(t, storages.ExpectationsStore.AddChange(changes, "", nil))
 		time.Sleep(1 * time.Second)
 		newStatus := watcher.GetStatus()
 		assert.False(t, newStatus.CorpStatus[corpus].OK)
@@ -106,7 +108,7 @@ func testStatusWatcher(t assert.TestingT, tileStore ptypes.TileStore) {
 		// Make sure all tests have an issue attached to each DigestInfo and
 		// trigger another expectations update.
 		storages.DigestStore.(*MockDigestStore).issueIDs = []int{1}
-		assert.Nil(t, storages.ExpectationsStore.AddChange(changes, ""))
+		assert.Nil(t, storages.ExpectationsStore.AddChange(changes, "", nil))
 		time.Sleep(1 * time.Second)
 
 		// Make sure the current corpus is now ok.
@@ -119,6 +121,68 @@ func testStatusWatcher(t assert.TestingT, tileStore ptypes.TileStore) {
 	assert.True(t, newStatus.OK)
 }
 
+func TestStatusHistory(t *testing.T) {
+	commits := []*ptypes.Commit{
+		&ptypes.Commit{CommitTime: 10, Hash: "h1", Author: "John Doe 1"},
+		&ptypes.Commit{CommitTime: 20, Hash: "h2", Author: "John Doe 2"},
+	}
+	params := []map[string]string{
+		map[string]string{"name": "foo", "config": "8888", "source_type": "gm"},
+		map[string]string{"name": "foo", "config": "565", "source_type": "gm"},
+		map[string]string{"name": "bar", "config": "8888", "source_type": "image"},
+	}
+	digests := [][]string{
+		[]string{"aaa", "bbb"},
+		[]string{"aaa", "ccc"},
+		[]string{"ddd", "ddd"},
+	}
+
+	storages := &storage.Storage{
+		ExpectationsStore: expstorage.NewMemExpectationsStore(),
+		TileStore:         mocks.NewMockTileStore(t, digests, params, commits),
+		DigestStore:       &MockDigestStore{},
+		StatusHistory:     statushistory.NewMemStatusHistory(),
+	}
+
+	// Snapshots older than HISTORY_RETENTION are removed.
+	expired := util.TimeStampMs() - int64(HISTORY_RETENTION/time.Millisecond) - 1000
+	assert.Nil(t, storages.StatusHistory.Add([]*statushistory.Snapshot{{TS: expired, Corpus: "gm", Untriaged: 10}}))
+
+	_, err := New(storages)
+	assert.Nil(t, err)
+
+	snapshots, err := storages.StatusHistory.Range(0, util.TimeStampMs()+1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(snapshots))
+	assert.Equal(t, "gm", snapshots[0].Corpus)
+	assert.Equal(t, 2, snapshots[0].Untriaged)
+	assert.Equal(t, "image", snapshots[1].Corpus)
+	assert.Equal(t, 1, snapshots[1].Untriaged)
+
+	// Every recalculation adds a snapshot.
+	assert.Nil(t, storages.ExpectationsStore.AddChange(map[string]types.TestClassification{
+		"foo": map[string]types.Label{"bbb": types.POSITIVE, "ccc": types.NEGATIVE},
+	}, "", nil))
+	deadline := time.Now().Add(10 * time.Second)
+	for len(snapshots) < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the status history. Got %d snapshots, want 4.", len(snapshots))
+		}
+		time.Sleep(100 * time.Millisecond)
+		snapshots, err = storages.StatusHistory.Range(0, util.TimeStampMs()+1)
+		assert.Nil(t, err)
+	}
+	var lastGM *statushistory.Snapshot
+	for _, snap := range snapshots {
+		if snap.Corpus == "gm" {
+			lastGM = snap
+		}
+	}
+	assert.Equal(t, 0, lastGM.Untriaged)
+	assert.Equal(t, 1, lastGM.Positive)
+	assert.Equal(t, 1, lastGM.Negative)
+}
+
 type MockDigestStore struct {
 	issueIDs []int
 }
@@ -128,3 +192,7 @@ func (m *MockDigestStore) GetDigestInfo(testName, digest string) *digeststore.Di
 		IssueIDs: m.issueIDs,
 	}
 }
+
+func (m *MockDigestStore) UpdateDigestInfo(digestInfos []*digeststore.DigestInfo) error {
+	return nil
+}
@@ -0,0 +1,188 @@
+// statushistory stores snapshots of the triage status of each corpus over
+// time, so the triage debt can be tracked and increases can be alerted on.
+package statushistory
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.skia.org/infra/go/database"
+	"go.skia.org/infra/go/util"
+)
+
+// Snapshot contains the number of digests at head with each label in one
+// corpus at the time TS, in milliseconds since the epoch.
+type Snapshot struct {
+	TS        int64  `json:"ts"`
+	Corpus    string `json:"corpus"`
+	Untriaged int    `json:"untriaged"`
+	Positive  int    `json:"positive"`
+	Negative  int    `json:"negative"`
+}
+
+// StatusHistory stores Snapshots.
+type StatusHistory interface {
+	// Add stores the given snapshots.
+	Add(snapshots []*Snapshot) error
+
+	// Range returns the snapshots with begin <= TS < end sorted by time and
+	// corpus.
+	Range(begin, end int64) ([]*Snapshot, error)
+
+	// Prune removes the snapshots with TS < before and returns the number of
+	// removed snapshots.
+	Prune(before int64) (int64, error)
+}
+
+// Downsample returns the last snapshot of each corpus in each interval of
+// the given length in milliseconds, sorted by time and corpus. The input
+// must be sorted by time.
+func Downsample(snapshots []*Snapshot, interval int64) []*Snapshot {
+	if interval <= 0 {
+		return snapshots
+	}
+
+	ret := []*Snapshot{}
+	// lastIdx maps a corpus to the index of its snapshot in the current
+	// interval in ret.
+	lastIdx := map[string]int{}
+	bucket := int64(-1)
+	for _, s := range snapshots {
+		if b := s.TS / interval; b != bucket {
+			bucket = b
+			lastIdx = map[string]int{}
+		}
+		if idx, ok := lastIdx[s.Corpus]; ok {
+			ret[idx] = s
+		} else {
+			lastIdx[s.Corpus] = len(ret)
+			ret = append(ret, s)
+		}
+	}
+	sort.Sort(snapshotSlice(ret))
+	return ret
+}
+
+// snapshotSlice sorts Snapshots by time and corpus.
+type snapshotSlice []*Snapshot
+
+func (p snapshotSlice) Len() int { return len(p) }
+func (p snapshotSlice) Less(i, j int) bool {
+	if p[i].TS == p[j].TS {
+		return p[i].Corpus < p[j].Corpus
+	}
+	return p[i].TS < p[j].TS
+}
+func (p snapshotSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// MemStatusHistory implements StatusHistory in memory for prototyping and
+// testing.
+type MemStatusHistory struct {
+	snapshots []*Snapshot
+	mutex     sync.Mutex
+}
+
+func NewMemStatusHistory() StatusHistory {
+	return &MemStatusHistory{
+		snapshots: []*Snapshot{},
+	}
+}
+
+// See StatusHistory interface.
+func (m *MemStatusHistory) Add(snapshots []*Snapshot) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.snapshots = append(m.snapshots, snapshots...)
+	sort.Stable(snapshotSlice(m.snapshots))
+	return nil
+}
+
+// See StatusHistory interface.
+func (m *MemStatusHistory) Range(begin, end int64) ([]*Snapshot, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ret := []*Snapshot{}
+	for _, s := range m.snapshots {
+		if (s.TS >= begin) && (s.TS < end) {
+			ret = append(ret, s)
+		}
+	}
+	return ret, nil
+}
+
+// See StatusHistory interface.
+func (m *MemStatusHistory) Prune(before int64) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// Snapshots are sorted by time.
+	idx := sort.Search(len(m.snapshots), func(i int) bool { return m.snapshots[i].TS >= before })
+	m.snapshots = append([]*Snapshot{}, m.snapshots[idx:]...)
+	return int64(idx), nil
+}
+
+// SQLStatusHistory implements StatusHistory in an SQL database.
+type SQLStatusHistory struct {
+	vdb *database.VersionedDB
+}
+
+func NewSQLStatusHistory(vdb *database.VersionedDB) StatusHistory {
+	return &SQLStatusHistory{
+		vdb: vdb,
+	}
+}
+
+// See StatusHistory interface.
+func (s *SQLStatusHistory) Add(snapshots []*Snapshot) error {
+	const insertStmt = `REPLACE INTO status_history (ts, corpus, untriaged, positive, negative) VALUES %s`
+
+	if len(snapshots) == 0 {
+		return nil
+	}
+
+	placeHolders := make([]string, 0, len(snapshots))
+	vals := make([]interface{}, 0, 5*len(snapshots))
+	for _, snap := range snapshots {
+		placeHolders = append(placeHolders, "(?, ?, ?, ?, ?)")
+		vals = append(vals, snap.TS, snap.Corpus, snap.Untriaged, snap.Positive, snap.Negative)
+	}
+	_, err := s.vdb.DB.Exec(fmt.Sprintf(insertStmt, strings.Join(placeHolders, ",")), vals...)
+	return err
+}
+
+// See StatusHistory interface.
+func (s *SQLStatusHistory) Range(begin, end int64) ([]*Snapshot, error) {
+	const stmt = `SELECT ts, corpus, untriaged, positive, negative
+	              FROM status_history
+	              WHERE ts >= ? AND ts < ?
+	              ORDER BY ts, corpus`
+
+	rows, err := s.vdb.DB.Query(stmt, begin, end)
+	if err != nil {
+		return nil, err
+	}
+	defer util.Close(rows)
+
+	ret := []*Snapshot{}
+	for rows.Next() {
+		snap := &Snapshot{}
+		if err := rows.Scan(&snap.TS, &snap.Corpus, &snap.Untriaged, &snap.Positive, &snap.Negative); err != nil {
+			return nil, err
+		}
+		ret = append(ret, snap)
+	}
+	return ret, nil
+}
+
+// See StatusHistory interface.
+func (s *SQLStatusHistory) Prune(before int64) (int64, error) {
+	res, err := s.vdb.DB.Exec(`DELETE FROM status_history WHERE ts < ?`, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,87 @@
+package statushistory
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/go/database"
+	"go.skia.org/infra/go/database/testutil"
+	"go.skia.org/infra/go/testutils"
+	"go.skia.org/infra/golden/go/db"
+)
+
+func TestMemStatusHistory(t *testing.T) {
+	testStatusHistory(t, NewMemStatusHistory())
+}
+
+func TestSQLStatusHistory(t *testing.T) {
+	// Set up the database. This also locks the db until this test is finished
+	// causing similar tests to wait.
+	migrationSteps := db.MigrationSteps()
+	mysqlDB := testutil.SetupMySQLTestDatabase(t, migrationSteps)
+	defer mysqlDB.Close(t)
+
+	vdb := database.NewVersionedDB(testutil.LocalTestDatabaseConfig(migrationSteps))
+	defer testutils.AssertCloses(t, vdb)
+
+	testStatusHistory(t, NewSQLStatusHistory(vdb))
+}
+
+func testStatusHistory(t *testing.T, history StatusHistory) {
+	snapshots, err := history.Range(0, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(snapshots))
+
+	assert.NoError(t, history.Add([]*Snapshot{
+		&Snapshot{TS: 20, Corpus: "gm", Untriaged: 2, Positive: 5, Negative: 1},
+		&Snapshot{TS: 20, Corpus: "image", Untriaged: 1},
+	}))
+	assert.NoError(t, history.Add([]*Snapshot{
+		&Snapshot{TS: 10, Corpus: "gm", Untriaged: 1, Positive: 5, Negative: 1},
+	}))
+	assert.NoError(t, history.Add([]*Snapshot{}))
+
+	snapshots, err = history.Range(0, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, []*Snapshot{
+		&Snapshot{TS: 10, Corpus: "gm", Untriaged: 1, Positive: 5, Negative: 1},
+		&Snapshot{TS: 20, Corpus: "gm", Untriaged: 2, Positive: 5, Negative: 1},
+		&Snapshot{TS: 20, Corpus: "image", Untriaged: 1},
+	}, snapshots)
+
+	snapshots, err = history.Range(11, 20)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(snapshots))
+	snapshots, err = history.Range(10, 11)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(snapshots))
+
+	n, err := history.Prune(20)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	snapshots, err = history.Range(0, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, []*Snapshot{
+		&Snapshot{TS: 20, Corpus: "gm", Untriaged: 2, Positive: 5, Negative: 1},
+		&Snapshot{TS: 20, Corpus: "image", Untriaged: 1},
+	}, snapshots)
+	n, err = history.Prune(20)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+func TestDownsample(t *testing.T) {
+	snapshots := []*Snapshot{
+		&Snapshot{TS: 1, Corpus: "image", Untriaged: 1},
+		&Snapshot{TS: 2, Corpus: "gm", Untriaged: 2},
+		&Snapshot{TS: 5, Corpus: "gm", Untriaged: 3},
+		&Snapshot{TS: 12, Corpus: "gm", Untriaged: 4},
+		&Snapshot{TS: 19, Corpus: "gm", Untriaged: 5},
+	}
+	assert.Equal(t, snapshots, Downsample(snapshots, 0))
+	assert.Equal(t, []*Snapshot{
+		&Snapshot{TS: 1, Corpus: "image", Untriaged: 1},
+		&Snapshot{TS: 5, Corpus: "gm", Untriaged: 3},
+		&Snapshot{TS: 19, Corpus: "gm", Untriaged: 5},
+	}, Downsample(snapshots, 10))
+}
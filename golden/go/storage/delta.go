@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"time"
+
+	"go.skia.org/infra/go/timer"
+	"go.skia.org/infra/golden/go/types"
+	ptypes "go.skia.org/infra/perf/go/types"
+)
+
+// TileDelta describes how a tile differs from the tile that was processed
+// before it, so that the consumers of tiles can update their state in place
+// instead of recomputing it from the whole tile.
+type TileDelta struct {
+	// Tile is the new tile and Prev is the tile the delta is relative to. Prev
+	// is nil for the first tile.
+	Tile *ptypes.Tile
+	Prev *ptypes.Tile
+
+	// Full is true if consumers have to recompute their state from Tile,
+	// because there is no previous tile, the commits of the tiles do not line
+	// up or a consistency check is due.
+	Full bool
+
+	// Check is true if Full is only set because a periodic consistency check
+	// is due. The remaining fields still describe the delta to Prev, so
+	// consumers can compare their incrementally updated state with the full
+	// recompute.
+	Check bool
+
+	// Shift is the number of commits at the start of Prev that are not part
+	// of Tile anymore and NewCommits the number of commits at the end of Tile
+	// that were not part of Prev. The commits in between are the same in both
+	// tiles, i.e. commit i of Tile is commit i+Shift of Prev.
+	Shift      int
+	NewCommits int
+
+	// ChangedTraces contains the ids of the traces that were added, removed
+	// or whose digests changed in the commits both tiles have in common.
+	// Every other trace only differs by the digests in the commits that
+	// were dropped or added.
+	ChangedTraces map[string]bool
+
+	// ChangedTests contains the names of the tests that have a trace in
+	// ChangedTraces or a digest in the commits that were dropped or added.
+	ChangedTests map[string]bool
+}
+
+// Incremental returns true if the delta can be applied to the state derived
+// from Prev, which is the case if the commits of the tiles line up.
+func (d *TileDelta) Incremental() bool {
+	return d.Prev != nil && d.ChangedTraces != nil
+}
+
+// CalcTileDelta returns the delta from prev to tile. If prev is nil or the
+// commits of the tiles do not line up the returned delta is a full delta.
+func CalcTileDelta(prev, tile *ptypes.Tile) *TileDelta {
+	ret := &TileDelta{
+		Tile: tile,
+		Prev: prev,
+		Full: true,
+	}
+	if prev == nil {
+		return ret
+	}
+
+	// Find the first commit of tile in prev and make sure the commits that
+	// follow it are the same.
+	prevLen := prev.LastCommitIndex() + 1
+	tileLen := tile.LastCommitIndex() + 1
+	if prevLen == 0 || tileLen == 0 {
+		return ret
+	}
+	shift := 0
+	for shift < prevLen && prev.Commits[shift].Hash != tile.Commits[0].Hash {
+		shift++
+	}
+	common := prevLen - shift
+	if common == 0 || common > tileLen {
+		return ret
+	}
+	for i := 0; i < common; i++ {
+		if tile.Commits[i].Hash != prev.Commits[shift+i].Hash {
+			return ret
+		}
+	}
+
+	defer timer.New("tileDelta").Stop()
+	ret.Full = false
+	ret.Shift = shift
+	ret.NewCommits = tileLen - common
+	ret.ChangedTraces = map[string]bool{}
+	ret.ChangedTests = map[string]bool{}
+	for id, trace := range tile.Traces {
+		values := trace.(*ptypes.GoldenTrace).Values
+		testName := trace.Params()[types.PRIMARY_KEY_FIELD]
+		prevTrace, ok := prev.Traces[id]
+		if !ok {
+			ret.ChangedTraces[id] = true
+			ret.ChangedTests[testName] = true
+			continue
+		}
+
+		prevValues := prevTrace.(*ptypes.GoldenTrace).Values
+		for i, v := range values[:common] {
+			if v != prevValues[shift+i] {
+				ret.ChangedTraces[id] = true
+				ret.ChangedTests[testName] = true
+				break
+			}
+		}
+		if !ret.ChangedTests[testName] && (hasDigests(prevValues[:shift]) || hasDigests(values[common:tileLen])) {
+			ret.ChangedTests[testName] = true
+		}
+	}
+	for id, trace := range prev.Traces {
+		if _, ok := tile.Traces[id]; !ok {
+			ret.ChangedTraces[id] = true
+			ret.ChangedTests[trace.Params()[types.PRIMARY_KEY_FIELD]] = true
+		}
+	}
+	return ret
+}
+
+// hasDigests returns true if values contains a digest that is not missing.
+func hasDigests(values []string) bool {
+	for _, v := range values {
+		if v != ptypes.MISSING_DIGEST {
+			return true
+		}
+	}
+	return false
+}
+
+// DeltaTracker turns a sequence of tiles into a sequence of TileDeltas. It
+// requests a full recompute at least once every fullInterval as a
+// consistency check.
+type DeltaTracker struct {
+	fullInterval time.Duration
+	lastTile     *ptypes.Tile
+	lastFull     time.Time
+}
+
+// NewDeltaTracker returns a new DeltaTracker. If fullInterval is 0 or smaller
+// every delta is a full delta.
+func NewDeltaTracker(fullInterval time.Duration) *DeltaTracker {
+	return &DeltaTracker{
+		fullInterval: fullInterval,
+	}
+}
+
+// Next returns the delta from the tile passed in the previous call to tile.
+func (d *DeltaTracker) Next(tile *ptypes.Tile) *TileDelta {
+	ret := CalcTileDelta(d.lastTile, tile)
+	if !ret.Full && time.Now().Sub(d.lastFull) >= d.fullInterval {
+		ret.Full = true
+		ret.Check = true
+	}
+	if ret.Full {
+		d.lastFull = time.Now()
+	}
+	d.lastTile = tile
+	return ret
+}
+
+// Reset makes the next delta a full delta. It is used when the previous
+// delta could not be processed completely.
+func (d *DeltaTracker) Reset() {
+	d.lastTile = nil
+}
+
+// GetTileDeltaStreamNow works like GetTileStreamNow, but sends the delta of
+// each tile to the previous one, see DeltaTracker.
+func GetTileDeltaStreamNow(tileStore ptypes.TileStore, interval, fullInterval time.Duration) <-chan *TileDelta {
+	retCh := make(chan *TileDelta)
+	go func() {
+		tracker := NewDeltaTracker(fullInterval)
+		for tile := range GetTileStreamNow(tileStore, interval) {
+			retCh <- tracker.Next(tile)
+		}
+	}()
+	return retCh
+}
@@ -7,8 +7,10 @@ import (
 	"github.com/skia-dev/glog"
 	"go.skia.org/infra/go/util"
 	"go.skia.org/infra/golden/go/diff"
+	"go.skia.org/infra/golden/go/digestmeta"
 	"go.skia.org/infra/golden/go/digeststore"
 	"go.skia.org/infra/golden/go/expstorage"
+	"go.skia.org/infra/golden/go/statushistory"
 	"go.skia.org/infra/golden/go/types"
 	ptypes "go.skia.org/infra/perf/go/types"
 )
@@ -19,13 +21,34 @@ type Storage struct {
 	DiffStore         diff.DiffStore
 	ExpectationsStore expstorage.ExpectationsStore
 	IgnoreStore       types.IgnoreStore
+	ToleranceStore    types.ToleranceStore
 	TileStore         ptypes.TileStore
 	DigestStore       digeststore.DigestStore
+	MetadataStore     digestmeta.MetadataStore
+
+	// IssueExpectationsStore holds the expectations that are scoped to code
+	// review issues.
+	IssueExpectationsStore expstorage.IssueExpectationsStore
+
+	// StatusHistory records the triage status of each corpus whenever it is
+	// recalculated. It is optional.
+	StatusHistory statushistory.StatusHistory
 
 	// NCommits is the number of commits we should consider. If NCommits is
 	// 0 or smaller all commits in the last tile will be considered.
 	NCommits int
 
+	// FlakyThreshold is the flakiness score above which the untriaged
+	// digests of a trace are not counted by summaries and the status, see
+	// flaky.Score. If FlakyThreshold is 0 or smaller all traces are counted.
+	FlakyThreshold float64
+
+	// FullRecomputeInterval is the interval in which the consumers of tiles
+	// recompute their state from the whole tile instead of applying the
+	// TileDelta to the previous tile. If it is 0 or smaller every tile is
+	// processed in full.
+	FullRecomputeInterval time.Duration
+
 	// Internal variables used to cache trimmed tiles.
 	lastTrimmedTile *ptypes.Tile
 	lastBaseTile    *ptypes.Tile
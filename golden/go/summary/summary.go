@@ -12,6 +12,7 @@ import (
 	"go.skia.org/infra/go/util"
 	"go.skia.org/infra/golden/go/diff"
 	"go.skia.org/infra/golden/go/expstorage"
+	"go.skia.org/infra/golden/go/flaky"
 	"go.skia.org/infra/golden/go/storage"
 	"go.skia.org/infra/golden/go/tally"
 	gtypes "go.skia.org/infra/golden/go/types"
@@ -26,6 +27,7 @@ type Summary struct {
 	Neg       int      `json:"neg"`
 	Untriaged int      `json:"untriaged"`
 	UntHashes []string `json:"untHashes"`
+	NegHashes []string `json:"negHashes"`
 	Num       int      `json:"num"`
 	Corpus    string   `json:"corpus"`
 }
@@ -55,15 +57,33 @@ func New(storages *storage.Storage, tallies *tally.Tallies) (*Summaries, error)
 
 	// TODO(jcgregorio) Move to a channel for tallies and then combine
 	// this and the expStore handling into a single switch statement.
-	tallies.OnChange(func() {
-		summaries, err := s.CalcSummaries(nil, "", false, true)
+	tallies.OnChange(func(testNames []string) {
+		summaries, err := s.CalcSummaries(testNames, "", false, true)
 		if err != nil {
 			glog.Errorf("Failed to refresh summaries: %s", err)
 			return
 		}
 		s.mutex.Lock()
-		s.summaries = summaries
-		s.mutex.Unlock()
+		defer s.mutex.Unlock()
+		if testNames == nil {
+			s.summaries = summaries
+			return
+		}
+
+		// Only the summaries of the changed tests were recalculated. Tests
+		// without digests are gone from the tile.
+		updated := make(map[string]*Summary, len(s.summaries))
+		for k, v := range s.summaries {
+			updated[k] = v
+		}
+		for _, testName := range testNames {
+			if summary, ok := summaries[testName]; ok {
+				updated[testName] = summary
+			} else {
+				delete(updated, testName)
+			}
+		}
+		s.summaries = updated
 	})
 
 	ch := storages.ExpectationsStore.Changes()
@@ -119,6 +139,46 @@ func (s *Summaries) CalcSummaries(testNames []string, query string, includeIgnor
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't retrieve tile: %s", err)
 	}
+	e, err := s.storages.ExpectationsStore.Get()
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get expectations: %s", err)
+	}
+	return s.calcSummaries(tile, e, testNames, query, includeIgnores, head, -1)
+}
+
+// CalcCommitSummaries returns a Summary for each test with only the digests
+// that were produced at the commit with the given hash, classified by the
+// given expectations. An empty hash selects the last commit in the tile.
+// query and includeIgnores are the same as for CalcSummaries.
+func (s *Summaries) CalcCommitSummaries(hash string, query string, includeIgnores bool, e *expstorage.Expectations) (map[string]*Summary, error) {
+	defer timer.New("CalcCommitSummaries").Stop()
+
+	tile, err := s.storages.GetLastTileTrimmed()
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't retrieve tile: %s", err)
+	}
+	lastCommitIndex := tile.LastCommitIndex()
+	commitIndex := -1
+	if hash == "" {
+		commitIndex = lastCommitIndex
+	} else {
+		for i := 0; i <= lastCommitIndex; i++ {
+			if tile.Commits[i].Hash == hash {
+				commitIndex = i
+				break
+			}
+		}
+	}
+	if commitIndex < 0 {
+		return nil, fmt.Errorf("Commit %s is not in the last tile.", hash)
+	}
+	return s.calcSummaries(tile, e, nil, query, includeIgnores, false, commitIndex)
+}
+
+// calcSummaries implements CalcSummaries and CalcCommitSummaries. If
+// commitIndex is not negative only the digests at that commit are
+// considered and head is ignored.
+func (s *Summaries) calcSummaries(tile *types.Tile, e *expstorage.Expectations, testNames []string, query string, includeIgnores bool, head bool, commitIndex int) (map[string]*Summary, error) {
 	q, err := url.ParseQuery(query)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to parse Query in CalcSummaries: %s", err)
@@ -141,17 +201,16 @@ func (s *Summaries) CalcSummaries(testNames []string, query string, includeIgnor
 
 	ret := map[string]*Summary{}
 
-	e, err := s.storages.ExpectationsStore.Get()
-	if err != nil {
-		return nil, fmt.Errorf("Couldn't get expectations: %s", err)
-	}
-
 	// Filter down to just the traces we are interested in, based on query and ignores.
 	filtered := map[string][]*TraceID{}
+	wanted := make(map[string]bool, len(testNames))
+	for _, name := range testNames {
+		wanted[name] = true
+	}
 	t = timer.New("Filter Traces")
 	for id, tr := range tile.Traces {
 		name := tr.Params()[gtypes.PRIMARY_KEY_FIELD]
-		if len(testNames) > 0 && !util.In(name, testNames) {
+		if len(testNames) > 0 && !wanted[name] {
 			continue
 		}
 		if types.MatchesWithIgnores(tr, q, ignores...) {
@@ -164,6 +223,12 @@ func (s *Summaries) CalcSummaries(testNames []string, query string, includeIgnor
 	}
 	t.Stop()
 
+	// Untriaged digests that only appear in flaky traces are not counted.
+	flakyTraces := map[string]*flaky.FlakyTrace{}
+	if s.storages.FlakyThreshold > 0 {
+		flakyTraces = flaky.FindFlaky(tile, s.storages.FlakyThreshold)
+	}
+
 	traceTally := s.tallies.ByTrace()
 
 	// Now create summaries for each test using the filtered set of traces.
@@ -171,16 +236,25 @@ func (s *Summaries) CalcSummaries(testNames []string, query string, includeIgnor
 	lastCommitIndex := tile.LastCommitIndex()
 	for name, traces := range filtered {
 		digests := map[string]bool{}
+		flakyDigests := map[string]bool{}
 		corpus := ""
 		for _, trid := range traces {
 			corpus = trid.tr.Params()["source_type"]
-			if head {
+			target := digests
+			if _, ok := flakyTraces[trid.id]; ok {
+				target = flakyDigests
+			}
+			if commitIndex >= 0 {
+				if !trid.tr.IsMissing(commitIndex) {
+					target[trid.tr.(*types.GoldenTrace).Values[commitIndex]] = true
+				}
+			} else if head {
 				// Find the last non-missing value in the trace.
 				for i := lastCommitIndex; i >= 0; i-- {
 					if trid.tr.IsMissing(i) {
 						continue
 					} else {
-						digests[trid.tr.(*types.GoldenTrace).Values[i]] = true
+						target[trid.tr.(*types.GoldenTrace).Values[i]] = true
 						break
 					}
 				}
@@ -188,17 +262,22 @@ func (s *Summaries) CalcSummaries(testNames []string, query string, includeIgnor
 				// Use the traceTally if available, otherwise just inspect the trace.
 				if t, ok := traceTally[trid.id]; ok {
 					for k, _ := range *t {
-						digests[k] = true
+						target[k] = true
 					}
 				} else {
 					for i := lastCommitIndex; i >= 0; i-- {
 						if !trid.tr.IsMissing(i) {
-							digests[trid.tr.(*types.GoldenTrace).Values[i]] = true
+							target[trid.tr.(*types.GoldenTrace).Values[i]] = true
 						}
 					}
 				}
 			}
 		}
+		for digest := range flakyDigests {
+			if e.Classification(name, digest) != gtypes.UNTRIAGED {
+				digests[digest] = true
+			}
+		}
 		ret[name] = makeSummary(name, e, s.storages.DiffStore, corpus, util.KeysOfStringSet(digests))
 	}
 	t.Stop()
@@ -213,6 +292,7 @@ func makeSummary(name string, e *expstorage.Expectations, diffStore diff.DiffSto
 	unt := 0
 	diamDigests := []string{}
 	untHashes := []string{}
+	negHashes := []string{}
 	if expectations, ok := e.Tests[name]; ok {
 		for _, digest := range digests {
 			if dtype, ok := expectations[digest]; ok {
@@ -223,6 +303,7 @@ func makeSummary(name string, e *expstorage.Expectations, diffStore diff.DiffSto
 					untHashes = append(untHashes, digest)
 				case gtypes.NEGATIVE:
 					neg += 1
+					negHashes = append(negHashes, digest)
 				case gtypes.POSITIVE:
 					pos += 1
 					diamDigests = append(diamDigests, digest)
@@ -240,6 +321,7 @@ func makeSummary(name string, e *expstorage.Expectations, diffStore diff.DiffSto
 	}
 	sort.Strings(diamDigests)
 	sort.Strings(untHashes)
+	sort.Strings(negHashes)
 	return &Summary{
 		Name: name,
 		// TODO(jcgregorio) Make diameter faster, and also make the actual diameter
@@ -250,6 +332,7 @@ func makeSummary(name string, e *expstorage.Expectations, diffStore diff.DiffSto
 		Neg:       neg,
 		Untriaged: unt,
 		UntHashes: untHashes,
+		NegHashes: negHashes,
 		Num:       pos + neg + unt,
 		Corpus:    corpus,
 	}
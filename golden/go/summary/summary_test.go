@@ -1,6 +1,7 @@
 package summary
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
@@ -32,6 +33,9 @@ func (m MockDiffStore) AbsPath(digest []string) map[string]string      { return
 func (m MockDiffStore) ThumbAbsPath(digest []string) map[string]string { return map[string]string{} }
 func (m MockDiffStore) UnavailableDigests() map[string]bool            { return map[string]bool{} }
 func (m MockDiffStore) CalculateDiffs([]string)                        {}
+func (m MockDiffStore) RenderPath(left, right, mode string) (string, error) {
+	return "", nil
+}
 
 /**
   Conditions to test.
@@ -170,7 +174,7 @@ func TestCalcSummaries(t *testing.T) {
 		"bar": map[string]gtypes.Label{
 			"fff": gtypes.NEGATIVE,
 		},
-	}, "foo@example.com"))
+	}, "foo@example.com", nil))
 
 	ta, _ := tally.New(storages)
 	assert.Nil(t, storages.IgnoreStore.Create(&gtypes.IgnoreRule{
@@ -251,6 +255,126 @@ func TestCalcSummaries(t *testing.T) {
 	assert.Equal(t, 0, len(sum))
 }
 
+func TestCalcSummariesFlaky(t *testing.T) {
+	commits := []*types.Commit{}
+	for i := 0; i < 6; i++ {
+		commits = append(commits, &types.Commit{CommitTime: int64(42 + i), Hash: fmt.Sprintf("hash%d", i), Author: "test@test.cz"})
+	}
+	tile := &types.Tile{
+		Traces: map[string]types.Trace{
+			// A flaky trace that alternates between aaa and bbb.
+			"a": &types.GoldenTrace{
+				Values: []string{"aaa", "bbb", "aaa", "bbb", "aaa", "bbb"},
+				Params_: map[string]string{
+					"name":        "foo",
+					"config":      "8888",
+					"source_type": "gm"},
+			},
+			"b": &types.GoldenTrace{
+				Values: []string{"ccc", "ccc", "ccc", "ccc", "ccc", "ddd"},
+				Params_: map[string]string{
+					"name":        "foo",
+					"config":      "565",
+					"source_type": "gm"},
+			},
+		},
+		Commits: commits,
+	}
+
+	storages := &storage.Storage{
+		DiffStore:         MockDiffStore{},
+		ExpectationsStore: expstorage.NewMemExpectationsStore(),
+		IgnoreStore:       gtypes.NewMemIgnoreStore(),
+		TileStore:         MockTileStore{Tile: tile},
+	}
+	assert.Nil(t, storages.ExpectationsStore.AddChange(map[string]gtypes.TestClassification{
+		"foo": map[string]gtypes.Label{
+			"aaa": gtypes.POSITIVE,
+			"ccc": gtypes.POSITIVE,
+		},
+	}, "foo@example.com", nil))
+
+	ta, _ := tally.New(storages)
+	summaries, err := New(storages, ta)
+	assert.Nil(t, err)
+
+	sum, err := summaries.CalcSummaries(nil, "", false, false)
+	assert.Nil(t, err)
+	triageCountsCorrect(t, sum, "foo", 2, 0, 2)
+
+	// The untriaged digest of the flaky trace is not counted, its positive
+	// digest is.
+	storages.FlakyThreshold = 0.3
+	sum, err = summaries.CalcSummaries(nil, "", false, false)
+	assert.Nil(t, err)
+	triageCountsCorrect(t, sum, "foo", 2, 0, 1)
+	assert.Equal(t, []string{"ddd"}, sum["foo"].UntHashes)
+}
+
+func TestCalcCommitSummaries(t *testing.T) {
+	tile := &types.Tile{
+		Traces: map[string]types.Trace{
+			"a": &types.GoldenTrace{
+				Values: []string{"aaa", "bbb", types.MISSING_DIGEST},
+				Params_: map[string]string{
+					"name":        "foo",
+					"config":      "8888",
+					"source_type": "gm"},
+			},
+			"b": &types.GoldenTrace{
+				Values: []string{"ccc", "ddd", "eee"},
+				Params_: map[string]string{
+					"name":        "foo",
+					"config":      "565",
+					"source_type": "gm"},
+			},
+		},
+		Commits: []*types.Commit{
+			&types.Commit{CommitTime: 42, Hash: "hash0", Author: "test@test.cz"},
+			&types.Commit{CommitTime: 43, Hash: "hash1", Author: "test@test.cz"},
+			&types.Commit{CommitTime: 44, Hash: "hash2", Author: "test@test.cz"},
+		},
+	}
+
+	storages := &storage.Storage{
+		DiffStore:         MockDiffStore{},
+		ExpectationsStore: expstorage.NewMemExpectationsStore(),
+		IgnoreStore:       gtypes.NewMemIgnoreStore(),
+		TileStore:         MockTileStore{Tile: tile},
+	}
+	ta, _ := tally.New(storages)
+	summaries, err := New(storages, ta)
+	assert.Nil(t, err)
+
+	e := expstorage.NewExpectations()
+	e.AddDigests(map[string]gtypes.TestClassification{
+		"foo": map[string]gtypes.Label{
+			"aaa": gtypes.POSITIVE,
+			"bbb": gtypes.NEGATIVE,
+			"ccc": gtypes.POSITIVE,
+		},
+	})
+
+	sum, err := summaries.CalcCommitSummaries("hash1", "", false, e)
+	assert.Nil(t, err)
+	triageCountsCorrect(t, sum, "foo", 0, 1, 1)
+	assert.Equal(t, []string{"bbb"}, sum["foo"].NegHashes)
+	assert.Equal(t, []string{"ddd"}, sum["foo"].UntHashes)
+
+	// The last commit is used if no hash is given, missing digests are skipped.
+	sum, err = summaries.CalcCommitSummaries("", "", false, e)
+	assert.Nil(t, err)
+	triageCountsCorrect(t, sum, "foo", 0, 0, 1)
+	assert.Equal(t, []string{"eee"}, sum["foo"].UntHashes)
+
+	sum, err = summaries.CalcCommitSummaries("hash0", "config=8888", false, e)
+	assert.Nil(t, err)
+	triageCountsCorrect(t, sum, "foo", 1, 0, 0)
+
+	_, err = summaries.CalcCommitSummaries("unknown", "", false, e)
+	assert.Error(t, err)
+}
+
 func triageCountsCorrect(t *testing.T, sum map[string]*Summary, name string, pos, neg, unt int) {
 	s := sum[name]
 	if got, want := s.Pos, pos; got != want {
@@ -4,6 +4,7 @@ package tally
 import (
 	"fmt"
 	"net/url"
+	"reflect"
 	"sync"
 	"time"
 
@@ -14,7 +15,10 @@ import (
 	"go.skia.org/infra/perf/go/types"
 )
 
-type OnChangeCallback func()
+// OnChangeCallback is called after the tallies changed with the names of the
+// tests whose tallies changed. testNames is nil if the tallies were
+// recomputed from the whole tile.
+type OnChangeCallback func(testNames []string)
 
 // Tally maps a digest to a count.
 type Tally map[string]int
@@ -48,6 +52,8 @@ func New(storages *storage.Storage) (*Tallies, error) {
 		storages:   storages,
 		callbacks:  []OnChangeCallback{},
 	}
+	tracker := storage.NewDeltaTracker(storages.FullRecomputeInterval)
+	tracker.Next(tile)
 	go func() {
 		for _ = range time.Tick(2 * time.Minute) {
 			tile, err := storages.GetLastTileTrimmed()
@@ -55,20 +61,49 @@ func New(storages *storage.Storage) (*Tallies, error) {
 				glog.Errorf("Couldn't retrieve tile: %s", err)
 				continue
 			}
-
-			trace, test := tallyTile(tile)
-			t.mutex.Lock()
-			t.traceTally = trace
-			t.testTally = test
-			t.mutex.Unlock()
-			for _, cb := range t.callbacks {
-				go cb()
-			}
+			t.update(tracker.Next(tile))
 		}
 	}()
 	return t, nil
 }
 
+// update applies the given delta to the tallies and notifies the callbacks.
+func (t *Tallies) update(delta *storage.TileDelta) {
+	if !delta.Full && len(delta.ChangedTests) == 0 {
+		return
+	}
+
+	t.mutex.Lock()
+	trace, test := t.traceTally, t.testTally
+	t.mutex.Unlock()
+
+	var testNames []string
+	if delta.Full {
+		fullTrace, fullTest := tallyTile(delta.Tile)
+		if delta.Check {
+			trace, test = updateTallies(trace, test, delta)
+			if !reflect.DeepEqual(trace, fullTrace) || !reflect.DeepEqual(test, fullTest) {
+				glog.Errorf("Incrementally updated tallies differ from the full recompute.")
+			}
+		}
+		trace, test = fullTrace, fullTest
+	} else {
+		trace, test = updateTallies(trace, test, delta)
+		testNames = make([]string, 0, len(delta.ChangedTests))
+		for testName := range delta.ChangedTests {
+			testNames = append(testNames, testName)
+		}
+	}
+
+	t.mutex.Lock()
+	t.traceTally = trace
+	t.testTally = test
+	t.mutex.Unlock()
+	for _, cb := range t.callbacks {
+		go cb(testNames)
+	}
+}
+
 func (t *Tallies) OnChange(f OnChangeCallback) {
 	t.callbacks = append(t.callbacks, f)
 }
@@ -115,6 +150,30 @@ func tallyBy(tile *types.Tile, traceTally TraceTally, query url.Values, ignores
 	return ret
 }
 
+// tallyValues counts the digests in values.
+func tallyValues(values []string) Tally {
+	tally := Tally{}
+	for _, s := range values {
+		if s == types.MISSING_DIGEST {
+			continue
+		}
+		if n, ok := tally[s]; ok {
+			tally[s] = n + 1
+		} else {
+			tally[s] = 1
+		}
+	}
+	return tally
+}
+
+// add adds n to the count of digest and removes the digest if its count
+// drops to zero.
+func (t Tally) add(digest string, n int) {
+	if t[digest] += n; t[digest] == 0 {
+		delete(t, digest)
+	}
+}
+
 // tallyTile computes a TraceTally and TestTally from the given Tile.
 func tallyTile(tile *types.Tile) (TraceTally, TestTally) {
 	defer timer.New("tally").Stop()
@@ -122,17 +181,7 @@ func tallyTile(tile *types.Tile) (TraceTally, TestTally) {
 	testTally := TestTally{}
 	for k, tr := range tile.Traces {
 		gtr := tr.(*types.GoldenTrace)
-		tally := Tally{}
-		for _, s := range gtr.Values {
-			if s == types.MISSING_DIGEST {
-				continue
-			}
-			if n, ok := tally[s]; ok {
-				tally[s] = n + 1
-			} else {
-				tally[s] = 1
-			}
-		}
+		tally := tallyValues(gtr.Values)
 		traceTally[k] = &tally
 		testName := tr.Params()[gtypes.PRIMARY_KEY_FIELD]
 		if t, ok := testTally[testName]; ok {
@@ -153,3 +202,95 @@ func tallyTile(tile *types.Tile) (TraceTally, TestTally) {
 	}
 	return traceTally, testTally
 }
+
+// updateTallies returns the tallies of delta.Tile given the tallies of
+// delta.Prev. Only the tallies of changed traces and tests are copied and
+// updated, the given tallies are not modified.
+func updateTallies(traceTally TraceTally, testTally TestTally, delta *storage.TileDelta) (TraceTally, TestTally) {
+	defer timer.New("tally update").Stop()
+	retTrace := make(TraceTally, len(traceTally))
+	for id, tally := range traceTally {
+		retTrace[id] = tally
+	}
+	retTest := make(TestTally, len(testTally))
+	for testName, tally := range testTally {
+		retTest[testName] = tally
+	}
+
+	// The tallies of tests are copied before they are changed the first time.
+	copied := map[string]bool{}
+	testTallyFor := func(testName string) Tally {
+		if !copied[testName] {
+			cp := Tally{}
+			if tally, ok := retTest[testName]; ok {
+				for digest, n := range *tally {
+					cp[digest] = n
+				}
+			}
+			retTest[testName] = &cp
+			copied[testName] = true
+		}
+		return *retTest[testName]
+	}
+
+	// Unchanged traces only differ by the digests of the dropped and the
+	// new commits.
+	common := delta.Prev.LastCommitIndex() + 1 - delta.Shift
+	tileLen := delta.Tile.LastCommitIndex() + 1
+	testNames := map[string]bool{}
+	for id, tr := range delta.Tile.Traces {
+		testName := tr.Params()[gtypes.PRIMARY_KEY_FIELD]
+		testNames[testName] = true
+		if delta.ChangedTraces[id] || !delta.ChangedTests[testName] {
+			continue
+		}
+		dropped := delta.Prev.Traces[id].(*types.GoldenTrace).Values[:delta.Shift]
+		added := tr.(*types.GoldenTrace).Values[common:tileLen]
+		droppedTally, addedTally := tallyValues(dropped), tallyValues(added)
+		if len(droppedTally) == 0 && len(addedTally) == 0 {
+			continue
+		}
+
+		tally := Tally{}
+		for digest, n := range *traceTally[id] {
+			tally[digest] = n
+		}
+		test := testTallyFor(testName)
+		for digest, n := range droppedTally {
+			tally.add(digest, -n)
+			test.add(digest, -n)
+		}
+		for digest, n := range addedTally {
+			tally.add(digest, n)
+			test.add(digest, n)
+		}
+		retTrace[id] = &tally
+	}
+
+	// Changed traces are tallied from scratch.
+	for id := range delta.ChangedTraces {
+		if old, ok := traceTally[id]; ok {
+			test := testTallyFor(delta.Prev.Traces[id].Params()[gtypes.PRIMARY_KEY_FIELD])
+			for digest, n := range *old {
+				test.add(digest, -n)
+			}
+			delete(retTrace, id)
+		}
+		if tr, ok := delta.Tile.Traces[id]; ok {
+			tally := tallyValues(tr.(*types.GoldenTrace).Values)
+			test := testTallyFor(tr.Params()[gtypes.PRIMARY_KEY_FIELD])
+			for digest, n := range tally {
+				test.add(digest, n)
+			}
+			retTrace[id] = &tally
+		}
+	}
+
+	// Remove the tests that have no traces left.
+	for testName := range delta.ChangedTests {
+		if !testNames[testName] {
+			delete(retTest, testName)
+		}
+	}
+	return retTrace, retTest
+}
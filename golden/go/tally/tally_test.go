@@ -2,8 +2,10 @@ package tally
 
 import (
 	"net/url"
+	"reflect"
 	"testing"
 
+	"go.skia.org/infra/golden/go/storage"
 	gtypes "go.skia.org/infra/golden/go/types"
 	"go.skia.org/infra/perf/go/types"
 )
@@ -60,3 +62,92 @@ func TestTallyBasic(t *testing.T) {
 		t.Errorf("Miscount: Got %v Want %v", got, want)
 	}
 }
+
+// deltaTile returns a tile with the given commits and a trace for each entry
+// of traces, which maps trace ids to test names and digests.
+func deltaTile(commits []string, traces map[string][]string) *types.Tile {
+	tile := types.NewTile()
+	for i, hash := range commits {
+		tile.Commits[i] = &types.Commit{
+			Hash:       hash,
+			CommitTime: int64(i + 1),
+		}
+	}
+	for id, values := range traces {
+		tr := types.NewGoldenTrace()
+		tr.Params_[gtypes.PRIMARY_KEY_FIELD] = values[0]
+		copy(tr.Values, values[1:])
+		tile.Traces[id] = tr
+	}
+	return tile
+}
+
+func TestUpdateTallies(t *testing.T) {
+	prev := deltaTile([]string{"c1", "c2", "c3"}, map[string][]string{
+		"foo:x86":    {"foo", "aaa", "aaa", "bbb"},
+		"foo:arm":    {"foo", "ccc", types.MISSING_DIGEST, types.MISSING_DIGEST},
+		"bar:x86":    {"bar", "ddd", "ddd", "ddd"},
+		"baz:x86":    {"baz", "eee", "eee", "eee"},
+		"qux:x86":    {"qux", "fff", types.MISSING_DIGEST, types.MISSING_DIGEST},
+		"stable:x86": {"stable", types.MISSING_DIGEST, "ggg", "ggg"},
+	})
+	// c1 is dropped, c4 is added, bar:x86 changed in a common commit, qux:x86
+	// is removed and new:x86 is added.
+	tile := deltaTile([]string{"c2", "c3", "c4"}, map[string][]string{
+		"foo:x86":    {"foo", "aaa", "bbb", "bbb"},
+		"foo:arm":    {"foo", types.MISSING_DIGEST, types.MISSING_DIGEST, types.MISSING_DIGEST},
+		"bar:x86":    {"bar", "hhh", "ddd", "ddd"},
+		"baz:x86":    {"baz", "eee", "eee", "eee"},
+		"new:x86":    {"new", "iii", "iii", types.MISSING_DIGEST},
+		"stable:x86": {"stable", "ggg", "ggg", types.MISSING_DIGEST},
+	})
+
+	delta := storage.CalcTileDelta(prev, tile)
+	if delta.Full {
+		t.Fatalf("Expected an incremental delta.")
+	}
+	if got, want := delta.Shift, 1; got != want {
+		t.Errorf("Wrong shift: Got %v Want %v", got, want)
+	}
+	if got, want := delta.NewCommits, 1; got != want {
+		t.Errorf("Wrong number of new commits: Got %v Want %v", got, want)
+	}
+	if got, want := delta.ChangedTraces, map[string]bool{"bar:x86": true, "qux:x86": true, "new:x86": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong changed traces: Got %v Want %v", got, want)
+	}
+	if got, want := delta.ChangedTests, map[string]bool{"foo": true, "bar": true, "baz": true, "qux": true, "new": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong changed tests: Got %v Want %v", got, want)
+	}
+
+	prevTrace, prevTest := tallyTile(prev)
+	prevTraceCopy, prevTestCopy := copyTallies(prevTrace), copyTallies(prevTest)
+	trace, test := updateTallies(prevTrace, prevTest, delta)
+	wantTrace, wantTest := tallyTile(tile)
+	if !reflect.DeepEqual(trace, wantTrace) {
+		t.Errorf("Wrong trace tallies: Got %v Want %v", trace, wantTrace)
+	}
+	if !reflect.DeepEqual(test, wantTest) {
+		t.Errorf("Wrong test tallies: Got %v Want %v", test, wantTest)
+	}
+
+	// The tallies of the previous tile must not be modified.
+	if got, want := copyTallies(prevTrace), prevTraceCopy; !reflect.DeepEqual(got, want) {
+		t.Errorf("Previous trace tallies modified: Got %v Want %v", got, want)
+	}
+	if got, want := copyTallies(prevTest), prevTestCopy; !reflect.DeepEqual(got, want) {
+		t.Errorf("Previous test tallies modified: Got %v Want %v", got, want)
+	}
+}
+
+// copyTallies returns a deep copy of the given TraceTally or TestTally.
+func copyTallies(tallies map[string]*Tally) map[string]Tally {
+	ret := map[string]Tally{}
+	for k, tally := range tallies {
+		cp := Tally{}
+		for digest, n := range *tally {
+			cp[digest] = n
+		}
+		ret[k] = cp
+	}
+	return ret
+}
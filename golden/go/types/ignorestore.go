@@ -5,6 +5,8 @@ import (
 	"net/url"
 	"sync"
 	"time"
+
+	"go.skia.org/infra/go/util"
 )
 
 // RuleMatcher returns a list of rules in the IgnoreStore that match the given
@@ -34,6 +36,11 @@ type IgnoreStore interface {
 	// BuildRuleMatcher returns a RuleMatcher based on the current content
 	// of the ignore store.
 	BuildRuleMatcher() (RuleMatcher, error)
+
+	// History returns the events of the ignore rule with the given id, most
+	// recent first. If id is smaller than zero the events of all rules are
+	// returned.
+	History(id int) ([]*IgnoreEvent, error)
 }
 
 // IgnoreRule is the GUI struct for dealing with Ignore rules.
@@ -43,7 +50,44 @@ type IgnoreRule struct {
 	Expires time.Time `json:"expires"`
 	Query   string    `json:"query"`
 	Note    string    `json:"note"`
-	Count   int       `json:"count"`
+
+	// Count is the number of traces in the last tile the rule matches and
+	// UntriagedCount is the number of untriaged digests that are only found
+	// in ignored traces, i.e. that the rule hides. See ignore.AddCounts.
+	Count          int `json:"count"`
+	UntriagedCount int `json:"untriagedCount"`
+}
+
+// Actions recorded in the history of ignore rules.
+const (
+	IGNORE_CREATE = "create"
+	IGNORE_UPDATE = "update"
+	IGNORE_DELETE = "delete"
+	IGNORE_EXPIRE = "expire"
+)
+
+// IgnoreEvent records a change to an ignore rule. Query, Note and Expires
+// are the values of the rule after the change, or before the deletion.
+type IgnoreEvent struct {
+	RuleID  int       `json:"ruleId"`
+	Action  string    `json:"action"`
+	UserID  string    `json:"userId"`
+	TS      int64     `json:"ts"`
+	Expires time.Time `json:"expires"`
+	Query   string    `json:"query"`
+	Note    string    `json:"note"`
+}
+
+func newIgnoreEvent(rule *IgnoreRule, action, userId string) *IgnoreEvent {
+	return &IgnoreEvent{
+		RuleID:  rule.ID,
+		Action:  action,
+		UserID:  userId,
+		TS:      util.TimeStampMs(),
+		Expires: rule.Expires,
+		Query:   rule.Query,
+		Note:    rule.Note,
+	}
 }
 
 // ToQuery makes a slice of url.Values from the given slice of IngoreRules.
@@ -71,6 +115,7 @@ func NewIgnoreRule(name string, expires time.Time, queryStr string, note string)
 // MemIgnoreStore is an in-memory implementation of IgnoreStore.
 type MemIgnoreStore struct {
 	rules    []*IgnoreRule
+	history  []*IgnoreEvent
 	mutex    sync.Mutex
 	nextId   int
 	revision int64
@@ -94,6 +139,7 @@ func (m *MemIgnoreStore) Create(rule *IgnoreRule) error {
 	rule.ID = m.nextId
 	m.nextId++
 	m.rules = append(m.rules, rule)
+	m.history = append(m.history, newIgnoreEvent(rule, IGNORE_CREATE, rule.Name))
 	m.inc()
 	return nil
 }
@@ -114,9 +160,10 @@ func (m *MemIgnoreStore) Update(id int, updated *IgnoreRule) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	for i, _ := range m.rules {
-		if updated.ID == id {
+	for i, rule := range m.rules {
+		if rule.ID == id {
 			m.rules[i] = updated
+			m.history = append(m.history, newIgnoreEvent(updated, IGNORE_UPDATE, updated.Name))
 			m.inc()
 			return nil
 		}
@@ -133,6 +180,7 @@ func (m *MemIgnoreStore) Delete(id int, userId string) (int, error) {
 	for idx, rule := range m.rules {
 		if rule.ID == id {
 			m.rules = append(m.rules[:idx], m.rules[idx+1:]...)
+			m.history = append(m.history, newIgnoreEvent(rule, IGNORE_DELETE, userId))
 			m.inc()
 			return 1, nil
 		}
@@ -148,12 +196,16 @@ func (m *MemIgnoreStore) Revision() int64 {
 	return m.revision
 }
 
+// expire removes the expired rules and records their expiration in the
+// history.
 func (m *MemIgnoreStore) expire() {
 	newrules := make([]*IgnoreRule, 0, len(m.rules))
 	now := time.Now()
 	for _, rule := range m.rules {
 		if rule.Expires.After(now) {
 			newrules = append(newrules, rule)
+		} else {
+			m.history = append(m.history, newIgnoreEvent(rule, IGNORE_EXPIRE, ""))
 		}
 	}
 	m.rules = newrules
@@ -164,6 +216,20 @@ func (m *MemIgnoreStore) BuildRuleMatcher() (RuleMatcher, error) {
 	return buildRuleMatcher(m)
 }
 
+// History, see IgnoreStore interface.
+func (m *MemIgnoreStore) History(id int) ([]*IgnoreEvent, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ret := []*IgnoreEvent{}
+	for i := len(m.history) - 1; i >= 0; i-- {
+		if (id < 0) || (m.history[i].RuleID == id) {
+			ret = append(ret, m.history[i])
+		}
+	}
+	return ret, nil
+}
+
 func compileRule(query string) (map[string]map[string]bool, error) {
 	v, err := url.ParseQuery(query)
 	if err != nil {
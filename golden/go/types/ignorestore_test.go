@@ -19,17 +19,17 @@ func testIgnoreStore(t *testing.T, store IgnoreStore) {
 	r2 := NewIgnoreRule("jim@example.com", time.Now().Add(time.Minute*10), "config=8888", "No good reason.")
 	r3 := NewIgnoreRule("jon@example.com", time.Now().Add(time.Minute*50), "extra=123&extra=abc", "Ignore multiple.")
 	r4 := NewIgnoreRule("jon@example.com", time.Now().Add(time.Minute*100), "extra=123&extra=abc&config=8888", "Ignore multiple.")
-	assert.Equal(t, 0, store.Revision())
+	assert.Equal(t, int64(0), store.Revision())
 	assert.Nil(t, store.Create(r1))
 	assert.Nil(t, store.Create(r2))
 	assert.Nil(t, store.Create(r3))
 	assert.Nil(t, store.Create(r4))
-	assert.Equal(t, 4, store.Revision())
+	assert.Equal(t, int64(4), store.Revision())
 
 	allRules, err := store.List()
 	assert.Nil(t, err)
 	assert.Equal(t, 4, len(allRules))
-	assert.Equal(t, 4, store.Revision())
+	assert.Equal(t, int64(4), store.Revision())
 
 	// Test the rule matcher
 	matcher, err := store.BuildRuleMatcher()
@@ -52,7 +52,7 @@ func testIgnoreStore(t *testing.T, store IgnoreStore) {
 	found, ok = matcher(map[string]string{"extra": "abc", "config": "gpu"})
 	assert.True(t, ok)
 	assert.Equal(t, 2, len(found))
-	assert.Equal(t, 4, store.Revision())
+	assert.Equal(t, int64(4), store.Revision())
 
 	// Remove the third and fourth rule
 	delCount, err := store.Delete(r3.ID, "jon@example.com")
@@ -64,7 +64,7 @@ func testIgnoreStore(t *testing.T, store IgnoreStore) {
 	allRules, err = store.List()
 	assert.Nil(t, err)
 	assert.Equal(t, 2, len(allRules))
-	assert.Equal(t, 6, store.Revision())
+	assert.Equal(t, int64(6), store.Revision())
 
 	for _, oneRule := range allRules {
 		assert.True(t, (oneRule.ID == r1.ID) || (oneRule.ID == r2.ID))
@@ -75,7 +75,7 @@ func testIgnoreStore(t *testing.T, store IgnoreStore) {
 	allRules, err = store.List()
 	assert.Equal(t, 1, len(allRules))
 	assert.Equal(t, r2.ID, allRules[0].ID)
-	assert.Equal(t, 7, store.Revision())
+	assert.Equal(t, int64(7), store.Revision())
 
 	// Update a rule.
 	updatedRule := *allRules[0]
@@ -86,20 +86,20 @@ func testIgnoreStore(t *testing.T, store IgnoreStore) {
 	assert.Equal(t, 1, len(allRules))
 	assert.Equal(t, r2.ID, allRules[0].ID)
 	assert.Equal(t, "an updated rule", allRules[0].Note)
-	assert.Equal(t, 8, store.Revision())
+	assert.Equal(t, int64(8), store.Revision())
 
 	// Try to update a non-existent rule.
 	updatedRule = *allRules[0]
 	err = store.Update(100001, &updatedRule)
 	assert.Error(t, err, "Update should fail for a bad id.")
-	assert.Equal(t, 8, store.Revision())
+	assert.Equal(t, int64(8), store.Revision())
 
 	delCount, err = store.Delete(r2.ID, "jon@example.com")
 	assert.Nil(t, err)
 	allRules, err = store.List()
 	assert.Nil(t, err)
 	assert.Equal(t, 0, len(allRules))
-	assert.Equal(t, 9, store.Revision())
+	assert.Equal(t, int64(9), store.Revision())
 
 	delCount, err = store.Delete(1000000, "someuser@example.com")
 	assert.Nil(t, err)
@@ -107,7 +107,44 @@ func testIgnoreStore(t *testing.T, store IgnoreStore) {
 	allRules, err = store.List()
 	assert.Nil(t, err)
 	assert.Equal(t, 0, len(allRules))
-	assert.Equal(t, 9, store.Revision())
+	assert.Equal(t, int64(9), store.Revision())
+
+	// Every change is recorded in the history, most recent first.
+	history, err := store.History(r2.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(history))
+	assert.Equal(t, IGNORE_DELETE, history[0].Action)
+	assert.Equal(t, "jon@example.com", history[0].UserID)
+	assert.Equal(t, "an updated rule", history[0].Note)
+	assert.Equal(t, IGNORE_UPDATE, history[1].Action)
+	assert.Equal(t, IGNORE_CREATE, history[2].Action)
+	assert.Equal(t, "jim@example.com", history[2].UserID)
+	assert.Equal(t, "config=8888", history[2].Query)
+
+	history, err = store.History(r1.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(history))
+	assert.Equal(t, "jane@example.com", history[0].UserID)
+
+	history, err = store.History(-1)
+	assert.Nil(t, err)
+	assert.Equal(t, 9, len(history))
+}
+
+func TestMemIgnoreStoreExpire(t *testing.T) {
+	store := NewMemIgnoreStore()
+	r1 := NewIgnoreRule("jon@example.com", time.Now().Add(-time.Minute), "config=gpu", "reason")
+	assert.Nil(t, store.Create(r1))
+
+	// Expired rules are removed, but the expiration is recorded.
+	allRules, err := store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(allRules))
+	history, err := store.History(r1.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(history))
+	assert.Equal(t, IGNORE_EXPIRE, history[0].Action)
+	assert.Equal(t, IGNORE_CREATE, history[1].Action)
 }
 
 func TestToQuery(t *testing.T) {
@@ -1,10 +1,12 @@
 package types
 
 import (
+	"database/sql"
 	"fmt"
 	"sync"
 	"time"
 
+	"github.com/skia-dev/glog"
 	"go.skia.org/infra/go/database"
 	"go.skia.org/infra/go/util"
 )
@@ -43,6 +45,7 @@ func (m *SQLIgnoreStore) Create(rule *IgnoreRule) error {
 		return err
 	}
 	rule.ID = int(createdId)
+	m.addHistory(newIgnoreEvent(rule, IGNORE_CREATE, rule.Name))
 	m.inc()
 	return nil
 }
@@ -51,7 +54,7 @@ func (m *SQLIgnoreStore) Create(rule *IgnoreRule) error {
 func (m *SQLIgnoreStore) Update(id int, rule *IgnoreRule) error {
 	stmt := `UPDATE ignorerule SET userid=?, expires=?, query=?, note=? WHERE id=?`
 
-	res, err := m.vdb.DB.Exec(stmt, rule.Name, rule.Expires.Unix(), rule.Query, rule.Note, rule.ID)
+	res, err := m.vdb.DB.Exec(stmt, rule.Name, rule.Expires.Unix(), rule.Query, rule.Note, id)
 	if err != nil {
 		return err
 	}
@@ -59,6 +62,7 @@ func (m *SQLIgnoreStore) Update(id int, rule *IgnoreRule) error {
 	if err == nil && n == 0 {
 		return fmt.Errorf("Did not find an IgnoreRule with id: %d", id)
 	}
+	m.addHistory(newIgnoreEvent(rule, IGNORE_UPDATE, rule.Name))
 	m.inc()
 	return nil
 }
@@ -90,6 +94,17 @@ func (m *SQLIgnoreStore) List() ([]*IgnoreRule, error) {
 
 // Delete, see IgnoreStore interface.
 func (m *SQLIgnoreStore) Delete(id int, userId string) (int, error) {
+	// Read the rule first so its last state ends up in the history.
+	deleted := &IgnoreRule{ID: id}
+	var expiresTS int64
+	row := m.vdb.DB.QueryRow(`SELECT expires, query, note FROM ignorerule WHERE id=?`, id)
+	if err := row.Scan(&expiresTS, &deleted.Query, &deleted.Note); err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	deleted.Expires = time.Unix(expiresTS, 0)
+
 	stmt := "DELETE FROM ignorerule WHERE id=?"
 	ret, err := m.vdb.DB.Exec(stmt, id)
 	if err != nil {
@@ -100,6 +115,7 @@ func (m *SQLIgnoreStore) Delete(id int, userId string) (int, error) {
 		return 0, err
 	}
 	if rowsAffected > 0 {
+		m.addHistory(newIgnoreEvent(deleted, IGNORE_DELETE, userId))
 		m.inc()
 	}
 	return int(rowsAffected), nil
@@ -117,12 +133,57 @@ func (m *SQLIgnoreStore) BuildRuleMatcher() (RuleMatcher, error) {
 	return buildRuleMatcher(m)
 }
 
+// History, see IgnoreStore interface.
+func (m *SQLIgnoreStore) History(id int) ([]*IgnoreEvent, error) {
+	stmt := `SELECT ruleid, action, userid, ts, expires, query, note
+	         FROM ignorerule_history`
+	args := []interface{}{}
+	if id >= 0 {
+		stmt += ` WHERE ruleid=?`
+		args = append(args, id)
+	}
+	stmt += ` ORDER BY ts DESC, id DESC`
+
+	rows, err := m.vdb.DB.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer util.Close(rows)
+
+	result := []*IgnoreEvent{}
+	for rows.Next() {
+		event := &IgnoreEvent{}
+		var expiresTS int64
+		if err := rows.Scan(&event.RuleID, &event.Action, &event.UserID, &event.TS, &expiresTS, &event.Query, &event.Note); err != nil {
+			return nil, err
+		}
+		event.Expires = time.Unix(expiresTS, 0)
+		result = append(result, event)
+	}
+	return result, nil
+}
+
+// addHistory writes the event to the history table. Failing to record the
+// history is logged but does not fail the change itself.
+func (m *SQLIgnoreStore) addHistory(event *IgnoreEvent) {
+	stmt := `INSERT INTO ignorerule_history (ruleid, action, userid, ts, expires, query, note)
+	         VALUES(?,?,?,?,?,?,?)`
+	if _, err := m.vdb.DB.Exec(stmt, event.RuleID, event.Action, event.UserID, event.TS, event.Expires.Unix(), event.Query, event.Note); err != nil {
+		glog.Errorf("Unable to record %s of ignore rule %d: %s", event.Action, event.RuleID, err)
+	}
+}
+
 func buildRuleMatcher(store IgnoreStore) (RuleMatcher, error) {
 	rulesList, err := store.List()
 	if err != nil {
 		return noopRuleMatcher, err
 	}
+	return NewRuleMatcher(rulesList)
+}
 
+// NewRuleMatcher returns a RuleMatcher for the given rules.
+func NewRuleMatcher(rulesList []*IgnoreRule) (RuleMatcher, error) {
+	var err error
 	ignoreRules := make([]map[string]map[string]bool, len(rulesList))
 	for idx, rawRule := range rulesList {
 		ignoreRules[idx], err = compileRule(rawRule.Query)
@@ -0,0 +1,115 @@
+package types
+
+import (
+	"fmt"
+	"sync"
+
+	"go.skia.org/infra/go/database"
+	"go.skia.org/infra/go/util"
+)
+
+type SQLToleranceStore struct {
+	vdb      *database.VersionedDB
+	mutex    sync.Mutex
+	revision int64
+}
+
+func NewSQLToleranceStore(vdb *database.VersionedDB) ToleranceStore {
+	return &SQLToleranceStore{
+		vdb: vdb,
+	}
+}
+
+func (m *SQLToleranceStore) inc() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.revision += 1
+}
+
+// Create, see ToleranceStore interface.
+func (m *SQLToleranceStore) Create(rule *ToleranceRule) error {
+	stmt := `INSERT INTO tolerancerule (userid, query, note, maxchanneldelta, maxpixeldiffpercent)
+	         VALUES(?,?,?,?,?)`
+
+	ret, err := m.vdb.DB.Exec(stmt, rule.Name, rule.Query, rule.Note, rule.MaxChannelDelta, rule.MaxPixelDiffPercent)
+	if err != nil {
+		return err
+	}
+	createdId, err := ret.LastInsertId()
+	if err != nil {
+		return err
+	}
+	rule.ID = int(createdId)
+	m.inc()
+	return nil
+}
+
+// Update, see ToleranceStore interface.
+func (m *SQLToleranceStore) Update(id int, rule *ToleranceRule) error {
+	stmt := `UPDATE tolerancerule SET userid=?, query=?, note=?, maxchanneldelta=?, maxpixeldiffpercent=? WHERE id=?`
+
+	res, err := m.vdb.DB.Exec(stmt, rule.Name, rule.Query, rule.Note, rule.MaxChannelDelta, rule.MaxPixelDiffPercent, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("Did not find a ToleranceRule with id: %d", id)
+	}
+	rule.ID = id
+	m.inc()
+	return nil
+}
+
+// List, see ToleranceStore interface.
+func (m *SQLToleranceStore) List() ([]*ToleranceRule, error) {
+	stmt := `SELECT id, userid, query, note, maxchanneldelta, maxpixeldiffpercent
+	         FROM tolerancerule
+	         ORDER BY id ASC`
+	rows, err := m.vdb.DB.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer util.Close(rows)
+
+	result := []*ToleranceRule{}
+	for rows.Next() {
+		target := &ToleranceRule{}
+		if err := rows.Scan(&target.ID, &target.Name, &target.Query, &target.Note, &target.MaxChannelDelta, &target.MaxPixelDiffPercent); err != nil {
+			return nil, err
+		}
+		result = append(result, target)
+	}
+	return result, nil
+}
+
+// Delete, see ToleranceStore interface.
+func (m *SQLToleranceStore) Delete(id int, userId string) (int, error) {
+	ret, err := m.vdb.DB.Exec("DELETE FROM tolerancerule WHERE id=?", id)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := ret.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if rowsAffected > 0 {
+		m.inc()
+	}
+	return int(rowsAffected), nil
+}
+
+// Revision, see ToleranceStore interface.
+func (m *SQLToleranceStore) Revision() int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.revision
+}
+
+// BuildToleranceMatcher, see ToleranceStore interface.
+func (m *SQLToleranceStore) BuildToleranceMatcher() (ToleranceMatcher, error) {
+	return buildToleranceMatcher(m)
+}
@@ -0,0 +1,228 @@
+package types
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.skia.org/infra/golden/go/diff"
+)
+
+const (
+	// TOLERANCE_RULE_USER_PREFIX is the prefix of the user id that is recorded
+	// in the triage log when a ToleranceRule labels a digest.
+	TOLERANCE_RULE_USER_PREFIX = "tolerance-rule:"
+)
+
+// ToleranceMatcher returns the list of rules in the ToleranceStore that
+// match the given set of parameters.
+type ToleranceMatcher func(map[string]string) ([]*ToleranceRule, bool)
+
+// ToleranceStore stores and matches tolerance rules.
+type ToleranceStore interface {
+	// Create adds a new rule to the tolerance store.
+	Create(*ToleranceRule) error
+
+	// List returns all tolerance rules in the tolerance store ordered by id.
+	List() ([]*ToleranceRule, error)
+
+	// Update updates a ToleranceRule.
+	Update(id int, rule *ToleranceRule) error
+
+	// Delete removes a ToleranceRule from the store.
+	Delete(id int, userId string) (int, error)
+
+	// Revision returns a monotonically increasing int64 that goes up each time
+	// the rules have been changed. See IgnoreStore.Revision.
+	Revision() int64
+
+	// BuildToleranceMatcher returns a ToleranceMatcher based on the current
+	// content of the tolerance store.
+	BuildToleranceMatcher() (ToleranceMatcher, error)
+}
+
+// ToleranceRule defines when an untriaged digest is close enough to a
+// positive digest of the same test to be labeled positive automatically.
+// The rule applies to all traces that match Query, e.g. "name=mytest" for a
+// single test or "config=gpu" for all GPU results.
+type ToleranceRule struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Query string `json:"query"`
+	Note  string `json:"note"`
+
+	// MaxChannelDelta is the maximum difference in any channel of any pixel.
+	MaxChannelDelta int `json:"maxChannelDelta"`
+
+	// MaxPixelDiffPercent is the maximum percentage of pixels that differ.
+	MaxPixelDiffPercent float32 `json:"maxPixelDiffPercent"`
+}
+
+func NewToleranceRule(name, queryStr string, maxChannelDelta int, maxPixelDiffPercent float32, note string) *ToleranceRule {
+	return &ToleranceRule{
+		Name:                name,
+		Query:               queryStr,
+		Note:                note,
+		MaxChannelDelta:     maxChannelDelta,
+		MaxPixelDiffPercent: maxPixelDiffPercent,
+	}
+}
+
+// Within returns true if the given diff metrics are within the tolerance of
+// the rule. Images with different dimensions are never within tolerance.
+func (r *ToleranceRule) Within(dm *diff.DiffMetrics) bool {
+	if dm == nil || dm.DimDiffer || dm.PixelDiffPercent > r.MaxPixelDiffPercent {
+		return false
+	}
+	for _, channelDelta := range dm.MaxRGBADiffs {
+		if channelDelta > r.MaxChannelDelta {
+			return false
+		}
+	}
+	return true
+}
+
+// UserID returns the user id that is recorded in the triage log for the
+// changes made by this rule.
+func (r *ToleranceRule) UserID() string {
+	return fmt.Sprintf("%s%d", TOLERANCE_RULE_USER_PREFIX, r.ID)
+}
+
+// ToleranceRuleID returns the id of the rule that made a change, given the
+// user id recorded in the triage log. Returns false if the change was not
+// made by a rule.
+func ToleranceRuleID(userId string) (int, bool) {
+	if !strings.HasPrefix(userId, TOLERANCE_RULE_USER_PREFIX) {
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(userId, TOLERANCE_RULE_USER_PREFIX))
+	return id, err == nil
+}
+
+// ToleranceRuleSlice is for sorting slices of ToleranceRule by id.
+type ToleranceRuleSlice []*ToleranceRule
+
+func (p ToleranceRuleSlice) Len() int           { return len(p) }
+func (p ToleranceRuleSlice) Less(i, j int) bool { return p[i].ID < p[j].ID }
+func (p ToleranceRuleSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// MemToleranceStore is an in-memory implementation of ToleranceStore.
+type MemToleranceStore struct {
+	rules    []*ToleranceRule
+	mutex    sync.Mutex
+	nextId   int
+	revision int64
+}
+
+func NewMemToleranceStore() ToleranceStore {
+	return &MemToleranceStore{
+		rules: []*ToleranceRule{},
+	}
+}
+
+// Create, see ToleranceStore interface.
+func (m *MemToleranceStore) Create(rule *ToleranceRule) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	rule.ID = m.nextId
+	m.nextId++
+	m.rules = append(m.rules, rule)
+	m.revision++
+	return nil
+}
+
+// List, see ToleranceStore interface.
+func (m *MemToleranceStore) List() ([]*ToleranceRule, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	result := make([]*ToleranceRule, len(m.rules))
+	copy(result, m.rules)
+	return result, nil
+}
+
+// Update, see ToleranceStore interface.
+func (m *MemToleranceStore) Update(id int, updated *ToleranceRule) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i, rule := range m.rules {
+		if rule.ID == id {
+			updated.ID = id
+			m.rules[i] = updated
+			m.revision++
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Did not find a ToleranceRule with id: %d", id)
+}
+
+// Delete, see ToleranceStore interface.
+func (m *MemToleranceStore) Delete(id int, userId string) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for idx, rule := range m.rules {
+		if rule.ID == id {
+			m.rules = append(m.rules[:idx], m.rules[idx+1:]...)
+			m.revision++
+			return 1, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// Revision, see ToleranceStore interface.
+func (m *MemToleranceStore) Revision() int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.revision
+}
+
+// BuildToleranceMatcher, see ToleranceStore interface.
+func (m *MemToleranceStore) BuildToleranceMatcher() (ToleranceMatcher, error) {
+	return buildToleranceMatcher(m)
+}
+
+func buildToleranceMatcher(store ToleranceStore) (ToleranceMatcher, error) {
+	rulesList, err := store.List()
+	if err != nil {
+		return noopToleranceMatcher, err
+	}
+	sort.Sort(ToleranceRuleSlice(rulesList))
+
+	compiled := make([]map[string]map[string]bool, len(rulesList))
+	for idx, rawRule := range rulesList {
+		compiled[idx], err = compileRule(rawRule.Query)
+		if err != nil {
+			return noopToleranceMatcher, err
+		}
+	}
+
+	return func(params map[string]string) ([]*ToleranceRule, bool) {
+		result := []*ToleranceRule{}
+
+	Loop:
+		for ruleIdx, rule := range compiled {
+			// All elements in the rules are AND connected.
+			for ruleKey, ruleValues := range rule {
+				if !ruleValues[params[ruleKey]] {
+					continue Loop
+				}
+			}
+			result = append(result, rulesList[ruleIdx])
+		}
+
+		return result, len(result) > 0
+	}, nil
+}
+
+func noopToleranceMatcher(p map[string]string) ([]*ToleranceRule, bool) {
+	return nil, false
+}
@@ -0,0 +1,78 @@
+package types
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/golden/go/diff"
+)
+
+func TestMemToleranceStore(t *testing.T) {
+	testToleranceStore(t, NewMemToleranceStore())
+}
+
+func testToleranceStore(t *testing.T, store ToleranceStore) {
+	r1 := NewToleranceRule("jon@example.com", "config=gpu", 2, 0.1, "Driver updates.")
+	r2 := NewToleranceRule("jim@example.com", "name=foo&config=8888", 5, 1, "Noisy test.")
+	assert.Equal(t, int64(0), store.Revision())
+	assert.Nil(t, store.Create(r1))
+	assert.Nil(t, store.Create(r2))
+	assert.Equal(t, int64(2), store.Revision())
+
+	allRules, err := store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []*ToleranceRule{r1, r2}, allRules)
+
+	matcher, err := store.BuildToleranceMatcher()
+	assert.Nil(t, err)
+	found, ok := matcher(map[string]string{"name": "foo", "config": "565"})
+	assert.False(t, ok)
+	assert.Equal(t, []*ToleranceRule{}, found)
+	found, ok = matcher(map[string]string{"name": "foo", "config": "gpu"})
+	assert.True(t, ok)
+	assert.Equal(t, []*ToleranceRule{r1}, found)
+	found, ok = matcher(map[string]string{"name": "foo", "config": "8888"})
+	assert.True(t, ok)
+	assert.Equal(t, []*ToleranceRule{r2}, found)
+	found, ok = matcher(map[string]string{"name": "bar", "config": "8888"})
+	assert.False(t, ok)
+
+	updated := NewToleranceRule("jon@example.com", "config=gpu", 3, 0.2, "Driver updates.")
+	assert.Nil(t, store.Update(r1.ID, updated))
+	assert.Equal(t, int64(3), store.Revision())
+	allRules, err = store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(allRules))
+	assert.Equal(t, r1.ID, allRules[0].ID)
+	assert.Equal(t, 3, allRules[0].MaxChannelDelta)
+	assert.NotNil(t, store.Update(r2.ID+100, updated))
+
+	delCount, err := store.Delete(r2.ID, "jon@example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, delCount)
+	delCount, err = store.Delete(r2.ID, "jon@example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, delCount)
+	allRules, err = store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(allRules))
+	assert.Equal(t, int64(4), store.Revision())
+}
+
+func TestToleranceRuleWithin(t *testing.T) {
+	rule := NewToleranceRule("jon@example.com", "config=gpu", 2, 0.1, "")
+	assert.True(t, rule.Within(&diff.DiffMetrics{PixelDiffPercent: 0.1, MaxRGBADiffs: []int{2, 1, 0, 0}}))
+	assert.False(t, rule.Within(&diff.DiffMetrics{PixelDiffPercent: 0.2, MaxRGBADiffs: []int{2, 1, 0, 0}}))
+	assert.False(t, rule.Within(&diff.DiffMetrics{PixelDiffPercent: 0.1, MaxRGBADiffs: []int{2, 1, 0, 3}}))
+	assert.False(t, rule.Within(&diff.DiffMetrics{DimDiffer: true, MaxRGBADiffs: []int{0, 0, 0, 0}}))
+	assert.False(t, rule.Within(nil))
+}
+
+func TestToleranceRuleID(t *testing.T) {
+	rule := &ToleranceRule{ID: 12}
+	id, ok := ToleranceRuleID(rule.UserID())
+	assert.True(t, ok)
+	assert.Equal(t, 12, id)
+	_, ok = ToleranceRuleID("jon@example.com")
+	assert.False(t, ok)
+}
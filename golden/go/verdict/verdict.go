@@ -0,0 +1,141 @@
+// verdict turns the summaries of the digests produced at a single commit into
+// a pass/fail verdict that continuous integration can gate on.
+package verdict
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"go.skia.org/infra/golden/go/summary"
+)
+
+// Output formats of a Verdict.
+const (
+	FORMAT_JSON  = "json"
+	FORMAT_JUNIT = "junit"
+)
+
+// TestVerdict is the verdict for a single test. A test passes if none of its
+// digests are untriaged or negative.
+type TestVerdict struct {
+	Test      string   `json:"test"`
+	Corpus    string   `json:"corpus"`
+	Pass      bool     `json:"pass"`
+	Untriaged []string `json:"untriaged"`
+	Negative  []string `json:"negative"`
+}
+
+// Verdict is the verdict for all tests that produced a digest at Commit.
+type Verdict struct {
+	Commit string         `json:"commit"`
+	Pass   bool           `json:"pass"`
+	Tests  []*TestVerdict `json:"tests"`
+}
+
+// New returns the Verdict for the given summaries, see
+// summary.Summaries.CalcCommitSummaries. Tests without digests are left out.
+func New(commit string, summaries map[string]*summary.Summary) *Verdict {
+	ret := &Verdict{
+		Commit: commit,
+		Pass:   true,
+		Tests:  []*TestVerdict{},
+	}
+	for _, s := range summaries {
+		if s.Num == 0 {
+			continue
+		}
+		tv := &TestVerdict{
+			Test:      s.Name,
+			Corpus:    s.Corpus,
+			Pass:      (s.Untriaged == 0) && (s.Neg == 0),
+			Untriaged: s.UntHashes,
+			Negative:  s.NegHashes,
+		}
+		ret.Pass = ret.Pass && tv.Pass
+		ret.Tests = append(ret.Tests, tv)
+	}
+	sort.Sort(testVerdictSlice(ret.Tests))
+	return ret
+}
+
+// Failed returns the verdicts of the failing tests.
+func (v *Verdict) Failed() []*TestVerdict {
+	ret := []*TestVerdict{}
+	for _, tv := range v.Tests {
+		if !tv.Pass {
+			ret = append(ret, tv)
+		}
+	}
+	return ret
+}
+
+// testVerdictSlice sorts TestVerdicts by corpus and test name.
+type testVerdictSlice []*TestVerdict
+
+func (p testVerdictSlice) Len() int { return len(p) }
+func (p testVerdictSlice) Less(i, j int) bool {
+	if p[i].Corpus == p[j].Corpus {
+		return p[i].Test < p[j].Test
+	}
+	return p[i].Corpus < p[j].Corpus
+}
+func (p testVerdictSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// The JUnit XML report, see WriteJUnit.
+type junitSuite struct {
+	XMLName  xml.Name     `xml:"testsuite"`
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Cases    []*junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// WriteJUnit writes the verdict as a JUnit XML report. Every test is a test
+// case of the corpus, failing tests list their untriaged and negative
+// digests.
+func WriteJUnit(w io.Writer, v *Verdict) error {
+	suite := &junitSuite{
+		Name:  "gold:" + v.Commit,
+		Tests: len(v.Tests),
+		Cases: make([]*junitCase, 0, len(v.Tests)),
+	}
+	for _, tv := range v.Tests {
+		c := &junitCase{
+			Name:      tv.Test,
+			ClassName: tv.Corpus,
+		}
+		if !tv.Pass {
+			suite.Failures++
+			c.Failure = &junitFailure{
+				Message: fmt.Sprintf("%d untriaged and %d negative digests", len(tv.Untriaged), len(tv.Negative)),
+				Body:    fmt.Sprintf("untriaged: %s\nnegative: %s", strings.Join(tv.Untriaged, " "), strings.Join(tv.Negative, " ")),
+			}
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suite); err != nil {
+		return fmt.Errorf("Failed to encode JUnit report: %s", err)
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,56 @@
+package verdict
+
+import (
+	"bytes"
+	"encoding/xml"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/golden/go/summary"
+)
+
+func testSummaries() map[string]*summary.Summary {
+	return map[string]*summary.Summary{
+		"foo":  &summary.Summary{Name: "foo", Corpus: "gm", Pos: 1, Num: 1, UntHashes: []string{}, NegHashes: []string{}},
+		"bar":  &summary.Summary{Name: "bar", Corpus: "gm", Pos: 1, Neg: 1, Untriaged: 2, Num: 4, UntHashes: []string{"ccc", "ddd"}, NegHashes: []string{"bbb"}},
+		"baz":  &summary.Summary{Name: "baz", Corpus: "image", Untriaged: 1, Num: 1, UntHashes: []string{"eee"}, NegHashes: []string{}},
+		"quux": &summary.Summary{Name: "quux", Corpus: "gm", UntHashes: []string{}, NegHashes: []string{}},
+	}
+}
+
+func TestNew(t *testing.T) {
+	v := New("hash1", testSummaries())
+	assert.False(t, v.Pass)
+	assert.Equal(t, 3, len(v.Tests))
+	assert.Equal(t, "bar", v.Tests[0].Test)
+	assert.Equal(t, []string{"ccc", "ddd"}, v.Tests[0].Untriaged)
+	assert.Equal(t, []string{"bbb"}, v.Tests[0].Negative)
+	assert.Equal(t, "foo", v.Tests[1].Test)
+	assert.True(t, v.Tests[1].Pass)
+	assert.Equal(t, "baz", v.Tests[2].Test)
+
+	failed := v.Failed()
+	assert.Equal(t, 2, len(failed))
+	assert.Equal(t, "bar", failed[0].Test)
+	assert.Equal(t, "baz", failed[1].Test)
+
+	v = New("hash1", map[string]*summary.Summary{"foo": testSummaries()["foo"]})
+	assert.True(t, v.Pass)
+	assert.Equal(t, 0, len(v.Failed()))
+}
+
+func TestWriteJUnit(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, WriteJUnit(&buf, New("hash1", testSummaries())))
+
+	suite := &junitSuite{}
+	assert.NoError(t, xml.Unmarshal(buf.Bytes(), suite))
+	assert.Equal(t, "gold:hash1", suite.Name)
+	assert.Equal(t, 3, suite.Tests)
+	assert.Equal(t, 2, suite.Failures)
+	assert.Equal(t, "bar", suite.Cases[0].Name)
+	assert.Equal(t, "gm", suite.Cases[0].ClassName)
+	assert.Equal(t, "2 untriaged and 1 negative digests", suite.Cases[0].Failure.Message)
+	assert.Equal(t, "untriaged: ccc ddd\nnegative: bbb", suite.Cases[0].Failure.Body)
+	assert.Nil(t, suite.Cases[1].Failure)
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"strings"
 	"time"
 )
 
@@ -74,6 +75,24 @@ const (
 	CONSTRUCTOR_ANDROID_GOLD = "android-gold"
 )
 
+const (
+	// MASTER_BRANCH is the branch whose results are stored in the datasets
+	// above. Results of other branches are stored in the datasets returned by
+	// BranchDataset.
+	MASTER_BRANCH = "master"
+)
+
+// BranchDataset returns the name of the dataset that contains the results of
+// the given branch. For the master branch (or an empty branch name) this is
+// the dataset itself, otherwise the branch is appended to the dataset name,
+// e.g. "nano@chrome_m45" for the branch "chrome/m45".
+func BranchDataset(dataset, branch string) string {
+	if branch == "" || branch == MASTER_BRANCH {
+		return dataset
+	}
+	return dataset + "@" + strings.Replace(branch, "/", "_", -1)
+}
+
 var (
 	VALID_DATASETS = []string{
 		DATASET_NANO,
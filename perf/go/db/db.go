@@ -71,6 +71,76 @@ var migrationSteps = []database.MigrationStep{
 		},
 		MySQLDown: []string{},
 	},
+	// version 3
+	{
+		MySQLUp: []string{
+			`CREATE TABLE IF NOT EXISTS provenance_sources (
+				id          INT           NOT NULL AUTO_INCREMENT PRIMARY KEY,
+				sourceHash  CHAR(32)      NOT NULL UNIQUE,
+				source      TEXT          NOT NULL,
+				buildNumber VARCHAR(64)   NOT NULL
+			)`,
+
+			`CREATE TABLE IF NOT EXISTS provenance (
+				traceHash   CHAR(32)      NOT NULL,
+				commitHash  CHAR(40)      NOT NULL,
+				sourceID    INT           NOT NULL,
+				PRIMARY KEY (traceHash, commitHash)
+			)`,
+		},
+		MySQLDown: []string{
+			`DROP TABLE IF EXISTS provenance`,
+			`DROP TABLE IF EXISTS provenance_sources`,
+		},
+	},
+	// version 4
+	{
+		MySQLUp: []string{
+			`CREATE TABLE IF NOT EXISTS tryissues (
+				issue       VARCHAR(255)  NOT NULL PRIMARY KEY,
+				owner       VARCHAR(255)  NOT NULL,
+				subject     TEXT          NOT NULL,
+				lastUpdated BIGINT        NOT NULL,
+				INDEX tryissues_owner (owner),
+				INDEX tryissues_lastUpdated (lastUpdated)
+			)`,
+
+			`CREATE TABLE IF NOT EXISTS tryresults (
+				issue       VARCHAR(255)  NOT NULL,
+				patchset    BIGINT        NOT NULL,
+				results     LONGTEXT      NOT NULL,
+				bots        TEXT          NOT NULL,
+				traceCount  INT           NOT NULL,
+				started     BIGINT        NOT NULL,
+				lastUpdated BIGINT        NOT NULL,
+				PRIMARY KEY (issue, patchset),
+				INDEX tryresults_lastUpdated (lastUpdated)
+			)`,
+
+			// Results stored per issue become the results of patchset -1, see
+			// trybot.LEGACY_PATCHSET.
+			`INSERT INTO tryissues (issue, owner, subject, lastUpdated)
+				SELECT issue, '', '', lastUpdated FROM tries`,
+
+			`INSERT INTO tryresults (issue, patchset, results, bots, traceCount, started, lastUpdated)
+				SELECT issue, -1, results, '[]', 0, lastUpdated, lastUpdated FROM tries`,
+
+			`DROP TABLE tries`,
+		},
+		MySQLDown: []string{
+			`CREATE TABLE IF NOT EXISTS tries (
+				issue       VARCHAR(255) NOT NULL PRIMARY KEY,
+				lastUpdated BIGINT       NOT NULL,
+				results     LONGTEXT   NOT NULL
+			)`,
+
+			`REPLACE INTO tries (issue, lastUpdated, results)
+				SELECT issue, lastUpdated, results FROM tryresults ORDER BY patchset`,
+
+			`DROP TABLE tryresults`,
+			`DROP TABLE tryissues`,
+		},
+	},
 
 	// Use this is a template for more migration steps.
 	// version x
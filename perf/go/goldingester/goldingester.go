@@ -11,13 +11,24 @@ import (
 	"github.com/skia-dev/glog"
 	"go.skia.org/infra/go/androidbuild"
 	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/golden/go/diff"
+	"go.skia.org/infra/golden/go/digestmeta"
+	gtypes "go.skia.org/infra/golden/go/types"
 	"go.skia.org/infra/perf/go/config"
 	"go.skia.org/infra/perf/go/ingester"
 	"go.skia.org/infra/perf/go/types"
 )
 
+// METADATA_DIR_PARAM is the key in the ingester's ExtraParams that contains
+// the directory where the metadata of the ingested digests is written.
+// Gold reads the metadata from the same directory.
+const METADATA_DIR_PARAM = "MetadataDir"
+
 // Init registers the GoldIngester and the Android specific GoldIngester.
-func Init(client *http.Client, dir string) error {
+// It also registers the HOOK_ANDROID_BUILD pre-ingestion hook. If
+// metadataStore is not nil the registered ingesters record the metadata of
+// every result in it.
+func Init(client *http.Client, dir string, metadataStore digestmeta.MetadataStore) error {
 	gitHashInfo, err := androidbuild.New(dir, client)
 	if err != nil {
 		return err
@@ -25,8 +36,11 @@ func Init(client *http.Client, dir string) error {
 
 	// Generate the pre-ingestion hook and register the ingester.
 	preIngestHook := getAndroidGoldPreIngestHook(gitHashInfo)
-	ingester.Register(config.CONSTRUCTOR_ANDROID_GOLD, func() ingester.ResultIngester { return NewGoldIngester(preIngestHook) })
-	ingester.Register(config.CONSTRUCTOR_GOLD, func() ingester.ResultIngester { return NewGoldIngester(nil) })
+	RegisterHook(HOOK_ANDROID_BUILD, func(extraParams map[string]string) (PreIngestionHook, error) {
+		return preIngestHook, nil
+	})
+	ingester.Register(config.CONSTRUCTOR_ANDROID_GOLD, func() ingester.ResultIngester { return NewGoldIngester(preIngestHook, metadataStore) })
+	ingester.Register(config.CONSTRUCTOR_GOLD, func() ingester.ResultIngester { return NewGoldIngester(nil, metadataStore) })
 	return nil
 }
 
@@ -139,14 +153,27 @@ func idAndParams(dm *DMResults, r *Result) (string, map[string]string) {
 	return strings.Join(values, ":"), params
 }
 
-// addResultToTile adds the Digests from the DMResults to the tile at the given offset.
-func addResultToTile(res *DMResults, tile *types.Tile, offset int, counter metrics.Counter) {
+// tileResults returns the results that are added to a tile. Results with an
+// extension Gold cannot decode, see diff.IMAGE_FORMATS, are skipped since
+// they could never be diffed.
+func tileResults(res *DMResults) []*Result {
+	ret := make([]*Result, 0, len(res.Results))
 	for _, r := range res.Results {
-		if ext, ok := r.Options["ext"]; !ok || ext != "png" {
-			continue // Temporarily skip non-PNG results until we know how to ingest them.
+		if ext, ok := r.Options["ext"]; ok && diff.SupportedExt(ext) {
+			ret = append(ret, r)
 		}
+	}
+	return ret
+}
 
+// addResultToTile adds the Digests from the DMResults to the tile at the given
+// offset and returns the ids of all traces that were written. Only the
+// results returned by tileResults are added.
+func addResultToTile(res *DMResults, tile *types.Tile, offset int, counter metrics.Counter) []string {
+	traceIDs := make([]string, 0, len(res.Results))
+	for _, r := range tileResults(res) {
 		traceID, params := idAndParams(res, r)
+		traceIDs = append(traceIDs, traceID)
 
 		var trace *types.GoldenTrace
 		var ok bool
@@ -176,16 +203,34 @@ func addResultToTile(res *DMResults, tile *types.Tile, offset int, counter metri
 		trace.Values[offset] = r.Digest
 		counter.Inc(1)
 	}
+	return traceIDs
+}
+
+// metadataFromResults returns the metadata of the results in res that are
+// added to the tile, see tileResults.
+func metadataFromResults(res *DMResults) []*digestmeta.DigestMetadata {
+	results := tileResults(res)
+	ret := make([]*digestmeta.DigestMetadata, 0, len(results))
+	for _, r := range results {
+		_, params := idAndParams(res, r)
+		ret = append(ret, digestmeta.New(params[gtypes.PRIMARY_KEY_FIELD], r.Digest, params, r.Options))
+	}
+	return ret
 }
 
 // GoldIngester implements the ingester.ResultIngester interface.
 type GoldIngester struct {
 	preIngestionHook PreIngestionHook
+	metadataStore    digestmeta.MetadataStore
 }
 
-func NewGoldIngester(hook PreIngestionHook) ingester.ResultIngester {
+// NewGoldIngester returns a new GoldIngester. Both arguments are optional.
+// hook is run on every file before it is ingested and metadataStore receives
+// the metadata of all ingested results.
+func NewGoldIngester(hook PreIngestionHook, metadataStore digestmeta.MetadataStore) ingester.ResultIngester {
 	return GoldIngester{
 		preIngestionHook: hook,
+		metadataStore:    metadataStore,
 	}
 }
 
@@ -215,7 +260,14 @@ func (i GoldIngester) Ingest(tt *ingester.TileTracker, opener ingester.Opener, f
 		if err := tt.Move(res.GitHash); err != nil {
 			return fmt.Errorf("Failed to move to correct Tile: %s: %s", res.GitHash, err)
 		}
-		addResultToTile(res, tt.Tile(), tt.Offset(res.GitHash), counter)
+		for _, traceID := range addResultToTile(res, tt.Tile(), tt.Offset(res.GitHash), counter) {
+			tt.AddProvenance(traceID, res.GitHash, res.BuildNumber)
+		}
+		if i.metadataStore != nil {
+			if err := i.metadataStore.Update(metadataFromResults(res)); err != nil {
+				return fmt.Errorf("Failed to update digest metadata: %s", err)
+			}
+		}
 	} else {
 		return fmt.Errorf("Missing hash.")
 	}
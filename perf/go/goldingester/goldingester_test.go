@@ -7,6 +7,7 @@ import (
 
 	metrics "github.com/rcrowley/go-metrics"
 	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/golden/go/digestmeta"
 	"go.skia.org/infra/perf/go/types"
 )
 
@@ -65,3 +66,44 @@ func TestParsing(t *testing.T) {
 		t.Errorf("Wrong number of points ingested: Got %v Want %v", got, want)
 	}
 }
+
+func TestNonPNGResults(t *testing.T) {
+	tile := types.NewTile()
+	dm := loadDMResults(t)
+	dm.Results[1].Options["ext"] = "pdf"
+
+	// Results that cannot be decoded are not added to the tile.
+	metricsProcessed := metrics.NewRegisteredCounter("testing.ingestion.nonpng", metrics.DefaultRegistry)
+	addResultToTile(dm, tile, 0, metricsProcessed)
+	assert.Equal(t, 1, len(tile.Traces))
+	assert.Equal(t, int64(1), metricsProcessed.Count())
+	assert.Equal(t, []string{"png"}, tile.ParamSet["ext"])
+
+	// Other formats that can be decoded are.
+	dm.Results[1].Options["ext"] = "jpg"
+	addResultToTile(dm, tile, 0, metricsProcessed)
+	assert.Equal(t, 2, len(tile.Traces))
+	assert.Equal(t, []string{"png", "jpg"}, tile.ParamSet["ext"])
+}
+
+func TestMetadataFromResults(t *testing.T) {
+	dm := loadDMResults(t)
+	dm.Results[1].Options["ext"] = "pdf"
+
+	store := digestmeta.NewMemMetadataStore()
+	assert.Nil(t, store.Update(metadataFromResults(dm)))
+
+	md, err := store.Get("varied_text_clipped_no_lcd", "445aa63b2200baaba9b37fd5f80c0447")
+	assert.Nil(t, err)
+	assert.Equal(t, "png", md.Ext)
+	assert.Equal(t, "GM", md.SourceType)
+	assert.Equal(t, map[string]string{"ext": "png", "source_type": "GM"}, md.Options)
+
+	// Results that are not added to the tile have no metadata.
+	md, err = store.Get("vertices", "1a9dae50f3db7e29912b3f2ed43e37da")
+	assert.Nil(t, err)
+	assert.Nil(t, md)
+	ext, err := store.Ext("1a9dae50f3db7e29912b3f2ed43e37da")
+	assert.Nil(t, err)
+	assert.Equal(t, "", ext)
+}
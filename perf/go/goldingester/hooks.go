@@ -0,0 +1,209 @@
+package goldingester
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"go.skia.org/infra/perf/go/types"
+)
+
+const (
+	// HOOKS_PARAM is the key in the ingester's ExtraParams that contains the
+	// comma separated list of pre-ingestion hooks to run, e.g.
+	//
+	//   PreIngestionHooks = "rename_keys, drop_results, add_params"
+	//
+	// The hooks are run in the order in which they are listed.
+	HOOKS_PARAM = "PreIngestionHooks"
+
+	// Names of the built-in hooks.
+	HOOK_RENAME_KEYS   = "rename_keys"
+	HOOK_DROP_RESULTS  = "drop_results"
+	HOOK_ANDROID_BUILD = "android_build"
+	HOOK_ADD_PARAMS    = "add_params"
+
+	// Keys in ExtraParams that configure the built-in hooks. The values are
+	// URL query encoded, e.g. RenameKeys = "cfg=config&test=name" renames the
+	// key 'cfg' to 'config' and the key 'test' to 'name'.
+	RENAME_KEYS_PARAM  = "RenameKeys"
+	DROP_RESULTS_PARAM = "DropQuery"
+	ADD_PARAMS_PARAM   = "AddParams"
+)
+
+// HookConstructor creates a PreIngestionHook from the ExtraParams of an
+// ingester configuration.
+type HookConstructor func(extraParams map[string]string) (PreIngestionHook, error)
+
+// hookConstructors maps hook names to their constructors.
+var hookConstructors = map[string]HookConstructor{
+	HOOK_RENAME_KEYS:  newRenameKeysHook,
+	HOOK_DROP_RESULTS: newDropResultsHook,
+	HOOK_ADD_PARAMS:   newAddParamsHook,
+}
+
+// RegisterHook makes the hook constructor available under the given name.
+// Registering a name twice replaces the previous constructor.
+func RegisterHook(name string, f HookConstructor) {
+	hookConstructors[name] = f
+}
+
+// NewHookChain parses the comma separated list of hook names and returns a
+// single PreIngestionHook that runs them in order. The hooks are configured
+// via extraParams.
+func NewHookChain(hookNames string, extraParams map[string]string) (PreIngestionHook, error) {
+	hooks := []PreIngestionHook{}
+	for _, name := range strings.Split(hookNames, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		f, ok := hookConstructors[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown pre-ingestion hook: %s", name)
+		}
+		hook, err := f(extraParams)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create pre-ingestion hook %s: %s", name, err)
+		}
+		hooks = append(hooks, hook)
+	}
+	return ChainHooks(hooks...), nil
+}
+
+// ChainHooks returns a PreIngestionHook that runs the given hooks in order.
+// It stops at the first hook that returns an error.
+func ChainHooks(hooks ...PreIngestionHook) PreIngestionHook {
+	return func(dmResults *DMResults) error {
+		for _, hook := range hooks {
+			if err := hook(dmResults); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// parseParam parses the URL query encoded value of extraParams[key].
+func parseParam(extraParams map[string]string, key string) (url.Values, error) {
+	value, ok := extraParams[key]
+	if !ok || value == "" {
+		return nil, fmt.Errorf("Missing value for '%s' in ExtraParams.", key)
+	}
+	ret, err := url.ParseQuery(value)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse '%s': %s", key, err)
+	}
+	return ret, nil
+}
+
+// singleValues converts the url.Values to a map of strings and makes sure
+// every key has exactly one value.
+func singleValues(key string, values url.Values) (map[string]string, error) {
+	ret := make(map[string]string, len(values))
+	for k, v := range values {
+		if len(v) != 1 {
+			return nil, fmt.Errorf("Key '%s' in '%s' must have exactly one value.", k, key)
+		}
+		ret[k] = v[0]
+	}
+	return ret, nil
+}
+
+func newRenameKeysHook(extraParams map[string]string) (PreIngestionHook, error) {
+	values, err := parseParam(extraParams, RENAME_KEYS_PARAM)
+	if err != nil {
+		return nil, err
+	}
+	renames, err := singleValues(RENAME_KEYS_PARAM, values)
+	if err != nil {
+		return nil, err
+	}
+	return renameKeysHook(renames), nil
+}
+
+// renameKeysHook returns a PreIngestionHook that renames keys in the
+// top level keys and in the keys and options of every result. All renames
+// are applied simultaneously, so keys can be swapped and the result does not
+// depend on the order of the renames. If several keys are renamed to the same
+// key the value of the key that sorts last wins.
+func renameKeysHook(renames map[string]string) PreIngestionHook {
+	froms := make([]string, 0, len(renames))
+	for from := range renames {
+		froms = append(froms, from)
+	}
+	sort.Strings(froms)
+
+	renameIn := func(m map[string]string) {
+		renamed := map[string]string{}
+		for _, from := range froms {
+			if v, ok := m[from]; ok {
+				renamed[renames[from]] = v
+				delete(m, from)
+			}
+		}
+		for to, v := range renamed {
+			m[to] = v
+		}
+	}
+
+	return func(dmResults *DMResults) error {
+		renameIn(dmResults.Key)
+		for _, r := range dmResults.Results {
+			renameIn(r.Key)
+			renameIn(r.Options)
+		}
+		return nil
+	}
+}
+
+func newDropResultsHook(extraParams map[string]string) (PreIngestionHook, error) {
+	query, err := parseParam(extraParams, DROP_RESULTS_PARAM)
+	if err != nil {
+		return nil, err
+	}
+	return dropResultsHook(query), nil
+}
+
+// dropResultsHook returns a PreIngestionHook that removes all results whose
+// params match the given query.
+func dropResultsHook(query url.Values) PreIngestionHook {
+	return func(dmResults *DMResults) error {
+		kept := make([]*Result, 0, len(dmResults.Results))
+		for _, r := range dmResults.Results {
+			_, params := idAndParams(dmResults, r)
+			if !types.Matches(&types.GoldenTrace{Params_: params}, query) {
+				kept = append(kept, r)
+			}
+		}
+		dmResults.Results = kept
+		return nil
+	}
+}
+
+func newAddParamsHook(extraParams map[string]string) (PreIngestionHook, error) {
+	values, err := parseParam(extraParams, ADD_PARAMS_PARAM)
+	if err != nil {
+		return nil, err
+	}
+	params, err := singleValues(ADD_PARAMS_PARAM, values)
+	if err != nil {
+		return nil, err
+	}
+	return addParamsHook(params), nil
+}
+
+// addParamsHook returns a PreIngestionHook that injects the given constant
+// params into the top level keys. Existing keys are overwritten.
+func addParamsHook(params map[string]string) PreIngestionHook {
+	return func(dmResults *DMResults) error {
+		if dmResults.Key == nil {
+			dmResults.Key = map[string]string{}
+		}
+		for k, v := range params {
+			dmResults.Key[k] = v
+		}
+		return nil
+	}
+}
@@ -0,0 +1,165 @@
+package goldingester
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/go/gitinfo"
+)
+
+func TestRenameKeysHook(t *testing.T) {
+	dm := loadDMResults(t)
+	hook, err := NewHookChain(HOOK_RENAME_KEYS, map[string]string{
+		RENAME_KEYS_PARAM: "gpu=gpu_name&config=cfg&source_type=corpus",
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, hook(dm))
+
+	assert.Equal(t, "HD7770", dm.Key["gpu_name"])
+	_, ok := dm.Key["gpu"]
+	assert.False(t, ok)
+	for _, r := range dm.Results {
+		_, ok := r.Key["config"]
+		assert.False(t, ok)
+		_, ok = r.Options["source_type"]
+		assert.False(t, ok)
+		assert.Equal(t, "GM", r.Options["corpus"])
+	}
+	assert.Equal(t, "565", dm.Results[0].Key["cfg"])
+	assert.Equal(t, "8888", dm.Results[1].Key["cfg"])
+}
+
+func TestRenameKeysHookSimultaneous(t *testing.T) {
+	// Swapped and chained renames do not depend on the order of the renames.
+	for i := 0; i < 20; i++ {
+		dm := &DMResults{Key: map[string]string{"a": "1", "b": "2", "c": "3"}}
+		assert.Nil(t, renameKeysHook(map[string]string{"a": "b", "b": "a", "c": "d"})(dm))
+		assert.Equal(t, map[string]string{"a": "2", "b": "1", "d": "3"}, dm.Key)
+
+		dm = &DMResults{Key: map[string]string{"a": "1", "b": "2"}}
+		assert.Nil(t, renameKeysHook(map[string]string{"a": "b", "b": "c"})(dm))
+		assert.Equal(t, map[string]string{"b": "1", "c": "2"}, dm.Key)
+	}
+}
+
+func TestDropResultsHook(t *testing.T) {
+	dm := loadDMResults(t)
+	hook, err := NewHookChain(HOOK_DROP_RESULTS, map[string]string{
+		DROP_RESULTS_PARAM: "config=565&os=Win8",
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, hook(dm))
+	assert.Equal(t, 1, len(dm.Results))
+	assert.Equal(t, "vertices", dm.Results[0].Key["name"])
+
+	// A query that does not match leaves the results untouched.
+	dm = loadDMResults(t)
+	assert.Nil(t, dropResultsHook(url.Values{"config": []string{"gpu"}})(dm))
+	assert.Equal(t, 2, len(dm.Results))
+}
+
+func TestAddParamsHook(t *testing.T) {
+	dm := loadDMResults(t)
+	hook, err := NewHookChain(HOOK_ADD_PARAMS, map[string]string{
+		ADD_PARAMS_PARAM: "corpus=downstream&os=Win10",
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, hook(dm))
+	assert.Equal(t, "downstream", dm.Key["corpus"])
+	assert.Equal(t, "Win10", dm.Key["os"])
+
+	_, params := idAndParams(dm, dm.Results[0])
+	assert.Equal(t, "downstream", params["corpus"])
+
+	// Results without top level keys get them.
+	dm = &DMResults{}
+	assert.Nil(t, hook(dm))
+	assert.Equal(t, map[string]string{"corpus": "downstream", "os": "Win10"}, dm.Key)
+}
+
+type mockInfo struct {
+	calls int
+}
+
+func (m *mockInfo) Get(branch, target, buildID string) (*gitinfo.ShortCommit, error) {
+	m.calls++
+	if buildID != "1727" {
+		return nil, fmt.Errorf("Unknown build id: %s", buildID)
+	}
+	return &gitinfo.ShortCommit{Hash: "abcdef-" + branch + "-" + target}, nil
+}
+
+func TestAndroidBuildHook(t *testing.T) {
+	info := &mockInfo{}
+	RegisterHook(HOOK_ANDROID_BUILD, func(extraParams map[string]string) (PreIngestionHook, error) {
+		return getAndroidGoldPreIngestHook(info), nil
+	})
+	defer delete(hookConstructors, HOOK_ANDROID_BUILD)
+
+	dm := loadDMResults(t)
+	hook, err := NewHookChain(HOOK_ANDROID_BUILD, nil)
+	assert.Nil(t, err)
+
+	// The required keys are missing.
+	assert.NotNil(t, hook(dm))
+
+	dm.Key["branch"] = "git_master-skia"
+	dm.Key["build_flavor"] = "fugu-userdebug"
+	assert.Nil(t, hook(dm))
+	assert.Equal(t, "abcdef-git_master-skia-fugu-userdebug", dm.GitHash)
+	assert.Equal(t, 1, info.calls)
+
+	// Unknown build ids are reported as errors.
+	dm.BuildNumber = "1"
+	assert.NotNil(t, hook(dm))
+}
+
+func TestHookChain(t *testing.T) {
+	extraParams := map[string]string{
+		RENAME_KEYS_PARAM:  "gpu=gpu_name",
+		DROP_RESULTS_PARAM: "gpu_name=HD7770&config=8888",
+		ADD_PARAMS_PARAM:   "corpus=downstream",
+	}
+
+	// The hooks are run in order, so the drop query sees the renamed key.
+	dm := loadDMResults(t)
+	hook, err := NewHookChain(" rename_keys, drop_results,add_params ", extraParams)
+	assert.Nil(t, err)
+	assert.Nil(t, hook(dm))
+	assert.Equal(t, 1, len(dm.Results))
+	assert.Equal(t, "565", dm.Results[0].Key["config"])
+	assert.Equal(t, "downstream", dm.Key["corpus"])
+
+	// In the reverse order the drop query does not match anything.
+	dm = loadDMResults(t)
+	hook, err = NewHookChain("drop_results,rename_keys", extraParams)
+	assert.Nil(t, err)
+	assert.Nil(t, hook(dm))
+	assert.Equal(t, 2, len(dm.Results))
+
+	// An empty chain does nothing.
+	dm = loadDMResults(t)
+	hook, err = NewHookChain("", extraParams)
+	assert.Nil(t, err)
+	assert.Nil(t, hook(dm))
+	assert.Equal(t, 2, len(dm.Results))
+
+	// Unknown hooks and missing configuration are errors.
+	_, err = NewHookChain("rename_keys,unknown", extraParams)
+	assert.NotNil(t, err)
+	_, err = NewHookChain(HOOK_ADD_PARAMS, map[string]string{})
+	assert.NotNil(t, err)
+	_, err = NewHookChain(HOOK_ADD_PARAMS, map[string]string{ADD_PARAMS_PARAM: "a=b&a=c"})
+	assert.NotNil(t, err)
+
+	// Errors stop the chain.
+	called := false
+	chain := ChainHooks(
+		func(dm *DMResults) error { return fmt.Errorf("Failed") },
+		func(dm *DMResults) error { called = true; return nil },
+	)
+	assert.NotNil(t, chain(loadDMResults(t)))
+	assert.False(t, called)
+}
@@ -20,6 +20,7 @@ import (
 	"go.skia.org/infra/go/database"
 	"go.skia.org/infra/go/gitinfo"
 	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/golden/go/digestmeta"
 	pconfig "go.skia.org/infra/perf/go/config"
 	"go.skia.org/infra/perf/go/db"
 	"go.skia.org/infra/perf/go/goldingester"
@@ -41,6 +42,7 @@ type IngesterConfig struct {
 	ExtraParams     map[string]string    // Any additional needed parameters (ingester specific)
 	ConstructorName string               // Named constructor for this ingester; must have been registered.
 	//    If not provided, ConstructorName will default to the dataset name
+	Branches []string // Additional branches that are ingested into their own datasets, see pconfig.BranchDataset.
 }
 
 type IngestConfig struct {
@@ -138,8 +140,14 @@ func main() {
 
 	// Initialize the ingester and gold ingester.
 	ingester.Init(client)
-	if _, ok := config.Ingesters["gold"]; ok {
-		if err := goldingester.Init(client, filepath.Join(config.Ingesters["gold"].StatusDir, "android-build-info")); err != nil {
+	var metadataStore digestmeta.MetadataStore
+	if goldConfig, ok := config.Ingesters["gold"]; ok {
+		if metadataDir := goldConfig.ExtraParams[goldingester.METADATA_DIR_PARAM]; metadataDir != "" {
+			if metadataStore, err = digestmeta.NewFileMetadataStore(metadataDir); err != nil {
+				glog.Fatalf("Unable to create digest metadata store: %s", err)
+			}
+		}
+		if err := goldingester.Init(client, filepath.Join(goldConfig.StatusDir, "android-build-info"), metadataStore); err != nil {
 			glog.Fatalf("Unable to initialize GoldIngester: %s", err)
 		}
 	}
@@ -159,13 +167,25 @@ func main() {
 		}
 
 		constructor := ingester.Constructor(constructorName)
-		resultIngester := constructor()
+
+		// Gold ingesters can be configured with a chain of pre-ingestion hooks
+		// that replaces the default hook of the constructor.
+		if hookNames, ok := ingesterConfig.ExtraParams[goldingester.HOOKS_PARAM]; ok {
+			if (constructorName != pconfig.CONSTRUCTOR_GOLD) && (constructorName != pconfig.CONSTRUCTOR_ANDROID_GOLD) {
+				glog.Fatalf("Pre-ingestion hooks are only supported by gold ingesters, not by %s of %s.", constructorName, dataset)
+			}
+			hook, err := goldingester.NewHookChain(hookNames, ingesterConfig.ExtraParams)
+			if err != nil {
+				glog.Fatalf("Unable to configure pre-ingestion hooks for %s: %s", dataset, err)
+			}
+			constructor = func() ingester.ResultIngester { return goldingester.NewGoldIngester(hook, metadataStore) }
+		}
 
 		glog.Infof("Process name: %s", dataset)
 		startProcess := NewIngestionProcess(git,
 			config.Common.TileDir,
 			dataset,
-			resultIngester,
+			constructor(),
 			ingesterConfig.ExtraParams["GSBucket"],
 			ingesterConfig.ExtraParams["GSDir"],
 			ingesterConfig.RunEvery.Duration,
@@ -174,6 +194,29 @@ func main() {
 			ingesterConfig.StatusDir,
 			ingesterConfig.MetricName)
 		startProcess()
+
+		// Every additional branch is ingested into its own dataset. Results
+		// for commits that are not on the branch are ignored.
+		for _, branch := range ingesterConfig.Branches {
+			branchGit, err := gitinfo.NewBranchGitInfo(config.Common.GitRepoDir, false, branch)
+			if err != nil {
+				glog.Fatalf("Failed loading Git info for branch %s: %s\n", branch, err)
+			}
+			branchDataset := pconfig.BranchDataset(dataset, branch)
+			glog.Infof("Process name: %s", branchDataset)
+			startProcess := NewIngestionProcess(branchGit,
+				config.Common.TileDir,
+				branchDataset,
+				constructor(),
+				ingesterConfig.ExtraParams["GSBucket"],
+				ingesterConfig.ExtraParams["GSDir"],
+				ingesterConfig.RunEvery.Duration,
+				ingesterConfig.NCommits,
+				minDuration,
+				ingesterConfig.StatusDir,
+				pconfig.BranchDataset(ingesterConfig.MetricName, branch))
+			startProcess()
+		}
 	}
 
 	select {}
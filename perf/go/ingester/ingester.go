@@ -24,6 +24,7 @@ import (
 	"go.skia.org/infra/go/util"
 	"go.skia.org/infra/perf/go/config"
 	"go.skia.org/infra/perf/go/filetilestore"
+	"go.skia.org/infra/perf/go/provenance"
 	"go.skia.org/infra/perf/go/types"
 )
 
@@ -100,6 +101,43 @@ type ResultIngester interface {
 	BatchFinished(counter metrics.Counter) error
 }
 
+// FailedFilesError can be returned by ResultIngester.BatchFinished if only
+// some files of the batch failed to ingest. Files are their names as passed
+// to Ingest. Only they are ingested again by the next run, all other files
+// of the batch count as processed.
+type FailedFilesError struct {
+	Files []string
+	Err   error
+}
+
+func (e *FailedFilesError) Error() string {
+	return fmt.Sprintf("Failed to ingest %d files: %s", len(e.Files), e.Err)
+}
+
+// processedAfterBatch returns the MD5 hashes of the files that count as
+// processed after ResultIngester.BatchFinished returned err. names and
+// md5Hashes are the names and hashes of the files of the batch.
+func processedAfterBatch(names, md5Hashes []string, err error) []string {
+	if err == nil {
+		return md5Hashes
+	}
+	failedErr, ok := err.(*FailedFilesError)
+	if !ok {
+		return []string{}
+	}
+	failed := map[string]bool{}
+	for _, name := range failedErr.Files {
+		failed[name] = true
+	}
+	ret := make([]string, 0, len(md5Hashes))
+	for idx, name := range names {
+		if !failed[name] {
+			ret = append(ret, md5Hashes[idx])
+		}
+	}
+	return ret
+}
+
 // Ingester does the work of loading JSON files from Google Storage and putting
 // the data into the TileStore. The time range it ingests is controlled by
 // minDuration and nCommits. It aims to cover all commits within minDuration
@@ -205,6 +243,15 @@ type TileTracker struct {
 	currentTile  *types.Tile
 	tileStore    types.TileStore
 	hashToNumber map[string]int
+
+	// source and buildNumber describe the file that is currently being
+	// ingested. See SetSource().
+	source      string
+	buildNumber string
+
+	// provenance contains the entries recorded since the last call to
+	// FlushProvenance().
+	provenance []*provenance.Entry
 }
 
 func NewTileTracker(tileStore types.TileStore, hashToNumber map[string]int) *TileTracker {
@@ -257,6 +304,36 @@ func (tt TileTracker) Flush() {
 	}
 }
 
+// SetSource sets the location and the build number of the file that is
+// ingested next. The build number is derived from the location and can be
+// overridden by the ingester in AddProvenance().
+func (tt *TileTracker) SetSource(source string) {
+	tt.source = source
+	tt.buildNumber = provenance.BuildNumberFromPath(source)
+}
+
+// AddProvenance records that the value of the given trace at the given
+// commit was read from the current source. buildNumber may be empty, in
+// which case the build number is taken from the location of the source.
+func (tt *TileTracker) AddProvenance(traceID, hash, buildNumber string) {
+	if buildNumber == "" {
+		buildNumber = tt.buildNumber
+	}
+	tt.provenance = append(tt.provenance, &provenance.Entry{
+		TraceID:     traceID,
+		CommitHash:  hash,
+		Source:      tt.source,
+		BuildNumber: buildNumber,
+	})
+}
+
+// FlushProvenance writes the recorded provenance entries to the database.
+func (tt *TileTracker) FlushProvenance() error {
+	entries := tt.provenance
+	tt.provenance = nil
+	return provenance.Write(entries)
+}
+
 // Tile returns the current Tile.
 func (tt TileTracker) Tile() *types.Tile {
 	return tt.currentTile
@@ -375,6 +452,7 @@ func (i *Ingester) UpdateTiles() error {
 
 	glog.Infof("Ingest %s: Found %d resultsFiles", i.datasetName, len(resultsFiles))
 
+	processedNames := make([]string, 0, len(resultsFiles))
 	processedMD5s := make([]string, 0, len(resultsFiles))
 	for _, resultLocation := range resultsFiles {
 		if !i.inProcessedFiles(resultLocation.MD5Hash) {
@@ -386,11 +464,16 @@ func (i *Ingester) UpdateTiles() error {
 				return r, nil
 			}
 
+			tt.SetSource(provenance.GSSource(i.storageBucket, resultLocation.Name))
 			if err := i.resultIngester.Ingest(tt, opener, resultLocation.Name, i.metricsProcessed); err != nil {
 				glog.Errorf("Failed to ingest %s: %s", resultLocation.Name, err)
 				continue
 			}
+			if err := tt.FlushProvenance(); err != nil {
+				glog.Errorf("Failed to record provenance of %s: %s", resultLocation.Name, err)
+			}
 			// Gather all successfully processed MD5s
+			processedNames = append(processedNames, resultLocation.Name)
 			processedMD5s = append(processedMD5s, resultLocation.MD5Hash)
 		} else {
 			glog.Infof("Skipped duplicate: %s (%s)", resultLocation.Name, resultLocation.MD5Hash)
@@ -399,11 +482,11 @@ func (i *Ingester) UpdateTiles() error {
 
 	// Notify the ingester that the batch has finished and cause it to reset its
 	// state and do any pending ingestion.
-	if err := i.resultIngester.BatchFinished(i.metricsProcessed); err != nil {
+	err = i.resultIngester.BatchFinished(i.metricsProcessed)
+	if err != nil {
 		glog.Errorf("Batchfinished failed (%s): %s", i.datasetName, err)
-	} else {
-		i.addToProcessedFiles(processedMD5s)
 	}
+	i.addToProcessedFiles(processedAfterBatch(processedNames, processedMD5s, err))
 
 	tt.Flush()
 
@@ -433,7 +516,8 @@ func (i *Ingester) addToProcessedFiles(md5Hashes []string) {
 		return
 	}
 
-	// Only consider the files ingested if Batchfinished succeeded.
+	// Only files that BatchFinished did not fail are passed in, see
+	// processedAfterBatch.
 	batch := &leveldb.Batch{}
 	for _, h := range md5Hashes {
 		batch.Put([]byte(h), []byte{})
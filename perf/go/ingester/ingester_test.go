@@ -1,6 +1,7 @@
 package ingester
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -141,7 +142,10 @@ func TestAddBenchDataToTile(t *testing.T) {
 	// Do everything twice to ensure that we are idempotent.
 	for i := 0; i < 2; i++ {
 		// Add the BenchData to the Tile.
-		addBenchDataToTile(benchData, tile, offset, metricsProcessed)
+		keys := addBenchDataToTile(benchData, tile, offset, metricsProcessed)
+		if got, want := len(keys), 13; got != want {
+			t.Errorf("Wrong number of keys returned: Got %d Want %d", got, want)
+		}
 
 		// Test that the Tile has the right data.
 		if got, want := len(tile.Traces), 13; got != want {
@@ -223,6 +227,32 @@ func TestAddBenchDataToTile(t *testing.T) {
 	}
 }
 
+func TestBenchDataSnippet(t *testing.T) {
+	_, filename, _, _ := runtime.Caller(0)
+	open := func() *os.File {
+		r, err := os.Open(filepath.Join(filepath.Dir(filename), "testdata", "nano.json"))
+		assert.Nil(t, err)
+		return r
+	}
+
+	b, err := BenchDataSnippet(open(), "x86:GTX660:ShuttleA:Ubuntu12:memory_usage_0_0:meta:max_rss_mb")
+	assert.Nil(t, err)
+	snippet, err := ParseBenchDataFromReader(ioutil.NopCloser(strings.NewReader(string(b))))
+	assert.Nil(t, err)
+	assert.Equal(t, "fe4a4029a080bc955e9588d05a6cd9eb490845d4", snippet.Hash)
+	assert.Equal(t, "UNIX", snippet.Options["system"])
+	assert.Equal(t, 1, len(snippet.Results))
+	assert.Equal(t, float64(858), (*(*snippet.Results["memory_usage_0_0"])["meta"])["max_rss_mb"])
+
+	b, err = BenchDataSnippet(open(), "x86:GTX660:ShuttleA:Ubuntu12:DeferredSurfaceCopy_discardable_640_480:gpu")
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(b), "GeForce GTX 660/PCIe/SSE2"))
+	assert.False(t, strings.Contains(string(b), "ChunkAlloc_Push_640_480"))
+
+	_, err = BenchDataSnippet(open(), "x86:GTX660:ShuttleA:Ubuntu12:DeferredSurfaceCopy_discardable_640_480:unknown")
+	assert.NotNil(t, err)
+}
+
 func TestGetResultFileLocations(t *testing.T) {
 	testutils.SkipIfShort(t)
 	storage, err := storage.New(http.DefaultClient)
@@ -250,3 +280,11 @@ func TestGetResultFileLocations(t *testing.T) {
 	assert.Equal(t, len(lines), len(resultNames))
 	assert.Equal(t, lines, resultNames)
 }
+
+func TestProcessedAfterBatch(t *testing.T) {
+	names := []string{"a.json", "b.json", "c.json"}
+	md5Hashes := []string{"aaa", "bbb", "ccc"}
+	assert.Equal(t, md5Hashes, processedAfterBatch(names, md5Hashes, nil))
+	assert.Equal(t, []string{}, processedAfterBatch(names, md5Hashes, fmt.Errorf("Failed")))
+	assert.Equal(t, []string{"aaa", "ccc"}, processedAfterBatch(names, md5Hashes, &FailedFilesError{Files: []string{"b.json"}, Err: fmt.Errorf("Failed")}))
+}
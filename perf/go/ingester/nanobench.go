@@ -213,10 +213,48 @@ func ParseBenchDataFromReader(r io.ReadCloser) (*BenchData, error) {
 	return benchData, nil
 }
 
-// addBenchDataToTile adds BenchData to a Tile.
+// rawBenchData is used to decode the nanobench JSON format without losing
+// the original representation of the results.
+type rawBenchData struct {
+	Hash    string                                `json:"gitHash"`
+	Key     map[string]string                     `json:"key"`
+	Options map[string]string                     `json:"options"`
+	Results map[string]map[string]json.RawMessage `json:"results"`
+}
+
+// BenchDataSnippet returns the part of the nanobench JSON file in r that
+// produced the trace with the given key. The snippet has the same format as
+// the file, but only contains the one result the trace was built from. The
+// reader is closed.
+func BenchDataSnippet(r io.ReadCloser, traceKey string) ([]byte, error) {
+	defer util.Close(r)
+
+	raw := &rawBenchData{}
+	if err := json.NewDecoder(r).Decode(raw); err != nil {
+		return nil, fmt.Errorf("Failed to decode JSON: %s", err)
+	}
+	keyPrefix := BenchData{Key: raw.Key}.KeyPrefix()
+	for testName, allConfigs := range raw.Results {
+		for configName, result := range allConfigs {
+			key := fmt.Sprintf("%s:%s:%s", keyPrefix, testName, configName)
+			if traceKey != key && !strings.HasPrefix(traceKey, key+":") {
+				continue
+			}
+			raw.Results = map[string]map[string]json.RawMessage{
+				testName: {configName: result},
+			}
+			return json.MarshalIndent(raw, "", "  ")
+		}
+	}
+	return nil, fmt.Errorf("Trace %s not found.", traceKey)
+}
+
+// addBenchDataToTile adds BenchData to a Tile and returns the keys of all
+// Traces that were written.
 //
 // See the description at the top of this file for how the mapping works.
-func addBenchDataToTile(benchData *BenchData, tile *types.Tile, offset int, counter metrics.Counter) {
+func addBenchDataToTile(benchData *BenchData, tile *types.Tile, offset int, counter metrics.Counter) []string {
+	keys := []string{}
 
 	// cb is the anonymous closure we'll pass over all the trace values found in benchData.
 	cb := func(key string, value float64, params map[string]string) {
@@ -234,6 +272,7 @@ func addBenchDataToTile(benchData *BenchData, tile *types.Tile, offset int, coun
 		}
 		trace.Params_ = params
 		trace.Values[offset] = value
+		keys = append(keys, key)
 		counter.Inc(1)
 
 		if needsUpdate {
@@ -252,6 +291,7 @@ func addBenchDataToTile(benchData *BenchData, tile *types.Tile, offset int, coun
 	}
 
 	benchData.ForEach(cb)
+	return keys
 }
 
 // NanoBenchIngester implements the ingester.ResultIngester interface.
@@ -288,7 +328,9 @@ func (i NanoBenchIngester) Ingest(tt *TileTracker, opener Opener, fname string,
 	}
 
 	// Add the parsed data to the Tile.
-	addBenchDataToTile(benchData, tt.Tile(), tt.Offset(hash), counter)
+	for _, key := range addBenchDataToTile(benchData, tt.Tile(), tt.Offset(hash), counter) {
+		tt.AddProvenance(key, hash, "")
+	}
 	return nil
 }
 
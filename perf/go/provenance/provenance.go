@@ -0,0 +1,185 @@
+// provenance records which results file produced each value in a Tile.
+//
+// The ingesters record an Entry for every value they add to a Tile. The
+// entries are stored in two tables to keep the index compact. The
+// provenance_sources table has one row per ingested file with its location
+// and the build number of the bot run that produced it. The provenance table
+// has one row per (trace, commit) pointing to a row in provenance_sources.
+// Trace ids can be very long, so only their MD5 hash is stored.
+//
+// Re-ingesting a value for the same trace and commit overwrites the previous
+// entry, i.e. the index always points to the file that produced the value
+// currently stored in the Tile.
+package provenance
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"go.skia.org/infra/go/gs"
+	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/perf/go/db"
+)
+
+const (
+	// GS_PREFIX is the prefix of sources that are stored in Google Storage.
+	GS_PREFIX = "gs://"
+
+	// GS_MEDIA_URL_TEMPLATE is used to download objects from Google Storage.
+	// The arguments are the bucket and the escaped object name.
+	GS_MEDIA_URL_TEMPLATE = "https://www.googleapis.com/storage/v1/b/%s/o/%s?alt=media"
+
+	// WRITE_BATCH_SIZE is the maximum number of rows written by a single
+	// statement.
+	WRITE_BATCH_SIZE = 1000
+)
+
+var (
+	// buildNumberRegex matches the builder and build number directories that
+	// bots add after the hour directory, e.g.
+	//
+	//   dm-json-v1/2015/05/14/13/Test-Ubuntu-GCC-Release/2045/dm.json
+	//
+	// Files directly in the hour directory have no build number.
+	buildNumberRegex = regexp.MustCompile(`/\d{4}/\d{2}/\d{2}/\d{2}/[^/]+/(\d+)/[^/]+$`)
+)
+
+// Entry links a single value in a trace to the file it was ingested from.
+type Entry struct {
+	TraceID     string `json:"traceID"`
+	CommitHash  string `json:"commitHash"`
+	Source      string `json:"source"`
+	BuildNumber string `json:"buildNumber"`
+}
+
+// GSSource returns the source string of an object in Google Storage.
+func GSSource(bucket, name string) string {
+	return GS_PREFIX + bucket + "/" + name
+}
+
+// BuildNumberFromPath extracts the build number from the path of a results
+// file. It returns "" if the path does not contain a build number.
+func BuildNumberFromPath(path string) string {
+	if match := buildNumberRegex.FindStringSubmatch(path); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// traceHash returns the hash of the trace id that is used as a key.
+func traceHash(traceID string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(traceID)))
+}
+
+// Write stores the given entries. Existing entries for the same trace id and
+// commit are replaced.
+func Write(entries []*Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if db.DB == nil {
+		return fmt.Errorf("Database is not initialized.")
+	}
+
+	// Look up or create the id of every source.
+	sourceIDs := map[string]int64{}
+	for _, e := range entries {
+		if _, ok := sourceIDs[e.Source]; ok {
+			continue
+		}
+		res, err := db.DB.Exec("INSERT INTO provenance_sources (sourceHash, source, buildNumber) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE id=LAST_INSERT_ID(id), buildNumber=VALUES(buildNumber)", traceHash(e.Source), e.Source, e.BuildNumber)
+		if err != nil {
+			return fmt.Errorf("Failed to write provenance source %s: %s", e.Source, err)
+		}
+		if sourceIDs[e.Source], err = res.LastInsertId(); err != nil {
+			return fmt.Errorf("Failed to retrieve id of provenance source %s: %s", e.Source, err)
+		}
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("Unable to start transaction: %s", err)
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				err = fmt.Errorf("%s. Rollback failed: %s", err, rbErr)
+			}
+		}
+	}()
+
+	for start := 0; start < len(entries); start += WRITE_BATCH_SIZE {
+		batch := entries[start:util.MinInt(start+WRITE_BATCH_SIZE, len(entries))]
+		placeholders := make([]string, 0, len(batch))
+		vals := make([]interface{}, 0, 3*len(batch))
+		for _, e := range batch {
+			placeholders = append(placeholders, "(?, ?, ?)")
+			vals = append(vals, traceHash(e.TraceID), e.CommitHash, sourceIDs[e.Source])
+		}
+		stmt := "REPLACE INTO provenance (traceHash, commitHash, sourceID) VALUES " + strings.Join(placeholders, ",")
+		if _, err = tx.Exec(stmt, vals...); err != nil {
+			return fmt.Errorf("Failed to write provenance: %s", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("Failed to commit provenance: %s", err)
+	}
+	return nil
+}
+
+// Get returns the entry for the given trace id and commit. It returns nil
+// if no entry has been recorded.
+func Get(traceID, commitHash string) (*Entry, error) {
+	if db.DB == nil {
+		return nil, fmt.Errorf("Database is not initialized.")
+	}
+	ret := &Entry{
+		TraceID:    traceID,
+		CommitHash: commitHash,
+	}
+	err := db.DB.QueryRow("SELECT s.source, s.buildNumber FROM provenance AS p JOIN provenance_sources AS s ON p.sourceID=s.id WHERE p.traceHash=? AND p.commitHash=?", traceHash(traceID), commitHash).Scan(&ret.Source, &ret.BuildNumber)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load provenance for %s at %s: %s", traceID, commitHash, err)
+	}
+	return ret, nil
+}
+
+// Open returns the content of the given source. Sources in Google Storage are
+// downloaded with the given client, all other sources are treated as local
+// files.
+//
+// Callers must call Close() on the returned io.ReadCloser.
+func Open(client *http.Client, source string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(source, GS_PREFIX) {
+		return os.Open(source)
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(source, GS_PREFIX), "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid source: %s", source)
+	}
+	request, err := gs.RequestForStorageURL(fmt.Sprintf(GS_MEDIA_URL_TEMPLATE, parts[0], url.QueryEscape(parts[1])))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to retrieve %s: %s", source, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		util.Close(resp.Body)
+		return nil, fmt.Errorf("Failed to retrieve %s: %s", source, resp.Status)
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,28 @@
+package provenance
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestBuildNumberFromPath(t *testing.T) {
+	assert.Equal(t, "2045", BuildNumberFromPath("gs://skia-infra-gm/dm-json-v1/2015/05/14/13/Test-Ubuntu-GCC-Release/2045/dm.json"))
+	assert.Equal(t, "2045", BuildNumberFromPath("dm-json-v1/2015/05/14/13/Test-Ubuntu-GCC-Release/2045/dm.json"))
+	assert.Equal(t, "", BuildNumberFromPath("nano-json-v1/2014/08/07/01/Perf-Ubuntu-Release/nanobench_da7a94_1407357280.json"))
+	assert.Equal(t, "", BuildNumberFromPath("dm.json"))
+
+	// The hour is not a build number.
+	assert.Equal(t, "", BuildNumberFromPath("dm-json-v1/2015/05/14/13/dm.json"))
+	assert.Equal(t, "", BuildNumberFromPath("gs://skia-infra-gm/dm-json-v1/2015/05/14/13/dm.json"))
+	assert.Equal(t, "", BuildNumberFromPath("dm-json-v1/2015/05/14/13/Test-Ubuntu-GCC-Release/dm.json"))
+}
+
+func TestGSSource(t *testing.T) {
+	assert.Equal(t, "gs://chromium-skia-gm/nano-json-v1/nanobench.json", GSSource("chromium-skia-gm", "nano-json-v1/nanobench.json"))
+}
+
+func TestTraceHash(t *testing.T) {
+	assert.Equal(t, 32, len(traceHash("x86:GTX660:ShuttleA:Ubuntu12:memory_usage_0_0:meta:max_rss_mb")))
+	assert.NotEqual(t, traceHash("a"), traceHash("b"))
+}
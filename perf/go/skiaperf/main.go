@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -31,7 +32,9 @@ import (
 	"go.skia.org/infra/perf/go/config"
 	"go.skia.org/infra/perf/go/db"
 	"go.skia.org/infra/perf/go/filetilestore"
+	"go.skia.org/infra/perf/go/ingester"
 	"go.skia.org/infra/perf/go/parser"
+	"go.skia.org/infra/perf/go/provenance"
 	"go.skia.org/infra/perf/go/shortcut"
 	"go.skia.org/infra/perf/go/stats"
 	"go.skia.org/infra/perf/go/trybot"
@@ -67,11 +70,17 @@ var (
 	// The optional capture group is a githash.
 	singleHandlerPath = regexp.MustCompile(`/single/([0-9a-f]+)?$`)
 
+	// The capture group is a githash.
+	provenanceHandlerPath = regexp.MustCompile(`/single/provenance/([0-9a-f]+)$`)
+
 	// The three capture groups are tile scale, tile number, and an optional 'trace.
 	queryHandlerPath = regexp.MustCompile(`/query/([0-9]*)/([-0-9]*)/(traces/)?$`)
 
 	clHandlerPath = regexp.MustCompile(`/cl/([0-9]*)$`)
 
+	// The optional capture group is a Rietveld issue id.
+	trybotHandlerPath = regexp.MustCompile(`/trybots/([0-9]*)$`)
+
 	activityHandlerPath = regexp.MustCompile(`/activitylog/([0-9]*)$`)
 
 	git *gitinfo.GitInfo = nil
@@ -89,10 +98,32 @@ var (
 	apikey         = flag.String("apikey", "", "The API Key used to make issue tracker requests. Only for local testing.")
 	gitRepoURL     = flag.String("git_repo_url", "https://skia.googlesource.com/skia", "The URL to pass to git clone for the source repository.")
 	resourcesDir   = flag.String("resources_dir", "", "The directory to find templates, JS, and CSS files. If blank the current directory will be used.")
+	branches       = flag.String("branches", "", "Comma separated list of additional branches that have been ingested into their own datasets.")
+	trybotMaxAge   = flag.Duration("trybot_max_age", 90*24*time.Hour, "Trybot results that haven't been updated for this long are removed. Zero keeps them forever.")
+)
+
+const (
+	// BRANCH_PARAM is the query parameter that selects the branch whose tiles
+	// are used to answer a request. If it is missing the master branch is used.
+	BRANCH_PARAM = "_branch"
+
+	// BRANCH_UPDATE_PERIOD is how often the history of the branches is
+	// refreshed.
+	BRANCH_UPDATE_PERIOD = time.Minute
 )
 
 var (
 	nanoTileStore types.TileStore
+
+	// branchTileStores and branchGits contain the tiles and the commit history
+	// of the additional branches, keyed by branch name.
+	branchTileStores = map[string]types.TileStore{}
+	branchGits       = map[string]*gitinfo.GitInfo{}
+
+	// provenanceClient is used to download the source files of ingested values.
+	provenanceClient = &http.Client{
+		Transport: util.NewBackOffTransport(),
+	}
 )
 
 func Init() {
@@ -145,6 +176,60 @@ func Init() {
 	if err != nil {
 		glog.Fatal(err)
 	}
+
+	for _, branch := range strings.Split(*branches, ",") {
+		branch = strings.TrimSpace(branch)
+		if branch == "" || branch == config.MASTER_BRANCH {
+			continue
+		}
+		branchTileStores[branch] = filetilestore.NewFileTileStore(*tileStoreDir, config.BranchDataset(config.DATASET_NANO, branch), 2*time.Minute)
+		if branchGits[branch], err = gitinfo.NewBranchGitInfo(*gitRepoDir, false, branch); err != nil {
+			glog.Fatalf("Failed loading Git info for branch %s: %s", branch, err)
+		}
+	}
+	if len(branchGits) > 0 {
+		go updateBranchGits()
+	}
+}
+
+// updateBranchGits periodically fetches the branches in branchGits and
+// refreshes their history. The GitInfos share one repo and are updated one at
+// a time.
+func updateBranchGits() {
+	for _ = range time.Tick(BRANCH_UPDATE_PERIOD) {
+		for branch, branchGit := range branchGits {
+			if err := branchGit.Update(true, false); err != nil {
+				glog.Errorf("Failed to update Git info for branch %s: %s", branch, err)
+			}
+		}
+	}
+}
+
+// branchFromRequest returns the TileStore and the GitInfo of the branch
+// selected by the BRANCH_PARAM query parameter. The parameter is removed from
+// r.Form so that it isn't used to match traces.
+func branchFromRequest(r *http.Request) (types.TileStore, *gitinfo.GitInfo, error) {
+	branch := r.FormValue(BRANCH_PARAM)
+	delete(r.Form, BRANCH_PARAM)
+	if branch == "" || branch == config.MASTER_BRANCH {
+		return nanoTileStore, git, nil
+	}
+	tileStore, ok := branchTileStores[branch]
+	if !ok {
+		return nil, nil, fmt.Errorf("Unknown branch: %s", branch)
+	}
+	return tileStore, branchGits[branch], nil
+}
+
+// allBranches returns the names of all branches that can be selected with
+// BRANCH_PARAM.
+func allBranches() []string {
+	ret := []string{config.MASTER_BRANCH}
+	for branch := range branchTileStores {
+		ret = append(ret, branch)
+	}
+	sort.Strings(ret[1:])
+	return ret
 }
 
 // showcutHandler handles the POST requests of the shortcut page.
@@ -194,16 +279,69 @@ func shortcutHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // trybotHandler handles the GET for trybot data.
+//
+// If an issue is appended to the path, i.e. /trybots/<issue>, the metadata of
+// that issue and all of its patchsets is returned. Otherwise the most recently
+// updated issues are listed. The list can be filtered with the following
+// query parameters:
+//
+//   owner - The email address of the issue owner.
+//   begin - Only list issues updated at or after this Unix timestamp.
+//   end   - Only list issues updated before this Unix timestamp.
+//   n     - The maximum number of issues to return. Defaults to 50.
+//
 func trybotHandler(w http.ResponseWriter, r *http.Request) {
 	glog.Infof("Trybot Handler: %q\n", r.URL.Path)
-	w.Header().Set("Content-Type", "application/json")
-	try, err := trybot.List(50)
-	if err != nil {
-		util.ReportError(w, r, err, "Failed to retrieve trybot results.")
+	match := trybotHandlerPath.FindStringSubmatch(r.URL.Path)
+	if r.Method != "GET" || match == nil || len(match) != 2 {
+		http.NotFound(w, r)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	var ret interface{}
+	if match[1] != "" {
+		info, err := trybot.GetIssue(match[1])
+		if err != nil {
+			util.ReportError(w, r, err, "Failed to retrieve trybot issue.")
+			return
+		}
+		if info == nil {
+			http.NotFound(w, r)
+			return
+		}
+		ret = info
+	} else {
+		q := &trybot.ListQuery{
+			Owner: r.FormValue("owner"),
+			N:     50,
+		}
+		for param, dst := range map[string]*time.Time{"begin": &q.Begin, "end": &q.End} {
+			if v := r.FormValue(param); v != "" {
+				ts, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					util.ReportError(w, r, err, fmt.Sprintf("%s parameter must be a Unix timestamp.", param))
+					return
+				}
+				*dst = time.Unix(ts, 0)
+			}
+		}
+		if v := r.FormValue("n"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				util.ReportError(w, r, err, "n parameter must be an integer.")
+				return
+			}
+			q.N = n
+		}
+		issues, err := trybot.List(q)
+		if err != nil {
+			util.ReportError(w, r, err, "Failed to retrieve trybot results.")
+			return
+		}
+		ret = issues
+	}
 	enc := json.NewEncoder(w)
-	if err = enc.Encode(try); err != nil {
+	if err := enc.Encode(ret); err != nil {
 		util.ReportError(w, r, err, "Error while encoding response.")
 	}
 }
@@ -382,12 +520,18 @@ func writeClusterSummaries(summary *clustering.ClusterSummaries, w http.Response
 //   _stddev - The standard deviation to use when normalize traces
 //             during k-means clustering.
 //   _issue  - The Rietveld issue ID with trybot results to include.
+//   _patchset - The patchset of the issue. Defaults to the most recent one.
 //
 // Additionally the rest of the query parameters as returned from
 // sk.Query.selectionsAsQuery().
 func clusteringHandler(w http.ResponseWriter, r *http.Request) {
 	glog.Infof("Clustering Handler: %q\n", r.URL.Path)
-	tile, err := nanoTileStore.Get(0, -1)
+	tileStore, _, err := branchFromRequest(r)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to select branch.")
+		return
+	}
+	tile, err := tileStore.Get(0, -1)
 	if err != nil {
 		util.ReportError(w, r, err, fmt.Sprintf("Failed to load tile."))
 		return
@@ -411,10 +555,17 @@ func clusteringHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	issue := r.FormValue("_issue")
+	patchset := int64(trybot.LATEST_PATCHSET)
+	if r.FormValue("_patchset") != "" {
+		if patchset, err = strconv.ParseInt(r.FormValue("_patchset"), 10, 64); err != nil {
+			util.ReportError(w, r, err, fmt.Sprintf("_patchset parameter must be an integer %s.", r.FormValue("_patchset")))
+			return
+		}
+	}
 	var tryResults *types.TryBotResults = nil
 	if issue != "" {
 		var err error
-		tryResults, err = trybot.Get(issue)
+		tryResults, err = trybot.Get(issue, patchset)
 		if err != nil {
 			util.ReportError(w, r, err, fmt.Sprintf("Failed to get trybot data for clustering."))
 			return
@@ -424,6 +575,7 @@ func clusteringHandler(w http.ResponseWriter, r *http.Request) {
 	delete(r.Form, "_k")
 	delete(r.Form, "_stddev")
 	delete(r.Form, "_issue")
+	delete(r.Form, "_patchset")
 
 	// Create a filter function for traces that match the query parameters and
 	// optionally tryResults.
@@ -437,7 +589,7 @@ func clusteringHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if issue != "" {
-		if tile, err = trybot.TileWithTryData(tile, issue); err != nil {
+		if tile, err = trybot.TileWithTryData(tile, issue, patchset); err != nil {
 			util.ReportError(w, r, err, fmt.Sprintf("Failed to get trybot data for clustering."))
 			return
 		}
@@ -451,9 +603,9 @@ func clusteringHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // getTile retrieves a tile from the disk
-func getTile(tileScale, tileNumber int) (*types.Tile, error) {
+func getTile(tileStore types.TileStore, tileScale, tileNumber int) (*types.Tile, error) {
 	start := time.Now()
-	tile, err := nanoTileStore.Get(int(tileScale), int(tileNumber))
+	tile, err := tileStore.Get(int(tileScale), int(tileNumber))
 	glog.Infoln("Time for tile load: ", time.Since(start).Nanoseconds())
 	if err != nil || tile == nil {
 		return nil, fmt.Errorf("Unable to get tile from tilestore: %s", err)
@@ -512,7 +664,12 @@ func tileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	glog.Infof("tile: %d %d", tileScale, tileNumber)
-	tile, err := getTile(int(tileScale), int(tileNumber))
+	tileStore, branchGit, err := branchFromRequest(r)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to select branch.")
+		return
+	}
+	tile, err := getTile(tileStore, int(tileScale), int(tileNumber))
 	if err != nil {
 		util.ReportError(w, r, err, "Failed retrieving tile.")
 		return
@@ -521,9 +678,10 @@ func tileHandler(w http.ResponseWriter, r *http.Request) {
 	guiTile := types.NewTileGUI(tile.Scale, tile.TileIndex)
 	guiTile.Commits = tile.Commits
 	guiTile.ParamSet = tile.ParamSet
+	guiTile.Branches = allBranches()
 	// SkpCommits goes out to the git repo, add caching if this turns out to be
 	// slow.
-	if skps, err := git.SkpCommits(tile); err != nil {
+	if skps, err := branchGit.SkpCommits(tile); err != nil {
 		guiTile.Skps = []int{}
 		glog.Errorf("Failed to calculate skps: %s", err)
 	} else {
@@ -651,7 +809,12 @@ func queryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	glog.Infof("tile: %d %d", tileScale, tileNumber)
-	tile, err := getTile(int(tileScale), int(tileNumber))
+	tileStore, _, err := branchFromRequest(r)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to select branch.")
+		return
+	}
+	tile, err := getTile(tileStore, int(tileScale), int(tileNumber))
 	if err != nil {
 		util.ReportError(w, r, err, "Failed retrieving tile.")
 		return
@@ -685,7 +848,7 @@ func queryHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			if sh.Issue != "" {
-				if tile, err = trybot.TileWithTryData(tile, sh.Issue); err != nil {
+				if tile, err = trybot.TileWithTryData(tile, sh.Issue, trybot.LATEST_PATCHSET); err != nil {
 					util.ReportError(w, r, err, "Failed to populate shortcut data with trybot result.")
 					return
 				}
@@ -767,14 +930,19 @@ func singleHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	hash := match[1]
 
-	tileNum, idx, err := git.TileAddressFromHash(hash, time.Time(config.BEGINNING_OF_TIME))
+	tileStore, branchGit, err := branchFromRequest(r)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to select branch.")
+		return
+	}
+	tileNum, idx, err := branchGit.TileAddressFromHash(hash, time.Time(config.BEGINNING_OF_TIME))
 	if err != nil {
 		glog.Infof("Did not find hash '%s', use latest: %q.\n", hash, err)
 		tileNum = -1
 		idx = -1
 	}
 	glog.Infof("Hash: %s tileNum: %d, idx: %d\n", hash, tileNum, idx)
-	tile, err := getTile(0, tileNum)
+	tile, err := getTile(tileStore, 0, tileNum)
 	if err != nil {
 		util.ReportError(w, r, err, "Failed retrieving tile.")
 		return
@@ -811,6 +979,72 @@ func singleHandler(w http.ResponseWriter, r *http.Request) {
 	glog.Infoln("Total handler time: ", time.Since(handlerStart).Nanoseconds())
 }
 
+// ProvenanceResponse is for formatting the JSON output from provenanceHandler.
+type ProvenanceResponse struct {
+	*provenance.Entry
+	Snippet json.RawMessage `json:"snippet"`
+}
+
+// provenanceHandler returns where the value of a single trace at the given
+// commit was ingested from, along with the part of the source file that
+// contains the value. The trace is selected with the 'id' query parameter,
+// i.e. /single/provenance/<githash>?id=<trace id>. The resulting JSON is in
+// ProvenanceResponse format that looks like:
+//
+//  {
+//    "traceID": "x86:GTX660:ShuttleA:Ubuntu12:...",
+//    "commitHash": "abc123",
+//    "source": "gs://chromium-skia-gm/nano-json-v1/.../nanobench_abc123_1407357280.json",
+//    "buildNumber": "",
+//    "snippet": {
+//      "gitHash": "abc123",
+//      "key": {...},
+//      "options": {...},
+//      "results": {...}
+//    }
+//  }
+//
+func provenanceHandler(w http.ResponseWriter, r *http.Request) {
+	glog.Infof("Provenance Handler: %q\n", r.URL.Path)
+	match := provenanceHandlerPath.FindStringSubmatch(r.URL.Path)
+	if r.Method != "GET" || match == nil || len(match) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	hash := match[1]
+	traceID := r.FormValue("id")
+	if traceID == "" {
+		util.ReportError(w, r, fmt.Errorf("Missing trace id."), "A trace id is required.")
+		return
+	}
+
+	entry, err := provenance.Get(traceID, hash)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to load provenance.")
+		return
+	}
+	if entry == nil {
+		http.NotFound(w, r)
+		return
+	}
+	source, err := provenance.Open(provenanceClient, entry.Source)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to retrieve source file.")
+		return
+	}
+	snippet, err := ingester.BenchDataSnippet(source, traceID)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to extract trace from source file.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(ProvenanceResponse{Entry: entry, Snippet: snippet}); err != nil {
+		util.ReportError(w, r, err, "Error while encoding provenance.")
+	}
+}
+
 // traceGuiFromTrace returns a populated TraceGUI from the given trace.
 func traceGuiFromTrace(trace *types.PerfTrace, key string, tile *types.Tile) *types.TraceGUI {
 	newTraceData := make([][2]float64, 0)
@@ -881,7 +1115,12 @@ func addFlatCalculatedTraces(qr *FlatQueryResponse, tile *types.Tile, formula st
 func calcHandler(w http.ResponseWriter, r *http.Request) {
 	glog.Infof("Calc Handler: %q\n", r.URL.Path)
 	w.Header().Set("Content-Type", "application/json")
-	tile, err := nanoTileStore.Get(0, -1)
+	tileStore, _, err := branchFromRequest(r)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to select branch.")
+		return
+	}
+	tile, err := tileStore.Get(0, -1)
 	if err != nil {
 		util.ReportError(w, r, err, fmt.Sprintf("Failed to load tile."))
 		return
@@ -1060,6 +1299,9 @@ func main() {
 	}
 	db.Init(conf)
 	stats.Start(nanoTileStore, git)
+	if *trybotMaxAge > 0 {
+		trybot.StartPruning(*trybotMaxAge, time.Hour)
+	}
 	alerting.Start(nanoTileStore, *apikey)
 
 	// By default use a set of credentials setup for localhost access.
@@ -1084,11 +1326,12 @@ func main() {
 	router.HandleFunc("/", mainHandler)
 	router.HandleFunc("/shortcuts/", shortcutHandler)
 	router.PathPrefix("/tiles/").HandlerFunc(tileHandler)
+	router.PathPrefix("/single/provenance/").HandlerFunc(provenanceHandler)
 	router.PathPrefix("/single/").HandlerFunc(singleHandler)
 	router.PathPrefix("/query/").HandlerFunc(queryHandler)
 	router.HandleFunc("/commits/", commitsHandler)
 	router.HandleFunc("/shortcommits/", shortCommitsHandler)
-	router.HandleFunc("/trybots/", trybotHandler)
+	router.PathPrefix("/trybots/").HandlerFunc(trybotHandler)
 	router.HandleFunc("/clusters/", clustersHandler)
 	router.HandleFunc("/clustering/", clusteringHandler)
 	router.PathPrefix("/cl/").HandlerFunc(clHandler)
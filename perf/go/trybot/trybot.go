@@ -13,6 +13,13 @@
     Note the 'trybot' dir prefix and the addition of the build number and codereview issue number in the directory.
     The Rietveld issue id appears before the file name.  Note that some of the tries aren't associated with an issue, we will ignore those.
 
+    The path does not contain the patchset, so results are stored under the
+    patchset reported in the 'patchset' option of the file, or under the most
+    recent patchset of the issue at the time of ingestion. Together with the
+    results we keep metadata about the issue (owner, subject) and every
+    patchset (bots, timestamps, trace count). Results that haven't been
+    updated in a while can be removed with Prune().
+
 
     Notes: I tried using both GOB and JSON as the serialization format and got the following numbers:
 
@@ -29,8 +36,11 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	metrics "github.com/rcrowley/go-metrics"
@@ -38,6 +48,7 @@ import (
 
 	storage "code.google.com/p/google-api-go-client/storage/v1"
 
+	"go.skia.org/infra/go/rietveld"
 	"go.skia.org/infra/go/util"
 	"go.skia.org/infra/perf/go/config"
 	"go.skia.org/infra/perf/go/db"
@@ -45,70 +56,274 @@ import (
 	"go.skia.org/infra/perf/go/types"
 )
 
+const (
+	// RIETVELD_URL is the code review server the trybot issues belong to.
+	RIETVELD_URL = "https://codereview.chromium.org"
+
+	// LATEST_PATCHSET can be passed to Get and TileWithTryData to select the
+	// most recent patchset of an issue.
+	LATEST_PATCHSET = 0
+
+	// LEGACY_PATCHSET is the patchset of results that were stored before
+	// results were kept per patchset.
+	LEGACY_PATCHSET = -1
+
+	// PATCHSET_OPTION is the option in the nanobench JSON that bots can use to
+	// report the patchset they ran on. If it is missing the results are stored
+	// under the most recent patchset of the issue at the time of ingestion.
+	PATCHSET_OPTION = "patchset"
+)
+
 var (
 	// nameRegex is the regexp that a trybot filename must match. This enforces the need for a Rietveld issue number.
+	// The capture groups are the bot name, the build number, the issue and the file name.
 	//
 	// REPL here: http://play.golang.org/p/uGmexyFxEr
-	nameRegex = regexp.MustCompile(`trybot/nano-json-v1/\d{4}/\d{2}/\d{2}/\d{2}/[^/]+/\d+/(\d+)/(.*)`)
+	nameRegex = regexp.MustCompile(`trybot/nano-json-v1/\d{4}/\d{2}/\d{2}/\d{2}/([^/]+)/(\d+)/(\d+)/(.*)`)
 
 	st *storage.Service = nil
+
+	// review is used to look up the owner and the patchsets of an issue.
+	review IssueLookup = rietveld.New(RIETVELD_URL)
 )
 
-// Write the TryBotResults to the datastore.
-func Write(issue string, try *types.TryBotResults) error {
+// IssueLookup retrieves the details of a Rietveld issue.
+type IssueLookup interface {
+	GetIssueProperties(issue int, messages bool) (*rietveld.Issue, error)
+}
+
+// IssueInfo is the metadata of an issue with trybot results.
+type IssueInfo struct {
+	Issue       string `json:"issue"`
+	Owner       string `json:"owner"`
+	Subject     string `json:"subject"`
+	LastUpdated int64  `json:"lastUpdated"`
+
+	// Patchsets contains the patchsets with results, sorted by patchset.
+	Patchsets []*PatchsetInfo `json:"patchsets"`
+}
+
+// PatchsetInfo is the metadata of the trybot results of a single patchset.
+type PatchsetInfo struct {
+	Patchset    int64    `json:"patchset"`
+	Bots        []string `json:"bots"`
+	Started     int64    `json:"started"`
+	LastUpdated int64    `json:"lastUpdated"`
+	TraceCount  int      `json:"traceCount"`
+}
+
+// PatchsetInfoSlice allows sorting PatchsetInfo's by patchset.
+type PatchsetInfoSlice []*PatchsetInfo
+
+func (p PatchsetInfoSlice) Len() int           { return len(p) }
+func (p PatchsetInfoSlice) Less(i, j int) bool { return p[i].Patchset < p[j].Patchset }
+func (p PatchsetInfoSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// ListQuery selects the issues returned by List. Zero values are ignored.
+type ListQuery struct {
+	// Owner is the email address of the issue owner.
+	Owner string
+
+	// Begin and End restrict the issues to the ones that have been updated in
+	// the time range [Begin, End).
+	Begin time.Time
+	End   time.Time
+
+	// N is the maximum number of issues returned.
+	N int
+}
+
+// Write the TryBotResults of the given issue and patchset to the datastore.
+// The metadata of the issue and the patchset are updated as well; the bots of
+// ps are added to the bots that have already reported results.
+func Write(issue *IssueInfo, ps *PatchsetInfo, try *types.TryBotResults) error {
 	b, err := json.Marshal(try)
 	if err != nil {
 		return fmt.Errorf("Failed to encode to JSON: %s", err)
 	}
-	glog.Infof("Writing: %s", issue)
-	_, err = db.DB.Exec("REPLACE INTO tries (issue, results, lastUpdated) VALUES (?, ?, ?)", issue, b, time.Now())
+	bots, err := json.Marshal(ps.Bots)
+	if err != nil {
+		return fmt.Errorf("Failed to encode bots to JSON: %s", err)
+	}
+	glog.Infof("Writing: %s/%d", issue.Issue, ps.Patchset)
+	now := time.Now().Unix()
+	_, err = db.DB.Exec("INSERT INTO tryissues (issue, owner, subject, lastUpdated) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE owner=VALUES(owner), subject=VALUES(subject), lastUpdated=VALUES(lastUpdated)", issue.Issue, issue.Owner, issue.Subject, now)
+	if err != nil {
+		return fmt.Errorf("Failed to write issue to database: %s", err)
+	}
+	_, err = db.DB.Exec("INSERT INTO tryresults (issue, patchset, results, bots, traceCount, started, lastUpdated) VALUES (?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE results=VALUES(results), bots=VALUES(bots), traceCount=VALUES(traceCount), lastUpdated=VALUES(lastUpdated)", issue.Issue, ps.Patchset, b, bots, len(try.Values), now, now)
 	if err != nil {
 		return fmt.Errorf("Failed to write to database: %s", err)
 	}
 	return nil
 }
 
-// Get the TryBotResults from the datastore.
-func Get(issue string) (*types.TryBotResults, error) {
+// Get the TryBotResults of the given issue and patchset from the datastore.
+// If patchset is LATEST_PATCHSET the results of the most recent patchset are
+// returned.
+func Get(issue string, patchset int64) (*types.TryBotResults, error) {
 	var results string
-	err := db.DB.QueryRow("SELECT results FROM tries WHERE issue=?", issue).Scan(&results)
+	var err error
+	if patchset == LATEST_PATCHSET {
+		err = db.DB.QueryRow("SELECT results FROM tryresults WHERE issue=? ORDER BY patchset DESC LIMIT 1", issue).Scan(&results)
+	} else {
+		err = db.DB.QueryRow("SELECT results FROM tryresults WHERE issue=? AND patchset=?", issue, patchset).Scan(&results)
+	}
 	if err == sql.ErrNoRows {
 		return types.NewTryBotResults(), nil
 	}
 	if err != nil {
-		return nil, fmt.Errorf("Failed to load try data with id %s: %s", issue, err)
+		return nil, fmt.Errorf("Failed to load try data with id %s/%d: %s", issue, patchset, err)
 	}
 	try := &types.TryBotResults{}
 	if err := json.Unmarshal([]byte(results), try); err != nil {
-		return nil, fmt.Errorf("Failed to decode try data with id: %s", issue)
+		return nil, fmt.Errorf("Failed to decode try data with id: %s/%d", issue, patchset)
 	}
 	return try, nil
 }
 
-// List returns the last N Rietveld issue IDs.
-func List(n int) ([]string, error) {
-	rows, err := db.DB.Query("SELECT issue FROM tries ORDER BY lastUpdated DESC LIMIT ?", n)
+// GetIssue returns the metadata of the given issue and all of its patchsets.
+// It returns nil if there are no results for the issue.
+func GetIssue(issue string) (*IssueInfo, error) {
+	ret := &IssueInfo{Issue: issue}
+	err := db.DB.QueryRow("SELECT owner, subject, lastUpdated FROM tryissues WHERE issue=?", issue).Scan(&ret.Owner, &ret.Subject, &ret.LastUpdated)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load issue %s: %s", issue, err)
+	}
+	rows, err := db.DB.Query("SELECT patchset, bots, traceCount, started, lastUpdated FROM tryresults WHERE issue=? ORDER BY patchset", issue)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load patchsets of issue %s: %s", issue, err)
+	}
+	defer util.Close(rows)
+
+	ret.Patchsets = []*PatchsetInfo{}
+	for rows.Next() {
+		ps := &PatchsetInfo{}
+		var bots string
+		if err := rows.Scan(&ps.Patchset, &bots, &ps.TraceCount, &ps.Started, &ps.LastUpdated); err != nil {
+			return nil, fmt.Errorf("Failed to read patchset of issue %s: %s", issue, err)
+		}
+		if err := json.Unmarshal([]byte(bots), &ps.Bots); err != nil {
+			return nil, fmt.Errorf("Failed to decode bots of issue %s: %s", issue, err)
+		}
+		ret.Patchsets = append(ret.Patchsets, ps)
+	}
+	return ret, nil
+}
+
+// List returns the metadata of the most recently updated issues that match
+// the given query. The returned IssueInfo's do not contain the patchsets, use
+// GetIssue to retrieve them.
+func List(q *ListQuery) ([]*IssueInfo, error) {
+	where := []string{}
+	args := []interface{}{}
+	if q.Owner != "" {
+		where = append(where, "owner=?")
+		args = append(args, q.Owner)
+	}
+	if !q.Begin.IsZero() {
+		where = append(where, "lastUpdated>=?")
+		args = append(args, q.Begin.Unix())
+	}
+	if !q.End.IsZero() {
+		where = append(where, "lastUpdated<?")
+		args = append(args, q.End.Unix())
+	}
+	stmt := "SELECT issue, owner, subject, lastUpdated FROM tryissues"
+	if len(where) > 0 {
+		stmt += " WHERE " + strings.Join(where, " AND ")
+	}
+	stmt += " ORDER BY lastUpdated DESC"
+	if q.N > 0 {
+		stmt += " LIMIT ?"
+		args = append(args, q.N)
+	}
+
+	rows, err := db.DB.Query(stmt, args...)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to read try data from database: %s", err)
 	}
 	defer util.Close(rows)
 
-	ret := []string{}
+	ret := []*IssueInfo{}
 	for rows.Next() {
-		var issue string
-		if err := rows.Scan(&issue); err != nil {
+		info := &IssueInfo{}
+		if err := rows.Scan(&info.Issue, &info.Owner, &info.Subject, &info.LastUpdated); err != nil {
 			return nil, fmt.Errorf("List: Failed to read issus from row: %s", err)
 		}
-		ret = append(ret, issue)
+		ret = append(ret, info)
 	}
-	sort.Sort(sort.Reverse(sort.StringSlice(ret)))
 	return ret, nil
 }
 
-// TileWithTryData will add all the trybot data for the given issue to the
-// given Tile. A new Tile that is a copy of the original Tile will be returned,
-// so we aren't modifying the underlying Tile.
-func TileWithTryData(tile *types.Tile, issue string) (*types.Tile, error) {
+// Prune removes the results of all patchsets that have not been updated
+// within maxAge and the issues that no longer have any results. It returns
+// the number of removed patchsets.
+func Prune(maxAge time.Duration) (int64, error) {
+	cutoff := time.Now().Add(-maxAge).Unix()
+	res, err := db.DB.Exec("DELETE FROM tryresults WHERE lastUpdated<?", cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to prune trybot results: %s", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to count pruned trybot results: %s", err)
+	}
+	if _, err := db.DB.Exec("DELETE FROM tryissues WHERE issue NOT IN (SELECT DISTINCT issue FROM tryresults)"); err != nil {
+		return 0, fmt.Errorf("Failed to prune trybot issues: %s", err)
+	}
+	return n, nil
+}
+
+// StartPruning starts a background process that calls Prune with the given
+// maxAge at the given interval.
+func StartPruning(maxAge, every time.Duration) {
+	prunedPatchsets := metrics.NewRegisteredCounter("trybot.pruned", metrics.DefaultRegistry)
+	go func() {
+		for _ = range time.Tick(every) {
+			n, err := Prune(maxAge)
+			if err != nil {
+				glog.Errorf("Failed to prune trybot results: %s", err)
+				continue
+			}
+			glog.Infof("Pruned %d trybot patchsets.", n)
+			prunedPatchsets.Inc(n)
+		}
+	}()
+}
+
+// getPatchset returns the results and the metadata of the given patchset.
+// Both are empty if no results have been stored yet.
+func getPatchset(issue string, patchset int64) (*types.TryBotResults, *PatchsetInfo, error) {
+	try := types.NewTryBotResults()
+	ps := &PatchsetInfo{
+		Patchset: patchset,
+		Bots:     []string{},
+	}
+	var results, bots string
+	err := db.DB.QueryRow("SELECT results, bots FROM tryresults WHERE issue=? AND patchset=?", issue, patchset).Scan(&results, &bots)
+	if err == sql.ErrNoRows {
+		return try, ps, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to load try data with id %s/%d: %s", issue, patchset, err)
+	}
+	if err := json.Unmarshal([]byte(results), try); err != nil {
+		return nil, nil, fmt.Errorf("Failed to decode try data with id: %s/%d", issue, patchset)
+	}
+	if err := json.Unmarshal([]byte(bots), &ps.Bots); err != nil {
+		return nil, nil, fmt.Errorf("Failed to decode bots of %s/%d: %s", issue, patchset, err)
+	}
+	return try, ps, nil
+}
+
+// TileWithTryData will add all the trybot data for the given issue and
+// patchset to the given Tile. A new Tile that is a copy of the original Tile
+// will be returned, so we aren't modifying the underlying Tile.
+func TileWithTryData(tile *types.Tile, issue string, patchset int64) (*types.Tile, error) {
 	ret := tile.Copy()
 	lastCommitIndex := tile.LastCommitIndex()
 	// The way we handle Tiles there is always empty space at the end of the
@@ -116,7 +331,7 @@ func TileWithTryData(tile *types.Tile, issue string) (*types.Tile, error) {
 	ret.Commits[lastCommitIndex+1].CommitTime = time.Now().Unix()
 	lastCommitIndex = ret.LastCommitIndex()
 
-	tryResults, err := Get(issue)
+	tryResults, err := Get(issue, patchset)
 	if err != nil {
 		return nil, fmt.Errorf("AppendToTile: Failed to retreive trybot results: %s", err)
 	}
@@ -131,20 +346,8 @@ func TileWithTryData(tile *types.Tile, issue string) (*types.Tile, error) {
 	return ret, nil
 }
 
-// addTryData copies the data from the ResultsFileLocation into the TryBotResults.
-func addTryData(res *types.TryBotResults, opener ingester.Opener, counter metrics.Counter) {
-	r, err := opener()
-	if err != nil {
-		glog.Errorf("Error opening input reader: %s", err)
-	}
-
-	benchData, err := ingester.ParseBenchDataFromReader(r)
-	if err != nil {
-		// Don't fall over for a single corrupt file.
-		glog.Errorf("Unable to parse trybot data: %s", err)
-		return
-	}
-
+// addTryData copies the data from the parsed benchData into the TryBotResults.
+func addTryData(res *types.TryBotResults, benchData *ingester.BenchData, counter metrics.Counter) {
 	// cb is the anonymous closure we'll pass over all the trace values found in benchData.
 	cb := func(key string, value float64, params map[string]string) {
 		res.Values[key] = value
@@ -154,13 +357,66 @@ func addTryData(res *types.TryBotResults, opener ingester.Opener, counter metric
 	benchData.ForEach(cb)
 }
 
+// patchsetOf returns the patchset the given results were produced for. If the
+// bot did not report it, latest is returned.
+func patchsetOf(benchData *ingester.BenchData, latest int64) int64 {
+	if ps, err := strconv.ParseInt(benchData.Options[PATCHSET_OPTION], 10, 64); err == nil {
+		return ps
+	}
+	return latest
+}
+
+// permanentError is returned for failures that retrying won't fix, e.g.
+// issues that were deleted or are private.
+type permanentError struct {
+	error
+}
+
+// isPermanent returns true if err is a permanentError.
+func isPermanent(err error) bool {
+	_, ok := err.(permanentError)
+	return ok
+}
+
+// lookupIssue returns the metadata of the given issue and its most recent
+// patchset. Issues that can never be looked up return a permanentError.
+func lookupIssue(issue string) (*IssueInfo, int64, error) {
+	id, err := strconv.Atoi(issue)
+	if err != nil {
+		return nil, 0, permanentError{fmt.Errorf("Invalid issue id %s: %s", issue, err)}
+	}
+	details, err := review.GetIssueProperties(id, false)
+	if err != nil {
+		if httpErr, ok := err.(*rietveld.HTTPError); ok && ((httpErr.StatusCode == http.StatusNotFound) || (httpErr.StatusCode == http.StatusForbidden)) {
+			return nil, 0, permanentError{err}
+		}
+		return nil, 0, err
+	}
+	if len(details.Patchsets) == 0 {
+		return nil, 0, permanentError{fmt.Errorf("Issue %s has no patchsets.", issue)}
+	}
+	latest := details.Patchsets[0]
+	for _, ps := range details.Patchsets {
+		if ps > latest {
+			latest = ps
+		}
+	}
+	return &IssueInfo{
+		Issue:   issue,
+		Owner:   details.Owner,
+		Subject: details.Subject,
+	}, latest, nil
+}
+
 // BenchByIssue allows sorting ResultsFileLocation's by the Rietveld issue id.
 //
 // We sort on issue id so that we aren't doing excessive writes to the
 // database.
 type BenchByIssue struct {
 	opener    ingester.Opener
+	Name      string
 	IssueName string
+	BotName   string
 }
 
 type BenchByIssueSlice []*BenchByIssue
@@ -194,16 +450,20 @@ func NewTrybotResultIngester() ingester.ResultIngester {
 func (i *TrybotResultIngester) Ingest(_ *ingester.TileTracker, opener ingester.Opener, fname string, counter metrics.Counter) error {
 	match := nameRegex.FindStringSubmatch(fname)
 	if match != nil {
-		issue := match[1]
 		i.benchFilesByIssue = append(i.benchFilesByIssue, &BenchByIssue{
 			opener:    opener,
-			IssueName: issue,
+			Name:      fname,
+			IssueName: match[3],
+			BotName:   match[1],
 		})
 	}
 	return nil
 }
 
-// See the ingester.ResultIngester interface.
+// See the ingester.ResultIngester interface. Issues that fail permanently,
+// e.g. because they were deleted, are skipped. The files of issues that fail
+// otherwise are reported in an *ingester.FailedFilesError, so only they are
+// ingested again.
 func (i *TrybotResultIngester) BatchFinished(counter metrics.Counter) error {
 	// Reset this instance regardless of the outcome of this call.
 	defer func() {
@@ -213,31 +473,81 @@ func (i *TrybotResultIngester) BatchFinished(counter metrics.Counter) error {
 	// Resort by issue id.
 	sort.Sort(BenchByIssueSlice(i.benchFilesByIssue))
 
-	lastIssue := ""
-	var cur *types.TryBotResults = nil
-	var err error
-	for _, b := range i.benchFilesByIssue {
-		if b.IssueName != lastIssue {
-			// Write out the current TryBotResults to the datastore and create a fresh new TryBotResults.
-			if cur != nil {
-				if err := Write(lastIssue, cur); err != nil {
-					return fmt.Errorf("Update failed to write trybot results: %s", err)
+	failed := &ingester.FailedFilesError{Files: []string{}}
+	for start := 0; start < len(i.benchFilesByIssue); {
+		issue := i.benchFilesByIssue[start].IssueName
+		end := start
+		for end < len(i.benchFilesByIssue) && i.benchFilesByIssue[end].IssueName == issue {
+			end++
+		}
+		if err := ingestIssue(issue, i.benchFilesByIssue[start:end], counter); err != nil {
+			if isPermanent(err) {
+				glog.Errorf("Skipping issue %s: %s", issue, err)
+			} else {
+				glog.Errorf("Failed to ingest issue %s: %s", issue, err)
+				for _, b := range i.benchFilesByIssue[start:end] {
+					failed.Files = append(failed.Files, b.Name)
 				}
+				failed.Err = err
 			}
-			if cur, err = Get(b.IssueName); err != nil {
-				return fmt.Errorf("Failed to load existing trybot data for issue %s: %s", b.IssueName, err)
+		} else {
+			glog.Infof("Finished issue: %s", issue)
+		}
+		start = end
+	}
+
+	glog.Infof("Finished trybot ingestion.")
+	if len(failed.Files) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// ingestIssue adds the results in files, which all belong to the given issue,
+// to the stored results of the patchsets they were produced for.
+func ingestIssue(issue string, files []*BenchByIssue, counter metrics.Counter) error {
+	info, latest, err := lookupIssue(issue)
+	if err != nil {
+		// Without the issue we can't tell the patchset. Unless the lookup
+		// failed permanently the files are ingested again by the next run.
+		if isPermanent(err) {
+			return permanentError{fmt.Errorf("Failed to look up issue %s: %s", issue, err)}
+		}
+		return fmt.Errorf("Failed to look up issue %s: %s", issue, err)
+	}
+
+	tries := map[int64]*types.TryBotResults{}
+	patchsets := map[int64]*PatchsetInfo{}
+	for _, b := range files {
+		r, err := b.opener()
+		if err != nil {
+			glog.Errorf("Error opening input reader: %s", err)
+			continue
+		}
+		benchData, err := ingester.ParseBenchDataFromReader(r)
+		if err != nil {
+			// Don't fall over for a single corrupt file.
+			glog.Errorf("Unable to parse trybot data: %s", err)
+			continue
+		}
+
+		patchset := patchsetOf(benchData, latest)
+		if _, ok := tries[patchset]; !ok {
+			if tries[patchset], patchsets[patchset], err = getPatchset(issue, patchset); err != nil {
+				return fmt.Errorf("Failed to load existing trybot data for issue %s: %s", issue, err)
 			}
-			lastIssue = b.IssueName
-			glog.Infof("Switched to issue: %s", lastIssue)
 		}
-		addTryData(cur, b.opener, counter)
+		addTryData(tries[patchset], benchData, counter)
+		if !util.In(b.BotName, patchsets[patchset].Bots) {
+			patchsets[patchset].Bots = append(patchsets[patchset].Bots, b.BotName)
+		}
 	}
-	if cur != nil {
-		if err := Write(lastIssue, cur); err != nil {
+
+	for patchset, try := range tries {
+		sort.Strings(patchsets[patchset].Bots)
+		if err := Write(info, patchsets[patchset], try); err != nil {
 			return fmt.Errorf("Update failed to write trybot results: %s", err)
 		}
 	}
-
-	glog.Infof("Finished trybot ingestion.")
 	return nil
 }
@@ -0,0 +1,100 @@
+package trybot
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/go/rietveld"
+	"go.skia.org/infra/perf/go/ingester"
+)
+
+type mockReview struct{}
+
+func (m mockReview) GetIssueProperties(issue int, messages bool) (*rietveld.Issue, error) {
+	if issue == 2 {
+		return &rietveld.Issue{Issue: issue}, nil
+	}
+	if issue == 3 {
+		return nil, &rietveld.HTTPError{Url: "https://codereview.chromium.org/api/3", StatusCode: http.StatusNotFound}
+	}
+	if issue != 448043002 {
+		return nil, fmt.Errorf("Unknown issue: %d", issue)
+	}
+	return &rietveld.Issue{
+		Issue:     issue,
+		Owner:     "jcgregorio@google.com",
+		Subject:   "Make things faster.",
+		Patchsets: []int64{1, 40001, 20001},
+	}, nil
+}
+
+func TestIngest(t *testing.T) {
+	i := NewTrybotResultIngester().(*TrybotResultIngester)
+	assert.Nil(t, i.Ingest(nil, nil, "trybot/nano-json-v1/2014/08/07/05/Perf-Android-Nexus7-Tegra3-Arm7-Release-Trybot/85/448043002/nanobench_da7a944_1407357280.json", nil))
+	assert.Nil(t, i.Ingest(nil, nil, "trybot/nano-json-v1/2014/08/07/05/Perf-Android-Nexus7-Tegra3-Arm7-Release-Trybot/85/nanobench_da7a944_1407357280.json", nil))
+	assert.Equal(t, 1, len(i.benchFilesByIssue))
+	assert.Equal(t, "448043002", i.benchFilesByIssue[0].IssueName)
+	assert.Equal(t, "Perf-Android-Nexus7-Tegra3-Arm7-Release-Trybot", i.benchFilesByIssue[0].BotName)
+}
+
+func TestLookupIssue(t *testing.T) {
+	defer func(r IssueLookup) { review = r }(review)
+	review = mockReview{}
+	info, latest, err := lookupIssue("448043002")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(40001), latest)
+	assert.Equal(t, "jcgregorio@google.com", info.Owner)
+	assert.Equal(t, "Make things faster.", info.Subject)
+
+	// Issues without patchsets, missing and invalid issues fail permanently,
+	// other errors might go away.
+	_, _, err = lookupIssue("1")
+	assert.NotNil(t, err)
+	assert.False(t, isPermanent(err))
+	for _, issue := range []string{"2", "3", "abc"} {
+		_, _, err = lookupIssue(issue)
+		assert.True(t, isPermanent(err), issue)
+	}
+	assert.True(t, isPermanent(ingestIssue("3", []*BenchByIssue{}, nil)))
+}
+
+func TestBatchFinished(t *testing.T) {
+	defer func(r IssueLookup) { review = r }(review)
+	review = mockReview{}
+
+	opener := func() (io.ReadCloser, error) {
+		return nil, fmt.Errorf("Not reached")
+	}
+	i := NewTrybotResultIngester().(*TrybotResultIngester)
+	names := []string{
+		"trybot/nano-json-v1/2014/08/07/05/Perf-Trybot/85/3/nanobench_1.json",
+		"trybot/nano-json-v1/2014/08/07/05/Perf-Trybot/85/1/nanobench_1.json",
+		"trybot/nano-json-v1/2014/08/07/05/Perf-Trybot/85/2/nanobench_1.json",
+		"trybot/nano-json-v1/2014/08/07/05/Perf-Trybot/86/1/nanobench_2.json",
+	}
+	for _, name := range names {
+		assert.Nil(t, i.Ingest(nil, opener, name, nil))
+	}
+
+	// Issues that fail permanently are skipped, only the files of the issue
+	// that might be looked up later are retried.
+	err := i.BatchFinished(nil)
+	failedErr, ok := err.(*ingester.FailedFilesError)
+	assert.True(t, ok)
+	sort.Strings(failedErr.Files)
+	assert.Equal(t, []string{names[1], names[3]}, failedErr.Files)
+	assert.Equal(t, 0, len(i.benchFilesByIssue))
+}
+
+func TestPatchsetOf(t *testing.T) {
+	benchData := &ingester.BenchData{Options: map[string]string{}}
+	assert.Equal(t, int64(40001), patchsetOf(benchData, 40001))
+	benchData.Options[PATCHSET_OPTION] = "20001"
+	assert.Equal(t, int64(20001), patchsetOf(benchData, 40001))
+	benchData.Options[PATCHSET_OPTION] = "latest"
+	assert.Equal(t, int64(40001), patchsetOf(benchData, 40001))
+}
@@ -396,8 +396,9 @@ type TileGUI struct {
 	Commits  []*Commit           `json:"commits,omitempty"`
 	Scale    int                 `json:"scale"`
 	Tiles    []int               `json:"tiles"`
-	Ticks    []interface{}       `json:"ticks"` // The x-axis tick marks.
-	Skps     []int               `json:"skps"`  // The x values where SKPs were regenerated.
+	Ticks    []interface{}       `json:"ticks"`              // The x-axis tick marks.
+	Skps     []int               `json:"skps"`               // The x values where SKPs were regenerated.
+	Branches []string            `json:"branches,omitempty"` // The branches that can be selected.
 }
 
 func NewTileGUI(scale int, tileIndex int) *TileGUI {